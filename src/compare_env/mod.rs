@@ -0,0 +1,40 @@
+mod tests;
+
+use crate::RequestConfig;
+use anyhow::{Result, bail};
+
+/// The base URLs of the two environments compared with --compare-env: the steps whose URL starts with
+/// the reference one are sent to the other one as well, with the same path
+#[derive(Clone, Debug)]
+pub struct BaseUrls {
+    pub reference: String,
+    pub other: String,
+}
+
+/// The step as sent to the other environment: to its own `compare_url` if it has one,
+/// otherwise to its URL with the reference base URL replaced by the other one
+pub fn on_other_environment(
+    step: &RequestConfig,
+    base_urls: Option<&BaseUrls>,
+) -> Result<RequestConfig> {
+    let url = match (&step.compare_url, base_urls) {
+        (Some(compare_url), _) => compare_url.clone(),
+        (None, Some(base_urls)) => match step.url.strip_prefix(&base_urls.reference) {
+            Some(path) => format!("{}{}", base_urls.other, path),
+            None => bail!(
+                "URL '{}' doesn't start with the reference base URL '{}'",
+                step.url,
+                base_urls.reference
+            ),
+        },
+        (None, None) => bail!(
+            "Step to '{}' has no compare_url, and no --compare-base-urls were given",
+            step.url
+        ),
+    };
+
+    let mut step = step.clone();
+    step.url = url;
+    step.compare_url = None;
+    Ok(step)
+}
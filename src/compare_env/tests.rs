@@ -0,0 +1,107 @@
+#[cfg(test)]
+mod tests {
+    use crate::RequestConfig;
+    use crate::compare_env::{BaseUrls, on_other_environment};
+    use crate::diff_finder::{DiffOptions, Difference, compute_differences};
+    use crate::fetch::{HostLimiter, ResponseLimits, RetryBackoff, fetch_with_retries};
+    use crate::interrupt::StopSignal;
+    use crate::test_server::{Reply, serve};
+    use reqwest::Client;
+    use serde_json::json;
+    use std::time::Duration;
+
+    fn step(url: &str) -> RequestConfig {
+        serde_json::from_value(json!({ "url": url })).unwrap()
+    }
+
+    fn base_urls() -> BaseUrls {
+        BaseUrls {
+            reference: "https://prod.example.com".to_string(),
+            other: "https://staging.example.com".to_string(),
+        }
+    }
+
+    #[test]
+    fn test_on_other_environment() {
+        let other = on_other_environment(
+            &step("https://prod.example.com/users?page=2"),
+            Some(&base_urls()),
+        )
+        .unwrap();
+        assert_eq!(other.url, "https://staging.example.com/users?page=2");
+
+        // The URL of the step wins over the base URLs
+        let mut own = step("https://prod.example.com/users");
+        own.compare_url = Some("https://legacy.example.com/v1/users".to_string());
+        let other = on_other_environment(&own, Some(&base_urls())).unwrap();
+        assert_eq!(other.url, "https://legacy.example.com/v1/users");
+        assert!(other.compare_url.is_none());
+        assert_eq!(
+            on_other_environment(&own, None).unwrap().url,
+            "https://legacy.example.com/v1/users"
+        );
+
+        // A step that can't be sent to the other environment is an error
+        assert!(
+            on_other_environment(&step("https://other.example.com/users"), Some(&base_urls()))
+                .is_err()
+        );
+        assert!(on_other_environment(&step("https://prod.example.com/users"), None).is_err());
+    }
+
+    async fn send(step: &RequestConfig) -> crate::HttpResponseData {
+        fetch_with_retries(
+            step,
+            &Client::new(),
+            &HostLimiter::new(1),
+            None,
+            ResponseLimits::default(),
+            &StopSignal::never(),
+            1,
+            RetryBackoff {
+                initial: Duration::ZERO,
+                max: Duration::ZERO,
+            },
+            true,
+            false,
+        )
+        .await
+        .unwrap()
+        .data
+    }
+
+    #[tokio::test]
+    async fn test_environments_are_compared() {
+        let reference = serve(|_| {
+            Reply::json(&json!({"version": "1.4.0", "features": ["search"], "region": "eu"}))
+        })
+        .await;
+        let other = serve(|_| {
+            Reply::json(&json!({"version": "1.5.0", "features": ["search"], "beta": true}))
+        })
+        .await;
+        let base_urls = BaseUrls {
+            reference: reference.url(""),
+            other: other.url(""),
+        };
+
+        let reference_step = step(&reference.url("/status"));
+        let other_step = on_other_environment(&reference_step, Some(&base_urls)).unwrap();
+        let differences = compute_differences(
+            &send(&reference_step).await,
+            &send(&other_step).await,
+            true,
+            None,
+            &DiffOptions::default(),
+        );
+
+        assert_eq!(differences.len(), 3, "{:?}", differences);
+        assert!(differences.iter().any(|d| matches!(d,
+            Difference::BodyValueChanged { path, old_val, new_val }
+                if path == "version" && old_val == "\"1.4.0\"" && new_val == "\"1.5.0\"")));
+        assert!(differences.iter().any(|d| matches!(d,
+            Difference::BodyValueRemoved { path, .. } if path == "region")));
+        assert!(differences.iter().any(|d| matches!(d,
+            Difference::BodyValueAdded { path, .. } if path == "beta")));
+    }
+}
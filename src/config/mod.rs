@@ -0,0 +1,719 @@
+mod tests;
+
+use crate::diff_finder::find_value_at_path;
+use crate::{RequestFlowConfig, SanityCheckConfig};
+use anyhow::{Context, Result, anyhow, bail};
+use log::debug;
+use reqwest::{Client, Url};
+use serde::{Deserialize, Serialize, de::DeserializeOwned};
+use serde_json::Value;
+use std::{
+    collections::{BTreeMap, BTreeSet, HashMap, HashSet},
+    fmt,
+    path::{Path, PathBuf},
+};
+use tokio::task::JoinSet;
+
+/// Where a config is loaded from
+#[derive(Debug, Clone)]
+pub enum ConfigSource {
+    File(PathBuf),
+    /// An http(s) URL serving either a config, or an index listing the URLs of configs
+    Url(Url),
+}
+
+impl From<PathBuf> for ConfigSource {
+    fn from(path: PathBuf) -> Self {
+        let url = path
+            .to_str()
+            .filter(|s| s.starts_with("http://") || s.starts_with("https://"))
+            .and_then(|s| Url::parse(s).ok());
+
+        match url {
+            Some(url) => ConfigSource::Url(url),
+            None => ConfigSource::File(path),
+        }
+    }
+}
+
+impl fmt::Display for ConfigSource {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            ConfigSource::File(path) => write!(f, "{}", path.display()),
+            ConfigSource::Url(url) => write!(f, "{}", url),
+        }
+    }
+}
+
+/// The configs of all the sources of a run, loaded concurrently, by source name in the order of the sources
+/// whatever the order they are loaded in. Every source failing to load is reported, not only the first one.
+pub async fn load_all_configs(
+    sources: &[ConfigSource],
+    client: &Client,
+) -> (Vec<(String, Vec<SanityCheckConfig>)>, Vec<anyhow::Error>) {
+    let mut loads = JoinSet::new();
+    // The index of the source loaded by each task, for a task that panicked to be reported against its source
+    let mut task_sources = HashMap::new();
+    for (index, source) in sources.iter().enumerate() {
+        let source = source.clone();
+        let client = client.clone();
+        let task = loads.spawn(async move {
+            load_configs(&source, &client)
+                .await
+                .with_context(|| format!("Failed to load config {}", source))
+        });
+        task_sources.insert(task.id(), index);
+    }
+
+    let mut loaded = Vec::with_capacity(sources.len());
+    while let Some(result) = loads.join_next_with_id().await {
+        let (index, configs) = match result {
+            Ok((id, configs)) => (task_sources[&id], configs),
+            Err(e) => {
+                let index = task_sources[&e.id()];
+                let error = anyhow!("Config loading task failed: {}", e)
+                    .context(format!("Failed to load config {}", sources[index]));
+                (index, Err(error))
+            }
+        };
+        loaded.push((index, sources[index].to_string(), configs));
+    }
+    loaded.sort_by_key(|(index, _, _)| *index);
+
+    let mut configs = Vec::with_capacity(loaded.len());
+    let mut errors = Vec::new();
+    for (_, name, result) in loaded {
+        match result {
+            Ok(source_configs) => configs.push((name, source_configs)),
+            Err(e) => errors.push(e),
+        }
+    }
+    (configs, errors)
+}
+
+/// Load the configs from a source. A local file holds a single config, while a URL can also serve an index,
+/// a list of config URLs (relative ones are resolved against the index URL), which are all fetched.
+/// The file-level ignored paths and headers of each config are added to the ones of all its requests.
+pub async fn load_configs(
+    source: &ConfigSource,
+    client: &Client,
+) -> Result<Vec<SanityCheckConfig>> {
+    let mut configs = read_configs(source, client).await?;
+
+    for config in &mut configs {
+        check_dependencies(&config.requests)?;
+
+        for request in &mut config.requests {
+            if !config.ignore_paths.is_empty() {
+                request
+                    .ignore_paths
+                    .get_or_insert_with(HashSet::new)
+                    .extend(config.ignore_paths.iter().cloned());
+            }
+            request
+                .ignore_headers
+                .extend(config.ignore_headers.iter().cloned());
+        }
+    }
+
+    Ok(configs)
+}
+
+/// Check that the requests of a config only depend on requests of the same config, without cycles
+pub fn check_dependencies(requests: &[RequestFlowConfig]) -> Result<()> {
+    let by_id: HashMap<&str, &RequestFlowConfig> =
+        requests.iter().map(|r| (r.id.as_str(), r)).collect();
+
+    for request in requests {
+        if let Some(unknown) = request
+            .depends_on
+            .iter()
+            .find(|id| !by_id.contains_key(id.as_str()))
+        {
+            bail!(
+                "Request '{}' depends on '{}', which isn't a request of the same config",
+                request.id,
+                unknown
+            );
+        }
+    }
+
+    // Depth-first search, a request met again while its dependencies are being visited closes a cycle
+    fn visit<'a>(
+        id: &'a str,
+        by_id: &HashMap<&'a str, &'a RequestFlowConfig>,
+        visiting: &mut Vec<&'a str>,
+        visited: &mut HashSet<&'a str>,
+    ) -> Result<()> {
+        if visited.contains(id) {
+            return Ok(());
+        }
+        if let Some(start) = visiting.iter().position(|&v| v == id) {
+            let mut cycle = visiting[start..].to_vec();
+            cycle.push(id);
+            bail!(
+                "Requests depend on each other in a cycle: {}",
+                cycle.join(" -> ")
+            );
+        }
+
+        visiting.push(id);
+        for dependency in &by_id[id].depends_on {
+            visit(dependency, by_id, visiting, visited)?;
+        }
+        visiting.pop();
+        visited.insert(id);
+        Ok(())
+    }
+
+    let mut visited = HashSet::new();
+    for request in requests {
+        visit(&request.id, &by_id, &mut Vec::new(), &mut visited)?;
+    }
+    Ok(())
+}
+
+/// Check the configs of all the sources of a run, given by source name, and return every problem found:
+/// requests without an ID, IDs used by more than one request, requests without a step to check, and steps
+/// without a valid http(s) URL.
+/// URLs using variables are only checked when they are sent, once the variables are substituted.
+pub fn validate_configs(sources: &[(String, Vec<SanityCheckConfig>)]) -> Vec<anyhow::Error> {
+    let mut errors = Vec::new();
+    let mut sources_by_id: HashMap<&str, &str> = HashMap::new();
+
+    for (source, configs) in sources {
+        for request in configs.iter().flat_map(|config| &config.requests) {
+            if request.id.trim().is_empty() {
+                errors.push(anyhow!("{}: a request has an empty id", source));
+            } else if let Some(first_source) = sources_by_id.insert(&request.id, source) {
+                errors.push(if first_source == source {
+                    anyhow!(
+                        "{}: request '{}' is defined more than once",
+                        source,
+                        request.id
+                    )
+                } else {
+                    anyhow!(
+                        "{}: request '{}' is already defined in {}",
+                        source,
+                        request.id,
+                        first_source
+                    )
+                });
+            }
+
+            if request.flow.is_empty() {
+                errors.push(anyhow!("{}: request '{}' has no steps", source, request.id));
+            } else if request.flow.iter().all(|flow| flow.capture_only) {
+                errors.push(anyhow!(
+                    "{}: request '{}' has no step to check, all of them are capture_only",
+                    source,
+                    request.id
+                ));
+            }
+
+            for (step, flow) in request.flow.iter().enumerate() {
+                let urls = std::iter::once(("url", &flow.url))
+                    .chain(flow.compare_url.iter().map(|url| ("compare_url", url)));
+                for (field, url) in urls {
+                    if let Err(e) = check_url(url) {
+                        errors.push(anyhow!(
+                            "{}: step {} of request '{}' has an invalid {} '{}': {}",
+                            source,
+                            step,
+                            request.id,
+                            field,
+                            url,
+                            e
+                        ));
+                    }
+                }
+            }
+        }
+    }
+
+    errors
+}
+
+fn check_url(url: &str) -> Result<()> {
+    if url.contains("{{") {
+        return Ok(());
+    }
+    let parsed = Url::parse(url)?;
+    if !matches!(parsed.scheme(), "http" | "https") {
+        bail!("only http and https URLs are supported");
+    }
+    Ok(())
+}
+
+/// The tags selecting the requests of a run, from --tags and --exclude-tags
+#[derive(Debug, Default, Clone)]
+pub struct TagFilter {
+    pub included: Vec<String>,
+    pub excluded: Vec<String>,
+}
+
+impl TagFilter {
+    /// Whether a request with the tags is selected: it has one of the included tags, if any are given,
+    /// and none of the excluded ones
+    pub fn matches(&self, tags: &[String]) -> bool {
+        (self.included.is_empty() || tags.iter().any(|tag| self.included.contains(tag)))
+            && !tags.iter().any(|tag| self.excluded.contains(tag))
+    }
+
+    /// The selected requests of a config, along with the ones they depend on so that they can run
+    pub fn select(&self, requests: Vec<RequestFlowConfig>) -> Vec<RequestFlowConfig> {
+        if self.included.is_empty() && self.excluded.is_empty() {
+            return requests;
+        }
+
+        let by_id: HashMap<&str, &RequestFlowConfig> =
+            requests.iter().map(|r| (r.id.as_str(), r)).collect();
+        let mut selected = HashSet::new();
+        let mut pending: Vec<&str> = requests
+            .iter()
+            .filter(|request| self.matches(&request.tags))
+            .map(|request| request.id.as_str())
+            .collect();
+        while let Some(id) = pending.pop() {
+            if selected.insert(id.to_string()) {
+                if let Some(request) = by_id.get(id) {
+                    pending.extend(request.depends_on.iter().map(String::as_str));
+                }
+            }
+        }
+
+        requests
+            .into_iter()
+            .filter(|request| selected.contains(&request.id))
+            .collect()
+    }
+}
+
+/// Split the requests of a config into the ones to run and the skipped ones:
+/// the disabled requests, and the ones depending on them which couldn't run
+pub fn skip_disabled(
+    requests: Vec<RequestFlowConfig>,
+) -> (Vec<RequestFlowConfig>, Vec<RequestFlowConfig>) {
+    let mut skipped: HashSet<String> = HashSet::new();
+    loop {
+        let newly_skipped: Vec<String> = requests
+            .iter()
+            .filter(|request| !skipped.contains(&request.id))
+            .filter(|request| {
+                request.enabled == Some(false)
+                    || request.depends_on.iter().any(|id| skipped.contains(id))
+            })
+            .map(|request| request.id.clone())
+            .collect();
+        if newly_skipped.is_empty() {
+            break;
+        }
+        skipped.extend(newly_skipped);
+    }
+
+    requests
+        .into_iter()
+        .partition(|request| !skipped.contains(&request.id))
+}
+
+/// The formats a config can be written in, told apart by the extension of its file or URL
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum ConfigFormat {
+    Json,
+    Yaml,
+}
+
+impl ConfigFormat {
+    fn of(path: &str) -> ConfigFormat {
+        if path.ends_with(".yaml") || path.ends_with(".yml") {
+            ConfigFormat::Yaml
+        } else {
+            ConfigFormat::Json
+        }
+    }
+
+    fn parse<T: DeserializeOwned>(self, content: &[u8]) -> Result<T> {
+        Ok(match self {
+            ConfigFormat::Json => serde_json::from_slice(content)?,
+            ConfigFormat::Yaml => serde_yaml::from_slice(content)?,
+        })
+    }
+}
+
+impl fmt::Display for ConfigFormat {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            ConfigFormat::Json => "JSON",
+            ConfigFormat::Yaml => "YAML",
+        })
+    }
+}
+
+/// Whether the file is a config, found when scanning a directory: a JSON or YAML file
+pub fn is_config_file(path: &Path) -> bool {
+    path.is_file()
+        && path
+            .extension()
+            .is_some_and(|ext| ext == "json" || ext == "yaml" || ext == "yml")
+}
+
+async fn read_configs(source: &ConfigSource, client: &Client) -> Result<Vec<SanityCheckConfig>> {
+    match source {
+        ConfigSource::File(path) => {
+            debug!("Reading config path at {:#?}...", path);
+            let content = tokio::fs::read(path)
+                .await
+                .with_context(|| format!("Failed to read config file {:?}", path))?;
+            let format = ConfigFormat::of(&path.to_string_lossy());
+            let mut config = format
+                .parse(&content)
+                .with_context(|| format!("Failed to parse {} config at {:?}", format, path))?;
+            load_body_files(&mut config, source, client).await?;
+            Ok(vec![config])
+        }
+        ConfigSource::Url(url) => {
+            let content = fetch_config(url, client).await?;
+
+            let Value::Array(entries) = content else {
+                let mut config = serde_json::from_value(content)
+                    .with_context(|| format!("Failed to parse config at {}", url))?;
+                load_body_files(&mut config, source, client).await?;
+                return Ok(vec![config]);
+            };
+
+            let mut configs = Vec::with_capacity(entries.len());
+            for entry in entries {
+                let Some(entry) = entry.as_str() else {
+                    bail!(
+                        "Config index at {} must only contain URLs, found {}",
+                        url,
+                        entry
+                    );
+                };
+                let config_url = url.join(entry).with_context(|| {
+                    format!("Invalid config URL '{}' in index at {}", entry, url)
+                })?;
+
+                let content = fetch_config(&config_url, client).await?;
+                let mut config = serde_json::from_value(content)
+                    .with_context(|| format!("Failed to parse config at {}", config_url))?;
+                load_body_files(&mut config, &ConfigSource::Url(config_url), client).await?;
+                configs.push(config);
+            }
+            Ok(configs)
+        }
+    }
+}
+
+/// Replace the request bodies given as `{"$file": "<path>"}` with the content of the file, a JSON or YAML
+/// document depending on its extension. The path is relative to the config: to its directory for a
+/// local config, to its URL for a remote one.
+async fn load_body_files(
+    config: &mut SanityCheckConfig,
+    source: &ConfigSource,
+    client: &Client,
+) -> Result<()> {
+    for request in &mut config.requests {
+        for step in &mut request.flow {
+            let Some(file) = body_file(&step.body) else {
+                continue;
+            };
+            step.body = match source {
+                ConfigSource::File(config_path) => {
+                    let path = config_path.parent().unwrap_or(Path::new("")).join(file);
+                    let content = tokio::fs::read(&path).await.with_context(|| {
+                        format!(
+                            "Failed to read body file {:?} of request '{}'",
+                            path, request.id
+                        )
+                    })?;
+                    let format = ConfigFormat::of(&path.to_string_lossy());
+                    format.parse(&content).with_context(|| {
+                        format!("Failed to parse {} body file at {:?}", format, path)
+                    })?
+                }
+                ConfigSource::Url(config_url) => {
+                    let url = config_url.join(file).with_context(|| {
+                        format!(
+                            "Invalid body file URL '{}' of request '{}'",
+                            file, request.id
+                        )
+                    })?;
+                    fetch_config(&url, client).await?
+                }
+            };
+        }
+    }
+
+    Ok(())
+}
+
+/// The path of the file holding the body, when it is given as `{"$file": "<path>"}`
+fn body_file(body: &Value) -> Option<&str> {
+    let object = body.as_object()?;
+    match object.get("$file") {
+        Some(Value::String(path)) if object.len() == 1 => Some(path),
+        _ => None,
+    }
+}
+
+/// Fetch a config or an index, in JSON or in YAML depending on the extension of the URL
+async fn fetch_config(url: &Url, client: &Client) -> Result<Value> {
+    debug!("Fetching config at {}...", url);
+    let body = client
+        .get(url.clone())
+        .send()
+        .await
+        .and_then(|response| response.error_for_status())
+        .with_context(|| format!("Failed to fetch config at {}", url))?
+        .bytes()
+        .await
+        .with_context(|| format!("Failed to read config at {}", url))?;
+
+    let format = ConfigFormat::of(url.path());
+    format
+        .parse(&body)
+        .with_context(|| format!("Failed to parse {} config at {}", format, url))
+}
+
+/// Status codes accepted for a request whatever the baseline one, either the same for all environments,
+/// or keyed by environment name (selected with `--env`), with an optional `default` entry
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(untagged)]
+pub enum AcceptableStatuses {
+    All(Vec<StatusRange>),
+    PerEnvironment(HashMap<String, Vec<StatusRange>>),
+}
+
+impl AcceptableStatuses {
+    /// The status ranges of the environment, empty if none is listed for it
+    fn ranges(&self, env: Option<&str>) -> &[StatusRange] {
+        let ranges = match self {
+            AcceptableStatuses::All(ranges) => Some(ranges),
+            AcceptableStatuses::PerEnvironment(per_env) => env
+                .and_then(|env| per_env.get(env))
+                .or_else(|| per_env.get(DEFAULT_ENVIRONMENT)),
+        };
+
+        ranges.map(Vec::as_slice).unwrap_or_default()
+    }
+
+    /// Whether the status is accepted in the environment
+    pub fn accepts(&self, env: Option<&str>, status: u16) -> bool {
+        self.ranges(env).iter().any(|r| r.contains(status))
+    }
+
+    /// Check that the status is one of the expected ones in the environment.
+    /// Nothing is checked when no status is listed for the environment
+    pub fn check(&self, env: Option<&str>, status: u16) -> Result<()> {
+        let ranges = self.ranges(env);
+        if ranges.is_empty() || self.accepts(env, status) {
+            return Ok(());
+        }
+
+        let expected: Vec<String> = ranges.iter().map(ToString::to_string).collect();
+        bail!("status {} isn't one of {}", status, expected.join(", "))
+    }
+}
+
+const DEFAULT_ENVIRONMENT: &str = "default";
+
+/// An inclusive range of status codes, written as a single code (`200`) or as a range (`"200-299"`)
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, PartialEq)]
+#[serde(try_from = "StatusRangeSpec", into = "StatusRangeSpec")]
+pub struct StatusRange {
+    low: u16,
+    high: u16,
+}
+
+impl StatusRange {
+    pub fn contains(&self, status: u16) -> bool {
+        (self.low..=self.high).contains(&status)
+    }
+}
+
+impl fmt::Display for StatusRange {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if self.low == self.high {
+            write!(f, "{}", self.low)
+        } else {
+            write!(f, "{}-{}", self.low, self.high)
+        }
+    }
+}
+
+#[derive(Serialize, Deserialize)]
+#[serde(untagged)]
+enum StatusRangeSpec {
+    Code(u16),
+    Range(String),
+}
+
+impl TryFrom<StatusRangeSpec> for StatusRange {
+    type Error = String;
+
+    fn try_from(spec: StatusRangeSpec) -> Result<Self, Self::Error> {
+        match spec {
+            StatusRangeSpec::Code(code) => Ok(StatusRange {
+                low: code,
+                high: code,
+            }),
+            StatusRangeSpec::Range(range) => {
+                let (low, high) = range.split_once('-').unwrap_or((&range, &range));
+                match (low.trim().parse(), high.trim().parse()) {
+                    (Ok(low), Ok(high)) if low <= high => Ok(StatusRange { low, high }),
+                    _ => Err(format!(
+                        "invalid status range '{}', expected e.g. 200 or \"200-299\"",
+                        range
+                    )),
+                }
+            }
+        }
+    }
+}
+
+impl From<StatusRange> for StatusRangeSpec {
+    fn from(range: StatusRange) -> Self {
+        if range.low == range.high {
+            StatusRangeSpec::Code(range.low)
+        } else {
+            StatusRangeSpec::Range(format!("{}-{}", range.low, range.high))
+        }
+    }
+}
+
+/// Credentials sent in the `Authorization` header of a request, instead of assembling the header by hand
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(tag = "type", rename_all = "snake_case")]
+pub enum RequestAuth {
+    Bearer { token: String },
+    Basic { username: String, password: String },
+}
+
+/// A condition the body of a response must meet for the request to succeed, whatever its status code,
+/// e.g. `{"path": "/status", "equals": "ok"}` for endpoints reporting failures in a 200 response
+#[derive(Serialize, Deserialize, Debug, Clone)]
+pub struct SuccessPredicate {
+    path: String,
+    equals: Value,
+}
+
+impl SuccessPredicate {
+    /// Check that the JSON body holds the expected value at the predicate path
+    pub fn check(&self, body: Option<&Value>, separator: &str) -> Result<()> {
+        let Some(body) = body else {
+            bail!(
+                "the body isn't JSON, expected {} at {}",
+                self.equals,
+                self.path
+            );
+        };
+
+        match find_value_at_path(body, &self.path, separator) {
+            Some(value) if *value == self.equals => Ok(()),
+            Some(value) => bail!("{} is {} instead of {}", self.path, value, self.equals),
+            None => bail!("{} is missing, expected {}", self.path, self.equals),
+        }
+    }
+}
+
+/// How a request changed between two versions of a config
+#[derive(Debug, PartialEq)]
+pub enum RequestChange {
+    Added {
+        id: String,
+    },
+    Removed {
+        id: String,
+    },
+    /// The fields that changed, e.g. `flow[0].url` or `ignore_paths`
+    Modified {
+        id: String,
+        fields: Vec<String>,
+    },
+}
+
+/// Compare the requests of two versions of a config, matched by ID
+pub fn diff_configs(
+    old: &[SanityCheckConfig],
+    new: &[SanityCheckConfig],
+) -> Result<Vec<RequestChange>> {
+    let by_id = |configs: &[SanityCheckConfig]| -> Result<BTreeMap<String, Value>> {
+        configs
+            .iter()
+            .flat_map(|config| &config.requests)
+            .map(|request| {
+                let mut value = serde_json::to_value(request)
+                    .with_context(|| format!("Failed to serialize request '{}'", request.id))?;
+                // Ignored paths and headers are sets, their order doesn't matter
+                for field in ["ignore_paths", "ignore_headers"] {
+                    if let Some(Value::Array(items)) = value.get_mut(field) {
+                        items.sort_by_key(|item| item.to_string());
+                    }
+                }
+                Ok((request.id.clone(), value))
+            })
+            .collect()
+    };
+    let (old, new) = (by_id(old)?, by_id(new)?);
+
+    let mut changes = Vec::new();
+    for (id, old_request) in &old {
+        match new.get(id) {
+            None => changes.push(RequestChange::Removed { id: id.clone() }),
+            Some(new_request) if new_request != old_request => {
+                let mut fields = Vec::new();
+                changed_fields("", old_request, new_request, &mut fields);
+                changes.push(RequestChange::Modified {
+                    id: id.clone(),
+                    fields,
+                });
+            }
+            Some(_) => {}
+        }
+    }
+    for id in new.keys().filter(|id| !old.contains_key(*id)) {
+        changes.push(RequestChange::Added { id: id.clone() });
+    }
+
+    Ok(changes)
+}
+
+/// Collect the paths of the fields that differ, going down into objects and the steps of the flow
+fn changed_fields(path: &str, old: &Value, new: &Value, fields: &mut Vec<String>) {
+    match (old, new) {
+        (Value::Object(old_fields), Value::Object(new_fields)) => {
+            let keys: BTreeSet<&String> = old_fields.keys().chain(new_fields.keys()).collect();
+            for key in keys {
+                let (old_value, new_value) = (
+                    old_fields.get(key).unwrap_or(&Value::Null),
+                    new_fields.get(key).unwrap_or(&Value::Null),
+                );
+                if old_value != new_value {
+                    let field_path = if path.is_empty() {
+                        key.clone()
+                    } else {
+                        format!("{}.{}", path, key)
+                    };
+                    changed_fields(&field_path, old_value, new_value, fields);
+                }
+            }
+        }
+        (Value::Array(old_steps), Value::Array(new_steps)) if path == "flow" => {
+            if old_steps.len() != new_steps.len() {
+                fields.push(format!(
+                    "flow (steps: {} -> {})",
+                    old_steps.len(),
+                    new_steps.len()
+                ));
+            }
+            for (i, (old_step, new_step)) in old_steps.iter().zip(new_steps).enumerate() {
+                if old_step != new_step {
+                    changed_fields(&format!("flow[{}]", i), old_step, new_step, fields);
+                }
+            }
+        }
+        _ => fields.push(path.to_string()),
+    }
+}
@@ -0,0 +1,539 @@
+#[cfg(test)]
+mod tests {
+    use crate::config::{
+        AcceptableStatuses, ConfigFormat, ConfigSource, RequestChange, SuccessPredicate, TagFilter,
+        check_dependencies, diff_configs, load_all_configs, load_configs, skip_disabled,
+        validate_configs,
+    };
+    use crate::{RequestFlowConfig, SanityCheckConfig};
+    use reqwest::Client;
+    use serde_json::json;
+    use std::path::PathBuf;
+
+    #[test]
+    fn test_acceptable_statuses() {
+        let all: AcceptableStatuses = serde_json::from_value(json!([200, "400-404"])).unwrap();
+        assert!(all.accepts(None, 200));
+        assert!(all.accepts(Some("prod"), 401));
+        assert!(!all.accepts(None, 500));
+
+        let per_env: AcceptableStatuses = serde_json::from_value(json!({
+            "staging": [200, 401],
+            "default": ["200-299"]
+        }))
+        .unwrap();
+        assert!(per_env.accepts(Some("staging"), 401));
+        assert!(!per_env.accepts(Some("prod"), 401));
+        assert!(per_env.accepts(Some("prod"), 204));
+        assert!(per_env.accepts(None, 204));
+
+        assert!(serde_json::from_value::<AcceptableStatuses>(json!(["299-200"])).is_err());
+    }
+
+    #[test]
+    fn test_expected_status() {
+        let expected: AcceptableStatuses = serde_json::from_value(json!([200, "201-204"])).unwrap();
+        assert!(expected.check(None, 200).is_ok());
+        assert!(expected.check(None, 204).is_ok());
+        let error = expected.check(None, 503).unwrap_err();
+        assert_eq!(error.to_string(), "status 503 isn't one of 200, 201-204");
+
+        // An empty list, or an environment without statuses, asserts nothing
+        let empty: AcceptableStatuses = serde_json::from_value(json!([])).unwrap();
+        assert!(empty.check(None, 503).is_ok());
+        let per_env: AcceptableStatuses = serde_json::from_value(json!({"prod": [200]})).unwrap();
+        assert!(per_env.check(Some("staging"), 503).is_ok());
+        assert!(per_env.check(Some("prod"), 503).is_err());
+
+        // No assertion unless configured
+        let config: SanityCheckConfig = serde_json::from_value(
+            json!({"requests": [{"id": "a", "flow": [{"url": "http://a"}]}]}),
+        )
+        .unwrap();
+        assert!(config.requests[0].expected_status.is_none());
+    }
+
+    #[test]
+    fn test_diff_configs() {
+        let old: SanityCheckConfig = serde_json::from_value(json!({"requests": [
+            {"id": "kept", "flow": [{"url": "http://a"}], "ignore_paths": ["/x", "/y"]},
+            {"id": "changed", "flow": [{"url": "http://a"}, {"url": "http://b"}]},
+            {"id": "removed", "flow": [{"url": "http://a"}]}
+        ]}))
+        .unwrap();
+        let new: SanityCheckConfig = serde_json::from_value(json!({"requests": [
+            {"id": "kept", "flow": [{"url": "http://a"}], "ignore_paths": ["/y", "/x"]},
+            {"id": "changed", "flow": [{"url": "http://a"}, {"url": "http://c", "body": {"a": 1}}]},
+            {"id": "added", "flow": [{"url": "http://a"}]}
+        ]}))
+        .unwrap();
+
+        assert_eq!(
+            diff_configs(&[old], &[new]).unwrap(),
+            vec![
+                RequestChange::Modified {
+                    id: "changed".to_string(),
+                    fields: vec!["flow[1].body".to_string(), "flow[1].url".to_string()],
+                },
+                RequestChange::Removed {
+                    id: "removed".to_string()
+                },
+                RequestChange::Added {
+                    id: "added".to_string()
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn test_yaml_config_matches_json() {
+        let json_config: SanityCheckConfig = ConfigFormat::Json
+            .parse(
+                json!({
+                    "ignore_paths": ["/meta/generated_at"],
+                    "requests": [{
+                        "id": "create-object",
+                        "flow": [{
+                            "url": "https://api.example.com/objects",
+                            "headers": {"Content-Type": ["application/json"]},
+                            "body": {
+                                "name": "Apple MacBook Pro 16",
+                                "data": {
+                                    "year": 2019,
+                                    "price": 1849.99,
+                                    "tags": ["laptop", "16\""],
+                                    "refurbished": false,
+                                    "discount": null
+                                }
+                            }
+                        }],
+                        "ignore_paths": ["/id"]
+                    }]
+                })
+                .to_string()
+                .as_bytes(),
+            )
+            .unwrap();
+        let yaml_config: SanityCheckConfig = ConfigFormat::Yaml
+            .parse(
+                br#"
+                # The same config as the JSON one, with comments
+                ignore_paths: [/meta/generated_at]
+                requests:
+                  - id: create-object
+                    flow:
+                      - url: https://api.example.com/objects
+                        headers:
+                          Content-Type: [application/json]
+                        body:
+                          name: Apple MacBook Pro 16
+                          data:
+                            year: 2019
+                            price: 1849.99
+                            tags: [laptop, "16\""]
+                            refurbished: false
+                            discount: null
+                    ignore_paths:
+                      - /id
+"#,
+            )
+            .unwrap();
+
+        assert!(
+            diff_configs(&[json_config.clone()], &[yaml_config.clone()])
+                .unwrap()
+                .is_empty()
+        );
+        // The body is converted to the same JSON, numbers included
+        assert_eq!(
+            yaml_config.requests[0].flow[0].body,
+            json_config.requests[0].flow[0].body
+        );
+        assert_eq!(yaml_config.ignore_paths, json_config.ignore_paths);
+    }
+
+    #[test]
+    fn test_config_format() {
+        assert_eq!(ConfigFormat::of("configs/api.yaml"), ConfigFormat::Yaml);
+        assert_eq!(ConfigFormat::of("/configs/api.yml"), ConfigFormat::Yaml);
+        assert_eq!(ConfigFormat::of("configs/api.json"), ConfigFormat::Json);
+        // Other files are parsed as JSON, as they always were
+        assert_eq!(ConfigFormat::of("configs/api"), ConfigFormat::Json);
+    }
+
+    #[test]
+    fn test_success_predicate() {
+        let predicate: SuccessPredicate =
+            serde_json::from_value(json!({"path": "/result/status", "equals": "ok"})).unwrap();
+        assert!(
+            predicate
+                .check(Some(&json!({"result": {"status": "ok"}})), "/")
+                .is_ok()
+        );
+
+        let error = predicate
+            .check(Some(&json!({"result": {"status": "error"}})), "/")
+            .unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            r#"/result/status is "error" instead of "ok""#
+        );
+        assert!(predicate.check(Some(&json!({"result": []})), "/").is_err());
+        assert!(predicate.check(None, "/").is_err());
+
+        // Paths are written like the paths of differences, with escapes and array indexes
+        let predicate: SuccessPredicate =
+            serde_json::from_value(json!({"path": ".items.1.a\\.b", "equals": true})).unwrap();
+        assert!(
+            predicate
+                .check(Some(&json!({"items": [{}, {"a.b": true}]})), ".")
+                .is_ok()
+        );
+    }
+
+    #[test]
+    fn test_check_dependencies() {
+        let config = |requests: serde_json::Value| -> SanityCheckConfig {
+            serde_json::from_value(json!({ "requests": requests })).unwrap()
+        };
+
+        let valid = config(json!([
+            {"id": "read", "flow": [], "depends_on": ["create"]},
+            {"id": "create", "flow": []},
+            {"id": "delete", "flow": [], "depends_on": ["create", "read"]},
+        ]));
+        assert!(check_dependencies(&valid.requests).is_ok());
+
+        let unknown = config(json!([{"id": "read", "flow": [], "depends_on": ["create"]}]));
+        assert!(check_dependencies(&unknown.requests).is_err());
+
+        let cycle = config(json!([
+            {"id": "a", "flow": [], "depends_on": ["b"]},
+            {"id": "b", "flow": [], "depends_on": ["c"]},
+            {"id": "c", "flow": [], "depends_on": ["a"]},
+        ]));
+        assert_eq!(
+            check_dependencies(&cycle.requests).unwrap_err().to_string(),
+            "Requests depend on each other in a cycle: a -> b -> c -> a"
+        );
+    }
+
+    #[test]
+    fn test_tag_filter() {
+        let config: SanityCheckConfig = serde_json::from_value(json!({"requests": [
+            {"id": "login", "flow": [], "tags": ["auth"]},
+            {"id": "search", "flow": [], "tags": ["smoke", "search"]},
+            {"id": "checkout", "flow": [], "tags": ["smoke", "payments"], "depends_on": ["login"]},
+            {"id": "export", "flow": [], "tags": ["slow"]},
+            {"id": "health", "flow": []},
+        ]}))
+        .unwrap();
+        let selected = |included: &[&str], excluded: &[&str]| -> Vec<String> {
+            let filter = TagFilter {
+                included: included.iter().map(|t| t.to_string()).collect(),
+                excluded: excluded.iter().map(|t| t.to_string()).collect(),
+            };
+            filter
+                .select(config.requests.clone())
+                .into_iter()
+                .map(|request| request.id)
+                .collect()
+        };
+
+        assert_eq!(
+            selected(&[], &[]),
+            vec!["login", "search", "checkout", "export", "health"]
+        );
+        // The requests the selected ones depend on run too, whatever their tags
+        assert_eq!(
+            selected(&["smoke"], &[]),
+            vec!["login", "search", "checkout"]
+        );
+        assert_eq!(selected(&["search", "slow"], &[]), vec!["search", "export"]);
+        assert_eq!(
+            selected(&[], &["slow", "payments"]),
+            vec!["login", "search", "health"]
+        );
+        assert_eq!(selected(&["smoke"], &["payments"]), vec!["search"]);
+        assert!(selected(&["unknown"], &[]).is_empty());
+    }
+
+    #[test]
+    fn test_skip_disabled() {
+        let config: SanityCheckConfig = serde_json::from_value(json!({"requests": [
+            {"id": "login", "flow": []},
+            {"id": "legacy", "flow": [], "enabled": false},
+            {"id": "search", "flow": [], "enabled": true, "depends_on": ["login"]},
+            {"id": "legacy-export", "flow": [], "depends_on": ["legacy"]},
+            {"id": "legacy-import", "flow": [], "depends_on": ["legacy-export"]},
+            {"id": "health", "flow": []},
+        ]}))
+        .unwrap();
+
+        let (run, skipped) = skip_disabled(config.requests);
+        let ids = |requests: &[RequestFlowConfig]| -> Vec<String> {
+            requests.iter().map(|request| request.id.clone()).collect()
+        };
+        assert_eq!(run.len(), 3);
+        assert_eq!(ids(&run), vec!["login", "search", "health"]);
+        // The requests depending on a disabled one, even indirectly, couldn't run either
+        assert_eq!(
+            ids(&skipped),
+            vec!["legacy", "legacy-export", "legacy-import"]
+        );
+    }
+
+    fn sources(configs: &[(&str, serde_json::Value)]) -> Vec<(String, Vec<SanityCheckConfig>)> {
+        configs
+            .iter()
+            .map(|(source, requests)| {
+                let config = serde_json::from_value(json!({ "requests": requests })).unwrap();
+                (source.to_string(), vec![config])
+            })
+            .collect()
+    }
+
+    fn validation_errors(configs: &[(&str, serde_json::Value)]) -> Vec<String> {
+        validate_configs(&sources(configs))
+            .iter()
+            .map(|e| e.to_string())
+            .collect()
+    }
+
+    #[test]
+    fn test_valid_configs() {
+        assert!(
+            validation_errors(&[
+                (
+                    "a.json",
+                    json!([{"id": "users", "flow": [{"url": "https://api/users"}]}])
+                ),
+                (
+                    "b.json",
+                    json!([{"id": "me", "flow": [
+                        {"url": "http://api/login", "extract": {"host": "host"}},
+                        {"url": "https://{{host}}/me", "compare_url": "https://staging/me"},
+                    ]}])
+                ),
+            ])
+            .is_empty()
+        );
+    }
+
+    #[test]
+    fn test_empty_id_is_invalid() {
+        assert_eq!(
+            validation_errors(&[(
+                "a.json",
+                json!([{"id": " ", "flow": [{"url": "https://api/users"}]}])
+            )]),
+            vec!["a.json: a request has an empty id"]
+        );
+    }
+
+    #[test]
+    fn test_duplicate_ids_are_invalid() {
+        let flow = json!([{"url": "https://api/users"}]);
+        assert_eq!(
+            validation_errors(&[
+                (
+                    "a.json",
+                    json!([{"id": "users", "flow": flow}, {"id": "users", "flow": flow}])
+                ),
+                (
+                    "b.json",
+                    json!([{"id": "users", "flow": flow}, {"id": "orders", "flow": flow}])
+                ),
+            ]),
+            vec![
+                "a.json: request 'users' is defined more than once",
+                "b.json: request 'users' is already defined in a.json",
+            ]
+        );
+    }
+
+    #[test]
+    fn test_invalid_urls() {
+        assert_eq!(
+            validation_errors(&[(
+                "a.json",
+                json!([{"id": "users", "flow": [
+                    {"url": ""},
+                    {"url": "api.example.com/users"},
+                    {"url": "ftp://api/users"},
+                    {"url": "https://api/users", "compare_url": "staging/users"},
+                ]}])
+            )]),
+            vec![
+                "a.json: step 0 of request 'users' has an invalid url '': relative URL without a base",
+                "a.json: step 1 of request 'users' has an invalid url 'api.example.com/users': relative URL without a base",
+                "a.json: step 2 of request 'users' has an invalid url 'ftp://api/users': only http and https URLs are supported",
+                "a.json: step 3 of request 'users' has an invalid compare_url 'staging/users': relative URL without a base",
+            ]
+        );
+
+        // A config missing a URL, or with a malformed method, doesn't even load
+        assert!(
+            serde_json::from_value::<SanityCheckConfig>(
+                json!({"requests": [{"id": "a", "flow": [{}]}]})
+            )
+            .is_err()
+        );
+        assert!(
+            serde_json::from_value::<SanityCheckConfig>(json!({"requests": [
+                {"id": "a", "flow": [{"url": "https://api/", "method": "GE T"}]}
+            ]}))
+            .is_err()
+        );
+    }
+
+    #[test]
+    fn test_requests_without_a_checked_step_are_invalid() {
+        assert_eq!(
+            validation_errors(&[(
+                "a.json",
+                json!([
+                    {"id": "empty", "flow": []},
+                    {"id": "login", "flow": [
+                        {"url": "https://api/login", "capture_only": true, "extract": {"token": "/token"}},
+                        {"url": "https://api/session", "capture_only": true},
+                    ]},
+                    // Capture only steps can follow the checked one
+                    {"id": "users", "flow": [
+                        {"url": "https://api/users"},
+                        {"url": "https://api/logout", "capture_only": true},
+                    ]},
+                ])
+            )]),
+            vec![
+                "a.json: request 'empty' has no steps",
+                "a.json: request 'login' has no step to check, all of them are capture_only",
+            ]
+        );
+    }
+
+    /// A fresh directory holding the config, in a subdirectory so that it isn't the working directory
+    fn config_dir(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!(
+            "release-sanity-checker-{}-{}",
+            name,
+            std::process::id()
+        ));
+        let _ = std::fs::remove_dir_all(&dir);
+        std::fs::create_dir_all(dir.join("configs").join("payloads")).unwrap();
+        dir.join("configs")
+    }
+
+    fn write_config(dir: &std::path::Path, flow: serde_json::Value) -> PathBuf {
+        let path = dir.join("config.json");
+        let config = json!({"requests": [{"id": "create", "flow": flow}]});
+        std::fs::write(&path, config.to_string()).unwrap();
+        path
+    }
+
+    #[tokio::test]
+    async fn test_body_from_file() {
+        let dir = config_dir("body-file");
+        std::fs::write(
+            dir.join("payloads").join("order.json"),
+            r#"{"items": [{"sku": "A-1", "quantity": 2}], "note": "gift"}"#,
+        )
+        .unwrap();
+        let path = write_config(
+            &dir,
+            json!([
+                {"url": "http://api/orders", "body": {"$file": "payloads/order.json"}},
+                {"url": "http://api/inline", "body": {"$file": "not a file", "other": 1}},
+                {"url": "http://api/plain", "body": {"name": "inline"}},
+            ]),
+        );
+
+        let configs = load_configs(&ConfigSource::File(path), &Client::new())
+            .await
+            .unwrap();
+        let flow = &configs[0].requests[0].flow;
+        // The path is resolved against the directory of the config, not the working directory
+        assert_eq!(
+            flow[0].body,
+            json!({"items": [{"sku": "A-1", "quantity": 2}], "note": "gift"})
+        );
+        // Other bodies are kept as they are
+        assert_eq!(flow[1].body, json!({"$file": "not a file", "other": 1}));
+        assert_eq!(flow[2].body, json!({"name": "inline"}));
+    }
+
+    #[tokio::test]
+    async fn test_missing_body_file() {
+        let dir = config_dir("missing-body-file");
+        let path = write_config(
+            &dir,
+            json!([{"url": "http://api/orders", "body": {"$file": "payloads/missing.json"}}]),
+        );
+
+        let error = load_configs(&ConfigSource::File(path), &Client::new())
+            .await
+            .unwrap_err();
+        let message = format!("{:#}", error);
+        assert!(message.contains("Failed to read body file"), "{}", message);
+        assert!(message.contains("missing.json"), "{}", message);
+        assert!(message.contains("'create'"), "{}", message);
+    }
+
+    #[tokio::test]
+    async fn test_load_errors_are_aggregated() {
+        let dir = config_dir("load-errors");
+        let config = |id: &str| json!({"requests": [{"id": id, "flow": []}]}).to_string();
+        std::fs::write(dir.join("users.json"), config("users")).unwrap();
+        std::fs::write(dir.join("broken.json"), "{\"requests\": [").unwrap();
+        std::fs::write(dir.join("orders.json"), config("orders")).unwrap();
+        let sources = [
+            ConfigSource::File(dir.join("users.json")),
+            ConfigSource::File(dir.join("broken.json")),
+            ConfigSource::File(dir.join("missing.json")),
+            ConfigSource::File(dir.join("orders.json")),
+        ];
+
+        let (loaded, errors) = load_all_configs(&sources, &Client::new()).await;
+        let loaded_ids: Vec<&str> = loaded
+            .iter()
+            .map(|(_, configs)| configs[0].requests[0].id.as_str())
+            .collect();
+        assert_eq!(loaded_ids, vec!["users", "orders"]);
+        assert_eq!(loaded[0].0, dir.join("users.json").display().to_string());
+
+        // Every failing config is reported, in the order of the sources
+        let messages: Vec<String> = errors.iter().map(|e| format!("{:#}", e)).collect();
+        assert_eq!(messages.len(), 2, "{:?}", messages);
+        assert!(messages[0].contains("broken.json"), "{}", messages[0]);
+        assert!(messages[0].contains("Failed to parse"), "{}", messages[0]);
+        assert!(messages[1].contains("missing.json"), "{}", messages[1]);
+        assert!(messages[1].contains("Failed to read"), "{}", messages[1]);
+    }
+
+    #[tokio::test]
+    async fn test_configs_are_loaded_in_order() {
+        let dir = config_dir("load-order");
+        let sources: Vec<ConfigSource> = (0..20)
+            .map(|i| {
+                let path = dir.join(format!("config-{}.json", i));
+                // Configs of different sizes, so that they don't all take as long to load
+                let requests: Vec<_> = (0..(20 - i) * 50)
+                    .map(|j| json!({"id": format!("{}-{}", i, j), "flow": []}))
+                    .collect();
+                std::fs::write(&path, json!({ "requests": requests }).to_string()).unwrap();
+                ConfigSource::File(path)
+            })
+            .collect();
+
+        for _ in 0..3 {
+            let (loaded, errors) = load_all_configs(&sources, &Client::new()).await;
+            assert!(errors.is_empty());
+            let request_counts: Vec<usize> = loaded
+                .iter()
+                .map(|(_, configs)| configs[0].requests.len())
+                .collect();
+            let expected: Vec<usize> = (0..20).map(|i| (20 - i) * 50).collect();
+            assert_eq!(request_counts, expected);
+        }
+    }
+}
@@ -0,0 +1,190 @@
+mod tests;
+
+use crate::RequestConfig;
+use crate::dates::parse_http_date;
+use crate::fetch::FetchedResponse;
+use reqwest::Url;
+use std::{
+    collections::{BTreeMap, HashMap},
+    sync::{Arc, Mutex},
+    time::{SystemTime, UNIX_EPOCH},
+};
+
+/// The cookies set by the responses of a flow's steps, sent back by its later steps to the hosts and paths
+/// they were set for. Each flow has its own jar, so the session of a flow never leaks into another.
+/// Clones share the same cookies, for the steps sent concurrently.
+#[derive(Clone, Default, Debug)]
+pub struct CookieJar {
+    /// Cookies by the domain they were set for, by name and path
+    cookies: Arc<Mutex<HashMap<String, BTreeMap<(String, String), StoredCookie>>>>,
+}
+
+#[derive(Debug)]
+struct StoredCookie {
+    value: String,
+    /// Whether the cookie is only sent to its domain, and not to its subdomains, when it has no `Domain`
+    host_only: bool,
+}
+
+impl CookieJar {
+    /// Keep the cookies of the `Set-Cookie` headers received from the URL, and drop the ones they expired.
+    /// A cookie whose `Domain` doesn't cover the host of the URL is ignored.
+    pub fn store(&self, url: &Url, set_cookies: &[String]) {
+        let Some(host) = url.host_str().map(str::to_lowercase) else {
+            return;
+        };
+        let Ok(mut cookies) = self.cookies.lock() else {
+            return;
+        };
+
+        for set_cookie in set_cookies {
+            let mut parts = set_cookie.split(';');
+            let Some((name, value)) = parts.next().and_then(|pair| pair.split_once('=')) else {
+                continue;
+            };
+            let name = name.trim();
+            if name.is_empty() {
+                continue;
+            }
+
+            let mut domain = None;
+            let mut path = None;
+            let mut expired = false;
+            for attribute in parts {
+                let (attribute, attribute_value) =
+                    attribute.split_once('=').unwrap_or((attribute, ""));
+                match attribute.trim().to_ascii_lowercase().as_str() {
+                    "domain" => {
+                        let value = attribute_value.trim().trim_start_matches('.');
+                        if !value.is_empty() {
+                            domain = Some(value.to_lowercase());
+                        }
+                    }
+                    "path" if attribute_value.trim().starts_with('/') => {
+                        path = Some(attribute_value.trim().to_string())
+                    }
+                    "max-age" | "expires" => {
+                        expired |= is_expiry_in_past(attribute, attribute_value)
+                    }
+                    _ => {}
+                }
+            }
+            if domain.as_ref().is_some_and(|d| !domain_matches(&host, d)) {
+                continue;
+            }
+
+            let host_only = domain.is_none();
+            let key = (name.to_string(), path.unwrap_or_else(|| default_path(url)));
+            let domain_cookies = cookies.entry(domain.unwrap_or(host.clone())).or_default();
+            if expired {
+                domain_cookies.remove(&key);
+            } else {
+                domain_cookies.insert(
+                    key,
+                    StoredCookie {
+                        value: value.trim().to_string(),
+                        host_only,
+                    },
+                );
+            }
+        }
+    }
+
+    /// Keep the cookies set by the response to the step, the redirects it followed included
+    pub fn store_response(&self, response: &FetchedResponse) {
+        for (url, set_cookies) in &response.set_cookies {
+            self.store(url, set_cookies);
+        }
+    }
+
+    /// A copy of the step sending the cookies stored for its URL, after the ones of its own `Cookie` header
+    pub fn apply(&self, step: &RequestConfig) -> RequestConfig {
+        let mut step = step.clone();
+        let Ok(url) = Url::parse(&step.url) else {
+            return step;
+        };
+        let Some(host) = url.host_str().map(str::to_lowercase) else {
+            return step;
+        };
+        let Ok(cookies) = self.cookies.lock() else {
+            return step;
+        };
+
+        let mut matching: Vec<(&str, &str, &str)> = cookies
+            .iter()
+            .filter(|(domain, _)| domain_matches(&host, domain))
+            .flat_map(|(domain, domain_cookies)| {
+                domain_cookies
+                    .iter()
+                    .filter(|(_, cookie)| !cookie.host_only || host == **domain)
+                    .filter(|((_, path), _)| path_matches(url.path(), path))
+                    .map(|((name, path), cookie)| {
+                        (name.as_str(), path.as_str(), cookie.value.as_str())
+                    })
+            })
+            .collect();
+        if matching.is_empty() {
+            return step;
+        }
+        // Like browsers, the cookies with longer paths come first
+        matching.sort_by(|a, b| b.1.len().cmp(&a.1.len()).then(a.0.cmp(b.0)));
+
+        let jar_cookies: Vec<String> = matching
+            .iter()
+            .map(|(name, _, value)| format!("{}={}", name, value))
+            .collect();
+        let jar_cookies = jar_cookies.join("; ");
+        match step
+            .headers
+            .iter_mut()
+            .find(|(name, _)| name.eq_ignore_ascii_case("cookie"))
+            .and_then(|(_, values)| values.last_mut())
+        {
+            Some(value) => *value = format!("{}; {}", value, jar_cookies),
+            None => {
+                step.headers.insert("Cookie".to_string(), vec![jar_cookies]);
+            }
+        }
+        step
+    }
+}
+
+/// Whether the host is the domain or one of its subdomains
+fn domain_matches(host: &str, domain: &str) -> bool {
+    host == domain
+        || host
+            .strip_suffix(domain)
+            .is_some_and(|subdomain| subdomain.ends_with('.'))
+}
+
+/// Whether a cookie set for the path is sent to the request path: the same path, or one under it
+fn path_matches(request_path: &str, path: &str) -> bool {
+    request_path == path
+        || request_path
+            .strip_prefix(path)
+            .is_some_and(|rest| path.ends_with('/') || rest.starts_with('/'))
+}
+
+/// The path of a cookie set without `Path`: the directory of the URL that set it
+fn default_path(url: &Url) -> String {
+    match url.path().rfind('/') {
+        Some(0) | None => "/".to_string(),
+        Some(end) => url.path()[..end].to_string(),
+    }
+}
+
+/// Whether a `Set-Cookie` attribute removes the cookie: a `Max-Age` of 0 or less, or an `Expires` date in the past
+fn is_expiry_in_past(name: &str, value: &str) -> bool {
+    let value = value.trim();
+    match name.trim().to_ascii_lowercase().as_str() {
+        "max-age" => value.parse::<i64>().is_ok_and(|age| age <= 0),
+        "expires" => parse_http_date(value).is_some_and(|expires| {
+            let now = SystemTime::now()
+                .duration_since(UNIX_EPOCH)
+                .unwrap_or_default()
+                .as_secs() as i64;
+            expires <= now
+        }),
+        _ => false,
+    }
+}
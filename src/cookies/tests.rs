@@ -0,0 +1,202 @@
+#[cfg(test)]
+mod tests {
+    use crate::RequestConfig;
+    use crate::cookies::CookieJar;
+    use crate::fetch::{
+        FetchedResponse, HostLimiter, ResponseLimits, RetryBackoff, fetch_with_retries,
+    };
+    use crate::interrupt::StopSignal;
+    use crate::test_server::{Reply, TestServer, serve};
+    use reqwest::{Client, Url};
+    use serde_json::json;
+    use std::time::Duration;
+
+    fn step(url: &str) -> RequestConfig {
+        serde_json::from_value(json!({ "url": url })).unwrap()
+    }
+
+    fn url(url: &str) -> Url {
+        Url::parse(url).unwrap()
+    }
+
+    fn set_cookies(cookies: &[&str]) -> Vec<String> {
+        cookies.iter().map(|c| c.to_string()).collect()
+    }
+
+    #[test]
+    fn test_cookies_are_sent_back_to_the_same_host() {
+        let jar = CookieJar::default();
+        jar.store(
+            &url("http://api/login"),
+            &set_cookies(&["session=abc; Path=/; HttpOnly", "theme=dark"]),
+        );
+
+        let next = jar.apply(&step("http://api/me"));
+        assert_eq!(next.headers["Cookie"], vec!["session=abc; theme=dark"]);
+
+        // Other hosts and other flows don't get them
+        assert!(jar.apply(&step("http://other/me")).headers.is_empty());
+        assert!(
+            CookieJar::default()
+                .apply(&step("http://api/me"))
+                .headers
+                .is_empty()
+        );
+
+        // A Cookie header of the step is kept
+        let mut own = step("http://api/me");
+        own.headers
+            .insert("cookie".to_string(), vec!["locale=fr".to_string()]);
+        assert_eq!(
+            jar.apply(&own).headers["cookie"],
+            vec!["locale=fr; session=abc; theme=dark"]
+        );
+    }
+
+    #[test]
+    fn test_expired_cookies_are_dropped() {
+        let jar = CookieJar::default();
+        jar.store(
+            &url("http://api/login"),
+            &set_cookies(&["session=abc", "theme=dark", "lang=en"]),
+        );
+        jar.store(
+            &url("http://api/logout"),
+            &set_cookies(&[
+                "session=; Max-Age=0",
+                "theme=; Expires=Thu, 01 Jan 1970 00:00:00 GMT",
+                "lang=fr; Max-Age=3600",
+            ]),
+        );
+
+        let next = jar.apply(&step("http://api/me"));
+        assert_eq!(next.headers["Cookie"], vec!["lang=fr"]);
+    }
+
+    #[test]
+    fn test_domain_and_path_attributes() {
+        let jar = CookieJar::default();
+        jar.store(
+            &url("http://api.example.com/account/login"),
+            &set_cookies(&[
+                "host=1",
+                "domain=2; Domain=.Example.com; Path=/",
+                "admin=3; Path=/admin",
+                "foreign=4; Domain=other.com",
+            ]),
+        );
+        let cookie = |target: &str| {
+            jar.apply(&step(target))
+                .headers
+                .get("Cookie")
+                .map(|values| values[0].clone())
+        };
+
+        // Without Path, a cookie is sent under the directory of the URL that set it, longer paths first
+        assert_eq!(
+            cookie("http://api.example.com/account/me"),
+            Some("host=1; domain=2".to_string())
+        );
+        assert_eq!(
+            cookie("http://api.example.com/accounts"),
+            Some("domain=2".to_string())
+        );
+        assert_eq!(
+            cookie("http://api.example.com/admin/users"),
+            Some("admin=3; domain=2".to_string())
+        );
+        // Without Domain, a cookie isn't sent to the other hosts of the domain
+        assert_eq!(
+            cookie("http://www.example.com/account/me"),
+            Some("domain=2".to_string())
+        );
+        assert_eq!(cookie("http://example.com/"), Some("domain=2".to_string()));
+        assert_eq!(cookie("http://notexample.com/"), None);
+        // A host can't set a cookie for another domain
+        assert_eq!(cookie("http://other.com/"), None);
+    }
+
+    /// Set a session cookie on /login, and only answer 200 on /me when the request sends it back
+    async fn serve_session() -> TestServer {
+        serve(|request| {
+            if request.target == "/login" {
+                Reply::new("200 OK", &[("set-cookie", "session=abc; HttpOnly")], "")
+            } else if request.header("cookie") == Some("session=abc") {
+                Reply::ok("")
+            } else {
+                Reply::new("401 Unauthorized", &[], "")
+            }
+        })
+        .await
+    }
+
+    async fn send(step: &RequestConfig) -> FetchedResponse {
+        // Like the client of a run, which never follows redirects by itself
+        let client = Client::builder()
+            .redirect(reqwest::redirect::Policy::none())
+            .build()
+            .unwrap();
+        fetch_with_retries(
+            step,
+            &client,
+            &HostLimiter::new(1),
+            None,
+            ResponseLimits::default(),
+            &StopSignal::never(),
+            1,
+            RetryBackoff {
+                initial: Duration::ZERO,
+                max: Duration::ZERO,
+            },
+            true,
+            false,
+        )
+        .await
+        .unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_session_cookie_flows_to_the_next_step() {
+        let server = serve_session().await;
+        let login = step(&server.url("/login"));
+        let me = step(&server.url("/me"));
+
+        let jar = CookieJar::default();
+        let response = send(&jar.apply(&login)).await;
+        jar.store_response(&response);
+        assert_eq!(send(&jar.apply(&me)).await.data.status_code, 200);
+
+        // A flow with a jar of its own has no session
+        assert_eq!(
+            send(&CookieJar::default().apply(&me))
+                .await
+                .data
+                .status_code,
+            401
+        );
+    }
+
+    #[tokio::test]
+    async fn test_cookie_set_on_a_redirect() {
+        let server = serve(|request| match request.target.as_str() {
+            "/login" => Reply::new(
+                "302 Found",
+                &[("location", "/home"), ("set-cookie", "session=abc; Path=/")],
+                "",
+            ),
+            "/home" => Reply::ok("home"),
+            _ if request.header("cookie") == Some("session=abc") => Reply::ok(""),
+            _ => Reply::new("401 Unauthorized", &[], ""),
+        })
+        .await;
+        let login = step(&server.url("/login"));
+        let me = step(&server.url("/me"));
+
+        let jar = CookieJar::default();
+        let response = send(&jar.apply(&login)).await;
+        assert_eq!(response.data.body.raw, "home");
+        assert!(!response.data.headers.contains_key("set-cookie"));
+        jar.store_response(&response);
+        assert_eq!(send(&jar.apply(&me)).await.data.status_code, 200);
+    }
+}
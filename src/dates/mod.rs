@@ -0,0 +1,156 @@
+mod tests;
+
+use std::time::{SystemTime, UNIX_EPOCH};
+
+/// Convert a number of days since 1970-01-01 into a (year, month, day) date of the proleptic Gregorian calendar
+pub fn civil_from_days(days: i64) -> (i64, u32, u32) {
+    let z = days + 719_468;
+    let era = z.div_euclid(146_097);
+    let day_of_era = z.rem_euclid(146_097);
+    let year_of_era =
+        (day_of_era - day_of_era / 1460 + day_of_era / 36_524 - day_of_era / 146_096) / 365;
+    let day_of_year = day_of_era - (365 * year_of_era + year_of_era / 4 - year_of_era / 100);
+    let mp = (5 * day_of_year + 2) / 153;
+    let day = (day_of_year - (153 * mp + 2) / 5 + 1) as u32;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 } as u32;
+    let year = year_of_era + era * 400 + i64::from(month <= 2);
+
+    (year, month, day)
+}
+
+/// Convert a (year, month, day) date of the proleptic Gregorian calendar into a number of days since 1970-01-01
+pub fn days_from_civil(year: i64, month: u32, day: u32) -> i64 {
+    let year = year - i64::from(month <= 2);
+    let era = year.div_euclid(400);
+    let year_of_era = year.rem_euclid(400);
+    let mp = i64::from(if month > 2 { month - 3 } else { month + 9 });
+    let day_of_year = (153 * mp + 2) / 5 + i64::from(day) - 1;
+    let day_of_era = year_of_era * 365 + year_of_era / 4 - year_of_era / 100 + day_of_year;
+
+    era * 146_097 + day_of_era - 719_468
+}
+
+/// Parse an RFC 3339 date-time, e.g. `2023-12-31T19:00:00.5-05:00`, into the UTC instant it stands for,
+/// as seconds since 1970-01-01 and nanoseconds
+pub fn parse_rfc3339(value: &str) -> Option<(i64, u32)> {
+    let bytes = value.as_bytes();
+    if bytes.len() < 20 || !value.is_ascii() {
+        return None;
+    }
+    let number = |range: std::ops::Range<usize>| -> Option<u32> {
+        let digits = &value[range];
+        digits
+            .bytes()
+            .all(|b| b.is_ascii_digit())
+            .then(|| digits.parse().ok())?
+    };
+
+    if bytes[4] != b'-'
+        || bytes[7] != b'-'
+        || !matches!(bytes[10], b'T' | b't' | b' ')
+        || bytes[13] != b':'
+        || bytes[16] != b':'
+    {
+        return None;
+    }
+    let (year, month, day) = (number(0..4)?, number(5..7)?, number(8..10)?);
+    let (hour, minute, second) = (number(11..13)?, number(14..16)?, number(17..19)?);
+    // A leap second (60) is accepted
+    if !(1..=12).contains(&month)
+        || !(1..=31).contains(&day)
+        || hour > 23
+        || minute > 59
+        || second > 60
+    {
+        return None;
+    }
+
+    let mut rest = &value[19..];
+    let mut nanos = 0;
+    if let Some(fraction) = rest.strip_prefix('.') {
+        let len = fraction.bytes().take_while(u8::is_ascii_digit).count();
+        if len == 0 {
+            return None;
+        }
+        // Digits beyond nanoseconds are dropped
+        let digits = &fraction[..len.min(9)];
+        nanos = digits.parse::<u32>().ok()? * 10u32.pow(9 - digits.len() as u32);
+        rest = &fraction[len..];
+    }
+
+    let offset_secs = match rest {
+        "Z" | "z" => 0,
+        _ => {
+            let offset = rest.as_bytes();
+            if offset.len() != 6 || !matches!(offset[0], b'+' | b'-') || offset[3] != b':' {
+                return None;
+            }
+            let (hours, minutes) = (
+                number(value.len() - 5..value.len() - 3)?,
+                number(value.len() - 2..value.len())?,
+            );
+            if hours > 23 || minutes > 59 {
+                return None;
+            }
+            let secs = i64::from(hours * 3600 + minutes * 60);
+            if offset[0] == b'-' { -secs } else { secs }
+        }
+    };
+
+    let days = days_from_civil(i64::from(year), month, day);
+    let secs = days * 86_400 + i64::from(hour * 3600 + minute * 60 + second) - offset_secs;
+    Some((secs, nanos))
+}
+
+/// Parse an HTTP date in its preferred format, e.g. `Sun, 06 Nov 1994 08:49:37 GMT`,
+/// into the number of seconds since 1970-01-01 it stands for
+pub fn parse_http_date(value: &str) -> Option<i64> {
+    const MONTHS: [&str; 12] = [
+        "Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec",
+    ];
+    let (_weekday, rest) = value.split_once(", ")?;
+    let parts: Vec<&str> = rest.split(' ').collect();
+    let [day, month, year, time, "GMT"] = parts[..] else {
+        return None;
+    };
+    let number = |digits: &str, len: usize| -> Option<u32> {
+        (digits.len() == len && digits.bytes().all(|b| b.is_ascii_digit()))
+            .then(|| digits.parse().ok())?
+    };
+
+    let day = number(day, 2)?;
+    let month = MONTHS.iter().position(|m| *m == month)? as u32 + 1;
+    let year = number(year, 4)?;
+    let mut time = time.split(':');
+    let (hour, minute, second) = (
+        number(time.next()?, 2)?,
+        number(time.next()?, 2)?,
+        number(time.next()?, 2)?,
+    );
+    if time.next().is_some() || !(1..=31).contains(&day) || hour > 23 || minute > 59 || second > 60
+    {
+        return None;
+    }
+
+    let days = days_from_civil(i64::from(year), month, day);
+    Some(days * 86_400 + i64::from(hour * 3600 + minute * 60 + second))
+}
+
+/// Format a time as an ISO 8601 UTC date-time with milliseconds, e.g. `2025-01-01T12:00:00.000Z`
+pub fn format_iso8601(time: SystemTime) -> String {
+    let since_epoch = time.duration_since(UNIX_EPOCH).unwrap_or_default();
+    let secs = since_epoch.as_secs();
+    let (year, month, day) = civil_from_days((secs / 86_400) as i64);
+    let secs_of_day = secs % 86_400;
+
+    format!(
+        "{:04}-{:02}-{:02}T{:02}:{:02}:{:02}.{:03}Z",
+        year,
+        month,
+        day,
+        secs_of_day / 3600,
+        secs_of_day % 3600 / 60,
+        secs_of_day % 60,
+        since_epoch.subsec_millis()
+    )
+}
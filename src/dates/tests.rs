@@ -0,0 +1,150 @@
+#[cfg(test)]
+mod tests {
+    use crate::dates::{
+        civil_from_days, days_from_civil, format_iso8601, parse_http_date, parse_rfc3339,
+    };
+    use std::time::{Duration, UNIX_EPOCH};
+
+    // 2024-01-01T00:00:00Z
+    const NEW_YEAR_2024: i64 = 1_704_067_200;
+
+    #[test]
+    fn test_civil_days() {
+        assert_eq!(days_from_civil(1970, 1, 1), 0);
+        assert_eq!(days_from_civil(2024, 1, 1), NEW_YEAR_2024 / 86_400);
+        assert_eq!(civil_from_days(-1), (1969, 12, 31));
+        assert_eq!(days_from_civil(1969, 12, 31), -1);
+
+        // 2000 and 2024 are leap years, 1900 and 2023 aren't
+        for (year, days_in_february) in [(1900, 28), (2000, 29), (2023, 28), (2024, 29)] {
+            assert_eq!(
+                days_from_civil(year, 3, 1) - days_from_civil(year, 2, 1),
+                days_in_february,
+                "{}",
+                year
+            );
+        }
+        assert_eq!(civil_from_days(days_from_civil(2024, 2, 29)), (2024, 2, 29));
+        assert_eq!(
+            civil_from_days(days_from_civil(2024, 2, 29) + 1),
+            (2024, 3, 1)
+        );
+    }
+
+    #[test]
+    fn test_parse_rfc3339() {
+        assert_eq!(parse_rfc3339("1970-01-01T00:00:00Z"), Some((0, 0)));
+        assert_eq!(
+            parse_rfc3339("2024-01-01T00:00:00Z"),
+            Some((NEW_YEAR_2024, 0))
+        );
+        // The same instant, with another offset or separator
+        for value in [
+            "2023-12-31T19:00:00-05:00",
+            "2024-01-01T05:30:00+05:30",
+            "2024-01-01 00:00:00z",
+            "2024-01-01t00:00:00+00:00",
+        ] {
+            assert_eq!(parse_rfc3339(value), Some((NEW_YEAR_2024, 0)), "{}", value);
+        }
+
+        // Fractions of a second, digits beyond nanoseconds being dropped
+        assert_eq!(
+            parse_rfc3339("2023-12-31T19:00:00.5-05:00"),
+            Some((NEW_YEAR_2024, 500_000_000))
+        );
+        assert_eq!(
+            parse_rfc3339("2024-01-01T00:00:00.000001Z"),
+            Some((NEW_YEAR_2024, 1_000))
+        );
+        assert_eq!(
+            parse_rfc3339("2024-01-01T00:00:00.1234567899Z"),
+            Some((NEW_YEAR_2024, 123_456_789))
+        );
+
+        // A leap day, and a leap second
+        assert_eq!(
+            parse_rfc3339("2024-02-29T00:00:00Z"),
+            Some((NEW_YEAR_2024 + 59 * 86_400, 0))
+        );
+        assert_eq!(
+            parse_rfc3339("2016-12-31T23:59:60Z"),
+            parse_rfc3339("2017-01-01T00:00:00Z")
+        );
+    }
+
+    #[test]
+    fn test_parse_malformed_rfc3339() {
+        for value in [
+            "",
+            "2024-01-01",
+            "2024-01-01T00:00:00",
+            "2024/01/01T00:00:00Z",
+            "2024-01-01T00-00-00Z",
+            "2024-01-01X00:00:00Z",
+            "2024-13-01T00:00:00Z",
+            "2024-00-01T00:00:00Z",
+            "2024-01-32T00:00:00Z",
+            "2024-01-01T24:00:00Z",
+            "2024-01-01T00:60:00Z",
+            "2024-01-01T00:00:61Z",
+            "2024-01-01T00:00:00.Z",
+            "2024-01-01T00:00:00ZZ",
+            "2024-01-01T00:00:00+0530",
+            "2024-01-01T00:00:00+24:00",
+            "2024-01-01T00:00:00+05:60",
+            "2024-01-01T00:00:00 05:30",
+            "+024-01-01T00:00:00Z",
+            "2024-01-01T00:00:00Zé",
+        ] {
+            assert_eq!(parse_rfc3339(value), None, "{}", value);
+        }
+    }
+
+    #[test]
+    fn test_parse_http_date() {
+        assert_eq!(
+            parse_http_date("Sun, 06 Nov 1994 08:49:37 GMT"),
+            Some(784_111_777)
+        );
+        assert_eq!(
+            parse_http_date("Mon, 01 Jan 2024 00:00:00 GMT"),
+            Some(NEW_YEAR_2024)
+        );
+        assert_eq!(
+            parse_http_date("Thu, 29 Feb 2024 00:00:00 GMT"),
+            Some(NEW_YEAR_2024 + 59 * 86_400)
+        );
+
+        // Only the preferred format is supported, not the obsolete RFC 850 and asctime ones
+        for value in [
+            "",
+            "Sunday, 06-Nov-94 08:49:37 GMT",
+            "Sun Nov  6 08:49:37 1994",
+            "Sun, 06 Nov 1994 08:49:37 UTC",
+            "Sun, 06 Nov 1994 08:49:37",
+            "Sun, 6 Nov 1994 08:49:37 GMT",
+            "Sun, 06 nov 1994 08:49:37 GMT",
+            "Sun, 06 Nov 94 08:49:37 GMT",
+            "Sun, 06 Nov 1994 08:49 GMT",
+            "Sun, 06 Nov 1994 08:49:37:00 GMT",
+            "Sun, 06 Nov 1994 24:00:00 GMT",
+            "Sun, 32 Nov 1994 08:49:37 GMT",
+        ] {
+            assert_eq!(parse_http_date(value), None, "{}", value);
+        }
+    }
+
+    #[test]
+    fn test_format_iso8601() {
+        let time =
+            UNIX_EPOCH + Duration::from_millis(NEW_YEAR_2024 as u64 * 1000 + 59 * 86_400_000 + 500);
+        let formatted = format_iso8601(time);
+        assert_eq!(formatted, "2024-02-29T00:00:00.500Z");
+        assert_eq!(
+            parse_rfc3339(&formatted),
+            Some((NEW_YEAR_2024 + 59 * 86_400, 500_000_000))
+        );
+        assert_eq!(format_iso8601(UNIX_EPOCH), "1970-01-01T00:00:00.000Z");
+    }
+}
@@ -0,0 +1,879 @@
+mod tests;
+
+use crate::HttpResponseData;
+use crate::dates::format_iso8601;
+use crate::fetch::ResponseTimings;
+use anyhow::{Context, Result, bail};
+use flate2::{Compression, read::GzDecoder, write::GzEncoder};
+use sqlx::{
+    Pool, Row, Sqlite,
+    sqlite::{SqliteConnectOptions, SqlitePoolOptions, SqliteRow},
+};
+use std::{
+    collections::HashMap,
+    io::{Read, Write},
+    path::Path,
+    str::FromStr,
+    time::{Duration, SystemTime},
+};
+
+/// Columns added after the creation of the response table, created on databases of older versions
+const ADDED_COLUMNS: [(&str, &str); 14] = [
+    ("baseline_timings", "TEXT"),
+    ("checktime_timings", "TEXT"),
+    ("baseline_run_id", "TEXT"),
+    ("checktime_run_id", "TEXT"),
+    ("baseline_redirects", "TEXT"),
+    ("checktime_redirects", "TEXT"),
+    ("baseline_body_size", "TEXT"),
+    ("checktime_body_size", "TEXT"),
+    ("baseline_label", "TEXT"),
+    ("checktime_label", "TEXT"),
+    ("baseline_captured_at", "TEXT"),
+    ("checktime_captured_at", "TEXT"),
+    ("baseline_latency_ms", "INTEGER"),
+    ("checktime_latency_ms", "INTEGER"),
+];
+
+/// Name of the baseline of requests when none is given, and of the baselines saved before they were named
+pub const DEFAULT_BASELINE_NAME: &str = "default";
+
+/// Magic bytes at the start of every gzip stream, used to tell compressed bodies apart
+const GZIP_MAGIC: [u8; 2] = [0x1f, 0x8b];
+
+/// Encode a body for storage, gzip-compressing it if requested
+fn encode_body(body: &str, compress: bool) -> Result<Vec<u8>> {
+    if !compress {
+        return Ok(body.as_bytes().to_vec());
+    }
+
+    let mut encoder = GzEncoder::new(Vec::new(), Compression::default());
+    encoder
+        .write_all(body.as_bytes())
+        .context("Failed to compress response body")?;
+    encoder.finish().context("Failed to compress response body")
+}
+
+/// Decode a stored body, whether it was compressed or not
+fn decode_body(stored: &[u8]) -> Result<String> {
+    if stored.starts_with(&GZIP_MAGIC) {
+        let mut body = String::new();
+        GzDecoder::new(stored)
+            .read_to_string(&mut body)
+            .context("Failed to decompress stored response body")?;
+        Ok(body)
+    } else {
+        String::from_utf8(stored.to_vec()).context("Stored response body is not valid UTF-8")
+    }
+}
+
+/// The database path of the runs keeping the responses in memory only, dropped when they end
+pub const IN_MEMORY_DB: &str = ":memory:";
+
+/// How long a query waits for a connection to the database file before failing
+const ACQUIRE_TIMEOUT: Duration = Duration::from_secs(1);
+
+/// How long a query waits for the single connection to an in-memory database. The queries of all the flows
+/// in progress queue up behind it, so waiting is expected rather than a sign of a locked database.
+const IN_MEMORY_ACQUIRE_TIMEOUT: Duration = Duration::from_secs(600);
+
+/// Open (creating it and its directory if missing) the database used to store responses and initialize its schema
+pub async fn init_db(db_path: &str) -> Result<Pool<Sqlite>> {
+    let in_memory = db_path == IN_MEMORY_DB;
+    let pool_options = if in_memory {
+        // Each connection to an in-memory database has its own, so a single one is kept open for the whole run
+        SqlitePoolOptions::new()
+            .max_connections(1)
+            .idle_timeout(None)
+            .max_lifetime(None)
+            .acquire_timeout(IN_MEMORY_ACQUIRE_TIMEOUT)
+    } else {
+        if let Some(dir) = Path::new(db_path)
+            .parent()
+            .filter(|dir| !dir.as_os_str().is_empty())
+        {
+            tokio::fs::create_dir_all(dir)
+                .await
+                .with_context(|| format!("Failed to create directory {:?} of the database", dir))?;
+        }
+        SqlitePoolOptions::new()
+            .max_connections(20)
+            .acquire_timeout(ACQUIRE_TIMEOUT)
+    };
+    let url = if in_memory {
+        "sqlite::memory:".to_string()
+    } else {
+        format!("sqlite://{}", db_path)
+    };
+
+    let db = pool_options
+        .connect_with(
+            SqliteConnectOptions::from_str(&url)
+                .context("Failed to parse SQLite connection options")?
+                .create_if_missing(true)
+                .journal_mode(sqlx::sqlite::SqliteJournalMode::Wal)
+                .synchronous(sqlx::sqlite::SqliteSynchronous::Normal)
+                .locking_mode(sqlx::sqlite::SqliteLockingMode::Normal),
+        )
+        .await
+        .context(format!("Failed to connect to database at {}", db_path))?;
+
+    let _ = sqlx::query(
+        "CREATE TABLE IF NOT EXISTS response (
+                request_id              TEXT NOT NULL,
+                url                     TEXT NOT NULL, 
+                baseline_status_code    INTEGER,
+                checktime_status_code   INTEGER,
+                baseline_headers        TEXT,
+                checktime_headers       TEXT,
+                baseline_body           TEXT,
+                checktime_body          TEXT,
+                baseline_name           TEXT NOT NULL DEFAULT 'default',
+                PRIMARY KEY(request_id, baseline_name)
+            );
+            CREATE INDEX IF NOT EXISTS url_idx ON response(request_id);",
+    )
+    .execute(&db)
+    .await
+    .context("Failed to initialize database schema")?;
+
+    let existing_columns: Vec<String> =
+        sqlx::query("SELECT name FROM pragma_table_info('response')")
+            .fetch_all(&db)
+            .await
+            .context("Failed to read database schema")?
+            .iter()
+            .map(|row| row.get("name"))
+            .collect();
+    // Accepted variants of the baseline, on top of the one in the response table
+    sqlx::query(
+        "CREATE TABLE IF NOT EXISTS baseline_variant (
+                request_id      TEXT NOT NULL,
+                status_code     INTEGER,
+                headers         TEXT,
+                body            TEXT,
+                redirects       TEXT,
+                run_id          TEXT,
+                baseline_name   TEXT NOT NULL DEFAULT 'default'
+            );
+            CREATE INDEX IF NOT EXISTS baseline_variant_idx ON baseline_variant(request_id);",
+    )
+    .execute(&db)
+    .await
+    .context("Failed to initialize baseline variants schema")?;
+
+    // The latencies used to be duplicated in a table of their own, they're now read from the response history
+    sqlx::query("DROP TABLE IF EXISTS latency_history")
+        .execute(&db)
+        .await
+        .context("Failed to drop the latency history table")?;
+
+    // Every checktime response saved, while the response table only keeps the latest one
+    sqlx::query(
+        "CREATE TABLE IF NOT EXISTS response_history (
+                request_id      TEXT NOT NULL,
+                baseline_name   TEXT NOT NULL DEFAULT 'default',
+                run_id          TEXT,
+                label           TEXT,
+                captured_at     TEXT NOT NULL,
+                status_code     INTEGER,
+                headers         TEXT,
+                body            TEXT,
+                latency_ms      INTEGER
+            );
+            CREATE INDEX IF NOT EXISTS response_history_idx ON response_history(request_id, baseline_name);",
+    )
+    .execute(&db)
+    .await
+    .context("Failed to initialize response history schema")?;
+
+    for (column, column_type) in ADDED_COLUMNS {
+        if !existing_columns.iter().any(|c| c == column) {
+            sqlx::query(&format!(
+                "ALTER TABLE response ADD COLUMN {} {}",
+                column, column_type
+            ))
+            .execute(&db)
+            .await
+            .with_context(|| format!("Failed to add column {} to database schema", column))?;
+        }
+    }
+
+    if !existing_columns.iter().any(|c| c == "baseline_name") {
+        name_existing_baselines(&db).await?;
+    }
+
+    Ok(db)
+}
+
+/// Migrate a response table of a version without named baselines, its rows becoming the default baseline.
+/// The name being part of the primary key, the table is rebuilt.
+async fn name_existing_baselines(db: &Pool<Sqlite>) -> Result<()> {
+    let columns: Vec<String> =
+        sqlx::query("SELECT name, type, \"notnull\" FROM pragma_table_info('response')")
+            .fetch_all(db)
+            .await
+            .context("Failed to read database schema")?
+            .iter()
+            .map(|row| {
+                let not_null = if row.get::<bool, _>("notnull") {
+                    " NOT NULL"
+                } else {
+                    ""
+                };
+                format!(
+                    "{} {}{}",
+                    row.get::<&str, _>("name"),
+                    row.get::<&str, _>("type"),
+                    not_null
+                )
+            })
+            .collect();
+    let names: Vec<&str> = columns
+        .iter()
+        .filter_map(|column| column.split(' ').next())
+        .collect();
+
+    let mut tx = db
+        .begin()
+        .await
+        .context("Failed to start the migration of baselines")?;
+    for statement in [
+        format!(
+            "CREATE TABLE response_named ({}, baseline_name TEXT NOT NULL DEFAULT '{}', PRIMARY KEY(request_id, baseline_name))",
+            columns.join(", "),
+            DEFAULT_BASELINE_NAME
+        ),
+        format!(
+            "INSERT INTO response_named ({0}) SELECT {0} FROM response",
+            names.join(", ")
+        ),
+        "DROP TABLE response".to_string(),
+        "ALTER TABLE response_named RENAME TO response".to_string(),
+        "CREATE INDEX IF NOT EXISTS url_idx ON response(request_id)".to_string(),
+    ] {
+        sqlx::query(&statement)
+            .execute(&mut *tx)
+            .await
+            .context("Failed to migrate baselines to named baselines")?;
+    }
+    tx.commit()
+        .await
+        .context("Failed to commit the migration of baselines")?;
+
+    let variant_columns: Vec<String> =
+        sqlx::query("SELECT name FROM pragma_table_info('baseline_variant')")
+            .fetch_all(db)
+            .await
+            .context("Failed to read database schema")?
+            .iter()
+            .map(|row| row.get("name"))
+            .collect();
+    if !variant_columns.iter().any(|c| c == "baseline_name") {
+        sqlx::query(&format!(
+            "ALTER TABLE baseline_variant ADD COLUMN baseline_name TEXT NOT NULL DEFAULT '{}'",
+            DEFAULT_BASELINE_NAME
+        ))
+        .execute(db)
+        .await
+        .context("Failed to add column baseline_name to database schema")?;
+    }
+
+    Ok(())
+}
+
+/// Open an existing database without ever writing to it, e.g. a baseline mounted on a read-only filesystem.
+/// It can't be migrated, so a database of an older version is rejected rather than failing on every request.
+pub async fn open_read_only_db(db_path: &str) -> Result<Pool<Sqlite>> {
+    let db = SqlitePoolOptions::new()
+        .max_connections(20)
+        .acquire_timeout(ACQUIRE_TIMEOUT)
+        .connect_with(
+            SqliteConnectOptions::from_str(&format!("sqlite://{}", db_path))
+                .context("Failed to parse SQLite connection options")?
+                .read_only(true)
+                .immutable(true),
+        )
+        .await
+        .context(format!("Failed to open read-only database at {}", db_path))?;
+
+    let missing = missing_baseline_schema(&db).await?;
+    if !missing.is_empty() {
+        bail!(
+            "The baseline database at {} is from an older version (missing {}), rebuild it or migrate it by opening it once with --db",
+            db_path,
+            missing.join(", ")
+        );
+    }
+    Ok(db)
+}
+
+/// The tables and columns the baselines are read from that are missing from the database, as it was
+/// created by an older version and never migrated
+async fn missing_baseline_schema(db: &Pool<Sqlite>) -> Result<Vec<String>> {
+    let response_columns = table_columns("response", db).await?;
+    if response_columns.is_empty() {
+        return Ok(vec!["table response".to_string()]);
+    }
+    let mut missing: Vec<String> = std::iter::once("baseline_name")
+        .chain(ADDED_COLUMNS.iter().map(|(column, _)| *column))
+        .filter(|column| !response_columns.iter().any(|c| c == column))
+        .map(|column| format!("column response.{}", column))
+        .collect();
+
+    let variant_columns = table_columns("baseline_variant", db).await?;
+    if variant_columns.is_empty() {
+        missing.push("table baseline_variant".to_string());
+    } else if !variant_columns.iter().any(|c| c == "baseline_name") {
+        missing.push("column baseline_variant.baseline_name".to_string());
+    }
+    Ok(missing)
+}
+
+/// The names of the columns of a table, none if the table doesn't exist
+async fn table_columns(table: &str, db: &Pool<Sqlite>) -> Result<Vec<String>> {
+    Ok(
+        sqlx::query(&format!("SELECT name FROM pragma_table_info('{}')", table))
+            .fetch_all(db)
+            .await
+            .context("Failed to read database schema")?
+            .iter()
+            .map(|row| row.get("name"))
+            .collect(),
+    )
+}
+
+/// Find previous response for a request ID in the named baseline, if it exists
+pub async fn find_previous_response(
+    request_id: &str,
+    baseline_name: &str,
+    headers_ignored: bool,
+    db: &Pool<Sqlite>,
+) -> Result<Option<HttpResponseData>> {
+    let query = if headers_ignored {
+        "SELECT baseline_status_code, baseline_body, baseline_redirects, baseline_body_size FROM response WHERE request_id = ? AND baseline_name = ?"
+    } else {
+        "SELECT baseline_status_code, baseline_body, baseline_headers, baseline_redirects, baseline_body_size FROM response WHERE request_id = ? AND baseline_name = ?"
+    };
+
+    sqlx::query(query)
+        .persistent(true)
+        .bind(request_id)
+        .bind(baseline_name)
+        .fetch_optional(db)
+        .await
+        .context("Failed to query previous response from database")?
+        .map(|row| previous_response_from_row(&row, headers_ignored))
+        .transpose()
+}
+
+/// Maximum number of request IDs bound to a single query, below the SQLite limit of bound variables
+const PRELOAD_CHUNK_SIZE: usize = 500;
+
+/// The baselines of several requests loaded at once, keyed by request ID
+#[derive(Debug, Default)]
+pub struct PreloadedBaselines {
+    pub responses: HashMap<String, HttpResponseData>,
+    /// The accepted variants of each baseline, in the order they were added
+    pub variants: HashMap<String, Vec<HttpResponseData>>,
+}
+
+/// Load the baseline responses of several requests at once, along with their variants, to avoid queries per request.
+/// Returns `None` when their bodies add up to more than `max_bytes`, in which case they should be queried one by one.
+pub async fn preload_previous_responses(
+    request_ids: &[String],
+    baseline_name: &str,
+    headers_ignored: bool,
+    max_bytes: u64,
+    db: &Pool<Sqlite>,
+) -> Result<Option<PreloadedBaselines>> {
+    let mut total_bytes: u64 = 0;
+    for chunk in request_ids.chunks(PRELOAD_CHUNK_SIZE) {
+        // The variants are loaded along with the baselines, their bodies count as well
+        for (table, body_column) in [("response", "baseline_body"), ("baseline_variant", "body")] {
+            let query = format!(
+                "SELECT COALESCE(SUM(length({})), 0) AS total_bytes FROM {} WHERE baseline_name = ? AND request_id IN ({})",
+                body_column,
+                table,
+                placeholders(chunk.len())
+            );
+            let row = chunk
+                .iter()
+                .fold(sqlx::query(&query).bind(baseline_name), |query, id| {
+                    query.bind(id.as_str())
+                })
+                .fetch_one(db)
+                .await
+                .context("Failed to query size of baseline responses from database")?;
+            total_bytes += row.get::<i64, _>("total_bytes") as u64;
+        }
+    }
+    if total_bytes > max_bytes {
+        return Ok(None);
+    }
+
+    let columns = if headers_ignored {
+        "request_id, baseline_status_code, baseline_body, baseline_redirects, baseline_body_size"
+    } else {
+        "request_id, baseline_status_code, baseline_body, baseline_headers, baseline_redirects, baseline_body_size"
+    };
+    let mut preloaded = PreloadedBaselines::default();
+    for chunk in request_ids.chunks(PRELOAD_CHUNK_SIZE) {
+        let query = format!(
+            "SELECT {} FROM response WHERE baseline_status_code IS NOT NULL AND baseline_name = ? AND request_id IN ({})",
+            columns,
+            placeholders(chunk.len())
+        );
+        let rows = chunk
+            .iter()
+            .fold(sqlx::query(&query).bind(baseline_name), |query, id| {
+                query.bind(id.as_str())
+            })
+            .fetch_all(db)
+            .await
+            .context("Failed to preload previous responses from database")?;
+        for row in rows {
+            preloaded.responses.insert(
+                row.get("request_id"),
+                previous_response_from_row(&row, headers_ignored)?,
+            );
+        }
+
+        let query = format!(
+            "SELECT request_id, status_code, headers, body, redirects FROM baseline_variant
+                WHERE baseline_name = ? AND request_id IN ({}) ORDER BY rowid",
+            placeholders(chunk.len())
+        );
+        let rows = chunk
+            .iter()
+            .fold(sqlx::query(&query).bind(baseline_name), |query, id| {
+                query.bind(id.as_str())
+            })
+            .fetch_all(db)
+            .await
+            .context("Failed to preload baseline variants from database")?;
+        for row in rows {
+            preloaded
+                .variants
+                .entry(row.get("request_id"))
+                .or_default()
+                .push(variant_from_row(&row, headers_ignored)?);
+        }
+    }
+
+    Ok(Some(preloaded))
+}
+
+fn placeholders(count: usize) -> String {
+    vec!["?"; count].join(", ")
+}
+
+fn previous_response_from_row(row: &SqliteRow, headers_ignored: bool) -> Result<HttpResponseData> {
+    let headers = if !headers_ignored {
+        let headers_str: &str = row.get("baseline_headers");
+        serde_json::from_str(headers_str).unwrap_or_default()
+    } else {
+        HashMap::new()
+    };
+
+    let body = decode_body(row.get("baseline_body"))?;
+    let redirects = row
+        .get::<Option<&str>, _>("baseline_redirects")
+        .map(serde_json::from_str)
+        .transpose()
+        .context("Failed to parse stored redirects")?;
+    let body_size = row
+        .get::<Option<&str>, _>("baseline_body_size")
+        .map(serde_json::from_str)
+        .transpose()
+        .context("Failed to parse stored body size")?;
+
+    Ok(HttpResponseData {
+        redirects,
+        body_size,
+        ..HttpResponseData::new(row.get("baseline_status_code"), headers, body)
+    })
+}
+
+/// Find the IDs of the requests having a response in the named baseline, along with the label of the baseline, if any
+pub async fn find_baselined_request_ids(
+    baseline_name: &str,
+    db: &Pool<Sqlite>,
+) -> Result<HashMap<String, Option<String>>> {
+    Ok(sqlx::query(
+        "SELECT request_id, baseline_label FROM response WHERE baseline_status_code IS NOT NULL AND baseline_name = ?",
+    )
+    .bind(baseline_name)
+    .fetch_all(db)
+    .await
+    .context("Failed to query baselined requests from database")?
+    .iter()
+    .map(|row| (row.get("request_id"), row.get("baseline_label")))
+    .collect())
+}
+
+/// A response row of the database, as listed with `list_responses`
+#[derive(Debug, PartialEq)]
+pub struct StoredResponse {
+    pub request_id: String,
+    pub baseline_name: String,
+    pub url: String,
+    pub baseline_status_code: Option<u16>,
+    pub baseline_captured_at: Option<String>,
+    pub baseline_latency_ms: Option<u64>,
+    pub has_checktime: bool,
+    pub checktime_captured_at: Option<String>,
+    pub checktime_latency_ms: Option<u64>,
+}
+
+/// List the responses stored for every request and baseline name, sorted by baseline name and request ID
+pub async fn list_responses(db: &Pool<Sqlite>) -> Result<Vec<StoredResponse>> {
+    Ok(sqlx::query(
+        "SELECT request_id, baseline_name, url, baseline_status_code, baseline_captured_at, baseline_latency_ms,
+                checktime_status_code IS NOT NULL AS has_checktime, checktime_captured_at, checktime_latency_ms
+            FROM response ORDER BY baseline_name, request_id",
+    )
+    .fetch_all(db)
+    .await
+    .context("Failed to list responses from database")?
+    .iter()
+    .map(|row| StoredResponse {
+        request_id: row.get("request_id"),
+        baseline_name: row.get("baseline_name"),
+        url: row.get("url"),
+        baseline_status_code: row.get("baseline_status_code"),
+        baseline_captured_at: row.get("baseline_captured_at"),
+        baseline_latency_ms: row
+            .get::<Option<i64>, _>("baseline_latency_ms")
+            .map(|ms| ms as u64),
+        has_checktime: row.get("has_checktime"),
+        checktime_captured_at: row.get("checktime_captured_at"),
+        checktime_latency_ms: row
+            .get::<Option<i64>, _>("checktime_latency_ms")
+            .map(|ms| ms as u64),
+    })
+    .collect())
+}
+
+/// A checktime response of the history of a request, as returned by `find_response_history`
+#[derive(Debug, PartialEq)]
+pub struct HistoryEntry {
+    pub run_id: Option<String>,
+    pub label: Option<String>,
+    pub captured_at: String,
+    pub response: HttpResponseData,
+    pub latency_ms: Option<u64>,
+}
+
+/// Find the checktime responses saved for a request ID in the named baseline, oldest first
+pub async fn find_response_history(
+    request_id: &str,
+    baseline_name: &str,
+    db: &Pool<Sqlite>,
+) -> Result<Vec<HistoryEntry>> {
+    let rows = sqlx::query(
+        "SELECT run_id, label, captured_at, status_code, headers, body, latency_ms FROM response_history
+            WHERE request_id = ? AND baseline_name = ? ORDER BY captured_at, rowid",
+    )
+    .bind(request_id)
+    .bind(baseline_name)
+    .fetch_all(db)
+    .await
+    .context("Failed to query response history from database")?;
+
+    rows.iter()
+        .map(|row| {
+            let headers_str: &str = row.get("headers");
+            Ok(HistoryEntry {
+                run_id: row.get("run_id"),
+                label: row.get("label"),
+                captured_at: row.get("captured_at"),
+                response: HttpResponseData::new(
+                    row.get("status_code"),
+                    serde_json::from_str(headers_str).unwrap_or_default(),
+                    decode_body(row.get("body"))?,
+                ),
+                latency_ms: row.get::<Option<i64>, _>("latency_ms").map(|ms| ms as u64),
+            })
+        })
+        .collect()
+}
+
+/// Find the timings of the baseline response for a request ID in the named baseline, if they were recorded
+pub async fn find_baseline_timings(
+    request_id: &str,
+    baseline_name: &str,
+    db: &Pool<Sqlite>,
+) -> Result<Option<ResponseTimings>> {
+    let row = sqlx::query(
+        "SELECT baseline_timings FROM response WHERE request_id = ? AND baseline_name = ?",
+    )
+    .persistent(true)
+    .bind(request_id)
+    .bind(baseline_name)
+    .fetch_optional(db)
+    .await
+    .context("Failed to query baseline timings from database")?;
+
+    Ok(row
+        .and_then(|row| row.get::<Option<String>, _>("baseline_timings"))
+        .and_then(|timings| serde_json::from_str(&timings).ok()))
+}
+
+/// Find the latencies of the last `limit` checktime responses saved for a request ID in the named baseline,
+/// most recent first, from its response history
+pub async fn find_latency_history(
+    request_id: &str,
+    baseline_name: &str,
+    limit: usize,
+    db: &Pool<Sqlite>,
+) -> Result<Vec<u64>> {
+    let rows = sqlx::query(
+        "SELECT latency_ms FROM response_history WHERE request_id = ? AND baseline_name = ? AND latency_ms IS NOT NULL
+            ORDER BY captured_at DESC, rowid DESC LIMIT ?",
+    )
+    .persistent(true)
+    .bind(request_id)
+    .bind(baseline_name)
+    .bind(limit as i64)
+    .fetch_all(db)
+    .await
+    .context("Failed to query latency history from database")?;
+
+    Ok(rows
+        .iter()
+        .map(|row| row.get::<i64, _>("latency_ms") as u64)
+        .collect())
+}
+
+/// Store the response of a request in the named baseline, either as its new baseline or as the latest
+/// checktime response, along with the time it was captured and its latency. Checktime responses are also
+/// added to the history of the request.
+/// The body is stored gzip-compressed if `compress` is set.
+#[allow(clippy::too_many_arguments)]
+pub async fn save_response(
+    request_id: &str,
+    baseline_name: &str,
+    url: &str,
+    response: &HttpResponseData,
+    timings: &ResponseTimings,
+    run_id: &str,
+    label: Option<&str>,
+    baseline: bool,
+    compress: bool,
+    db: &Pool<Sqlite>,
+) -> Result<()> {
+    let query_str = if baseline {
+        "INSERT INTO response (request_id, baseline_name, url, baseline_status_code, baseline_body, baseline_headers, baseline_timings, baseline_run_id, baseline_redirects, baseline_body_size, baseline_label, baseline_captured_at, baseline_latency_ms)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT (request_id, baseline_name) DO UPDATE SET url = excluded.url, baseline_status_code = excluded.baseline_status_code,
+                    baseline_body = excluded.baseline_body,
+                    baseline_headers = excluded.baseline_headers,
+                    baseline_timings = excluded.baseline_timings,
+                    baseline_run_id = excluded.baseline_run_id,
+                    baseline_redirects = excluded.baseline_redirects,
+                    baseline_body_size = excluded.baseline_body_size,
+                    baseline_label = excluded.baseline_label,
+                    baseline_captured_at = excluded.baseline_captured_at,
+                    baseline_latency_ms = excluded.baseline_latency_ms"
+    } else {
+        "INSERT INTO response (request_id, baseline_name, url, checktime_status_code, checktime_body, checktime_headers, checktime_timings, checktime_run_id, checktime_redirects, checktime_body_size, checktime_label, checktime_captured_at, checktime_latency_ms)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT (request_id, baseline_name) DO UPDATE SET checktime_status_code = excluded.checktime_status_code,
+                    checktime_body = excluded.checktime_body,
+                    checktime_headers = excluded.checktime_headers,
+                    checktime_timings = excluded.checktime_timings,
+                    checktime_run_id = excluded.checktime_run_id,
+                    checktime_redirects = excluded.checktime_redirects,
+                    checktime_body_size = excluded.checktime_body_size,
+                    checktime_label = excluded.checktime_label,
+                    checktime_captured_at = excluded.checktime_captured_at,
+                    checktime_latency_ms = excluded.checktime_latency_ms"
+    };
+
+    let captured_at = format_iso8601(SystemTime::now());
+    sqlx::query(query_str)
+        .persistent(true)
+        .bind(request_id)
+        .bind(baseline_name)
+        .bind(url)
+        .bind(response.status_code)
+        .bind(encode_body(&response.body.raw, compress)?)
+        .bind(serde_json::to_string(&response.headers).context("Failed to serialize headers")?)
+        .bind(serde_json::to_string(timings).context("Failed to serialize timings")?)
+        .bind(run_id)
+        .bind(
+            response
+                .redirects
+                .as_ref()
+                .map(serde_json::to_string)
+                .transpose()
+                .context("Failed to serialize redirects")?,
+        )
+        .bind(
+            response
+                .body_size
+                .as_ref()
+                .map(serde_json::to_string)
+                .transpose()
+                .context("Failed to serialize body size")?,
+        )
+        .bind(label)
+        .bind(&captured_at)
+        .bind(timings.latency_ms() as i64)
+        .execute(db)
+        .await
+        .context("Failed to save response to database")?;
+
+    if !baseline {
+        sqlx::query(
+            "INSERT INTO response_history (request_id, baseline_name, run_id, label, captured_at, status_code, headers, body, latency_ms)
+                VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+        )
+        .persistent(true)
+        .bind(request_id)
+        .bind(baseline_name)
+        .bind(run_id)
+        .bind(label)
+        .bind(&captured_at)
+        .bind(response.status_code)
+        .bind(serde_json::to_string(&response.headers).context("Failed to serialize headers")?)
+        .bind(encode_body(&response.body.raw, compress)?)
+        .bind(timings.latency_ms() as i64)
+        .execute(db)
+        .await
+        .context("Failed to save response history to database")?;
+    }
+
+    // A rebuilt baseline replaces all the accepted variants
+    if baseline {
+        sqlx::query("DELETE FROM baseline_variant WHERE request_id = ? AND baseline_name = ?")
+            .persistent(true)
+            .bind(request_id)
+            .bind(baseline_name)
+            .execute(db)
+            .await
+            .context("Failed to delete baseline variants from database")?;
+    }
+
+    Ok(())
+}
+
+/// Delete the responses of the named baseline, of a single request or of all of them, along with their
+/// variants and their history, which the latency percentiles are computed from. Either all of them are
+/// deleted or none is. Returns the number of responses deleted.
+pub async fn clear_baseline(
+    request_id: Option<&str>,
+    baseline_name: &str,
+    db: &Pool<Sqlite>,
+) -> Result<u64> {
+    let mut tx = db
+        .begin()
+        .await
+        .context("Failed to start the deletion of the baseline")?;
+    let mut deleted = 0;
+    // The responses are deleted last, their count being the one returned
+    for table in ["baseline_variant", "response_history", "response"] {
+        let condition = match request_id {
+            Some(_) => "baseline_name = ? AND request_id = ?",
+            None => "baseline_name = ?",
+        };
+        let query_str = format!("DELETE FROM {} WHERE {}", table, condition);
+        let query = sqlx::query(&query_str).bind(baseline_name);
+        let query = match request_id {
+            Some(request_id) => query.bind(request_id),
+            None => query,
+        };
+        deleted = query
+            .execute(&mut *tx)
+            .await
+            .with_context(|| format!("Failed to delete baseline rows from {} table", table))?
+            .rows_affected();
+    }
+    tx.commit()
+        .await
+        .context("Failed to commit the deletion of the baseline")?;
+
+    Ok(deleted)
+}
+
+/// Store a response as an additional accepted response of the named baseline for the request
+pub async fn save_baseline_variant(
+    request_id: &str,
+    baseline_name: &str,
+    response: &HttpResponseData,
+    run_id: &str,
+    compress: bool,
+    db: &Pool<Sqlite>,
+) -> Result<()> {
+    sqlx::query(
+        "INSERT INTO baseline_variant (request_id, baseline_name, status_code, headers, body, redirects, run_id)
+            VALUES (?, ?, ?, ?, ?, ?, ?)",
+    )
+    .persistent(true)
+    .bind(request_id)
+    .bind(baseline_name)
+    .bind(response.status_code)
+    .bind(serde_json::to_string(&response.headers).context("Failed to serialize headers")?)
+    .bind(encode_body(&response.body.raw, compress)?)
+    .bind(
+        response
+            .redirects
+            .as_ref()
+            .map(serde_json::to_string)
+            .transpose()
+            .context("Failed to serialize redirects")?,
+    )
+    .bind(run_id)
+    .execute(db)
+    .await
+    .context("Failed to save baseline variant to database")?;
+
+    Ok(())
+}
+
+/// Find the accepted variants of the named baseline of a request, in the order they were added
+pub async fn find_baseline_variants(
+    request_id: &str,
+    baseline_name: &str,
+    headers_ignored: bool,
+    db: &Pool<Sqlite>,
+) -> Result<Vec<HttpResponseData>> {
+    let rows = sqlx::query(
+        "SELECT status_code, headers, body, redirects FROM baseline_variant
+            WHERE request_id = ? AND baseline_name = ? ORDER BY rowid",
+    )
+    .persistent(true)
+    .bind(request_id)
+    .bind(baseline_name)
+    .fetch_all(db)
+    .await
+    .context("Failed to query baseline variants from database")?;
+
+    rows.iter()
+        .map(|row| variant_from_row(row, headers_ignored))
+        .collect()
+}
+
+fn variant_from_row(row: &SqliteRow, headers_ignored: bool) -> Result<HttpResponseData> {
+    let headers = if !headers_ignored {
+        let headers_str: &str = row.get("headers");
+        serde_json::from_str(headers_str).unwrap_or_default()
+    } else {
+        HashMap::new()
+    };
+    let redirects = row
+        .get::<Option<&str>, _>("redirects")
+        .map(serde_json::from_str)
+        .transpose()
+        .context("Failed to parse stored redirects")?;
+
+    Ok(HttpResponseData {
+        redirects,
+        ..HttpResponseData::new(
+            row.get("status_code"),
+            headers,
+            decode_body(row.get("body"))?,
+        )
+    })
+}
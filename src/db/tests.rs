@@ -0,0 +1,810 @@
+#[cfg(test)]
+mod tests {
+    use crate::HttpResponseData;
+    use crate::dates::parse_rfc3339;
+    use crate::db::{
+        DEFAULT_BASELINE_NAME, IN_MEMORY_DB, clear_baseline, decode_body, encode_body,
+        find_baseline_variants, find_latency_history, find_previous_response,
+        find_response_history, init_db, list_responses, open_read_only_db,
+        preload_previous_responses, save_baseline_variant, save_response,
+    };
+    use crate::diff_finder::{DiffOptions, compute_differences};
+    use crate::fetch::ResponseTimings;
+    use std::collections::HashMap;
+    use std::path::PathBuf;
+    use std::sync::Arc;
+    use tokio::task::JoinSet;
+
+    /// A database file of its own for a test, removed beforehand in case a previous run left it behind
+    fn test_db_path(name: &str) -> PathBuf {
+        let path = std::env::temp_dir().join(format!(
+            "release-sanity-checker-{}-{}.db",
+            name,
+            std::process::id()
+        ));
+        let _ = std::fs::remove_file(&path);
+        path
+    }
+
+    fn json_headers() -> HashMap<String, Vec<String>> {
+        HashMap::from([("Content-Type".into(), vec!["application/json".into()])])
+    }
+
+    #[test]
+    fn test_body_compression_round_trip() {
+        let body = r#"{"name": "Caffè", "items": [1, 2, 3]}"#;
+
+        let compressed = encode_body(body, true).unwrap();
+        assert_ne!(compressed, body.as_bytes());
+        assert_eq!(decode_body(&compressed).unwrap(), body);
+
+        let uncompressed = encode_body(body, false).unwrap();
+        assert_eq!(uncompressed, body.as_bytes());
+        assert_eq!(decode_body(&uncompressed).unwrap(), body);
+    }
+
+    #[test]
+    fn test_compressed_baseline_diffs_like_uncompressed() {
+        let baseline = r#"{"name": "John", "age": 30, "tags": ["a", "b"]}"#;
+        let current = HttpResponseData::new(
+            200,
+            json_headers(),
+            r#"{"name": "John", "age": 31, "tags": ["a", "c"]}"#.to_string(),
+        );
+
+        let from_compressed = HttpResponseData::new(
+            200,
+            json_headers(),
+            decode_body(&encode_body(baseline, true).unwrap()).unwrap(),
+        );
+        let from_uncompressed = HttpResponseData::new(
+            200,
+            json_headers(),
+            decode_body(&encode_body(baseline, false).unwrap()).unwrap(),
+        );
+
+        let options = DiffOptions::default();
+        let differences1 = compute_differences(&from_compressed, &current, false, None, &options);
+        let differences2 = compute_differences(&from_uncompressed, &current, false, None, &options);
+
+        assert!(!differences1.is_empty());
+        assert_eq!(differences1.len(), differences2.len());
+        for diff in &differences1 {
+            assert!(differences2.contains(diff));
+        }
+    }
+
+    #[tokio::test]
+    async fn test_db_named_baselines() {
+        let path = test_db_path("named-baselines");
+        let db = init_db(path.to_str().unwrap()).await.unwrap();
+        let timings = ResponseTimings {
+            time_to_first_byte_ms: 10,
+            download_ms: 5,
+            ..Default::default()
+        };
+
+        for (name, version) in [("v1.0", "1.0"), ("v1.1", "1.1")] {
+            let response = HttpResponseData::new(
+                200,
+                json_headers(),
+                format!(r#"{{"version": "{}"}}"#, version),
+            );
+            save_response(
+                "a", name, "http://a", &response, &timings, "run", None, true, false, &db,
+            )
+            .await
+            .unwrap();
+        }
+
+        // Each named baseline keeps its own response, and is compared on its own
+        let current =
+            HttpResponseData::new(200, json_headers(), r#"{"version": "1.1"}"#.to_string());
+        let options = DiffOptions::default();
+        let v1_0 = find_previous_response("a", "v1.0", false, &db)
+            .await
+            .unwrap()
+            .unwrap();
+        let v1_1 = find_previous_response("a", "v1.1", false, &db)
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(
+            compute_differences(&v1_0, &current, false, None, &options).len(),
+            1
+        );
+        assert!(compute_differences(&v1_1, &current, false, None, &options).is_empty());
+
+        assert!(
+            find_previous_response("a", DEFAULT_BASELINE_NAME, false, &db)
+                .await
+                .unwrap()
+                .is_none()
+        );
+
+        db.close().await;
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[tokio::test]
+    async fn test_db_clear_baseline() {
+        let path = test_db_path("clear-baseline");
+        let db = init_db(path.to_str().unwrap()).await.unwrap();
+        let response = HttpResponseData::new(200, json_headers(), "{}".to_string());
+        for (id, name) in [("a", "v1"), ("b", "v1"), ("c", "v1"), ("a", "v2")] {
+            save_response(
+                id,
+                name,
+                "http://a",
+                &response,
+                &ResponseTimings::default(),
+                "run",
+                None,
+                true,
+                false,
+                &db,
+            )
+            .await
+            .unwrap();
+        }
+        // Along with a variant and the history of checktime responses
+        save_baseline_variant("a", "v1", &response, "run", false, &db)
+            .await
+            .unwrap();
+        for (id, name) in [("a", "v1"), ("b", "v1"), ("a", "v2")] {
+            save_response(
+                id,
+                name,
+                "http://a",
+                &response,
+                &ResponseTimings::default(),
+                "run",
+                None,
+                false,
+                false,
+                &db,
+            )
+            .await
+            .unwrap();
+        }
+
+        assert_eq!(clear_baseline(Some("a"), "v1", &db).await.unwrap(), 1);
+        assert!(
+            find_baseline_variants("a", "v1", false, &db)
+                .await
+                .unwrap()
+                .is_empty()
+        );
+        assert!(
+            find_response_history("a", "v1", &db)
+                .await
+                .unwrap()
+                .is_empty()
+        );
+        assert_eq!(
+            find_response_history("b", "v1", &db).await.unwrap().len(),
+            1
+        );
+        assert!(
+            find_previous_response("a", "v1", false, &db)
+                .await
+                .unwrap()
+                .is_none()
+        );
+        assert!(
+            find_previous_response("b", "v1", false, &db)
+                .await
+                .unwrap()
+                .is_some()
+        );
+        // Other baselines are kept
+        assert!(
+            find_previous_response("a", "v2", false, &db)
+                .await
+                .unwrap()
+                .is_some()
+        );
+
+        assert_eq!(clear_baseline(None, "v1", &db).await.unwrap(), 2);
+        assert!(
+            find_response_history("b", "v1", &db)
+                .await
+                .unwrap()
+                .is_empty()
+        );
+        assert_eq!(
+            find_response_history("a", "v2", &db).await.unwrap().len(),
+            1
+        );
+        assert!(
+            find_previous_response("c", "v1", false, &db)
+                .await
+                .unwrap()
+                .is_none()
+        );
+        assert!(
+            find_previous_response("a", "v2", false, &db)
+                .await
+                .unwrap()
+                .is_some()
+        );
+
+        db.close().await;
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[tokio::test]
+    async fn test_db_list_responses() {
+        let path = test_db_path("list-responses");
+        let db = init_db(path.to_str().unwrap()).await.unwrap();
+        let response = HttpResponseData::new(404, json_headers(), "{}".to_string());
+        for (id, name, baseline) in [
+            ("b", "v1", true),
+            ("a", "v1", true),
+            ("a", "v1", false),
+            ("a", DEFAULT_BASELINE_NAME, false),
+        ] {
+            save_response(
+                id,
+                name,
+                &format!("http://{}", id),
+                &response,
+                &ResponseTimings {
+                    time_to_first_byte_ms: 120,
+                    download_ms: 30,
+                    ..Default::default()
+                },
+                "run",
+                None,
+                baseline,
+                false,
+                &db,
+            )
+            .await
+            .unwrap();
+        }
+
+        let listed = list_responses(&db).await.unwrap();
+        let rows: Vec<_> = listed
+            .iter()
+            .map(|r| {
+                (
+                    r.request_id.as_str(),
+                    r.baseline_name.as_str(),
+                    r.url.as_str(),
+                    r.baseline_status_code,
+                    r.has_checktime,
+                )
+            })
+            .collect();
+        assert_eq!(
+            rows,
+            vec![
+                ("a", DEFAULT_BASELINE_NAME, "http://a", None, true),
+                ("a", "v1", "http://a", Some(404), true),
+                ("b", "v1", "http://b", Some(404), false),
+            ]
+        );
+
+        // The capture time and latency are stored with each response
+        for response in &listed {
+            let baselined = response.baseline_status_code.is_some();
+            assert_eq!(
+                response
+                    .baseline_captured_at
+                    .as_deref()
+                    .and_then(parse_rfc3339)
+                    .is_some(),
+                baselined
+            );
+            assert_eq!(response.baseline_latency_ms, baselined.then_some(150));
+            assert_eq!(
+                response
+                    .checktime_captured_at
+                    .as_deref()
+                    .and_then(parse_rfc3339)
+                    .is_some(),
+                response.has_checktime
+            );
+            assert_eq!(
+                response.checktime_latency_ms,
+                response.has_checktime.then_some(150)
+            );
+        }
+
+        db.close().await;
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[tokio::test]
+    async fn test_db_migrates_unnamed_baselines() {
+        let path = test_db_path("unnamed-baselines");
+        let db = init_db(path.to_str().unwrap()).await.unwrap();
+        // The schema of the versions without named baselines
+        sqlx::query("DROP TABLE response")
+            .execute(&db)
+            .await
+            .unwrap();
+        sqlx::query(
+            "CREATE TABLE response (
+                request_id TEXT NOT NULL, url TEXT NOT NULL, baseline_status_code INTEGER,
+                checktime_status_code INTEGER, baseline_headers TEXT, checktime_headers TEXT,
+                baseline_body TEXT, checktime_body TEXT, PRIMARY KEY(request_id)
+            )",
+        )
+        .execute(&db)
+        .await
+        .unwrap();
+        sqlx::query(
+            "INSERT INTO response (request_id, url, baseline_status_code, baseline_headers, baseline_body)
+                VALUES ('a', 'http://a', 200, '{}', 'old')",
+        )
+        .execute(&db)
+        .await
+        .unwrap();
+        db.close().await;
+
+        let db = init_db(path.to_str().unwrap()).await.unwrap();
+        let baseline = find_previous_response("a", DEFAULT_BASELINE_NAME, false, &db)
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(baseline.body.raw, "old");
+        assert!(
+            find_previous_response("a", "v1.0", false, &db)
+                .await
+                .unwrap()
+                .is_none()
+        );
+
+        db.close().await;
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[tokio::test]
+    async fn test_db_custom_path() {
+        let dir = std::env::temp_dir().join(format!(
+            "release-sanity-checker-custom-path-{}",
+            std::process::id()
+        ));
+        let _ = std::fs::remove_dir_all(&dir);
+        // The missing directories are created
+        let path = dir.join("project").join("responses.db");
+
+        let db = init_db(path.to_str().unwrap()).await.unwrap();
+        let response = HttpResponseData::new(200, json_headers(), "{}".to_string());
+        save_response(
+            "a",
+            DEFAULT_BASELINE_NAME,
+            "http://a",
+            &response,
+            &ResponseTimings::default(),
+            "run",
+            None,
+            true,
+            false,
+            &db,
+        )
+        .await
+        .unwrap();
+        db.close().await;
+        assert!(path.is_file());
+
+        let db = init_db(path.to_str().unwrap()).await.unwrap();
+        assert!(
+            find_previous_response("a", DEFAULT_BASELINE_NAME, false, &db)
+                .await
+                .unwrap()
+                .is_some()
+        );
+
+        db.close().await;
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+
+    #[tokio::test]
+    async fn test_db_in_memory() {
+        let db = init_db(IN_MEMORY_DB).await.unwrap();
+        let response = HttpResponseData::new(200, json_headers(), "{}".to_string());
+        for id in ["a", "b"] {
+            save_response(
+                id,
+                DEFAULT_BASELINE_NAME,
+                "http://a",
+                &response,
+                &ResponseTimings::default(),
+                "run",
+                None,
+                true,
+                false,
+                &db,
+            )
+            .await
+            .unwrap();
+        }
+        assert_eq!(list_responses(&db).await.unwrap().len(), 2);
+        assert!(!std::path::Path::new(IN_MEMORY_DB).exists());
+        db.close().await;
+
+        // Nothing is kept from one run to the next
+        let db = init_db(IN_MEMORY_DB).await.unwrap();
+        assert!(list_responses(&db).await.unwrap().is_empty());
+        db.close().await;
+    }
+
+    #[tokio::test]
+    async fn test_db_in_memory_concurrent_saves() {
+        let db = Arc::new(init_db(IN_MEMORY_DB).await.unwrap());
+        let response = Arc::new(HttpResponseData::new(200, json_headers(), "{}".to_string()));
+
+        // Far more flows than the single connection can serve at once, as with a high --concurrency
+        let mut saves = JoinSet::new();
+        for i in 0..300 {
+            let (db, response) = (db.clone(), response.clone());
+            saves.spawn(async move {
+                save_response(
+                    &format!("request-{}", i),
+                    DEFAULT_BASELINE_NAME,
+                    "http://a",
+                    &response,
+                    &ResponseTimings::default(),
+                    "run",
+                    None,
+                    i % 2 == 0,
+                    false,
+                    db.as_ref(),
+                )
+                .await
+            });
+        }
+        while let Some(result) = saves.join_next().await {
+            result.unwrap().unwrap();
+        }
+
+        assert_eq!(list_responses(db.as_ref()).await.unwrap().len(), 300);
+        db.close().await;
+    }
+
+    #[tokio::test]
+    async fn test_db_response_history() {
+        let db = init_db(IN_MEMORY_DB).await.unwrap();
+        for (run_id, status, body, baseline) in [
+            ("baseline", 200, r#"{"name":"Ann"}"#, true),
+            ("run-1", 200, r#"{"name":"Ann"}"#, false),
+            ("run-2", 200, r#"{"name":"Bob"}"#, false),
+            ("run-3", 500, "oops", false),
+        ] {
+            let response = HttpResponseData::new(status, json_headers(), body.to_string());
+            save_response(
+                "get-user",
+                DEFAULT_BASELINE_NAME,
+                "http://api/user",
+                &response,
+                &ResponseTimings {
+                    time_to_first_byte_ms: 40,
+                    download_ms: 2,
+                    ..Default::default()
+                },
+                run_id,
+                Some("v2"),
+                baseline,
+                true,
+                &db,
+            )
+            .await
+            .unwrap();
+        }
+
+        // Every checktime response is kept, oldest first, while baselines aren't part of the history
+        let history = find_response_history("get-user", DEFAULT_BASELINE_NAME, &db)
+            .await
+            .unwrap();
+        let entries: Vec<_> = history
+            .iter()
+            .map(|entry| {
+                (
+                    entry.run_id.as_deref(),
+                    entry.response.status_code,
+                    entry.response.body.raw.as_str(),
+                )
+            })
+            .collect();
+        assert_eq!(
+            entries,
+            vec![
+                (Some("run-1"), 200, r#"{"name":"Ann"}"#),
+                (Some("run-2"), 200, r#"{"name":"Bob"}"#),
+                (Some("run-3"), 500, "oops"),
+            ]
+        );
+        for entry in &history {
+            assert_eq!(entry.label.as_deref(), Some("v2"));
+            assert_eq!(entry.latency_ms, Some(42));
+            assert!(parse_rfc3339(&entry.captured_at).is_some());
+            assert_eq!(entry.response.headers, json_headers());
+        }
+        assert!(
+            history
+                .windows(2)
+                .all(|pair| pair[0].captured_at <= pair[1].captured_at)
+        );
+
+        // Histories are kept per baseline name
+        assert!(
+            find_response_history("get-user", "other", &db)
+                .await
+                .unwrap()
+                .is_empty()
+        );
+    }
+
+    #[tokio::test]
+    async fn test_db_latency_history() {
+        let db = init_db(IN_MEMORY_DB).await.unwrap();
+        let response = HttpResponseData::new(200, json_headers(), "{}".to_string());
+        for (name, latency_ms, baseline) in [
+            ("v1", 100, false),
+            ("v2", 900, false),
+            ("v1", 110, false),
+            ("v1", 5000, true),
+            ("v1", 120, false),
+        ] {
+            save_response(
+                "a",
+                name,
+                "http://a",
+                &response,
+                &ResponseTimings {
+                    time_to_first_byte_ms: latency_ms,
+                    ..Default::default()
+                },
+                "run",
+                None,
+                baseline,
+                false,
+                &db,
+            )
+            .await
+            .unwrap();
+        }
+
+        // Each baseline name has its own history of checktime latencies, most recent first
+        assert_eq!(
+            find_latency_history("a", "v1", 10, &db).await.unwrap(),
+            vec![120, 110, 100]
+        );
+        assert_eq!(
+            find_latency_history("a", "v1", 2, &db).await.unwrap(),
+            vec![120, 110]
+        );
+        assert_eq!(
+            find_latency_history("a", "v2", 10, &db).await.unwrap(),
+            vec![900]
+        );
+        assert!(
+            find_latency_history("b", "v1", 10, &db)
+                .await
+                .unwrap()
+                .is_empty()
+        );
+        db.close().await;
+    }
+
+    #[tokio::test]
+    async fn test_db_read_only_baseline() {
+        let baseline_path = test_db_path("read-only-baseline");
+        let path = test_db_path("read-only-checks");
+        let baseline_db = init_db(baseline_path.to_str().unwrap()).await.unwrap();
+        let baseline = HttpResponseData::new(200, json_headers(), r#"{"v": 1}"#.to_string());
+        save_response(
+            "a",
+            DEFAULT_BASELINE_NAME,
+            "http://a",
+            &baseline,
+            &ResponseTimings::default(),
+            "baseline-run",
+            None,
+            true,
+            false,
+            &baseline_db,
+        )
+        .await
+        .unwrap();
+        baseline_db.close().await;
+
+        // Baselines are read from the read-only database, while responses are written to the other one
+        let baseline_db = open_read_only_db(baseline_path.to_str().unwrap())
+            .await
+            .unwrap();
+        let db = init_db(path.to_str().unwrap()).await.unwrap();
+        let read = find_previous_response("a", DEFAULT_BASELINE_NAME, false, &baseline_db)
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(read.body.raw, baseline.body.raw);
+
+        let current = HttpResponseData::new(200, json_headers(), r#"{"v": 2}"#.to_string());
+        save_response(
+            "a",
+            DEFAULT_BASELINE_NAME,
+            "http://a",
+            &current,
+            &ResponseTimings::default(),
+            "run",
+            None,
+            false,
+            false,
+            &db,
+        )
+        .await
+        .unwrap();
+        assert!(
+            save_response(
+                "a",
+                DEFAULT_BASELINE_NAME,
+                "http://a",
+                &current,
+                &ResponseTimings::default(),
+                "run",
+                None,
+                false,
+                false,
+                &baseline_db,
+            )
+            .await
+            .is_err()
+        );
+
+        let written = list_responses(&db).await.unwrap();
+        assert_eq!(written.len(), 1);
+        assert!(written[0].has_checktime);
+        assert_eq!(written[0].baseline_status_code, None);
+        let baselines = list_responses(&baseline_db).await.unwrap();
+        assert_eq!(baselines.len(), 1);
+        assert!(!baselines[0].has_checktime);
+        assert_eq!(baselines[0].baseline_status_code, Some(200));
+
+        baseline_db.close().await;
+        db.close().await;
+        let _ = std::fs::remove_file(&baseline_path);
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[tokio::test]
+    async fn test_db_read_only_older_version() {
+        // A database without the baseline variants
+        let path = test_db_path("read-only-without-variants");
+        let db = init_db(path.to_str().unwrap()).await.unwrap();
+        sqlx::query("DROP TABLE baseline_variant")
+            .execute(&db)
+            .await
+            .unwrap();
+        db.close().await;
+        let error = open_read_only_db(path.to_str().unwrap())
+            .await
+            .err()
+            .unwrap()
+            .to_string();
+        assert!(error.contains("older version"), "{}", error);
+        assert!(error.contains("table baseline_variant"), "{}", error);
+        let _ = std::fs::remove_file(&path);
+
+        // A database of the versions without named baselines, whose columns are all reported at once
+        let path = test_db_path("read-only-unnamed-baselines");
+        let db = init_db(path.to_str().unwrap()).await.unwrap();
+        sqlx::query("DROP TABLE response")
+            .execute(&db)
+            .await
+            .unwrap();
+        sqlx::query(
+            "CREATE TABLE response (
+                request_id TEXT NOT NULL, url TEXT NOT NULL, baseline_status_code INTEGER,
+                checktime_status_code INTEGER, baseline_headers TEXT, checktime_headers TEXT,
+                baseline_body TEXT, checktime_body TEXT, PRIMARY KEY(request_id)
+            )",
+        )
+        .execute(&db)
+        .await
+        .unwrap();
+        db.close().await;
+        let error = open_read_only_db(path.to_str().unwrap())
+            .await
+            .err()
+            .unwrap()
+            .to_string();
+        for column in ["baseline_name", "baseline_redirects", "baseline_body_size"] {
+            assert!(error.contains(&format!("response.{}", column)), "{}", error);
+        }
+
+        // Once migrated, it can be opened
+        init_db(path.to_str().unwrap()).await.unwrap().close().await;
+        open_read_only_db(path.to_str().unwrap())
+            .await
+            .unwrap()
+            .close()
+            .await;
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[tokio::test]
+    async fn test_db_preload_baselines() {
+        let db = init_db(IN_MEMORY_DB).await.unwrap();
+        // More requests than fit in a single query
+        let request_ids: Vec<String> = (0..1203).map(|i| format!("request-{}", i)).collect();
+        for (i, id) in request_ids.iter().enumerate() {
+            let response = HttpResponseData::new(200, json_headers(), format!(r#"{{"i": {}}}"#, i));
+            save_response(
+                id,
+                DEFAULT_BASELINE_NAME,
+                "http://a",
+                &response,
+                &ResponseTimings::default(),
+                "run",
+                None,
+                // The last request only has a checktime response
+                i != 1202,
+                false,
+                &db,
+            )
+            .await
+            .unwrap();
+        }
+        let variant = HttpResponseData::new(503, json_headers(), "{}".to_string());
+        for id in ["request-7", "request-7", "request-700"] {
+            save_baseline_variant(id, DEFAULT_BASELINE_NAME, &variant, "run", false, &db)
+                .await
+                .unwrap();
+        }
+
+        let preloaded =
+            preload_previous_responses(&request_ids, DEFAULT_BASELINE_NAME, false, u64::MAX, &db)
+                .await
+                .unwrap()
+                .unwrap();
+        // Every baseline is loaded, from each chunk, while the rows without one are left out
+        assert_eq!(preloaded.responses.len(), 1202);
+        for i in [0, 499, 500, 1000, 1201] {
+            let id = format!("request-{}", i);
+            assert_eq!(
+                preloaded.responses[&id].body.raw,
+                format!(r#"{{"i": {}}}"#, i)
+            );
+            assert_eq!(preloaded.responses[&id].headers, json_headers());
+        }
+        assert!(!preloaded.responses.contains_key("request-1202"));
+
+        // Along with the variants, as they would be queried one request at a time
+        assert_eq!(preloaded.variants.len(), 2);
+        assert_eq!(preloaded.variants["request-7"].len(), 2);
+        assert_eq!(preloaded.variants["request-700"][0].status_code, 503);
+        assert_eq!(
+            preloaded.variants["request-700"],
+            find_baseline_variants("request-700", DEFAULT_BASELINE_NAME, false, &db)
+                .await
+                .unwrap()
+        );
+
+        // Baselines larger than the limit are left to be queried one by one
+        assert!(
+            preload_previous_responses(&request_ids, DEFAULT_BASELINE_NAME, false, 100, &db)
+                .await
+                .unwrap()
+                .is_none()
+        );
+        // The variants count towards the limit: the two baselines are 18 bytes, their three variants 6 more
+        let ids = ["request-7".to_string(), "request-700".to_string()];
+        assert!(
+            preload_previous_responses(&ids, DEFAULT_BASELINE_NAME, false, 23, &db)
+                .await
+                .unwrap()
+                .is_none()
+        );
+        assert!(
+            preload_previous_responses(&ids, DEFAULT_BASELINE_NAME, false, 24, &db)
+                .await
+                .unwrap()
+                .is_some()
+        );
+        db.close().await;
+    }
+}
@@ -1,14 +1,144 @@
 mod tests;
 
-use std::collections::HashSet;
+use std::borrow::Cow;
+use std::collections::{BTreeMap, BTreeSet, HashMap, HashSet};
+use std::fmt;
 
-use colored::Colorize;
+use colored::{ColoredString, Colorize};
+use regex::Regex;
+use serde::{Deserialize, Serialize};
 use serde_json::Value;
 
-use crate::HttpResponseData;
+use crate::fetch::ResponseTimings;
+use crate::dates::parse_rfc3339;
+use crate::{HttpResponseData, ParsedBody, RedirectHop};
 
-/// Represents a difference found in JSON structures
-#[derive(Debug, PartialEq)]
+/// Settings tuning how two responses are compared
+#[derive(Debug, Clone)]
+pub struct DiffOptions {
+    /// Compare JSON bodies by value rather than by representation, e.g. `1.0` equals `1`
+    pub canonical_json: bool,
+    /// Only compare the status code and the headers, e.g. for HEAD requests that have no body
+    pub skip_body: bool,
+    /// Separator between the keys of a JSON path, in differences and ignored paths
+    pub path_separator: String,
+    /// How much numbers can drift at the given paths without being reported
+    pub numeric_tolerances: HashMap<String, Tolerance>,
+    /// How much the numbers at any other path can drift without being reported
+    pub numeric_tolerance: Option<Tolerance>,
+    /// Compare only the structure of JSON bodies, their paths and value types, ignoring the values
+    pub shape_only: bool,
+    /// Lowercase names of the headers whose changes aren't reported, e.g. `date`
+    pub ignored_headers: HashSet<String>,
+    /// Lowercase names of the headers whose comma-separated values are compared regardless of their order
+    /// and whitespace
+    pub normalized_headers: HashSet<String>,
+    /// Consider a numeric string equal to the number it holds, e.g. `"42"` and `42`
+    pub coerce_numeric_strings: bool,
+    /// Consider a boolean-like string equal to the boolean it holds, e.g. `"true"` or `"1"` and `true`
+    pub coerce_boolean_strings: bool,
+    /// Consider RFC 3339 date-times equal when they stand for the same instant, whatever their timezone
+    pub normalize_dates: bool,
+    /// Don't report added keys holding `null`, `[]` or `{}`, a backward-compatible change
+    pub allow_empty_additions: bool,
+    /// Arrays of objects whose elements are matched by the value of a key field rather than compared
+    /// as a whole, keyed by the path of the array, e.g. `/items` -> `id`
+    pub array_keys: HashMap<String, String>,
+    /// How deep JSON bodies are compared, values differing below it being reported as `DepthTruncated`
+    pub max_depth: usize,
+    /// How many characters of a string value are shown in differences, 0 to show them whole.
+    /// Non-JSON bodies are shown up to twice as many.
+    pub max_value_length: usize,
+}
+
+pub const DEFAULT_PATH_SEPARATOR: &str = "/";
+pub const DEFAULT_MAX_DIFF_DEPTH: usize = 10;
+pub const DEFAULT_MAX_VALUE_LENGTH: usize = 50;
+
+impl Default for DiffOptions {
+    fn default() -> Self {
+        DiffOptions {
+            canonical_json: false,
+            skip_body: false,
+            path_separator: DEFAULT_PATH_SEPARATOR.to_string(),
+            numeric_tolerances: HashMap::new(),
+            numeric_tolerance: None,
+            shape_only: false,
+            ignored_headers: HashSet::new(),
+            normalized_headers: HashSet::new(),
+            coerce_numeric_strings: false,
+            coerce_boolean_strings: false,
+            normalize_dates: false,
+            allow_empty_additions: false,
+            array_keys: HashMap::new(),
+            max_depth: DEFAULT_MAX_DIFF_DEPTH,
+            max_value_length: DEFAULT_MAX_VALUE_LENGTH,
+        }
+    }
+}
+
+/// The accepted drift of a number, written either as an absolute value (`1000`) or as a percentage of
+/// the baseline value (`"5%"`)
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, PartialEq)]
+#[serde(try_from = "Value", into = "Value")]
+pub enum Tolerance {
+    Absolute(f64),
+    Percent(f64),
+}
+
+impl Tolerance {
+    /// Whether the new number is within the tolerance of the old one
+    pub fn accepts(&self, old: &serde_json::Number, new: &serde_json::Number) -> bool {
+        let (Some(old), Some(new)) = (old.as_f64(), new.as_f64()) else {
+            return false;
+        };
+        let max_drift = match self {
+            Tolerance::Absolute(value) => *value,
+            Tolerance::Percent(percent) => old.abs() * percent / 100.0,
+        };
+
+        (new - old).abs() <= max_drift
+    }
+}
+
+impl TryFrom<Value> for Tolerance {
+    type Error = String;
+
+    fn try_from(value: Value) -> Result<Self, Self::Error> {
+        let tolerance = match &value {
+            Value::Number(n) => n.as_f64().map(Tolerance::Absolute),
+            Value::String(s) => match s.trim().strip_suffix('%') {
+                Some(percent) => percent.trim().parse().ok().map(Tolerance::Percent),
+                None => s.trim().parse().ok().map(Tolerance::Absolute),
+            },
+            _ => None,
+        };
+
+        match tolerance {
+            Some(tolerance @ (Tolerance::Absolute(v) | Tolerance::Percent(v))) if v >= 0.0 => {
+                Ok(tolerance)
+            }
+            _ => Err(format!(
+                "invalid tolerance {}, expected a positive number or percentage, e.g. 1000 or \"5%\"",
+                value
+            )),
+        }
+    }
+}
+
+impl From<Tolerance> for Value {
+    fn from(tolerance: Tolerance) -> Self {
+        match tolerance {
+            Tolerance::Absolute(value) => Value::from(value),
+            Tolerance::Percent(percent) => Value::from(format!("{}%", percent)),
+        }
+    }
+}
+
+/// Represents a difference found in JSON structures.
+/// Serialized with its kind, as returned by `kind`, next to its fields.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+#[serde(tag = "kind", rename_all = "snake_case")]
 pub enum Difference {
     StatusCodeChanged {
         old_val: u16,
@@ -55,88 +185,424 @@ pub enum Difference {
         before: String,
         after: String,
     },
+    /// A phase of the request took longer than in the baseline, beyond the tolerated threshold
+    TimingRegressed {
+        phase: String,
+        old_ms: u64,
+        new_ms: u64,
+    },
+    /// The array has the same elements, but in a different order
+    ArrayOrderChanged {
+        path: String,
+    },
+    /// A hop of the redirect chain was added, removed or now points somewhere else
+    RedirectHopChanged {
+        hop: usize,
+        old_val: Option<String>,
+        new_val: Option<String>,
+    },
+    /// The type of the value at the path changed, when only the structure of the body is compared
+    TypeChanged {
+        path: String,
+        old_type: String,
+        new_type: String,
+    },
+    /// A substring that must never appear was found in the body, at the given line and column
+    ForbiddenSubstring {
+        substring: String,
+        line: usize,
+        column: usize,
+        context: String,
+    },
+    /// A header required with a given value is missing, or has another value
+    ExpectedHeaderMismatch {
+        header_name: String,
+        expected: String,
+        actual: Option<Vec<String>>,
+    },
+    /// A body assertion isn't met, `actual` being what was found instead, if anything
+    AssertionFailed {
+        assertion: String,
+        actual: Option<String>,
+    },
+    /// The values at the path differ, but deeper than the maximum depth of the comparison,
+    /// so the differences below it aren't detailed
+    DepthTruncated {
+        path: String,
+        max_depth: usize,
+    },
+    /// The response body was cut at the size limit, so the response was neither compared nor saved
+    BodyTruncated {
+        limit_bytes: usize,
+    },
+    /// The same kind of difference found at several paths sharing one pattern
+    Repeated {
+        path: String,
+        count: usize,
+        sample: Box<Difference>,
+    },
 }
 
 impl Difference {
+    /// Stable names of the kinds of differences, as returned by `kind`
+    pub const KINDS: [&'static str; 21] = [
+        "status_code_changed",
+        "header_value_changed",
+        "header_value_removed",
+        "header_value_added",
+        "body_value_changed",
+        "body_value_removed",
+        "body_value_added",
+        "array_length_changed",
+        "array_element_removed",
+        "array_element_added",
+        "different_body_string",
+        "timing_regressed",
+        "array_order_changed",
+        "redirect_hop_changed",
+        "type_changed",
+        "forbidden_substring",
+        "expected_header_mismatch",
+        "assertion_failed",
+        "depth_truncated",
+        "body_truncated",
+        "repeated",
+    ];
+
+    /// A stable name for the kind of difference
+    pub fn kind(&self) -> &'static str {
+        match self {
+            Difference::StatusCodeChanged { .. } => "status_code_changed",
+            Difference::HeaderValueChanged { .. } => "header_value_changed",
+            Difference::HeaderValueRemoved { .. } => "header_value_removed",
+            Difference::HeaderValueAdded { .. } => "header_value_added",
+            Difference::BodyValueChanged { .. } => "body_value_changed",
+            Difference::BodyValueRemoved { .. } => "body_value_removed",
+            Difference::BodyValueAdded { .. } => "body_value_added",
+            Difference::ArrayLengthChanged { .. } => "array_length_changed",
+            Difference::ArrayElementRemoved { .. } => "array_element_removed",
+            Difference::ArrayElementAdded { .. } => "array_element_added",
+            Difference::DifferentBodyString { .. } => "different_body_string",
+            Difference::TimingRegressed { .. } => "timing_regressed",
+            Difference::ArrayOrderChanged { .. } => "array_order_changed",
+            Difference::RedirectHopChanged { .. } => "redirect_hop_changed",
+            Difference::TypeChanged { .. } => "type_changed",
+            Difference::ForbiddenSubstring { .. } => "forbidden_substring",
+            Difference::ExpectedHeaderMismatch { .. } => "expected_header_mismatch",
+            Difference::AssertionFailed { .. } => "assertion_failed",
+            Difference::DepthTruncated { .. } => "depth_truncated",
+            Difference::BodyTruncated { .. } => "body_truncated",
+            Difference::Repeated { .. } => "repeated",
+        }
+    }
+
+    /// The JSON path the difference refers to, if any
+    pub fn path(&self) -> Option<&str> {
+        match self {
+            Difference::BodyValueChanged { path, .. }
+            | Difference::BodyValueRemoved { path, .. }
+            | Difference::BodyValueAdded { path, .. }
+            | Difference::ArrayLengthChanged { path, .. }
+            | Difference::ArrayElementRemoved { path, .. }
+            | Difference::ArrayElementAdded { path, .. }
+            | Difference::ArrayOrderChanged { path }
+            | Difference::TypeChanged { path, .. }
+            | Difference::DepthTruncated { path, .. }
+            | Difference::Repeated { path, .. } => Some(path),
+            _ => None,
+        }
+    }
+
     pub fn print(&self) {
+        let mut out = String::new();
+        let _ = self.write_to(&mut out, true);
+        print!("{}", out);
+    }
+
+    /// Write a human readable description of the difference, colorized if requested
+    pub fn write_to(&self, out: &mut impl fmt::Write, colorize: bool) -> fmt::Result {
+        let old = |v: &str| paint(v, colorize, |s| s.green());
+        let new = |v: &str| paint(v, colorize, |s| s.red());
+        let highlight = |v: &str| paint(v, colorize, |s| s.bright_white());
+
         match self {
             Difference::StatusCodeChanged { old_val, new_val } => {
-                println!("  Status Code Difference:");
-                println!("    - {}", old_val.to_string().green());
-                println!("    + {}", new_val.to_string().red());
+                writeln!(out, "  Status Code Difference:")?;
+                writeln!(out, "    - {}", old(&old_val.to_string()))?;
+                writeln!(out, "    + {}", new(&new_val.to_string()))?;
             }
             Difference::HeaderValueChanged {
                 header_name,
                 old_val,
                 new_val,
             } => {
-                println!("    Changed Header: {}", header_name);
-                println!("      - {}", format!("{:?}", old_val).green());
-                println!("      + {}", format!("{:?}", new_val).red());
+                writeln!(out, "    Changed Header: {}", header_name)?;
+                writeln!(out, "      - {}", old(&format!("{:?}", old_val)))?;
+                writeln!(out, "      + {}", new(&format!("{:?}", new_val)))?;
             }
             Difference::HeaderValueRemoved { header_name } => {
-                println!("    Removed Header: {}", header_name);
+                writeln!(out, "    Removed Header: {}", header_name)?;
             }
             Difference::HeaderValueAdded { header_name } => {
-                println!("    Added Header: {}", header_name);
+                writeln!(out, "    Added Header: {}", header_name)?;
             }
             Difference::BodyValueChanged {
                 path,
                 old_val,
                 new_val,
             } => {
-                println!("    Changed body value at '{}' ", path.bright_white());
-                println!("      - {}", old_val.green());
-                println!("      + {}", new_val.red());
+                writeln!(out, "    Changed body value at '{}' ", highlight(path))?;
+                writeln!(out, "      - {}", old(old_val))?;
+                writeln!(out, "      + {}", new(new_val))?;
             }
             Difference::BodyValueRemoved { path, value } => {
-                println!("    Removed body value at '{}' ", path.bright_white());
-                println!("      - {}", value.green());
+                writeln!(out, "    Removed body value at '{}' ", highlight(path))?;
+                writeln!(out, "      - {}", old(value))?;
             }
             Difference::BodyValueAdded { path, value } => {
-                println!("    Added body value at '{}' ", path.bright_white());
-                println!("      + {}", value.red());
+                writeln!(out, "    Added body value at '{}' ", highlight(path))?;
+                writeln!(out, "      + {}", new(value))?;
             }
             Difference::ArrayLengthChanged {
                 path,
                 old_len,
                 new_len,
             } => {
-                println!("    Array length changed at '{}' ", path.bright_white());
-                println!("      - length: {}", old_len.to_string().green());
-                println!("      + length: {}", new_len.to_string().red());
+                writeln!(out, "    Array length changed at '{}' ", highlight(path))?;
+                writeln!(out, "      - length: {}", old(&old_len.to_string()))?;
+                writeln!(out, "      + length: {}", new(&new_len.to_string()))?;
             }
             Difference::ArrayElementRemoved { path, value } => {
-                println!("    Array element removed at '{}' ", path.bright_white());
-                println!("      - {}", value.green());
+                writeln!(out, "    Array element removed at '{}' ", highlight(path))?;
+                writeln!(out, "      - {}", old(value))?;
             }
             Difference::ArrayElementAdded { path, value } => {
-                println!("    Array element added at '{}' ", path.bright_white());
-                println!("      + {}", value.red());
+                writeln!(out, "    Array element added at '{}' ", highlight(path))?;
+                writeln!(out, "      + {}", new(value))?;
             }
             Difference::DifferentBodyString { before, after } => {
-                println!("\n  Body (non-JSON or invalid JSON):");
+                writeln!(out, "\n  Body (non-JSON or invalid JSON):")?;
 
-                if !before.is_empty() && !after.is_empty() {
-                    let body1_preview = format!("{}...", &before[..100]);
-                    let body2_preview = format!("{}...", &after[..100]);
-                    println!("    - {}", body1_preview.green());
-                    println!("    + {}", body2_preview.red());
+                writeln!(out, "    - {}", old(before))?;
+                writeln!(out, "    + {}", new(after))?;
+            }
+            Difference::TimingRegressed {
+                phase,
+                old_ms,
+                new_ms,
+            } => {
+                writeln!(out, "    Timing regressed for {}", phase)?;
+                writeln!(out, "      - {}", old(&format!("{} ms", old_ms)))?;
+                writeln!(out, "      + {}", new(&format!("{} ms", new_ms)))?;
+            }
+            Difference::ArrayOrderChanged { path } => {
+                writeln!(out, "    Array order changed at '{}' ", highlight(path))?;
+            }
+            Difference::RedirectHopChanged {
+                hop,
+                old_val,
+                new_val,
+            } => {
+                writeln!(out, "    Redirect chain changed at hop {}", hop + 1)?;
+                if let Some(old_val) = old_val {
+                    writeln!(out, "      - {}", old(old_val))?;
+                }
+                if let Some(new_val) = new_val {
+                    writeln!(out, "      + {}", new(new_val))?;
+                }
+            }
+            Difference::TypeChanged {
+                path,
+                old_type,
+                new_type,
+            } => {
+                writeln!(out, "    Type changed at '{}' ", highlight(path))?;
+                writeln!(out, "      - {}", old(old_type))?;
+                writeln!(out, "      + {}", new(new_type))?;
+            }
+            Difference::ForbiddenSubstring {
+                substring,
+                line,
+                column,
+                context,
+            } => {
+                writeln!(
+                    out,
+                    "    Forbidden substring '{}' found at line {}, column {}",
+                    highlight(substring),
+                    line,
+                    column
+                )?;
+                writeln!(out, "      + {}", new(context))?;
+            }
+            Difference::ExpectedHeaderMismatch {
+                header_name,
+                expected,
+                actual,
+            } => {
+                writeln!(out, "    Expected Header: {}", highlight(header_name))?;
+                writeln!(out, "      - {}", old(expected))?;
+                match actual {
+                    Some(actual) => writeln!(out, "      + {}", new(&format!("{:?}", actual)))?,
+                    None => writeln!(out, "      + {}", new("(missing)"))?,
                 }
             }
+            Difference::AssertionFailed { assertion, actual } => {
+                writeln!(out, "    Assertion failed: {}", highlight(assertion))?;
+                writeln!(
+                    out,
+                    "      + {}",
+                    new(actual.as_deref().unwrap_or("(missing)"))
+                )?;
+            }
+            Difference::DepthTruncated { path, max_depth } => {
+                writeln!(
+                    out,
+                    "    Values differ below '{}', deeper than the maximum depth of {} (see --max-diff-depth)",
+                    highlight(path),
+                    max_depth
+                )?;
+            }
+            Difference::BodyTruncated { limit_bytes } => {
+                writeln!(
+                    out,
+                    "    Body truncated at the limit of {} bytes (see --max-body-bytes), it wasn't compared",
+                    limit_bytes
+                )?;
+            }
+            Difference::Repeated {
+                path,
+                count,
+                sample,
+            } => {
+                writeln!(
+                    out,
+                    "    Same difference repeated {} times at '{}', e.g.:",
+                    count,
+                    highlight(path)
+                )?;
+                sample.write_to(out, colorize)?;
+            }
         }
+
+        Ok(())
     }
 }
 
-fn format_value(value: &Value, max_length: usize) -> String {
-    match value {
-        Value::String(s) => {
-            if s.len() > max_length {
-                format!("\"{}...\"", &s[..max_length])
-            } else {
-                format!("\"{}\"", s)
+fn paint(value: &str, colorize: bool, color: impl Fn(&str) -> ColoredString) -> String {
+    if colorize {
+        color(value).to_string()
+    } else {
+        value.to_string()
+    }
+}
+
+/// The path without the array element segments, e.g. `[0]`, `[*]` or `[id=5]`, so that it points
+/// to any element of its arrays
+pub fn without_elements(path: &str) -> String {
+    let mut stripped = String::with_capacity(path.len());
+    let mut rest = path;
+    while let Some(start) = rest.find('[') {
+        stripped.push_str(&rest[..start]);
+        match rest[start..].find(']') {
+            Some(end) => rest = &rest[start + end + 1..],
+            None => {
+                rest = &rest[start..];
+                break;
             }
         }
+    }
+    stripped.push_str(rest);
+    stripped
+}
+
+/// Replaces array indexes and keys in a path with `[*]`, e.g. `items[3]` or `items[id=3]`, so
+/// that paths pointing to the same field of different array elements share the same pattern
+fn path_pattern(path: &str) -> String {
+    let mut pattern = String::with_capacity(path.len());
+    let mut rest = path;
+
+    while let Some(start) = rest.find('[') {
+        pattern.push_str(&rest[..start]);
+        let after = &rest[start + 1..];
+        match after.find(']') {
+            Some(end)
+                if end > 0
+                    && (after[..end].chars().all(|c| c.is_ascii_digit())
+                        || after[..end].contains('=')) =>
+            {
+                pattern.push_str("[*]");
+                rest = &after[end + 1..];
+            }
+            _ => {
+                pattern.push('[');
+                rest = after;
+            }
+        }
+    }
+    pattern.push_str(rest);
+
+    pattern
+}
+
+/// The type of a value as formatted by `format_value`
+fn formatted_type(formatted: &str) -> &'static str {
+    match formatted {
+        "null" => "null",
+        "true" | "false" => "boolean",
+        _ if formatted.starts_with('"') => "string",
+        _ if formatted.starts_with('[') || formatted.starts_with("Array[") => "array",
+        _ if formatted.starts_with('{') || formatted.starts_with("Object{") => "object",
+        _ => "number",
+    }
+}
+
+/// Groups differences of the same kind whose paths share the same pattern into a single
+/// `Difference::Repeated`. Changed values are only grouped with changes between the same types,
+/// e.g. a string becoming null isn't grouped with a string becoming another string.
+/// Differences without a path, or without repetitions, are kept as they are.
+pub fn collapse_repeated_differences(differences: Vec<Difference>) -> Vec<Difference> {
+    let mut groups: Vec<(Option<String>, Vec<Difference>)> = Vec::new();
+    let mut group_index: HashMap<_, usize> = HashMap::new();
+
+    for diff in differences {
+        match diff.path().map(path_pattern) {
+            Some(pattern) => {
+                let shape = match &diff {
+                    Difference::BodyValueChanged {
+                        old_val, new_val, ..
+                    } => Some((formatted_type(old_val), formatted_type(new_val))),
+                    _ => None,
+                };
+                let key = (std::mem::discriminant(&diff), pattern.clone(), shape);
+                match group_index.get(&key) {
+                    Some(&i) => groups[i].1.push(diff),
+                    None => {
+                        group_index.insert(key, groups.len());
+                        groups.push((Some(pattern), vec![diff]));
+                    }
+                }
+            }
+            None => groups.push((None, vec![diff])),
+        }
+    }
+
+    groups
+        .into_iter()
+        .map(|(pattern, mut diffs)| match pattern {
+            Some(path) if diffs.len() > 1 => Difference::Repeated {
+                path,
+                count: diffs.len(),
+                sample: Box::new(diffs.swap_remove(0)),
+            },
+            _ => diffs.swap_remove(0),
+        })
+        .collect()
+}
+
+fn format_value(value: &Value, max_length: usize) -> String {
+    match value {
+        Value::String(s) => format!("\"{}\"", truncate(s, max_length)),
         Value::Array(arr) => {
             if arr.len() > 3 {
                 format!("Array[{}]", arr.len())
@@ -155,6 +621,88 @@ fn format_value(value: &Value, max_length: usize) -> String {
     }
 }
 
+/// The first `max_chars` characters of the text followed by `...` when it is longer, cut between two
+/// characters so that multibyte ones are kept whole. A maximum of 0 keeps the whole text.
+fn truncate(text: &str, max_chars: usize) -> Cow<'_, str> {
+    if max_chars == 0 {
+        return Cow::Borrowed(text);
+    }
+    match text.char_indices().nth(max_chars) {
+        Some((end, _)) => Cow::Owned(format!("{}...", &text[..end])),
+        None => Cow::Borrowed(text),
+    }
+}
+
+/// Append a key to a path. Backslashes and separators within the key are escaped with a backslash,
+/// so that paths stay unambiguous
+fn build_path(path: &str, key: &str, separator: &str) -> String {
+    let key = if key.contains('\\') || key.contains(separator) {
+        key.replace('\\', "\\\\")
+            .replace(separator, &format!("\\{}", separator))
+    } else {
+        key.to_string()
+    };
+
+    if path.is_empty() {
+        key
+    } else {
+        format!("{}{}{}", path, separator, key)
+    }
+}
+
+/// Split a path into its keys, the reverse of `build_path`. A leading separator is optional.
+fn split_path(path: &str, separator: &str) -> Vec<String> {
+    let mut keys = Vec::new();
+    let mut key = String::new();
+    let mut rest = path.strip_prefix(separator).unwrap_or(path);
+
+    while let Some(c) = rest.chars().next() {
+        if let Some(escaped) = rest.strip_prefix('\\') {
+            // An escaped backslash or separator is part of the key
+            let unescaped = if escaped.starts_with(separator) {
+                separator
+            } else {
+                escaped.get(..1).unwrap_or_default()
+            };
+            key.push_str(unescaped);
+            rest = &escaped[unescaped.len()..];
+        } else if let Some(after) = rest.strip_prefix(separator) {
+            keys.push(std::mem::take(&mut key));
+            rest = after;
+        } else {
+            key.push(c);
+            rest = &rest[c.len_utf8()..];
+        }
+    }
+    if !path.is_empty() && path != separator {
+        keys.push(key);
+    }
+
+    keys
+}
+
+/// Find the value at a path, written like the paths of differences. Array elements are selected by index.
+pub fn find_value_at_path<'a>(value: &'a Value, path: &str, separator: &str) -> Option<&'a Value> {
+    split_path(path, separator)
+        .iter()
+        .try_fold(value, |value, key| match value {
+            Value::Object(map) => map.get(key),
+            Value::Array(arr) => key.parse::<usize>().ok().and_then(|i| arr.get(i)),
+            _ => None,
+        })
+}
+
+/// Whether a value holds nothing: `null`, an empty array or an empty object
+fn is_null_equivalent(value: &Value) -> bool {
+    match value {
+        Value::Null => true,
+        Value::Array(arr) => arr.is_empty(),
+        Value::Object(map) => map.is_empty(),
+        _ => false,
+    }
+}
+
+#[allow(clippy::too_many_arguments)]
 fn compare_objects(
     path: &str,
     map1: &serde_json::Map<String, Value>,
@@ -163,43 +711,36 @@ fn compare_objects(
     max_depth: usize,
     current_depth: usize,
     ignored_paths: &Option<&HashSet<String>>,
+    options: &DiffOptions,
 ) {
+    let separator = options.path_separator.as_str();
     let keys1: HashSet<&String> = map1.keys().collect();
     let keys2: HashSet<&String> = map2.keys().collect();
 
     // Find removed keys
     for key in keys1.difference(&keys2) {
-        let new_path = if path.is_empty() {
-            key.to_string()
-        } else {
-            format!("{}/{}", path, key)
-        };
+        let new_path = build_path(path, key, separator);
         differences.push(Difference::BodyValueRemoved {
             path: new_path,
-            value: format_value(&map1[*key], 50),
+            value: format_value(&map1[*key], options.max_value_length),
         });
     }
 
     // Find added keys
     for key in keys2.difference(&keys1) {
-        let new_path = if path.is_empty() {
-            key.to_string()
-        } else {
-            format!("{}/{}", path, key)
-        };
+        if options.allow_empty_additions && is_null_equivalent(&map2[*key]) {
+            continue;
+        }
+        let new_path = build_path(path, key, separator);
         differences.push(Difference::BodyValueAdded {
             path: new_path,
-            value: format_value(&map2[*key], 50),
+            value: format_value(&map2[*key], options.max_value_length),
         });
     }
 
     // Compare common keys
     for key in keys1.intersection(&keys2) {
-        let new_path = if path.is_empty() {
-            key.to_string()
-        } else {
-            format!("{}/{}", path, key)
-        };
+        let new_path = build_path(path, key, separator);
         find_json_differences(
             &new_path,
             &map1[*key],
@@ -208,6 +749,7 @@ fn compare_objects(
             max_depth,
             current_depth + 1,
             ignored_paths,
+            options,
         );
     }
 }
@@ -217,6 +759,7 @@ fn compare_arrays_order_independent(
     arr1: &[Value],
     arr2: &[Value],
     differences: &mut Vec<Difference>,
+    max_value_length: usize,
 ) {
     if arr1.len() != arr2.len() {
         differences.push(Difference::ArrayLengthChanged {
@@ -236,34 +779,25 @@ fn compare_arrays_order_independent(
         *counts2.entry(val).or_insert(0) += 1;
     }
 
-    let keys1: HashSet<&&Value> = counts1.keys().collect();
-    let keys2: HashSet<&&Value> = counts2.keys().collect();
-
-    // Elements in arr1 but not in arr2 (or with higher count)
-    for &&val in &keys1 {
-        let count1 = counts1[val];
-        let count2 = *counts2.get(val).unwrap_or(&0);
-        if count1 > count2 {
-            for _ in 0..(count1 - count2) {
-                differences.push(Difference::ArrayElementRemoved {
-                    path: format!("{}[*]", path),
-                    value: format_value(val, 50),
-                });
-            }
+    // Occurrences of a value in arr1 beyond the ones in arr2 are removed, reported at their index in arr1
+    for (i, val) in arr1.iter().enumerate() {
+        match counts2.get_mut(val) {
+            Some(count) if *count > 0 => *count -= 1,
+            _ => differences.push(Difference::ArrayElementRemoved {
+                path: format!("{}[{}]", path, i),
+                value: format_value(val, max_value_length),
+            }),
         }
     }
 
-    // Elements in arr2 but not in arr1 (or with higher count)
-    for &&val in &keys2 {
-        let count1 = *counts1.get(val).unwrap_or(&0);
-        let count2 = counts2[val];
-        if count2 > count1 {
-            for _ in 0..(count2 - count1) {
-                differences.push(Difference::ArrayElementAdded {
-                    path: format!("{}[*]", path),
-                    value: format_value(val, 50),
-                });
-            }
+    // Occurrences of a value in arr2 beyond the ones in arr1 are added, reported at their index in arr2
+    for (i, val) in arr2.iter().enumerate() {
+        match counts1.get_mut(val) {
+            Some(count) if *count > 0 => *count -= 1,
+            _ => differences.push(Difference::ArrayElementAdded {
+                path: format!("{}[{}]", path, i),
+                value: format_value(val, max_value_length),
+            }),
         }
     }
 
@@ -274,6 +808,103 @@ fn compare_arrays_order_independent(
     // Given the current design, we'll stick to exact match for order-independent elements.
 }
 
+/// The elements of an array of objects by the value of their key field, in the order of the array.
+/// `None` if an element isn't an object, has no scalar value for the key, or shares its value with another
+fn index_by_key<'a>(arr: &'a [Value], key: &str) -> Option<Vec<(String, &'a Value)>> {
+    let mut seen = HashSet::new();
+    arr.iter()
+        .map(|element| {
+            let id = match element.get(key)? {
+                Value::String(s) => s.clone(),
+                value @ (Value::Number(_) | Value::Bool(_)) => value.to_string(),
+                _ => return None,
+            };
+            seen.insert(id.clone()).then_some((id, element))
+        })
+        .collect()
+}
+
+/// Compare arrays whose elements are matched by their key value, wherever they are in the array.
+/// Matched elements are compared field by field, at the `path[key=value]` path.
+#[allow(clippy::too_many_arguments)]
+fn compare_arrays_by_key(
+    path: &str,
+    key: &str,
+    elements1: &[(String, &Value)],
+    elements2: &[(String, &Value)],
+    differences: &mut Vec<Difference>,
+    max_depth: usize,
+    current_depth: usize,
+    ignored_paths: &Option<&HashSet<String>>,
+    options: &DiffOptions,
+) {
+    if elements1.len() != elements2.len() {
+        differences.push(Difference::ArrayLengthChanged {
+            path: path.to_string(),
+            old_len: elements1.len(),
+            new_len: elements2.len(),
+        });
+    }
+
+    let element_path = |id: &str| format!("{}[{}={}]", path, key, id);
+    let ids1: HashMap<&str, &Value> = elements1.iter().map(|(id, v)| (id.as_str(), *v)).collect();
+    let ids2: HashMap<&str, &Value> = elements2.iter().map(|(id, v)| (id.as_str(), *v)).collect();
+
+    for (id, val1) in elements1 {
+        match ids2.get(id.as_str()) {
+            Some(val2) => find_json_differences(
+                &element_path(id),
+                val1,
+                val2,
+                differences,
+                max_depth,
+                current_depth + 1,
+                ignored_paths,
+                options,
+            ),
+            None => differences.push(Difference::ArrayElementRemoved {
+                path: element_path(id),
+                value: format_value(val1, options.max_value_length),
+            }),
+        }
+    }
+
+    for (id, val2) in elements2 {
+        if !ids1.contains_key(id.as_str()) {
+            differences.push(Difference::ArrayElementAdded {
+                path: element_path(id),
+                value: format_value(val2, options.max_value_length),
+            });
+        }
+    }
+}
+
+/// Whether a string holds the given number, e.g. `"42"`, `"42.0"` or `" 4.2e1 "` for `42`
+fn is_same_number(s: &str, n: &serde_json::Number) -> bool {
+    let s = s.trim();
+    s == n.to_string()
+        || s.parse::<f64>()
+            .ok()
+            .zip(n.as_f64())
+            .is_some_and(|(a, b)| a == b)
+}
+
+/// Whether a string holds the given boolean, as `"true"`/`"false"` or `"1"`/`"0"`
+fn is_same_boolean(s: &str, b: bool) -> bool {
+    match s.trim() {
+        "true" | "1" => b,
+        "false" | "0" => !b,
+        _ => false,
+    }
+}
+
+/// Whether both strings are RFC 3339 date-times of the same instant, e.g. `2024-01-01T00:00:00Z`
+/// and `2023-12-31T19:00:00-05:00`
+fn is_same_instant(s1: &str, s2: &str) -> bool {
+    parse_rfc3339(s1).is_some_and(|instant| parse_rfc3339(s2) == Some(instant))
+}
+
+#[allow(clippy::too_many_arguments)]
 pub fn find_json_differences(
     path: &str,
     val1: &Value,
@@ -282,24 +913,37 @@ pub fn find_json_differences(
     max_depth: usize,
     current_depth: usize,
     ignored_paths: &Option<&HashSet<String>>,
+    options: &DiffOptions,
 ) {
-    if current_depth > max_depth {
-        return;
-    }
-
-    let current_path = format!("/{}", path);
+    let separator = options.path_separator.as_str();
+    let current_path = format!("{}{}", separator, path);
+    // The configured paths don't spell out the elements of keyed arrays: `/items/updatedAt` covers
+    // `items[id=3]/updatedAt`
+    let config_path = without_elements(&current_path);
     if let Some(ignored_paths) = ignored_paths {
         // If the current pointer exactly matches the ignore path
         // or is a sub-path of the ignore path, skip diffing.
-        if ignored_paths.contains(&current_path)
-            || ignored_paths
-                .iter()
-                .any(|ip| current_path.starts_with(&format!("{}/", ip)))
-        {
+        if [&current_path, &config_path].into_iter().any(|path| {
+            ignored_paths.contains(path)
+                || ignored_paths
+                    .iter()
+                    .any(|ip| path.starts_with(&format!("{}{}", ip, separator)))
+        }) {
             return;
         }
     }
 
+    // Values deeper than the limit aren't compared, but a change below it isn't silently hidden either
+    if current_depth > max_depth {
+        if val1 != val2 {
+            differences.push(Difference::DepthTruncated {
+                path: path.to_string(),
+                max_depth,
+            });
+        }
+        return;
+    }
+
     match (val1, val2) {
         (Value::Object(map1), Value::Object(map2)) => {
             compare_objects(
@@ -310,41 +954,574 @@ pub fn find_json_differences(
                 max_depth,
                 current_depth,
                 ignored_paths,
+                options,
             );
         }
         (Value::Array(arr1), Value::Array(arr2)) => {
-            compare_arrays_order_independent(
-                path,
-                arr1,
-                arr2,
-                differences
-            );
+            let keyed = options
+                .array_keys
+                .get(&config_path)
+                .and_then(|key| Some((key, index_by_key(arr1, key)?, index_by_key(arr2, key)?)));
+            match keyed {
+                Some((key, elements1, elements2)) => compare_arrays_by_key(
+                    path,
+                    key,
+                    &elements1,
+                    &elements2,
+                    differences,
+                    max_depth,
+                    current_depth,
+                    ignored_paths,
+                    options,
+                ),
+                None => compare_arrays_order_independent(
+                    path,
+                    arr1,
+                    arr2,
+                    differences,
+                    options.max_value_length,
+                ),
+            }
         }
+        // Numbers may be allowed to drift by a tolerance configured for their path, or for the whole body
+        (Value::Number(n1), Value::Number(n2))
+            if options
+                .numeric_tolerances
+                .get(&config_path)
+                .or(options.numeric_tolerance.as_ref())
+                .is_some_and(|tolerance| tolerance.accepts(n1, n2)) => {}
+        (Value::Number(n), Value::String(s)) | (Value::String(s), Value::Number(n))
+            if options.coerce_numeric_strings && is_same_number(s, n) => {}
+        (Value::Bool(b), Value::String(s)) | (Value::String(s), Value::Bool(b))
+            if options.coerce_boolean_strings && is_same_boolean(s, *b) => {}
+        (Value::String(s1), Value::String(s2))
+            if options.normalize_dates && is_same_instant(s1, s2) => {}
         // If the current values are either a Number, String, Boolean, Null, just perform a simple comparison
         (v1, v2) if v1 != v2 => {
             differences.push(Difference::BodyValueChanged {
                 path: path.to_string(),
-                old_val: format_value(v1, 50),
-                new_val: format_value(v2, 50),
+                old_val: format_value(v1, options.max_value_length),
+                new_val: format_value(v2, options.max_value_length),
             });
         }
         _ => {}
     }
 }
 
+/// The structure of a JSON value: the types of the values found at each path, the elements of an array
+/// sharing the `[*]` path of the array. The types of the elements of mixed arrays are joined with `|`.
+pub fn json_fingerprint(value: &Value, separator: &str) -> BTreeMap<String, String> {
+    let mut types: BTreeMap<String, BTreeSet<&'static str>> = BTreeMap::new();
+    collect_fingerprint("", value, separator, &mut types);
+
+    types
+        .into_iter()
+        .map(|(path, types)| (path, types.into_iter().collect::<Vec<_>>().join("|")))
+        .collect()
+}
+
+fn collect_fingerprint(
+    path: &str,
+    value: &Value,
+    separator: &str,
+    types: &mut BTreeMap<String, BTreeSet<&'static str>>,
+) {
+    let children: Vec<(String, &Value)> = match value {
+        Value::Object(map) => map
+            .iter()
+            .map(|(key, value)| (build_path(path, key, separator), value))
+            .collect(),
+        Value::Array(arr) => arr
+            .iter()
+            .map(|value| (format!("{}[*]", path), value))
+            .collect(),
+        _ => return,
+    };
+
+    for (child_path, child) in children {
+        types
+            .entry(child_path.clone())
+            .or_default()
+            .insert(type_name(child));
+        collect_fingerprint(&child_path, child, separator, types);
+    }
+}
+
+fn type_name(value: &Value) -> &'static str {
+    match value {
+        Value::Null => "null",
+        Value::Bool(_) => "boolean",
+        Value::Number(_) => "number",
+        Value::String(_) => "string",
+        Value::Array(_) => "array",
+        Value::Object(_) => "object",
+    }
+}
+
+/// Find the paths added, removed, or holding another type of value between two fingerprints
+pub fn compare_fingerprints(
+    old: &BTreeMap<String, String>,
+    new: &BTreeMap<String, String>,
+    ignored_paths: &Option<&HashSet<String>>,
+    separator: &str,
+) -> Vec<Difference> {
+    let is_ignored = |path: &str| {
+        let current_path = format!("{}{}", separator, path);
+        ignored_paths.is_some_and(|ignored_paths| {
+            ignored_paths.iter().any(|ip| {
+                current_path == *ip
+                    || current_path.starts_with(&format!("{}{}", ip, separator))
+                    || current_path.starts_with(&format!("{}[*]", ip))
+            })
+        })
+    };
+
+    let mut differences = Vec::new();
+    for (path, old_type) in old {
+        if is_ignored(path) {
+            continue;
+        }
+        match new.get(path) {
+            None => differences.push(Difference::BodyValueRemoved {
+                path: path.clone(),
+                value: old_type.clone(),
+            }),
+            Some(new_type) if new_type != old_type => differences.push(Difference::TypeChanged {
+                path: path.clone(),
+                old_type: old_type.clone(),
+                new_type: new_type.clone(),
+            }),
+            _ => {}
+        }
+    }
+    for (path, new_type) in new {
+        if !old.contains_key(path) && !is_ignored(path) {
+            differences.push(Difference::BodyValueAdded {
+                path: path.clone(),
+                value: new_type.clone(),
+            });
+        }
+    }
+
+    differences
+}
+
+/// Find the first occurrence of each forbidden substring in a body, along with its location and
+/// the text around it
+pub fn find_forbidden_substrings(body: &str, forbidden: &[String]) -> Vec<Difference> {
+    const CONTEXT_CHARS: usize = 30;
+
+    forbidden
+        .iter()
+        .filter(|substring| !substring.is_empty())
+        .filter_map(|substring| {
+            let offset = body.find(substring.as_str())?;
+            let before = &body[..offset];
+            let line = before.matches('\n').count() + 1;
+            let column = before.chars().rev().take_while(|&c| c != '\n').count() + 1;
+
+            let context_start = before
+                .char_indices()
+                .rev()
+                .nth(CONTEXT_CHARS - 1)
+                .map_or(0, |(i, _)| i);
+            let after = &body[offset + substring.len()..];
+            let context_end = offset
+                + substring.len()
+                + after
+                    .char_indices()
+                    .nth(CONTEXT_CHARS)
+                    .map_or(after.len(), |(i, _)| i);
+
+            Some(Difference::ForbiddenSubstring {
+                substring: substring.clone(),
+                line,
+                column,
+                context: body[context_start..context_end].replace('\n', " "),
+            })
+        })
+        .collect()
+}
+
+/// A condition the body of a response must meet, on the whole raw body or on the JSON value at `path`,
+/// e.g. `{"type": "regex", "path": "/version", "expected": "^v2\\."}`
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(tag = "type", rename_all = "snake_case")]
+pub enum BodyAssertion {
+    /// The text contains the expected substring
+    Contains {
+        path: Option<String>,
+        expected: String,
+    },
+    /// The text matches the expected regex
+    Regex {
+        path: Option<String>,
+        expected: AssertionRegex,
+    },
+    /// The JSON value equals the expected one
+    JsonEquals {
+        path: Option<String>,
+        expected: Value,
+    },
+}
+
+/// A regex of a body assertion, written as a string in the config
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(try_from = "String", into = "String")]
+pub struct AssertionRegex(Regex);
+
+impl TryFrom<String> for AssertionRegex {
+    type Error = String;
+
+    fn try_from(pattern: String) -> Result<Self, Self::Error> {
+        Regex::new(&pattern)
+            .map(AssertionRegex)
+            .map_err(|e| format!("invalid assertion regex '{}': {}", pattern, e))
+    }
+}
+
+impl From<AssertionRegex> for String {
+    fn from(regex: AssertionRegex) -> Self {
+        regex.0.as_str().to_string()
+    }
+}
+
+impl fmt::Display for BodyAssertion {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            BodyAssertion::Contains { path, expected } => {
+                write!(
+                    f,
+                    "{} contains {:?}",
+                    path.as_deref().unwrap_or("body"),
+                    expected
+                )
+            }
+            BodyAssertion::Regex { path, expected } => {
+                write!(
+                    f,
+                    "{} matches {}",
+                    path.as_deref().unwrap_or("body"),
+                    expected.0
+                )
+            }
+            BodyAssertion::JsonEquals { path, expected } => {
+                write!(
+                    f,
+                    "{} equals {}",
+                    path.as_deref().unwrap_or("body"),
+                    expected
+                )
+            }
+        }
+    }
+}
+
+impl BodyAssertion {
+    /// Check the assertion against a body, failing with what was found instead, if anything
+    fn check(&self, body: &ParsedBody, separator: &str) -> Result<(), Option<String>> {
+        match self {
+            BodyAssertion::Contains { path, expected } => {
+                check_text(body, path.as_deref(), separator, |text| {
+                    text.contains(expected.as_str())
+                })
+            }
+            BodyAssertion::Regex { path, expected } => {
+                check_text(body, path.as_deref(), separator, |text| {
+                    expected.0.is_match(text)
+                })
+            }
+            BodyAssertion::JsonEquals { path, expected } => {
+                let value = body.json.as_ref().and_then(|json| match path {
+                    Some(path) => find_value_at_path(json, path, separator),
+                    None => Some(json),
+                });
+                match value {
+                    Some(value) if value == expected => Ok(()),
+                    value => Err(value.map(|value| format_value(value, DEFAULT_MAX_VALUE_LENGTH))),
+                }
+            }
+        }
+    }
+}
+
+/// Check a condition on the raw body, or on the JSON value at the path, strings being taken unquoted
+fn check_text(
+    body: &ParsedBody,
+    path: Option<&str>,
+    separator: &str,
+    met: impl Fn(&str) -> bool,
+) -> Result<(), Option<String>> {
+    const MAX_CHARS: usize = 50;
+
+    let text = match path {
+        None => Some(Cow::Borrowed(body.raw.as_str())),
+        Some(path) => body
+            .json
+            .as_ref()
+            .and_then(|json| find_value_at_path(json, path, separator))
+            .map(|value| match value {
+                Value::String(s) => Cow::Borrowed(s.as_str()),
+                value => Cow::Owned(value.to_string()),
+            }),
+    };
+
+    match text {
+        Some(text) if met(&text) => Ok(()),
+        text => Err(text.map(|text| truncate(&text, MAX_CHARS).into_owned())),
+    }
+}
+
+/// Check the body of a response against assertions, one difference per unmet assertion
+pub fn find_failed_assertions(
+    body: &ParsedBody,
+    assertions: &[BodyAssertion],
+    separator: &str,
+) -> Vec<Difference> {
+    assertions
+        .iter()
+        .filter_map(|assertion| {
+            let actual = assertion.check(body, separator).err()?;
+            Some(Difference::AssertionFailed {
+                assertion: assertion.to_string(),
+                actual,
+            })
+        })
+        .collect()
+}
+
+/// Find the expected headers that are missing from the response headers, or hold none of the
+/// expected value. Header names are matched case-insensitively, the response ones being lowercase.
+pub fn find_expected_header_mismatches(
+    headers: &HashMap<String, Vec<String>>,
+    expected: &BTreeMap<String, String>,
+) -> Vec<Difference> {
+    expected
+        .iter()
+        .filter_map(|(name, expected)| {
+            let actual = headers.get(&name.to_lowercase());
+            if actual.is_some_and(|values| values.iter().any(|v| v.trim() == expected.trim())) {
+                return None;
+            }
+
+            Some(Difference::ExpectedHeaderMismatch {
+                header_name: name.clone(),
+                expected: expected.clone(),
+                actual: actual.cloned(),
+            })
+        })
+        .collect()
+}
+
+/// Find the request phases that got slower than in the baseline by more than `threshold_ms`
+pub fn compare_timings(
+    baseline: &ResponseTimings,
+    current: &ResponseTimings,
+    threshold_ms: u64,
+) -> Vec<Difference> {
+    [
+        ("redirects", baseline.redirects_ms, current.redirects_ms),
+        (
+            "time to first byte",
+            baseline.time_to_first_byte_ms,
+            current.time_to_first_byte_ms,
+        ),
+        ("download", baseline.download_ms, current.download_ms),
+    ]
+    .into_iter()
+    .filter(|(_, old_ms, new_ms)| new_ms.saturating_sub(*old_ms) > threshold_ms)
+    .map(|(phase, old_ms, new_ms)| Difference::TimingRegressed {
+        phase: phase.to_string(),
+        old_ms,
+        new_ms,
+    })
+    .collect()
+}
+
+/// The latency (redirects, time to first byte and download) of the response, if it's above `max_ms`
+pub fn check_max_latency(current: &ResponseTimings, max_ms: u64) -> Option<Difference> {
+    let latency_ms = current.latency_ms();
+    (latency_ms > max_ms).then(|| Difference::TimingRegressed {
+        phase: "latency (max allowed)".to_string(),
+        old_ms: max_ms,
+        new_ms: latency_ms,
+    })
+}
+
+/// The latency of the response, if it grew from the baseline one by more than the tolerance,
+/// in milliseconds or in percentage of the baseline latency
+pub fn compare_latency(
+    baseline: &ResponseTimings,
+    current: &ResponseTimings,
+    max_increase: &Tolerance,
+) -> Option<Difference> {
+    let (old_ms, new_ms) = (baseline.latency_ms(), current.latency_ms());
+    (new_ms > old_ms && !max_increase.accepts(&old_ms.into(), &new_ms.into())).then(|| {
+        Difference::TimingRegressed {
+            phase: "latency".to_string(),
+            old_ms,
+            new_ms,
+        }
+    })
+}
+
+/// The latency (redirects, time to first byte and download) of the response, if it's above the given percentile
+/// of the latencies in the history. Nothing is reported until the history holds `min_samples` latencies.
+pub fn compare_latency_percentile(
+    history: &[u64],
+    current: &ResponseTimings,
+    percentile: f64,
+    min_samples: usize,
+) -> Option<Difference> {
+    if history.len() < min_samples.max(1) {
+        return None;
+    }
+
+    // Nearest-rank percentile
+    let mut sorted = history.to_vec();
+    sorted.sort_unstable();
+    let rank = ((percentile / 100.0 * sorted.len() as f64).ceil() as usize).clamp(1, sorted.len());
+    let threshold_ms = sorted[rank - 1];
+
+    let latency_ms = current.latency_ms();
+    (latency_ms > threshold_ms).then(|| Difference::TimingRegressed {
+        phase: format!(
+            "latency (p{} of the last {} runs)",
+            percentile,
+            sorted.len()
+        ),
+        old_ms: threshold_ms,
+        new_ms: latency_ms,
+    })
+}
+
+/// Find the arrays holding the same elements in both values, but in a different order
+pub fn find_array_order_changes(
+    path: &str,
+    val1: &Value,
+    val2: &Value,
+    differences: &mut Vec<Difference>,
+    separator: &str,
+) {
+    match (val1, val2) {
+        (Value::Object(map1), Value::Object(map2)) => {
+            for (key, v1) in map1 {
+                if let Some(v2) = map2.get(key) {
+                    find_array_order_changes(
+                        &build_path(path, key, separator),
+                        v1,
+                        v2,
+                        differences,
+                        separator,
+                    );
+                }
+            }
+        }
+        (Value::Array(arr1), Value::Array(arr2)) if arr1.len() == arr2.len() && arr1 != arr2 => {
+            let mut matched = vec![false; arr2.len()];
+            let same_elements = arr1.iter().all(|v1| {
+                match (0..arr2.len()).find(|&i| !matched[i] && &arr2[i] == v1) {
+                    Some(i) => {
+                        matched[i] = true;
+                        true
+                    }
+                    None => false,
+                }
+            });
+
+            if same_elements {
+                differences.push(Difference::ArrayOrderChanged {
+                    path: path.to_string(),
+                });
+            } else {
+                // The elements changed, look for reordered arrays inside them
+                for (i, (v1, v2)) in arr1.iter().zip(arr2).enumerate() {
+                    find_array_order_changes(
+                        &format!("{}[{}]", path, i),
+                        v1,
+                        v2,
+                        differences,
+                        separator,
+                    );
+                }
+            }
+        }
+        _ => {}
+    }
+}
+
+/// Compare two redirect chains hop by hop
+fn compare_redirects(old_chain: &[RedirectHop], new_chain: &[RedirectHop]) -> Vec<Difference> {
+    let describe = |hop: &RedirectHop| format!("{} -> {}", hop.status_code, hop.location);
+
+    (0..old_chain.len().max(new_chain.len()))
+        .filter_map(|i| {
+            let (old_hop, new_hop) = (old_chain.get(i), new_chain.get(i));
+            (old_hop != new_hop).then(|| Difference::RedirectHopChanged {
+                hop: i,
+                old_val: old_hop.map(describe),
+                new_val: new_hop.map(describe),
+            })
+        })
+        .collect()
+}
+
+/// Rewrite the numbers of a JSON value so that the ones with the same value have the same representation,
+/// e.g. `1.0`, `1.00` and `1e0` all become `1`. Plain decimals are rewritten as written, without the
+/// trailing zeros, so that those more precise than a float keep their digits.
+pub fn canonicalize_json(value: &mut Value) {
+    match value {
+        Value::Number(n) if n.is_f64() && !n.to_string().contains(['e', 'E']) => {
+            let repr = n.to_string();
+            let shortened = repr.trim_end_matches('0').trim_end_matches('.');
+            if let Ok(number) = shortened.parse::<serde_json::Number>() {
+                *value = Value::Number(number);
+            }
+        }
+        Value::Number(n) if n.is_f64() => {
+            if let Some(f) = n.as_f64() {
+                if f.fract() == 0.0 && f >= i64::MIN as f64 && f < i64::MAX as f64 {
+                    *value = Value::from(f as i64);
+                } else if f.fract() == 0.0 && f >= 0.0 && f < u64::MAX as f64 {
+                    *value = Value::from(f as u64);
+                }
+            }
+        }
+        Value::Array(arr) => arr.iter_mut().for_each(canonicalize_json),
+        Value::Object(map) => map.values_mut().for_each(canonicalize_json),
+        _ => {}
+    }
+}
+
+/// Split the values of a header into their comma-separated items, trimmed and sorted,
+/// e.g. `["no-store,  no-cache"]` and `["no-cache", "no-store"]` give the same items
+fn normalize_header_values(values: &[String]) -> Vec<&str> {
+    let mut items: Vec<&str> = values
+        .iter()
+        .flat_map(|value| value.split(','))
+        .map(str::trim)
+        .filter(|item| !item.is_empty())
+        .collect();
+    items.sort_unstable();
+
+    items
+}
+
 pub fn compute_differences(
     response1: &HttpResponseData,
     response2: &HttpResponseData,
     headers_ignored: bool,
     ignored_paths: Option<&HashSet<String>>,
+    options: &DiffOptions,
 ) -> Vec<Difference> {
     // Pre-normalize ignored paths
     let normalized_ignored_paths: Option<HashSet<String>> = ignored_paths.map(|paths| {
         paths
             .iter()
             .map(|p| {
-                if p.ends_with('/') && p.len() > 1 {
-                    p.trim_end_matches('/').to_string()
+                let separator = options.path_separator.as_str();
+                if p.ends_with(separator) && p.len() > separator.len() {
+                    p.trim_end_matches(separator).to_string()
                 } else {
                     p.clone()
                 }
@@ -367,9 +1544,16 @@ pub fn compute_differences(
 
         if headers1 != headers2 {
             for (key, value1) in headers1.iter() {
+                if options.ignored_headers.contains(key) {
+                    continue;
+                }
                 match headers2.get(key) {
                     Some(value2) => {
-                        if value1 != value2 {
+                        let unchanged = value1 == value2
+                            || (options.normalized_headers.contains(key)
+                                && normalize_header_values(value1)
+                                    == normalize_header_values(value2));
+                        if !unchanged {
                             differences.push(Difference::HeaderValueChanged {
                                 header_name: key.to_string(),
                                 old_val: value1.clone(),
@@ -386,7 +1570,7 @@ pub fn compute_differences(
             }
 
             for (key, _value2) in headers2.iter() {
-                if !headers1.contains_key(key) {
+                if !headers1.contains_key(key) && !options.ignored_headers.contains(key) {
                     differences.push(Difference::HeaderValueAdded {
                         header_name: key.to_string(),
                     });
@@ -395,28 +1579,87 @@ pub fn compute_differences(
         }
     }
 
-    match (&response1.body.json, &response2.body.json) {
-        (Some(body1), Some(body2)) => {
-            find_json_differences(
-                "",
-                body1,
-                body2,
-                &mut differences,
-                10,
-                0,
-                &ignored_paths_ref,
-            );
-        }
-        // String body
-        _ => {
-            if response1.body != response2.body {
-                differences.push(Difference::DifferentBodyString {
-                    before: response1.body.raw.clone(),
-                    after: response2.body.raw.clone(),
+    // Redirects are only compared when both responses captured them
+    if let (Some(redirects1), Some(redirects2)) = (&response1.redirects, &response2.redirects) {
+        differences.extend(compare_redirects(redirects1, redirects2));
+    }
+
+    if !options.skip_body {
+        match (&response1.body.json, &response2.body.json) {
+            (Some(body1), Some(body2)) => {
+                let canonical_bodies = options.canonical_json.then(|| {
+                    let (mut body1, mut body2) = (body1.clone(), body2.clone());
+                    canonicalize_json(&mut body1);
+                    canonicalize_json(&mut body2);
+                    (body1, body2)
                 });
+                let (body1, body2) = match &canonical_bodies {
+                    Some((body1, body2)) => (body1, body2),
+                    None => (body1, body2),
+                };
+
+                if options.shape_only {
+                    differences.extend(compare_fingerprints(
+                        &json_fingerprint(body1, &options.path_separator),
+                        &json_fingerprint(body2, &options.path_separator),
+                        &ignored_paths_ref,
+                        &options.path_separator,
+                    ));
+                } else {
+                    find_json_differences(
+                        "",
+                        body1,
+                        body2,
+                        &mut differences,
+                        options.max_depth,
+                        0,
+                        &ignored_paths_ref,
+                        options,
+                    );
+                }
+            }
+            // Only JSON bodies have a structure to compare
+            _ if options.shape_only => {}
+            // String body
+            _ => {
+                if response1.body != response2.body {
+                    let max_length = options.max_value_length * 2;
+                    differences.push(Difference::DifferentBodyString {
+                        before: truncate(&response1.body.raw, max_length).into_owned(),
+                        after: truncate(&response2.body.raw, max_length).into_owned(),
+                    });
+                }
             }
         }
     }
 
     differences
 }
+
+/// Compare a response to several accepted baselines. Returns the index of the first baseline it matches,
+/// or of the closest one (with the fewest differences) when it matches none, along with the differences to it.
+pub fn compute_differences_to_closest(
+    baselines: &[&HttpResponseData],
+    response: &HttpResponseData,
+    headers_ignored: bool,
+    ignored_paths: Option<&HashSet<String>>,
+    options: &DiffOptions,
+) -> Option<(usize, Vec<Difference>)> {
+    let mut closest: Option<(usize, Vec<Difference>)> = None;
+
+    for (i, baseline) in baselines.iter().enumerate() {
+        let differences =
+            compute_differences(baseline, response, headers_ignored, ignored_paths, options);
+        if differences.is_empty() {
+            return Some((i, differences));
+        }
+        if closest
+            .as_ref()
+            .is_none_or(|(_, closest)| differences.len() < closest.len())
+        {
+            closest = Some((i, differences));
+        }
+    }
+
+    closest
+}
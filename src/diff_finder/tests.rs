@@ -1,11 +1,18 @@
 #[cfg(test)]
 mod tests {
-    use crate::diff_finder::{Difference, compute_differences};
-    use crate::{HttpResponseData, ParsedBody};
-    use serde_json::json;
-    use std::collections::{HashMap, HashSet};
-
-    fn make_json_response(status_code: u16, json: serde_json::Value) -> HttpResponseData {
+    use crate::diff_finder::{BodyAssertion, Tolerance};
+    use crate::diff_finder::{
+        DiffOptions, Difference, check_max_latency, collapse_repeated_differences, compare_latency,
+        compare_latency_percentile, compare_timings, compute_differences,
+        compute_differences_to_closest, find_array_order_changes, find_expected_header_mismatches,
+        find_failed_assertions, find_forbidden_substrings, truncate,
+    };
+    use crate::fetch::ResponseTimings;
+    use crate::{HttpResponseData, ParsedBody, RedirectHop};
+    use serde_json::{Value, json};
+    use std::collections::{BTreeMap, HashMap, HashSet};
+
+    fn make_json_response(status_code: u16, json: Value) -> HttpResponseData {
         HttpResponseData {
             status_code,
             headers: HashMap::from([("Content-Type".into(), vec!["application/json".into()])]),
@@ -13,6 +20,8 @@ mod tests {
                 json: Some(json),
                 ..Default::default()
             },
+            redirects: None,
+            body_size: None,
         }
     }
 
@@ -25,6 +34,8 @@ mod tests {
                 raw: "".to_string(),
                 json: None,
             },
+            redirects: None,
+            body_size: None,
         };
 
         let response2 = HttpResponseData {
@@ -34,9 +45,12 @@ mod tests {
                 raw: "".to_string(),
                 json: None,
             },
+            redirects: None,
+            body_size: None,
         };
 
-        let differences = compute_differences(&response1, &response2, false, None);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
 
         assert_eq!(differences.len(), 1);
         assert!(matches!(
@@ -72,6 +86,8 @@ mod tests {
                 raw: "".to_string(),
                 json: None,
             },
+            redirects: None,
+            body_size: None,
         };
 
         let response2 = HttpResponseData {
@@ -81,9 +97,12 @@ mod tests {
                 raw: "".to_string(),
                 json: None,
             },
+            redirects: None,
+            body_size: None,
         };
 
-        let differences = compute_differences(&response1, &response2, false, None);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
 
         assert_eq!(differences.len(), 3);
 
@@ -139,6 +158,8 @@ mod tests {
                 raw: "".to_string(),
                 json: None,
             },
+            redirects: None,
+            body_size: None,
         };
 
         let response2 = HttpResponseData {
@@ -148,10 +169,13 @@ mod tests {
                 raw: "".to_string(),
                 json: None,
             },
+            redirects: None,
+            body_size: None,
         };
 
         // Ignore headers
-        let differences = compute_differences(&response1, &response2, true, None);
+        let differences =
+            compute_differences(&response1, &response2, true, None, &DiffOptions::default());
 
         assert_eq!(
             differences.len(),
@@ -165,7 +189,8 @@ mod tests {
         let response1 = make_json_response(200, json!({"name": "John", "age": 30}));
         let response2 = make_json_response(200, json!({"name": "John", "age": 31}));
 
-        let differences = compute_differences(&response1, &response2, false, None);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
 
         assert_eq!(differences.len(), 1);
         assert!(matches!(
@@ -195,7 +220,8 @@ mod tests {
             make_json_response(200, json!({"name": "John", "email": "john@example.com"}));
         let response2 = make_json_response(200, json!({"name": "John", "phone": "555-1234"}));
 
-        let differences = compute_differences(&response1, &response2, false, None);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
 
         assert_eq!(differences.len(), 2);
 
@@ -233,7 +259,8 @@ mod tests {
             json!({"user": {"name": "John", "details": {"age": 31}}}),
         );
 
-        let differences = compute_differences(&response1, &response2, false, None);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
 
         assert_eq!(differences.len(), 1);
 
@@ -256,7 +283,8 @@ mod tests {
         let response1 = make_json_response(200, json!({"items": [1, 2, 3]}));
         let response2 = make_json_response(200, json!({"items": [1, 2, 3, 4, 5]}));
 
-        let differences = compute_differences(&response1, &response2, false, None);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
 
         // There should be 3 differences:
         // 1. Array length changed
@@ -280,8 +308,14 @@ mod tests {
                     found_length_change = true;
                 }
                 Difference::ArrayElementAdded { path, value } => {
-                    assert_eq!(path, "items[*]");
-                    assert!(value == "4" || value == "5");
+                    // Added elements are reported at their index in the new array
+                    assert!(
+                        (path == "items[3]" && value == "4")
+                            || (path == "items[4]" && value == "5"),
+                        "{} {}",
+                        path,
+                        value
+                    );
                     found_element_added += 1;
                 }
                 _ => panic!("Unexpected difference type: {:?}", diff),
@@ -306,7 +340,8 @@ mod tests {
             json!({"users": [{"id": 1, "name": "Alice"}, {"id": 2, "name": "Bobby"}]}),
         );
 
-        let differences = compute_differences(&response1, &response2, false, None);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
 
         // Order-independent array comparison should show:
         // 1. Element with "Bob" removed
@@ -319,13 +354,13 @@ mod tests {
         for diff in &differences {
             match diff {
                 Difference::ArrayElementRemoved { path, value } => {
-                    assert_eq!(path, "users[*]");
+                    assert_eq!(path, "users[1]");
                     assert!(value.contains("Bob"));
                     assert!(!value.contains("Bobby"));
                     found_removed = true;
                 }
                 Difference::ArrayElementAdded { path, value } => {
-                    assert_eq!(path, "users[*]");
+                    assert_eq!(path, "users[1]");
                     assert!(value.contains("Bobby"));
                     found_added = true;
                 }
@@ -387,7 +422,8 @@ mod tests {
             }),
         );
 
-        let differences = compute_differences(&response1, &response2, false, None);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
         assert_eq!(differences.len(), 0, "All differences should be ignored");
 
         // Now, let's change the value of two keys, the differences should be spotted...
@@ -415,7 +451,8 @@ mod tests {
             }),
         );
 
-        let differences = compute_differences(&response1, &response2, false, None);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
         assert_eq!(differences.len(), 4, "The differences should be spotted");
     }
 
@@ -428,6 +465,8 @@ mod tests {
                 raw: "Hello World".to_string(),
                 json: None,
             },
+            redirects: None,
+            body_size: None,
         };
 
         let response2 = HttpResponseData {
@@ -437,9 +476,12 @@ mod tests {
                 raw: "Hello Universe".to_string(),
                 json: None,
             },
+            redirects: None,
+            body_size: None,
         };
 
-        let differences = compute_differences(&response1, &response2, false, None);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
 
         assert_eq!(differences.len(), 1);
 
@@ -483,7 +525,13 @@ mod tests {
         ignored_paths.insert("/timestamp".to_string());
 
         // Compute differences with ignored paths
-        let differences = compute_differences(&response1, &response2, false, Some(&ignored_paths));
+        let differences = compute_differences(
+            &response1,
+            &response2,
+            false,
+            Some(&ignored_paths),
+            &DiffOptions::default(),
+        );
 
         // Should find no differences since the only changes are in ignored paths
         assert_eq!(differences.len(), 0);
@@ -492,8 +540,13 @@ mod tests {
         let mut only_id_ignored = HashSet::new();
         only_id_ignored.insert("/id".to_string());
 
-        let differences =
-            compute_differences(&response1, &response2, false, Some(&only_id_ignored));
+        let differences = compute_differences(
+            &response1,
+            &response2,
+            false,
+            Some(&only_id_ignored),
+            &DiffOptions::default(),
+        );
 
         assert_eq!(differences.len(), 1);
 
@@ -520,6 +573,8 @@ mod tests {
                 raw: "".to_string(),
                 json: None,
             },
+            redirects: None,
+            body_size: None,
         };
 
         let empty_response2 = HttpResponseData {
@@ -529,9 +584,17 @@ mod tests {
                 raw: "".to_string(),
                 json: None,
             },
+            redirects: None,
+            body_size: None,
         };
 
-        let differences = compute_differences(&empty_response1, &empty_response2, false, None);
+        let differences = compute_differences(
+            &empty_response1,
+            &empty_response2,
+            false,
+            None,
+            &DiffOptions::default(),
+        );
         assert_eq!(
             differences.len(),
             0,
@@ -577,15 +640,26 @@ mod tests {
         let mut ignored_paths = HashSet::new();
         ignored_paths.insert("/data/user".to_string());
 
-        let differences = compute_differences(&response1, &response2, false, Some(&ignored_paths));
+        let differences = compute_differences(
+            &response1,
+            &response2,
+            false,
+            Some(&ignored_paths),
+            &DiffOptions::default(),
+        );
         assert_eq!(differences.len(), 0, "All differences should be ignored");
 
         // Ignore just the user ID
         let mut only_id_ignored = HashSet::new();
         only_id_ignored.insert("/data/user/id".to_string());
 
-        let differences =
-            compute_differences(&response1, &response2, false, Some(&only_id_ignored));
+        let differences = compute_differences(
+            &response1,
+            &response2,
+            false,
+            Some(&only_id_ignored),
+            &DiffOptions::default(),
+        );
         assert_eq!(differences.len(), 1, "Should only find the age difference");
 
         if let Difference::BodyValueChanged {
@@ -617,15 +691,20 @@ mod tests {
             status_code: 200,
             headers: headers1,
             body: ParsedBody::default(),
+            redirects: None,
+            body_size: None,
         };
 
         let response2 = HttpResponseData {
             status_code: 200,
             headers: headers2,
             body: ParsedBody::default(),
+            redirects: None,
+            body_size: None,
         };
 
-        let differences = compute_differences(&response1, &response2, false, None);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
 
         assert_eq!(differences.len(), 1);
         if let Difference::HeaderValueChanged {
@@ -653,7 +732,8 @@ mod tests {
         let response1 = make_json_response(200, json!([1, 1, 2]));
         let response2 = make_json_response(200, json!([1, 2, 2]));
 
-        let differences = compute_differences(&response1, &response2, false, None);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
 
         // Now implementation correctly detects one '1' removed and one '2' added
         assert_eq!(differences.len(), 2);
@@ -679,7 +759,8 @@ mod tests {
         let response1 = make_json_response(200, json!({"msg": long_string}));
         let response2 = make_json_response(200, json!({"msg": "short"}));
 
-        let differences = compute_differences(&response1, &response2, false, None);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
 
         assert_eq!(differences.len(), 1);
         if let Difference::BodyValueChanged {
@@ -692,4 +773,1209 @@ mod tests {
             assert!(old_val.len() <= 55); // 50 + quotes + ...
         }
     }
+
+    #[test]
+    fn test_collapse_repeated_differences() {
+        let items = |updated: &dyn Fn(usize) -> Value| -> Vec<Value> {
+            (0..16)
+                .map(|i| json!({"id": i, "updatedAt": updated(i), "name": format!("item {}", i)}))
+                .collect()
+        };
+        let response1 = make_json_response(
+            200,
+            json!({"total": 16, "items": items(&|i| json!(format!("2023-01-{:02}", i + 1)))}),
+        );
+        // 14 elements were updated, one lost its date, and another one didn't change
+        let response2 = make_json_response(
+            200,
+            json!({"total": 15, "items": items(&|i| match i {
+                14 => Value::Null,
+                15 => json!("2023-01-16"),
+                _ => json!(format!("2024-01-{:02}", i + 1)),
+            })}),
+        );
+
+        let collapsed = collapse_repeated_differences(compute_differences(
+            &response1,
+            &response2,
+            false,
+            None,
+            &keyed_options(),
+        ));
+
+        assert_eq!(collapsed.len(), 3, "{:?}", collapsed);
+        let repeated = collapsed
+            .iter()
+            .find(|d| matches!(d, Difference::Repeated { .. }))
+            .expect("The updated dates are grouped");
+        let Difference::Repeated {
+            path,
+            count,
+            sample,
+        } = repeated
+        else {
+            unreachable!()
+        };
+        assert_eq!(path, "items[*]/updatedAt");
+        assert_eq!(*count, 14);
+        assert!(matches!(
+            sample.as_ref(),
+            Difference::BodyValueChanged { old_val, new_val, .. }
+                if old_val.starts_with("\"2023-") && new_val.starts_with("\"2024-")
+        ));
+
+        // A date that became null changed in another way, it isn't grouped with the others
+        assert!(collapsed.contains(&Difference::BodyValueChanged {
+            path: "items[id=14]/updatedAt".to_string(),
+            old_val: "\"2023-01-15\"".to_string(),
+            new_val: "null".to_string(),
+        }));
+        assert!(collapsed.iter().any(|d| d.path() == Some("total")));
+    }
+
+    #[test]
+    fn test_collapse_repeated_array_elements() {
+        let response1 = make_json_response(200, json!({"items": [1]}));
+        let response2 = make_json_response(200, json!({"items": [1, 2, 3, 4]}));
+
+        let differences = collapse_repeated_differences(compute_differences(
+            &response1,
+            &response2,
+            false,
+            None,
+            &DiffOptions::default(),
+        ));
+
+        assert_eq!(differences.len(), 2);
+        assert!(differences.iter().any(|d| matches!(
+            d,
+            Difference::Repeated { path, count: 3, .. } if path == "items[*]"
+        )));
+    }
+
+    #[test]
+    fn test_canonical_json() {
+        let response1 = make_json_response(
+            200,
+            serde_json::from_str(r#"{"price": 1.0, "items": [2.0, 3], "name": "caf\u00e9"}"#)
+                .unwrap(),
+        );
+        let response2 = make_json_response(
+            200,
+            serde_json::from_str(r#"{"price": 1, "items": [2, 3e0], "name": "café"}"#).unwrap(),
+        );
+
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
+        assert!(
+            !differences.is_empty(),
+            "Representation changes are spotted"
+        );
+
+        let options = DiffOptions {
+            canonical_json: true,
+            ..Default::default()
+        };
+        let differences = compute_differences(&response1, &response2, false, None, &options);
+        assert_eq!(differences.len(), 0, "Representation changes are ignored");
+
+        // Magnitude changes are still detected
+        let response2 =
+            make_json_response(200, json!({"price": 1.5, "items": [2, 3], "name": "café"}));
+        let differences = compute_differences(&response1, &response2, false, None, &options);
+        assert_eq!(differences.len(), 1);
+    }
+
+    #[test]
+    fn test_exact_numbers() {
+        let body = |text: &str| make_json_response(200, serde_json::from_str(text).unwrap());
+        let response1 = body(
+            r#"{"id": 10000000000000001, "big": 100000000000000000000000001, "rate": 0.10000000000000000001}"#,
+        );
+        let response2 = body(
+            r#"{"id": 10000000000000000, "big": 100000000000000000000000002, "rate": 0.10000000000000000002}"#,
+        );
+
+        // Numbers beyond the precision of a float are compared and shown as written
+        for canonical_json in [false, true] {
+            let options = DiffOptions {
+                canonical_json,
+                ..Default::default()
+            };
+            let mut differences =
+                compute_differences(&response1, &response2, false, None, &options);
+            differences.sort_by(|a, b| a.path().cmp(&b.path()));
+            assert_eq!(
+                differences,
+                vec![
+                    Difference::BodyValueChanged {
+                        path: "big".to_string(),
+                        old_val: "100000000000000000000000001".to_string(),
+                        new_val: "100000000000000000000000002".to_string(),
+                    },
+                    Difference::BodyValueChanged {
+                        path: "id".to_string(),
+                        old_val: "10000000000000001".to_string(),
+                        new_val: "10000000000000000".to_string(),
+                    },
+                    Difference::BodyValueChanged {
+                        path: "rate".to_string(),
+                        old_val: "0.10000000000000000001".to_string(),
+                        new_val: "0.10000000000000000002".to_string(),
+                    },
+                ]
+            );
+        }
+
+        // The trailing zeros of a precise decimal are only a representation change
+        let response1 = body(r#"{"rate": 0.100000000000000000010, "price": 1.50}"#);
+        let response2 = body(r#"{"rate": 0.10000000000000000001, "price": 1.5}"#);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
+        assert_eq!(differences.len(), 2);
+        let options = DiffOptions {
+            canonical_json: true,
+            ..Default::default()
+        };
+        let differences = compute_differences(&response1, &response2, false, None, &options);
+        assert!(differences.is_empty());
+    }
+
+    #[test]
+    fn test_array_order_changes() {
+        let first = json!({
+            "ids": [1, 2, 3],
+            "stable": ["a", "b"],
+            "resized": [1, 2],
+            "users": [
+                {"name": "Alice", "roles": ["admin", "dev"]},
+                {"name": "Bob", "roles": ["ops"]}
+            ]
+        });
+        let second = json!({
+            "ids": [3, 1, 2],
+            "stable": ["a", "b"],
+            "resized": [2, 1, 3],
+            "users": [
+                {"name": "Alice", "roles": ["dev", "admin"]},
+                {"name": "Bobby", "roles": ["ops"]}
+            ]
+        });
+
+        let mut differences = Vec::new();
+        find_array_order_changes("", &first, &second, &mut differences, "/");
+
+        assert_eq!(differences.len(), 2);
+        assert!(differences.contains(&Difference::ArrayOrderChanged {
+            path: "ids".to_string()
+        }));
+        assert!(differences.contains(&Difference::ArrayOrderChanged {
+            path: "users[0]/roles".to_string()
+        }));
+    }
+
+    #[test]
+    fn test_timing_regressions() {
+        let baseline = ResponseTimings {
+            time_to_first_byte_ms: 100,
+            download_ms: 50,
+            redirects_ms: 20,
+        };
+        let current = ResponseTimings {
+            time_to_first_byte_ms: 180,
+            download_ms: 300,
+            redirects_ms: 90,
+        };
+
+        let differences = compare_timings(&baseline, &current, 100);
+        assert_eq!(
+            differences,
+            vec![Difference::TimingRegressed {
+                phase: "download".to_string(),
+                old_ms: 50,
+                new_ms: 300,
+            }]
+        );
+
+        assert_eq!(compare_timings(&baseline, &current, 50).len(), 3);
+        assert!(compare_timings(&current, &baseline, 0).is_empty());
+
+        // Redirects are a phase of their own, never counted in the time to first byte
+        assert_eq!(
+            compare_timings(&baseline, &current, 60)[0],
+            Difference::TimingRegressed {
+                phase: "redirects".to_string(),
+                old_ms: 20,
+                new_ms: 90,
+            }
+        );
+    }
+
+    #[test]
+    fn test_skip_body() {
+        let response1 = make_json_response(200, json!({"size": 1}));
+        let response2 = make_json_response(404, json!({"size": 2}));
+
+        let options = DiffOptions {
+            skip_body: true,
+            ..Default::default()
+        };
+        let differences = compute_differences(&response1, &response2, false, None, &options);
+        assert_eq!(
+            differences,
+            vec![Difference::StatusCodeChanged {
+                old_val: 200,
+                new_val: 404
+            }]
+        );
+    }
+
+    #[test]
+    fn test_redirect_chain_changes() {
+        let hop = |status_code, location: &str| RedirectHop {
+            status_code,
+            location: location.to_string(),
+        };
+        let mut response1 = make_json_response(200, json!({}));
+        let mut response2 = make_json_response(200, json!({}));
+
+        // Nothing is compared until both responses captured their redirects
+        response2.redirects = Some(vec![hop(301, "/login")]);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
+        assert!(differences.is_empty());
+
+        response1.redirects = Some(vec![hop(301, "/signin")]);
+        response2.redirects = Some(vec![hop(301, "/login"), hop(302, "/home")]);
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
+        assert_eq!(
+            differences,
+            vec![
+                Difference::RedirectHopChanged {
+                    hop: 0,
+                    old_val: Some("301 -> /signin".to_string()),
+                    new_val: Some("301 -> /login".to_string()),
+                },
+                Difference::RedirectHopChanged {
+                    hop: 1,
+                    old_val: None,
+                    new_val: Some("302 -> /home".to_string()),
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn test_closest_baseline() {
+        let first = make_json_response(200, json!({"state": "ready", "count": 1}));
+        let second = make_json_response(200, json!({"state": "pending", "count": 2}));
+        let baselines = [&first, &second];
+        let options = DiffOptions::default();
+
+        let response = make_json_response(200, json!({"state": "pending", "count": 2}));
+        let (matched, differences) =
+            compute_differences_to_closest(&baselines, &response, false, None, &options).unwrap();
+        assert_eq!(matched, 1);
+        assert!(differences.is_empty());
+
+        let response = make_json_response(200, json!({"state": "pending", "count": 3}));
+        let (matched, differences) =
+            compute_differences_to_closest(&baselines, &response, false, None, &options).unwrap();
+        assert_eq!(matched, 1, "The closest baseline is reported");
+        assert_eq!(differences.len(), 1);
+
+        assert!(compute_differences_to_closest(&[], &response, false, None, &options).is_none());
+    }
+
+    #[test]
+    fn test_path_separator() {
+        let response1 = make_json_response(
+            200,
+            json!({"types": {"application/json": 1, "a.b": 1}, "meta": {"id": 1}}),
+        );
+        let response2 = make_json_response(
+            200,
+            json!({"types": {"application/json": 2, "a.b": 2}, "meta": {"id": 2}}),
+        );
+
+        let options = DiffOptions {
+            path_separator: ".".to_string(),
+            ..Default::default()
+        };
+        let ignored_paths = HashSet::from([".meta".to_string()]);
+        let mut paths: Vec<String> = compute_differences(
+            &response1,
+            &response2,
+            false,
+            Some(&ignored_paths),
+            &options,
+        )
+        .iter()
+        .filter_map(|d| d.path().map(str::to_string))
+        .collect();
+        paths.sort();
+        assert_eq!(paths, vec!["types.a\\.b", "types.application/json"]);
+
+        // Keys containing the default separator are escaped
+        let ignored_paths = HashSet::from(["/meta".to_string()]);
+        let mut paths: Vec<String> = compute_differences(
+            &response1,
+            &response2,
+            false,
+            Some(&ignored_paths),
+            &DiffOptions::default(),
+        )
+        .iter()
+        .filter_map(|d| d.path().map(str::to_string))
+        .collect();
+        paths.sort();
+        assert_eq!(paths, vec!["types/a.b", "types/application\\/json"]);
+    }
+
+    #[test]
+    fn test_numeric_tolerance() {
+        let response1 = make_json_response(
+            200,
+            json!({"lat": 1.0000001, "lon": 2, "duration": 1.5, "count": 10}),
+        );
+        let response2 = make_json_response(
+            200,
+            json!({"lat": 1.0, "lon": 2.0000004, "duration": 1.6, "count": 10}),
+        );
+
+        // Within the tolerance, including ints compared to floats; outside of it
+        let options = DiffOptions {
+            numeric_tolerance: Some(Tolerance::Absolute(0.001)),
+            ..Default::default()
+        };
+        let paths: Vec<String> = compute_differences(&response1, &response2, false, None, &options)
+            .iter()
+            .filter_map(|d| d.path().map(str::to_string))
+            .collect();
+        assert_eq!(paths, vec!["duration"]);
+
+        // Relative tolerance
+        let options = DiffOptions {
+            numeric_tolerance: Some(Tolerance::Percent(10.0)),
+            ..Default::default()
+        };
+        assert_eq!(
+            compute_differences(&response1, &response2, false, None, &options),
+            vec![]
+        );
+
+        // A tolerance configured for a path takes precedence
+        let options = DiffOptions {
+            numeric_tolerances: HashMap::from([(
+                "/duration".to_string(),
+                Tolerance::Absolute(0.0),
+            )]),
+            numeric_tolerance: Some(Tolerance::Percent(10.0)),
+            ..Default::default()
+        };
+        let paths: Vec<String> = compute_differences(&response1, &response2, false, None, &options)
+            .iter()
+            .filter_map(|d| d.path().map(str::to_string))
+            .collect();
+        assert_eq!(paths, vec!["duration"]);
+    }
+
+    #[test]
+    fn test_numeric_tolerances() {
+        let response1 = make_json_response(200, json!({"price": 100, "stock": 1000, "id": 1}));
+        let response2 = make_json_response(200, json!({"price": 104, "stock": 1500, "id": 2}));
+
+        let options = DiffOptions {
+            numeric_tolerances: HashMap::from([
+                (
+                    "/price".to_string(),
+                    serde_json::from_value(json!("5%")).unwrap(),
+                ),
+                (
+                    "/stock".to_string(),
+                    serde_json::from_value(json!(400)).unwrap(),
+                ),
+            ]),
+            ..Default::default()
+        };
+        let mut paths: Vec<String> =
+            compute_differences(&response1, &response2, false, None, &options)
+                .iter()
+                .filter_map(|d| d.path().map(str::to_string))
+                .collect();
+        paths.sort();
+        assert_eq!(paths, vec!["id", "stock"]);
+
+        assert_eq!(
+            serde_json::from_value::<Tolerance>(json!("2.5 %")).unwrap(),
+            Tolerance::Percent(2.5)
+        );
+        assert_eq!(
+            serde_json::from_value::<Tolerance>(json!("10")).unwrap(),
+            Tolerance::Absolute(10.0)
+        );
+        assert!(serde_json::from_value::<Tolerance>(json!("-5%")).is_err());
+        assert!(serde_json::from_value::<Tolerance>(json!(true)).is_err());
+    }
+
+    #[test]
+    fn test_shape_only() {
+        let response1 = make_json_response(
+            200,
+            json!({"id": 1, "name": "a", "tags": ["x"], "meta": {"ts": 1}, "gone": null}),
+        );
+        let response2 = make_json_response(
+            200,
+            json!({"id": 2, "name": 5, "tags": ["y", 1], "meta": {"ts": 2, "new": true}}),
+        );
+
+        let options = DiffOptions {
+            shape_only: true,
+            ..Default::default()
+        };
+        let ignored_paths = HashSet::from(["/meta".to_string()]);
+        let differences = compute_differences(
+            &response1,
+            &response2,
+            false,
+            Some(&ignored_paths),
+            &options,
+        );
+
+        assert_eq!(differences.len(), 3, "{:?}", differences);
+        assert!(differences.contains(&Difference::BodyValueRemoved {
+            path: "gone".to_string(),
+            value: "null".to_string(),
+        }));
+        assert!(differences.contains(&Difference::TypeChanged {
+            path: "name".to_string(),
+            old_type: "string".to_string(),
+            new_type: "number".to_string(),
+        }));
+        assert!(differences.contains(&Difference::TypeChanged {
+            path: "tags[*]".to_string(),
+            old_type: "string".to_string(),
+            new_type: "number|string".to_string(),
+        }));
+    }
+
+    #[test]
+    fn test_ignored_headers() {
+        let response = |date: &str, request_id: Option<&str>, version: &str| {
+            let mut headers = HashMap::from([
+                ("date".to_string(), vec![date.to_string()]),
+                ("x-version".to_string(), vec![version.to_string()]),
+            ]);
+            if let Some(request_id) = request_id {
+                headers.insert("x-request-id".to_string(), vec![request_id.to_string()]);
+            }
+            HttpResponseData::new(200, headers, String::new())
+        };
+        let response1 = response("Mon, 01 Jan 2024 00:00:00 GMT", None, "1");
+        let response2 = response("Tue, 02 Jan 2024 00:00:00 GMT", Some("abc"), "2");
+
+        let options = DiffOptions {
+            ignored_headers: HashSet::from(["date".to_string(), "x-request-id".to_string()]),
+            ..Default::default()
+        };
+        // Only the headers that aren't listed are compared, whether they changed or were added
+        let differences = compute_differences(&response1, &response2, false, None, &options);
+        assert_eq!(differences.len(), 1);
+        assert!(matches!(
+            &differences[0],
+            Difference::HeaderValueChanged { header_name, .. } if header_name == "x-version"
+        ));
+
+        let differences = compute_differences(&response2, &response1, false, None, &options);
+        assert_eq!(differences.len(), 1);
+
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
+        assert_eq!(differences.len(), 3);
+    }
+
+    #[test]
+    fn test_normalized_headers() {
+        let response = |cache_control: Vec<&str>, vary: &str| HttpResponseData {
+            status_code: 200,
+            headers: HashMap::from([
+                (
+                    "cache-control".to_string(),
+                    cache_control.into_iter().map(str::to_string).collect(),
+                ),
+                ("vary".to_string(), vec![vary.to_string()]),
+            ]),
+            body: ParsedBody::default(),
+            redirects: None,
+            body_size: None,
+        };
+        let response1 = response(vec!["no-cache, no-store"], "Accept, Origin");
+        let response2 = response(vec!["no-store,no-cache "], "Origin, Accept");
+
+        let options = DiffOptions {
+            normalized_headers: HashSet::from(["cache-control".to_string()]),
+            ..Default::default()
+        };
+        let differences = compute_differences(&response1, &response2, false, None, &options);
+        assert_eq!(differences.len(), 1);
+        assert!(matches!(
+            &differences[0],
+            Difference::HeaderValueChanged { header_name, .. } if header_name == "vary"
+        ));
+
+        // Directives split over several header lines are the same as a single line
+        let response3 = response(vec!["no-store", "no-cache"], "Accept, Origin");
+        let differences = compute_differences(&response1, &response3, false, None, &options);
+        assert!(differences.is_empty());
+
+        let response4 = response(vec!["no-store, private"], "Accept, Origin");
+        let differences = compute_differences(&response1, &response4, false, None, &options);
+        assert_eq!(differences.len(), 1);
+    }
+
+    #[test]
+    fn test_forbidden_substrings() {
+        let body = "{\n  \"name\": \"é\",\n  \"error\": \"Traceback (most recent call last)\"\n}";
+        let differences = find_forbidden_substrings(
+            body,
+            &[
+                "Traceback".to_string(),
+                "undefined".to_string(),
+                String::new(),
+            ],
+        );
+
+        assert_eq!(
+            differences,
+            vec![Difference::ForbiddenSubstring {
+                substring: "Traceback".to_string(),
+                line: 3,
+                column: 13,
+                context:
+                    "{   \"name\": \"é\",   \"error\": \"Traceback (most recent call last)\" }"
+                        .to_string(),
+            }]
+        );
+    }
+
+    #[test]
+    fn test_assertions_on_json_body() {
+        let assertions: Vec<BodyAssertion> = serde_json::from_value(json!([
+            {"type": "contains", "expected": "\"status\":\"ok\""},
+            {"type": "regex", "path": "/version", "expected": "^v2\\."},
+            {"type": "json_equals", "path": "/items/0/count", "expected": 3},
+            {"type": "json_equals", "path": "/missing", "expected": true}
+        ]))
+        .unwrap();
+        let raw = r#"{"status":"ok","version":"v2.1.0","items":[{"count":3}]}"#;
+        let body = ParsedBody {
+            raw: raw.to_string(),
+            json: serde_json::from_str(raw).ok(),
+        };
+
+        assert_eq!(
+            find_failed_assertions(&body, &assertions, "/"),
+            vec![Difference::AssertionFailed {
+                assertion: "/missing equals true".to_string(),
+                actual: None,
+            }]
+        );
+
+        let raw = r#"{"status":"down","version":"v1.9.0","items":[{"count":"3"}]}"#;
+        let body = ParsedBody {
+            raw: raw.to_string(),
+            json: serde_json::from_str(raw).ok(),
+        };
+        let failed: Vec<Option<String>> = find_failed_assertions(&body, &assertions, "/")
+            .into_iter()
+            .map(|d| match d {
+                Difference::AssertionFailed { actual, .. } => actual,
+                d => panic!("Expected AssertionFailed difference, got {:?}", d),
+            })
+            .collect();
+        assert_eq!(
+            failed,
+            vec![
+                Some(raw.chars().take(50).collect::<String>() + "..."),
+                Some("v1.9.0".to_string()),
+                Some("\"3\"".to_string()),
+                None,
+            ]
+        );
+    }
+
+    #[test]
+    fn test_assertions_on_plaintext_body() {
+        let assertions: Vec<BodyAssertion> = serde_json::from_value(json!([
+            {"type": "contains", "expected": "healthy"},
+            {"type": "regex", "expected": "^uptime: \\d+s"}
+        ]))
+        .unwrap();
+        let body = ParsedBody {
+            raw: "uptime: 42s, healthy".to_string(),
+            json: None,
+        };
+        assert_eq!(find_failed_assertions(&body, &assertions, "/"), vec![]);
+
+        let body = ParsedBody {
+            raw: "degraded".to_string(),
+            json: None,
+        };
+        let differences = find_failed_assertions(&body, &assertions, "/");
+        assert_eq!(
+            differences,
+            vec![
+                Difference::AssertionFailed {
+                    assertion: "body contains \"healthy\"".to_string(),
+                    actual: Some("degraded".to_string()),
+                },
+                Difference::AssertionFailed {
+                    assertion: "body matches ^uptime: \\d+s".to_string(),
+                    actual: Some("degraded".to_string()),
+                },
+            ]
+        );
+
+        // A JSON assertion on a plaintext body fails, and invalid regexes are rejected with the config
+        let json_equals: Vec<BodyAssertion> =
+            serde_json::from_value(json!([{"type": "json_equals", "expected": "degraded"}]))
+                .unwrap();
+        assert_eq!(find_failed_assertions(&body, &json_equals, "/").len(), 1);
+        assert!(
+            serde_json::from_value::<BodyAssertion>(json!({"type": "regex", "expected": "("}))
+                .is_err()
+        );
+    }
+
+    #[test]
+    fn test_expected_headers() {
+        let headers = HashMap::from([
+            (
+                "strict-transport-security".to_string(),
+                vec!["max-age=31536000".to_string()],
+            ),
+            (
+                "x-frame-options".to_string(),
+                vec!["SAMEORIGIN".to_string()],
+            ),
+        ]);
+        let expected = BTreeMap::from([
+            (
+                "Strict-Transport-Security".to_string(),
+                "max-age=31536000".to_string(),
+            ),
+            ("X-Frame-Options".to_string(), "DENY".to_string()),
+            (
+                "Content-Security-Policy".to_string(),
+                "default-src 'self'".to_string(),
+            ),
+        ]);
+
+        assert_eq!(
+            find_expected_header_mismatches(&headers, &expected),
+            vec![
+                Difference::ExpectedHeaderMismatch {
+                    header_name: "Content-Security-Policy".to_string(),
+                    expected: "default-src 'self'".to_string(),
+                    actual: None,
+                },
+                Difference::ExpectedHeaderMismatch {
+                    header_name: "X-Frame-Options".to_string(),
+                    expected: "DENY".to_string(),
+                    actual: Some(vec!["SAMEORIGIN".to_string()]),
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn test_coerce_numeric_strings() {
+        let response1 = make_json_response(200, json!({"a": "42", "b": 1.5, "c": "x", "d": "7"}));
+        let response2 = make_json_response(200, json!({"a": 42, "b": "1.50", "c": 1, "d": 8}));
+
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
+        assert_eq!(differences.len(), 4);
+
+        let options = DiffOptions {
+            coerce_numeric_strings: true,
+            ..Default::default()
+        };
+        let mut paths: Vec<String> =
+            compute_differences(&response1, &response2, false, None, &options)
+                .iter()
+                .filter_map(|d| d.path().map(str::to_string))
+                .collect();
+        paths.sort();
+        assert_eq!(paths, vec!["c", "d"]);
+    }
+
+    #[test]
+    fn test_normalize_dates() {
+        let response1 = make_json_response(
+            200,
+            json!({
+                "a": "2024-01-01T00:00:00Z",
+                "b": "2024-01-01T00:00:00.500Z",
+                "c": "2024-01-01T00:00:00Z",
+                "d": "not a date",
+            }),
+        );
+        let response2 = make_json_response(
+            200,
+            json!({
+                "a": "2023-12-31T19:00:00-05:00",
+                "b": "2024-01-01t05:30:00.5+05:30",
+                "c": "2024-01-01T00:00:01Z",
+                "d": "Not a date",
+            }),
+        );
+
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
+        assert_eq!(differences.len(), 4);
+
+        let options = DiffOptions {
+            normalize_dates: true,
+            ..Default::default()
+        };
+        let mut paths: Vec<String> =
+            compute_differences(&response1, &response2, false, None, &options)
+                .iter()
+                .filter_map(|d| d.path().map(str::to_string))
+                .collect();
+        paths.sort();
+        assert_eq!(paths, vec!["c", "d"]);
+    }
+
+    #[test]
+    fn test_coerce_boolean_strings() {
+        let response1 = make_json_response(
+            200,
+            json!({"a": "true", "b": false, "c": "1", "d": "yes", "e": "0"}),
+        );
+        let response2 = make_json_response(
+            200,
+            json!({"a": true, "b": "0", "c": true, "d": true, "e": true}),
+        );
+
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
+        assert_eq!(differences.len(), 5);
+
+        let options = DiffOptions {
+            coerce_boolean_strings: true,
+            ..Default::default()
+        };
+        let mut paths: Vec<String> =
+            compute_differences(&response1, &response2, false, None, &options)
+                .iter()
+                .filter_map(|d| d.path().map(str::to_string))
+                .collect();
+        paths.sort();
+        assert_eq!(paths, vec!["d", "e"]);
+    }
+
+    #[test]
+    fn test_latency_percentile() {
+        let history = [100, 120, 90, 110, 300, 105, 95, 115, 100, 130];
+        let timings = |latency_ms: u64| ResponseTimings {
+            time_to_first_byte_ms: latency_ms - 10,
+            download_ms: 10,
+            ..Default::default()
+        };
+
+        // The p90 of the history is 130 ms, the outlier being above it
+        assert_eq!(
+            compare_latency_percentile(&history, &timings(140), 90.0, 5),
+            Some(Difference::TimingRegressed {
+                phase: "latency (p90 of the last 10 runs)".to_string(),
+                old_ms: 130,
+                new_ms: 140,
+            })
+        );
+        assert_eq!(
+            compare_latency_percentile(&history, &timings(130), 90.0, 5),
+            None
+        );
+        assert_eq!(
+            compare_latency_percentile(&history[..4], &timings(1000), 90.0, 5),
+            None
+        );
+    }
+
+    #[test]
+    fn test_latency_regressions() {
+        let timings = |latency_ms: u64| ResponseTimings {
+            time_to_first_byte_ms: latency_ms - 10,
+            download_ms: 10,
+            ..Default::default()
+        };
+
+        // A slow response is reported above the maximum only
+        assert_eq!(
+            check_max_latency(&timings(501), 500),
+            Some(Difference::TimingRegressed {
+                phase: "latency (max allowed)".to_string(),
+                old_ms: 500,
+                new_ms: 501,
+            })
+        );
+        assert_eq!(check_max_latency(&timings(500), 500), None);
+
+        // Relative to the baseline latency, by a percentage or a number of milliseconds
+        let baseline = timings(200);
+        assert_eq!(
+            compare_latency(&baseline, &timings(260), &Tolerance::Percent(25.0)),
+            Some(Difference::TimingRegressed {
+                phase: "latency".to_string(),
+                old_ms: 200,
+                new_ms: 260,
+            })
+        );
+        assert_eq!(
+            compare_latency(&baseline, &timings(250), &Tolerance::Percent(25.0)),
+            None
+        );
+        assert!(compare_latency(&baseline, &timings(301), &Tolerance::Absolute(100.0)).is_some());
+        assert_eq!(
+            compare_latency(&baseline, &timings(300), &Tolerance::Absolute(100.0)),
+            None
+        );
+        // Faster responses are never reported
+        assert_eq!(
+            compare_latency(&baseline, &timings(20), &Tolerance::Percent(25.0)),
+            None
+        );
+    }
+
+    #[test]
+    fn test_allow_empty_additions() {
+        let response1 = make_json_response(200, json!({"a": 1, "b": {"c": "x"}}));
+        let response2 = make_json_response(
+            200,
+            json!({"a": null, "b": {"c": "x", "d": null, "e": [], "f": {}, "g": [null]}, "h": 0}),
+        );
+
+        let options = DiffOptions {
+            allow_empty_additions: true,
+            ..Default::default()
+        };
+        let mut paths: Vec<String> =
+            compute_differences(&response1, &response2, false, None, &options)
+                .iter()
+                .filter_map(|d| d.path().map(str::to_string))
+                .collect();
+        paths.sort();
+        assert_eq!(paths, vec!["a", "b/g", "h"]);
+    }
+
+    fn keyed_options() -> DiffOptions {
+        DiffOptions {
+            array_keys: HashMap::from([("/items".to_string(), "id".to_string())]),
+            ..DiffOptions::default()
+        }
+    }
+
+    #[test]
+    fn test_keyed_array_reordered() {
+        let response1 = make_json_response(
+            200,
+            json!({"items": [{"id": 1, "name": "a"}, {"id": 2, "name": "b"}]}),
+        );
+        let response2 = make_json_response(
+            200,
+            json!({"items": [{"id": 2, "name": "b"}, {"id": 1, "name": "a"}]}),
+        );
+
+        let differences =
+            compute_differences(&response1, &response2, false, None, &keyed_options());
+        assert_eq!(differences, vec![]);
+    }
+
+    #[test]
+    fn test_keyed_array_element_modified() {
+        let response1 = make_json_response(
+            200,
+            json!({"items": [{"id": "x", "price": 10}, {"id": "y", "price": 20}]}),
+        );
+        let response2 = make_json_response(
+            200,
+            json!({"items": [{"id": "y", "price": 20}, {"id": "x", "price": 12}]}),
+        );
+
+        let differences =
+            compute_differences(&response1, &response2, false, None, &keyed_options());
+        assert_eq!(
+            differences,
+            vec![Difference::BodyValueChanged {
+                path: "items[id=x]/price".to_string(),
+                old_val: "10".to_string(),
+                new_val: "12".to_string(),
+            }]
+        );
+
+        // Without a key, the modified element is reported as removed and added again
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
+        assert_eq!(differences.len(), 2);
+        assert!(matches!(
+            differences[0],
+            Difference::ArrayElementRemoved { .. }
+        ));
+        assert!(matches!(
+            differences[1],
+            Difference::ArrayElementAdded { .. }
+        ));
+    }
+
+    #[test]
+    fn test_keyed_array_paths() {
+        let response1 = make_json_response(
+            200,
+            json!({"items": [
+                {"id": 3, "updatedAt": "2023-01-01", "price": 100, "variants": [{"sku": "a", "stock": 1}]},
+                {"id": 4, "updatedAt": "2023-01-02", "price": 200, "variants": [{"sku": "b", "stock": 2}]}
+            ]}),
+        );
+        let response2 = make_json_response(
+            200,
+            json!({"items": [
+                {"id": 4, "updatedAt": "2024-01-02", "price": 230, "variants": [{"sku": "b", "stock": 5}]},
+                {"id": 3, "updatedAt": "2024-01-01", "price": 102, "variants": [{"sku": "a", "stock": 1}]}
+            ]}),
+        );
+
+        // The configured paths cover the fields of every element of the keyed arrays
+        let options = DiffOptions {
+            array_keys: HashMap::from([
+                ("/items".to_string(), "id".to_string()),
+                ("/items/variants".to_string(), "sku".to_string()),
+            ]),
+            numeric_tolerances: HashMap::from([(
+                "/items/price".to_string(),
+                Tolerance::Percent(5.0),
+            )]),
+            ..DiffOptions::default()
+        };
+        let ignored = HashSet::from(["/items/updatedAt".to_string()]);
+        let mut differences =
+            compute_differences(&response1, &response2, false, Some(&ignored), &options);
+        differences.sort_by(|a, b| a.path().cmp(&b.path()));
+        assert_eq!(
+            differences,
+            vec![
+                Difference::BodyValueChanged {
+                    path: "items[id=4]/price".to_string(),
+                    old_val: "200".to_string(),
+                    new_val: "230".to_string(),
+                },
+                Difference::BodyValueChanged {
+                    path: "items[id=4]/variants[sku=b]/stock".to_string(),
+                    old_val: "2".to_string(),
+                    new_val: "5".to_string(),
+                },
+            ]
+        );
+
+        // A single element can still be ignored
+        let ignored = HashSet::from(["/items/updatedAt".to_string(), "/items[id=4]".to_string()]);
+        let differences =
+            compute_differences(&response1, &response2, false, Some(&ignored), &options);
+        assert_eq!(differences, vec![]);
+    }
+
+    #[test]
+    fn test_depth_truncated() {
+        let nested = |leaf: i32| json!({"a": {"b": {"c": {"d": {"e": leaf}}}}, "top": 1});
+        let response1 = make_json_response(200, nested(1));
+        let response2 = make_json_response(200, nested(2));
+
+        let options = DiffOptions {
+            max_depth: 2,
+            ..Default::default()
+        };
+        // The change below the limit is reported where the comparison stopped
+        let differences = compute_differences(&response1, &response2, false, None, &options);
+        assert_eq!(
+            differences,
+            vec![Difference::DepthTruncated {
+                path: "a/b/c".to_string(),
+                max_depth: 2,
+            }]
+        );
+
+        // Nothing is reported when the values below the limit are the same
+        let differences = compute_differences(&response1, &response1, false, None, &options);
+        assert!(differences.is_empty());
+
+        // Within the limit, the change itself is reported
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
+        assert!(matches!(
+            &differences[..],
+            [Difference::BodyValueChanged { path, .. }] if path == "a/b/c/d/e"
+        ));
+    }
+
+    #[test]
+    fn test_array_element_indices() {
+        let response1 = make_json_response(200, json!({"tags": ["a", "b", "b", "c", "d"]}));
+        let response2 = make_json_response(200, json!({"tags": ["x", "b", "a", "d", "y"]}));
+
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
+        // Each unmatched element is reported at its index, in the old array when removed
+        // and in the new one when added. The first occurrences of a repeated value are the matched ones
+        assert_eq!(
+            differences,
+            vec![
+                Difference::ArrayElementRemoved {
+                    path: "tags[2]".to_string(),
+                    value: "\"b\"".to_string(),
+                },
+                Difference::ArrayElementRemoved {
+                    path: "tags[3]".to_string(),
+                    value: "\"c\"".to_string(),
+                },
+                Difference::ArrayElementAdded {
+                    path: "tags[0]".to_string(),
+                    value: "\"x\"".to_string(),
+                },
+                Difference::ArrayElementAdded {
+                    path: "tags[4]".to_string(),
+                    value: "\"y\"".to_string(),
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn test_keyed_array_ids_added_and_removed() {
+        let response1 = make_json_response(200, json!({"items": [{"id": 1}, {"id": 2}]}));
+        let response2 =
+            make_json_response(200, json!({"items": [{"id": 2}, {"id": 3}, {"id": 4}]}));
+
+        let differences =
+            compute_differences(&response1, &response2, false, None, &keyed_options());
+        assert_eq!(
+            differences,
+            vec![
+                Difference::ArrayLengthChanged {
+                    path: "items".to_string(),
+                    old_len: 2,
+                    new_len: 3,
+                },
+                Difference::ArrayElementRemoved {
+                    path: "items[id=1]".to_string(),
+                    value: "{\"id\":1}".to_string(),
+                },
+                Difference::ArrayElementAdded {
+                    path: "items[id=3]".to_string(),
+                    value: "{\"id\":3}".to_string(),
+                },
+                Difference::ArrayElementAdded {
+                    path: "items[id=4]".to_string(),
+                    value: "{\"id\":4}".to_string(),
+                },
+            ]
+        );
+
+        // Elements without the key, or sharing it, fall back to comparing whole elements
+        let response3 = make_json_response(200, json!({"items": [{"id": 2}, {"id": 2}]}));
+        let differences =
+            compute_differences(&response1, &response3, false, None, &keyed_options());
+        assert_eq!(
+            differences,
+            vec![
+                Difference::ArrayElementRemoved {
+                    path: "items[0]".to_string(),
+                    value: "{\"id\":1}".to_string(),
+                },
+                Difference::ArrayElementAdded {
+                    path: "items[1]".to_string(),
+                    value: "{\"id\":2}".to_string(),
+                }
+            ]
+        );
+    }
+
+    #[test]
+    fn test_truncate_on_character_boundaries() {
+        assert_eq!(truncate("hello", 10), "hello");
+        assert_eq!(truncate("hello", 5), "hello");
+        assert_eq!(truncate("hello world", 5), "hello...");
+        // Multibyte characters are counted as one and never cut
+        assert_eq!(truncate("héllo wörld", 7), "héllo w...");
+        assert_eq!(truncate("日本語のテキスト", 3), "日本語...");
+        assert_eq!(truncate("🎉🎉🎉", 2), "🎉🎉...");
+        // 0 keeps the whole text
+        assert_eq!(truncate("hello world", 0), "hello world");
+    }
+
+    #[test]
+    fn test_max_value_length() {
+        let token = |end: &str| format!("eyJhbGciOiJIUzI1NiJ9.{}.{}", "x".repeat(60), end);
+        let response1 = make_json_response(200, json!({"token": token("aaa")}));
+        let response2 = make_json_response(200, json!({"token": token("bbb")}));
+
+        // By default, long values are cut before the part that changed
+        let differences =
+            compute_differences(&response1, &response2, false, None, &DiffOptions::default());
+        let [
+            Difference::BodyValueChanged {
+                old_val, new_val, ..
+            },
+        ] = &differences[..]
+        else {
+            panic!("Expected BodyValueChanged difference");
+        };
+        assert_eq!(old_val, new_val);
+        assert!(old_val.ends_with("...\""));
+
+        // Wider values show it, and 0 shows them whole
+        for max_value_length in [100, 0] {
+            let options = DiffOptions {
+                max_value_length,
+                ..Default::default()
+            };
+            let differences = compute_differences(&response1, &response2, false, None, &options);
+            assert_eq!(
+                differences,
+                vec![Difference::BodyValueChanged {
+                    path: "token".to_string(),
+                    old_val: format!("\"{}\"", token("aaa")),
+                    new_val: format!("\"{}\"", token("bbb")),
+                }]
+            );
+        }
+
+        // Non-JSON bodies are shown up to twice the length, cut on character boundaries
+        let text_response = |raw: String| HttpResponseData {
+            status_code: 200,
+            headers: HashMap::new(),
+            body: ParsedBody { raw, json: None },
+            redirects: None,
+            body_size: None,
+        };
+        let options = DiffOptions {
+            max_value_length: 2,
+            ..Default::default()
+        };
+        let differences = compute_differences(
+            &text_response("ééééé".to_string()),
+            &text_response("ab".to_string()),
+            false,
+            None,
+            &options,
+        );
+        assert_eq!(
+            differences,
+            vec![Difference::DifferentBodyString {
+                before: "éééé...".to_string(),
+                after: "ab".to_string(),
+            }]
+        );
+    }
 }
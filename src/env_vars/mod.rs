@@ -0,0 +1,36 @@
+mod tests;
+
+use anyhow::{Context, Result, bail};
+use std::{cmp::max, env::VarError};
+
+/// Parse a number from the value of an env variable, as returned by `env::var`, or the default one when it isn't set.
+/// A value that isn't a valid number is an error rather than silently replaced by the default.
+pub fn env_number<T>(name: &str, value: Result<String, VarError>, default: T) -> Result<T>
+where
+    T: std::str::FromStr,
+    T::Err: std::error::Error + Send + Sync + 'static,
+{
+    match value {
+        Ok(value) => value
+            .trim()
+            .parse()
+            .with_context(|| format!("Invalid {} env variable '{}'", name, value)),
+        Err(VarError::NotPresent) => Ok(default),
+        Err(e) => Err(e).with_context(|| format!("Invalid {} env variable", name)),
+    }
+}
+
+/// The maximum number of concurrent requests per host, from REQUESTS_PER_HOST (default 30)
+pub fn requests_per_host(value: Result<String, VarError>) -> Result<usize> {
+    let requests_per_host = env_number("REQUESTS_PER_HOST", value, 30)?;
+    // No request could ever be sent without a permit
+    if requests_per_host == 0 {
+        bail!("Invalid REQUESTS_PER_HOST env variable: it must be at least 1");
+    }
+    Ok(requests_per_host)
+}
+
+/// The maximum number of retries of a failed request, from MAX_RETRIES (default 3, at least 1)
+pub fn max_retries(value: Result<String, VarError>) -> Result<u16> {
+    Ok(max(1, env_number("MAX_RETRIES", value, 3)?))
+}
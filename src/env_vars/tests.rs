@@ -0,0 +1,55 @@
+#[cfg(test)]
+mod tests {
+    use crate::env_vars::{env_number, max_retries, requests_per_host};
+    use std::env::VarError;
+
+    fn set(value: &str) -> Result<String, VarError> {
+        Ok(value.to_string())
+    }
+
+    #[test]
+    fn test_env_number() {
+        assert_eq!(
+            env_number::<u64>("DELAY_MS", set(" 250 "), 10).unwrap(),
+            250
+        );
+        assert_eq!(
+            env_number::<u64>("DELAY_MS", Err(VarError::NotPresent), 10).unwrap(),
+            10
+        );
+
+        let error = env_number::<u64>("DELAY_MS", set("fast"), 10).unwrap_err();
+        assert_eq!(error.to_string(), "Invalid DELAY_MS env variable 'fast'");
+        assert!(env_number::<u64>("DELAY_MS", set("-1"), 10).is_err());
+        assert!(env_number::<u64>("DELAY_MS", set(""), 10).is_err());
+    }
+
+    #[test]
+    fn test_requests_per_host() {
+        assert_eq!(requests_per_host(set("5")).unwrap(), 5);
+        assert_eq!(requests_per_host(Err(VarError::NotPresent)).unwrap(), 30);
+
+        // No request could be sent without a permit
+        let error = requests_per_host(set("0")).unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "Invalid REQUESTS_PER_HOST env variable: it must be at least 1"
+        );
+        let error = requests_per_host(set("many")).unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "Invalid REQUESTS_PER_HOST env variable 'many'"
+        );
+    }
+
+    #[test]
+    fn test_max_retries() {
+        assert_eq!(max_retries(set("7")).unwrap(), 7);
+        assert_eq!(max_retries(Err(VarError::NotPresent)).unwrap(), 3);
+        // A request is always attempted at least once
+        assert_eq!(max_retries(set("0")).unwrap(), 1);
+        assert!(max_retries(set("three")).is_err());
+        // The value must fit the type
+        assert!(max_retries(set("70000")).is_err());
+    }
+}
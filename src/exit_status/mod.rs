@@ -0,0 +1,79 @@
+mod tests;
+
+use std::{
+    process::ExitCode,
+    sync::atomic::{AtomicUsize, Ordering},
+};
+
+/// How a run ended, reported as the exit code of the process
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum ExitStatus {
+    /// No change was detected and every request was processed (exit code 0)
+    Clean,
+    /// At least one request has differences that fail the run (exit code 1)
+    Changed,
+    /// At least one request, or the run itself, failed (exit code 2)
+    Errored,
+}
+
+impl ExitStatus {
+    /// Status of a run from its counters.
+    /// Errors take precedence over changes: the changes of a run with errors are incomplete
+    pub fn of_run(changed_requests: usize, errors: usize, fail_on_change: bool) -> Self {
+        if errors > 0 {
+            ExitStatus::Errored
+        } else if changed_requests > 0 && fail_on_change {
+            ExitStatus::Changed
+        } else {
+            ExitStatus::Clean
+        }
+    }
+
+    pub fn code(self) -> u8 {
+        match self {
+            ExitStatus::Clean => 0,
+            ExitStatus::Changed => 1,
+            ExitStatus::Errored => 2,
+        }
+    }
+}
+
+impl From<ExitStatus> for ExitCode {
+    fn from(status: ExitStatus) -> Self {
+        ExitCode::from(status.code())
+    }
+}
+
+/// Counters of the requests of a run, shared by its flows. Their totals only depend on the outcome of each
+/// request, not on the order the flows complete in.
+#[derive(Debug, Default)]
+pub struct RunCounters {
+    requests: AtomicUsize,
+    changed: AtomicUsize,
+    warned: AtomicUsize,
+}
+
+impl RunCounters {
+    /// Count a request whose flow started
+    pub fn count_request(&self) {
+        self.requests.fetch_add(1, Ordering::SeqCst);
+    }
+
+    /// Count a request with differences, as changed when one of them fails the run, as warned otherwise
+    pub fn count_differences(&self, failing: bool) {
+        let counter = if failing { &self.changed } else { &self.warned };
+        counter.fetch_add(1, Ordering::SeqCst);
+    }
+
+    pub fn requests(&self) -> usize {
+        self.requests.load(Ordering::SeqCst)
+    }
+
+    pub fn changed(&self) -> usize {
+        self.changed.load(Ordering::SeqCst)
+    }
+
+    pub fn warned(&self) -> usize {
+        self.warned.load(Ordering::SeqCst)
+    }
+}
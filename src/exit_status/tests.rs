@@ -0,0 +1,49 @@
+#[cfg(test)]
+mod tests {
+    use crate::exit_status::{ExitStatus, RunCounters};
+    use std::{sync::Arc, time::Duration};
+    use tokio::task::JoinSet;
+
+    #[test]
+    fn test_exit_status_of_run() {
+        assert_eq!(ExitStatus::of_run(0, 0, true), ExitStatus::Clean);
+        assert_eq!(ExitStatus::of_run(3, 0, true), ExitStatus::Changed);
+        assert_eq!(ExitStatus::of_run(0, 1, true), ExitStatus::Errored);
+        // Errors take precedence over changes
+        assert_eq!(ExitStatus::of_run(3, 1, true), ExitStatus::Errored);
+
+        // Changes can be reported without failing the run, errors still do
+        assert_eq!(ExitStatus::of_run(3, 0, false), ExitStatus::Clean);
+        assert_eq!(ExitStatus::of_run(3, 1, false), ExitStatus::Errored);
+
+        assert_eq!(ExitStatus::Clean.code(), 0);
+        assert_eq!(ExitStatus::Changed.code(), 1);
+        assert_eq!(ExitStatus::Errored.code(), 2);
+    }
+
+    #[tokio::test]
+    async fn test_counters_are_stable() {
+        // Request `i` fails the run when `i % 3 == 0`, only warns when `i % 3 == 1`, and doesn't change otherwise
+        let run = || async {
+            let counters = Arc::new(RunCounters::default());
+            let mut flows = JoinSet::new();
+            for i in 0..60u64 {
+                let counters = counters.clone();
+                flows.spawn(async move {
+                    counters.count_request();
+                    // Flows complete in another order than they started in
+                    tokio::time::sleep(Duration::from_millis((i * 7) % 13)).await;
+                    if i % 3 != 2 {
+                        counters.count_differences(i % 3 == 0);
+                    }
+                });
+            }
+            while flows.join_next().await.is_some() {}
+            (counters.requests(), counters.changed(), counters.warned())
+        };
+
+        for _ in 0..3 {
+            assert_eq!(run().await, (60, 20, 20));
+        }
+    }
+}
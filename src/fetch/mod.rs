@@ -0,0 +1,1010 @@
+mod tests;
+
+use crate::config::RequestAuth;
+use crate::dates::parse_http_date;
+use crate::interrupt::{Interrupted, StopSignal};
+use crate::{BodySize, HttpResponseData, RedirectHop, RequestConfig, is_json};
+use anyhow::{Context, Result, bail};
+use log::debug;
+use reqwest::{Client, ClientBuilder, RequestBuilder, Url};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::{
+    collections::{HashMap, hash_map::RandomState},
+    fmt,
+    hash::{BuildHasher, DefaultHasher, Hash, Hasher},
+    io::Read,
+    path::Path,
+    sync::{Arc, Mutex},
+    time::{Duration, Instant, SystemTime, UNIX_EPOCH},
+};
+use tokio::sync::{OwnedSemaphorePermit, Semaphore, TryAcquireError};
+
+/// Delay between the attempts of a failing request, doubling after each attempt up to a cap, with jitter
+#[derive(Clone, Copy, Debug)]
+pub struct RetryBackoff {
+    pub initial: Duration,
+    pub max: Duration,
+}
+
+/// Maximum number of redirects followed when capturing them, same as the client's default policy
+const MAX_REDIRECTS: usize = 10;
+
+pub const DEFAULT_RETRY_BACKOFF: RetryBackoff = RetryBackoff {
+    initial: Duration::from_millis(50),
+    max: Duration::from_secs(2),
+};
+
+/// Longest wait honored from a `Retry-After` header, so that a server can't stall the run
+const MAX_RETRY_AFTER: Duration = Duration::from_secs(60);
+
+impl RetryBackoff {
+    /// The backoff to use for a request, with its own settings taking precedence over the global ones
+    pub fn for_request(&self, request: &RequestConfig) -> RetryBackoff {
+        RetryBackoff {
+            initial: request
+                .retry_backoff_ms
+                .map_or(self.initial, Duration::from_millis),
+            max: request
+                .max_retry_backoff_ms
+                .map_or(self.max, Duration::from_millis),
+        }
+    }
+
+    /// The delay to wait before the next attempt, after `attempt` attempts have failed
+    pub fn delay(&self, attempt: u32) -> Duration {
+        self.initial
+            .saturating_mul(2u32.saturating_pow(attempt.saturating_sub(1)))
+            .min(self.max)
+    }
+
+    /// The delay to actually wait before the next attempt: the one asked by the server in a `Retry-After`
+    /// header if any, otherwise a random delay between half and all of the exponential one.
+    /// The jitter keeps the requests failing together from being retried all at the same time
+    pub fn next_delay(&self, attempt: u32, retry_after: Option<Duration>) -> Duration {
+        if let Some(retry_after) = retry_after {
+            return retry_after.min(MAX_RETRY_AFTER);
+        }
+        let delay = self.delay(attempt);
+        // RandomState is seeded randomly by the standard library, which is enough for a jitter
+        let mut hasher = RandomState::new().build_hasher();
+        hasher.write_u32(attempt);
+        let fraction = hasher.finish() as f64 / u64::MAX as f64;
+        delay / 2 + (delay / 2).mul_f64(fraction)
+    }
+}
+
+/// Parse the value of a `Retry-After` header: either a number of seconds, or an HTTP date
+pub fn parse_retry_after(value: &str, now: SystemTime) -> Option<Duration> {
+    let value = value.trim();
+    if let Ok(secs) = value.parse::<u64>() {
+        return Some(Duration::from_secs(secs));
+    }
+    let at = parse_http_date(value)?;
+    let now = now.duration_since(UNIX_EPOCH).unwrap_or_default().as_secs() as i64;
+    // A date in the past allows retrying right away
+    Some(Duration::from_secs(at.saturating_sub(now).max(0) as u64))
+}
+
+/// Limits the number of requests in progress to each host at the same time, redirects included
+#[derive(Clone)]
+pub struct HostLimiter {
+    semaphores: Arc<Mutex<HashMap<String, Arc<Semaphore>>>>,
+    requests_per_host: usize,
+}
+
+impl HostLimiter {
+    pub fn new(requests_per_host: usize) -> HostLimiter {
+        HostLimiter {
+            semaphores: Arc::default(),
+            requests_per_host: requests_per_host.max(1),
+        }
+    }
+
+    /// Wait for a request to the host of the URL, the port included, to be allowed
+    async fn acquire(&self, url: &Url) -> Result<OwnedSemaphorePermit> {
+        let host = format!(
+            "{}:{}",
+            url.host_str().unwrap_or_default(),
+            url.port_or_known_default().unwrap_or_default()
+        );
+        let semaphore = {
+            let mut semaphores = self
+                .semaphores
+                .lock()
+                .map_err(|_| anyhow::anyhow!("Host limiter poisoned"))?;
+            semaphores
+                .entry(host)
+                .or_insert_with(|| Arc::new(Semaphore::new(self.requests_per_host)))
+                .clone()
+        };
+        semaphore
+            .acquire_owned()
+            .await
+            .context("Failed to acquire semaphore")
+    }
+}
+
+/// Limits the total size of the response bodies being read at the same time by concurrent requests.
+/// The memory of a body is reserved chunk by chunk while it's read, and released once it's stored in its response.
+#[derive(Clone)]
+pub struct BodyMemoryGovernor {
+    semaphore: Arc<Semaphore>,
+    max_bytes: usize,
+}
+
+impl BodyMemoryGovernor {
+    pub fn new(max_bytes: usize) -> BodyMemoryGovernor {
+        let max_bytes = max_bytes.clamp(1, Semaphore::MAX_PERMITS.min(u32::MAX as usize));
+        BodyMemoryGovernor {
+            semaphore: Arc::new(Semaphore::new(max_bytes)),
+            max_bytes,
+        }
+    }
+
+    /// Grow the reservation by the given amount of body bytes, waiting until other requests release theirs.
+    /// A reservation never exceeds the whole budget, so a single huge body can't wait forever.
+    /// When the memory isn't available right away, the reservation is given back while waiting for
+    /// the whole of it, so that two requests growing theirs never wait on each other.
+    async fn grow(
+        &self,
+        reservation: &mut Option<OwnedSemaphorePermit>,
+        bytes: usize,
+    ) -> Result<()> {
+        let held = reservation.as_ref().map_or(0, |r| r.num_permits());
+        let wanted = held.saturating_add(bytes).min(self.max_bytes);
+        if wanted <= held {
+            return Ok(());
+        }
+
+        match self
+            .semaphore
+            .clone()
+            .try_acquire_many_owned((wanted - held) as u32)
+        {
+            Ok(extra) => match reservation.as_mut() {
+                Some(r) => r.merge(extra),
+                None => *reservation = Some(extra),
+            },
+            Err(TryAcquireError::NoPermits) => {
+                *reservation = None;
+                *reservation = Some(
+                    self.semaphore
+                        .clone()
+                        .acquire_many_owned(wanted as u32)
+                        .await
+                        .context("Failed to reserve memory for response body")?,
+                );
+            }
+            Err(TryAcquireError::Closed) => bail!("Failed to reserve memory for response body"),
+        }
+        Ok(())
+    }
+}
+
+/// Limits a response must stay within, guarding against hostile or broken endpoints
+#[derive(Clone, Copy, Debug, Default)]
+pub struct ResponseLimits {
+    /// Maximum size of the body, checked while it's read. A larger body is cut at the limit.
+    pub max_body_bytes: Option<usize>,
+    /// Maximum nesting depth of a JSON body, checked before it's parsed
+    pub max_json_depth: Option<usize>,
+}
+
+/// A response that exceeded one of the limits, which is never retried
+#[derive(Debug)]
+pub struct LimitExceeded(String);
+
+impl fmt::Display for LimitExceeded {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(&self.0)
+    }
+}
+
+impl std::error::Error for LimitExceeded {}
+
+/// Decompress a body from the encodings listed by its Content-Encoding, `gzip` and `deflate` being supported.
+/// Bodies with another encoding are kept as they are. The decompressed body is cut at `max_bytes` too,
+/// so that a small compressed body can't blow up in memory, and is returned along with whether it was cut.
+fn decompress_body(
+    bytes: Vec<u8>,
+    headers: &HashMap<String, Vec<String>>,
+    max_bytes: Option<usize>,
+    url: &str,
+) -> Result<(Vec<u8>, bool)> {
+    let encodings: Vec<String> = headers
+        .get("content-encoding")
+        .into_iter()
+        .flatten()
+        .flat_map(|value| value.split(','))
+        .map(|encoding| encoding.trim().to_ascii_lowercase())
+        .filter(|encoding| !encoding.is_empty() && encoding != "identity")
+        .collect();
+
+    let mut bytes = bytes;
+    // The encodings are listed in the order they were applied
+    for encoding in encodings.iter().rev() {
+        let limit = max_bytes.map_or(u64::MAX, |max| max as u64 + 1);
+        let mut decompressed = Vec::new();
+        let read = match encoding.as_str() {
+            "gzip" | "x-gzip" => flate2::read::MultiGzDecoder::new(bytes.as_slice())
+                .take(limit)
+                .read_to_end(&mut decompressed),
+            // Deflate is meant to be zlib-wrapped, but some servers send it raw
+            "deflate" if is_zlib(&bytes) => flate2::read::ZlibDecoder::new(bytes.as_slice())
+                .take(limit)
+                .read_to_end(&mut decompressed),
+            "deflate" => flate2::read::DeflateDecoder::new(bytes.as_slice())
+                .take(limit)
+                .read_to_end(&mut decompressed),
+            _ => {
+                debug!("Unsupported content encoding '{}' from {}", encoding, url);
+                return Ok((bytes, false));
+            }
+        };
+        read.with_context(|| format!("Failed to decompress {} body from {}", encoding, url))?;
+        if let Some(max) = max_bytes.filter(|&max| decompressed.len() > max) {
+            decompressed.truncate(max);
+            return Ok((decompressed, true));
+        }
+        bytes = decompressed;
+    }
+
+    Ok((bytes, false))
+}
+
+/// Whether the bytes start with a zlib header: the deflate method, and a checksum of the two header bytes
+fn is_zlib(bytes: &[u8]) -> bool {
+    match bytes {
+        [cmf, flg, ..] => cmf & 0x0f == 8 && (u16::from(*cmf) << 8 | u16::from(*flg)) % 31 == 0,
+        _ => false,
+    }
+}
+
+/// Decode a body into UTF-8 from the charset announced by its Content-Type, e.g. `text/html; charset=ISO-8859-1`.
+/// Bodies without a charset, or with an unknown one, are decoded as UTF-8, invalid sequences being replaced.
+fn decode_body(bytes: &[u8], headers: &HashMap<String, Vec<String>>) -> String {
+    let encoding = headers
+        .get("content-type")
+        .into_iter()
+        .flatten()
+        .flat_map(|content_type| content_type.split(';').skip(1))
+        .find_map(|param| {
+            let (name, value) = param.split_once('=')?;
+            name.trim()
+                .eq_ignore_ascii_case("charset")
+                .then(|| value.trim().trim_matches('"'))
+        })
+        .and_then(|charset| encoding_rs::Encoding::for_label(charset.as_bytes()))
+        .unwrap_or(encoding_rs::UTF_8);
+
+    let (text, _, _) = encoding.decode(bytes);
+    text.into_owned()
+}
+
+/// Whether the JSON text nests arrays and objects deeper than `max_depth`.
+/// Only brackets are counted, so it's linear and allocation free whatever the input.
+fn json_depth_exceeds(json: &str, max_depth: usize) -> bool {
+    let mut depth = 0usize;
+    let mut in_string = false;
+    let mut escaped = false;
+
+    for byte in json.bytes() {
+        if in_string {
+            match byte {
+                _ if escaped => escaped = false,
+                b'\\' => escaped = true,
+                b'"' => in_string = false,
+                _ => {}
+            }
+            continue;
+        }
+
+        match byte {
+            b'"' => in_string = true,
+            b'[' | b'{' => {
+                depth += 1;
+                if depth > max_depth {
+                    return true;
+                }
+            }
+            b']' | b'}' => depth = depth.saturating_sub(1),
+            _ => {}
+        }
+    }
+
+    false
+}
+
+/// How long the phases of a request took, in milliseconds.
+/// The HTTP client doesn't expose DNS, connect and TLS handshake durations, so they are part of
+/// the time to first byte of the request they were needed for.
+#[derive(Serialize, Deserialize, Debug, Default, Clone, Copy, PartialEq)]
+pub struct ResponseTimings {
+    /// From sending the request that got the final response, after any redirect, to its first byte
+    pub time_to_first_byte_ms: u64,
+    pub download_ms: u64,
+    /// Spent on the redirects followed before the final response, 0 for the timings saved before it was measured
+    #[serde(default)]
+    pub redirects_ms: u64,
+}
+
+impl ResponseTimings {
+    /// The time from sending the request to receiving the last byte of the response, redirects included
+    pub fn latency_ms(&self) -> u64 {
+        self.redirects_ms + self.time_to_first_byte_ms + self.download_ms
+    }
+}
+
+/// A response along with how long it took to receive it
+pub struct FetchedResponse {
+    pub data: HttpResponseData,
+    pub timings: ResponseTimings,
+    /// The `Set-Cookie` headers of each response received, the redirects followed included,
+    /// along with the URL that set them
+    pub set_cookies: Vec<(Url, Vec<String>)>,
+}
+
+impl FetchedResponse {
+    pub fn new(data: HttpResponseData, timings: ResponseTimings) -> FetchedResponse {
+        FetchedResponse {
+            data,
+            timings,
+            set_cookies: Vec::new(),
+        }
+    }
+}
+
+async fn fetch_response(
+    request: &RequestConfig,
+    client: &Client,
+    host_limiter: &HostLimiter,
+    body_memory: Option<&BodyMemoryGovernor>,
+    limits: ResponseLimits,
+    follow_redirects: bool,
+    capture_redirects: bool,
+) -> Result<FetchedResponse> {
+    let url = &request.url;
+    let mut method = request.method();
+    let encoded_body = encode_body(request)?;
+    let header_map = request_headers(request, encoded_body.as_ref());
+    let mut body = encoded_body.map(|body| body.content);
+    let origin = Url::parse(url).with_context(|| format!("Invalid URL {}", url))?;
+    let mut next_url = origin.clone();
+    let mut redirects = capture_redirects.then(Vec::new);
+    let mut set_cookies = Vec::new();
+    let mut hops = 0;
+    let mut permit = None;
+    let mut hop_start;
+    let mut redirects_time = Duration::ZERO;
+
+    let response = loop {
+        // Each hop waits for its own host, the permit of the previous hop being released first
+        drop(permit.take());
+        debug!("Acquiring semaphore for request to {}...", next_url);
+        permit = Some(host_limiter.acquire(&next_url).await?);
+        debug!(
+            "Semaphore for request to {} acquired! Sending request...",
+            next_url
+        );
+        hop_start = Instant::now();
+
+        let mut request_builder = client.request(method.clone(), next_url.clone());
+        // The credentials are only sent to the origin of the request, never to another one it redirects to
+        if next_url.origin() == origin.origin() {
+            request_builder = request_builder.headers(header_map.clone());
+            request_builder = with_auth(request_builder, request.auth.as_ref());
+        } else {
+            request_builder = request_builder.headers(without_credentials(&header_map));
+        }
+        if let Some(body) = &body {
+            request_builder = request_builder.body(body.clone());
+        }
+        if let Some(timeout_ms) = request.timeout_ms {
+            request_builder = request_builder.timeout(Duration::from_millis(timeout_ms));
+        }
+        let response = request_builder
+            .send()
+            .await
+            .with_context(|| format!("Failed to send request to {}", next_url))?;
+        let hop_cookies: Vec<String> = response
+            .headers()
+            .get_all(reqwest::header::SET_COOKIE)
+            .iter()
+            .filter_map(|value| value.to_str().ok())
+            .map(str::to_string)
+            .collect();
+        if !hop_cookies.is_empty() {
+            set_cookies.push((next_url.clone(), hop_cookies));
+        }
+
+        // The client never follows redirects by itself, so that a request can stop at the redirect
+        if !follow_redirects {
+            break response;
+        }
+        let location = response
+            .headers()
+            .get(reqwest::header::LOCATION)
+            .and_then(|l| l.to_str().ok())
+            .map(str::to_string);
+        let Some(location) = location.filter(|_| response.status().is_redirection()) else {
+            break response;
+        };
+
+        if hops >= MAX_REDIRECTS {
+            bail!("Too many redirects for request to {}", url);
+        }
+        hops += 1;
+        redirects_time += hop_start.elapsed();
+        let status_code = response.status().as_u16();
+        next_url = response
+            .url()
+            .join(&location)
+            .with_context(|| format!("Invalid redirect location {} from {}", location, next_url))?;
+        if let Some(chain) = redirects.as_mut() {
+            chain.push(RedirectHop {
+                status_code,
+                location,
+            });
+        }
+
+        // Like browsers, only 307 and 308 keep the method and the body of the request
+        if !matches!(status_code, 307 | 308) && method != reqwest::Method::HEAD {
+            method = reqwest::Method::GET;
+            body = None;
+        }
+    };
+    let time_to_first_byte = hop_start.elapsed();
+
+    let status = response.status().as_u16();
+    let mut resp_headers: HashMap<String, Vec<String>> = HashMap::new();
+    for (k, v) in response.headers().iter() {
+        resp_headers
+            .entry(k.to_string())
+            .or_default()
+            .push(v.to_str().unwrap_or_default().to_string());
+    }
+
+    // The limit of the request takes precedence over the one of the run
+    let limits = ResponseLimits {
+        max_body_bytes: request.max_body_bytes.or(limits.max_body_bytes),
+        ..limits
+    };
+
+    // HEAD responses have no body, while their Content-Length describes the body a GET would return
+    let has_body = request.method() != reqwest::Method::HEAD;
+
+    // The announced length is the one of the body as transferred, before any content decoding
+    let announced_length: Option<u64> = response
+        .headers()
+        .get(reqwest::header::CONTENT_LENGTH)
+        .and_then(|len| len.to_str().ok())
+        .and_then(|len| len.parse().ok());
+
+    let mut reservation = None;
+    let download_start = Instant::now();
+    let mut wire_length = 0;
+    let mut truncated = false;
+    // The body is read chunk by chunk, to stop as soon as it goes over the limit
+    let text = if has_body {
+        let mut response = response;
+        let mut bytes = Vec::new();
+        while let Some(chunk) = response
+            .chunk()
+            .await
+            .with_context(|| format!("Failed to read response body from {}", url))?
+        {
+            // The rest of the body is never read, its connection being dropped
+            let kept = match limits.max_body_bytes {
+                Some(max) if bytes.len() + chunk.len() > max => {
+                    truncated = true;
+                    &chunk[..max - bytes.len()]
+                }
+                _ => &chunk[..],
+            };
+            // Wait for enough memory to be available before keeping the chunk
+            if let Some(governor) = body_memory {
+                governor.grow(&mut reservation, kept.len()).await?;
+            }
+            bytes.extend_from_slice(kept);
+            if truncated {
+                break;
+            }
+        }
+        wire_length = bytes.len() as u64;
+        // A compressed body cut short can't be decompressed, it's kept as received
+        let bytes = if truncated {
+            bytes
+        } else {
+            let (bytes, cut) = decompress_body(bytes, &resp_headers, limits.max_body_bytes, url)?;
+            truncated = cut;
+            bytes
+        };
+        decode_body(&bytes, &resp_headers)
+    } else {
+        String::new()
+    };
+    if truncated {
+        debug!(
+            "Response body from {} is more than the limit of {} bytes, it was truncated",
+            url,
+            limits.max_body_bytes.unwrap_or_default()
+        );
+    }
+    let download = download_start.elapsed();
+
+    // A decompressed body can be larger than the one read
+    if let Some(governor) = body_memory {
+        let reserved = reservation.as_ref().map_or(0, |r| r.num_permits());
+        governor
+            .grow(&mut reservation, text.len().saturating_sub(reserved))
+            .await?;
+    }
+
+    if let Some(max_depth) = limits.max_json_depth.filter(|_| !truncated) {
+        if is_json(&resp_headers) && json_depth_exceeds(&text, max_depth) {
+            return Err(LimitExceeded(format!(
+                "JSON body from {} is nested deeper than the limit of {} levels",
+                url, max_depth
+            ))
+            .into());
+        }
+    }
+
+    // The body is stored in the response from here on, so its memory is released for the next ones
+    drop(reservation);
+
+    let mut data = HttpResponseData {
+        redirects,
+        body_size: has_body.then(|| BodySize {
+            wire_bytes: announced_length.unwrap_or(wire_length),
+            decoded_bytes: text.len() as u64,
+            truncated,
+        }),
+        ..HttpResponseData::new(status, resp_headers, text)
+    };
+    // A truncated JSON body isn't valid anymore, even when what's left happens to parse
+    if truncated {
+        data.body.json = None;
+    }
+
+    Ok(FetchedResponse {
+        data,
+        timings: ResponseTimings {
+            time_to_first_byte_ms: time_to_first_byte.as_millis() as u64,
+            download_ms: download.as_millis() as u64,
+            redirects_ms: redirects_time.as_millis() as u64,
+        },
+        set_cookies,
+    })
+}
+
+/// Load the certificates of a PEM bundle, trusted in addition to the system ones, e.g. a staging CA
+pub fn load_ca_bundle(path: &Path) -> Result<Vec<reqwest::Certificate>> {
+    let pem = std::fs::read(path)
+        .with_context(|| format!("Failed to read CA bundle {}", path.display()))?;
+    let certificates = reqwest::Certificate::from_pem_bundle(&pem)
+        .with_context(|| format!("Failed to parse CA bundle {}", path.display()))?;
+    if certificates.is_empty() {
+        bail!("No certificate found in CA bundle {}", path.display());
+    }
+    Ok(certificates)
+}
+
+/// Route all the requests of the client through the proxy, instead of the ones of the environment
+pub fn with_proxy(builder: ClientBuilder, proxy: Option<&Url>) -> Result<ClientBuilder> {
+    let Some(proxy) = proxy else {
+        return Ok(builder);
+    };
+    let proxy = reqwest::Proxy::all(proxy.clone())
+        .with_context(|| format!("Invalid proxy URL {}", proxy))?;
+    Ok(builder.proxy(proxy))
+}
+
+/// The headers of the request, with the `Content-Type` of its encoded body unless it sets one
+fn request_headers(
+    request: &RequestConfig,
+    encoded_body: Option<&EncodedBody>,
+) -> reqwest::header::HeaderMap {
+    let mut header_map = reqwest::header::HeaderMap::new();
+    for (k, vs) in &request.headers {
+        if let Ok(header_name) = k.parse::<reqwest::header::HeaderName>() {
+            for v in vs {
+                if let Ok(header_value) = v.parse() {
+                    header_map.append(header_name.clone(), header_value);
+                } else {
+                    eprintln!("Could not parse header value for {}:{}", k, v);
+                }
+            }
+        } else {
+            eprintln!("Could not parse header name: {}", k);
+        }
+    }
+
+    if let Some(content_type) = encoded_body.and_then(|b| b.content_type.as_ref()) {
+        // A Content-Type set in the headers of the request takes precedence
+        if !header_map.contains_key(reqwest::header::CONTENT_TYPE) {
+            match content_type.parse() {
+                Ok(value) => {
+                    header_map.insert(reqwest::header::CONTENT_TYPE, value);
+                }
+                Err(_) => eprintln!("Could not parse content type {}", content_type),
+            }
+        }
+    }
+    header_map
+}
+
+/// A copy of the headers without the ones carrying credentials, for a redirect to another origin
+fn without_credentials(header_map: &reqwest::header::HeaderMap) -> reqwest::header::HeaderMap {
+    let mut header_map = header_map.clone();
+    for name in [
+        reqwest::header::AUTHORIZATION,
+        reqwest::header::COOKIE,
+        reqwest::header::PROXY_AUTHORIZATION,
+    ] {
+        header_map.remove(name);
+    }
+    header_map
+}
+
+/// The first request sent for the step, built as `fetch_with_retries` does but without sending it, for --dry-run.
+/// The headers added by the client when sending, such as the User-Agent, aren't part of it.
+pub fn build_request(request: &RequestConfig, client: &Client) -> Result<reqwest::Request> {
+    let encoded_body = encode_body(request)?;
+    let url = Url::parse(&request.url).with_context(|| format!("Invalid URL {}", request.url))?;
+    let mut request_builder = client
+        .request(request.method(), url)
+        .headers(request_headers(request, encoded_body.as_ref()));
+    request_builder = with_auth(request_builder, request.auth.as_ref());
+    if let Some(body) = encoded_body {
+        request_builder = request_builder.body(body.content);
+    }
+    request_builder
+        .build()
+        .with_context(|| format!("Failed to build request to {}", request.url))
+}
+
+/// A request as printed by --dry-run: its method and URL, its headers sorted by name, then its body.
+/// Sensitive header values, such as the credentials set from `auth`, are masked.
+pub fn format_request(request: &reqwest::Request) -> String {
+    let mut text = format!("{} {}\n", request.method(), request.url());
+    let mut headers: Vec<_> = request.headers().iter().collect();
+    headers.sort_by_key(|(name, _)| name.as_str());
+    for (name, value) in headers {
+        let value = if value.is_sensitive() {
+            "***"
+        } else {
+            value.to_str().unwrap_or("<non-ASCII value>")
+        };
+        text.push_str(&format!("{}: {}\n", name, value));
+    }
+    if let Some(body) = request.body().and_then(|body| body.as_bytes()) {
+        text.push_str(&format!("\n{}\n", String::from_utf8_lossy(body)));
+    }
+    text
+}
+
+/// Set the `Authorization` header of the request from its credentials, if any
+fn with_auth(builder: RequestBuilder, auth: Option<&RequestAuth>) -> RequestBuilder {
+    match auth {
+        Some(RequestAuth::Bearer { token }) => builder.bearer_auth(token),
+        Some(RequestAuth::Basic { username, password }) => {
+            builder.basic_auth(username, Some(password))
+        }
+        None => builder,
+    }
+}
+
+pub const FORM_URLENCODED: &str = "application/x-www-form-urlencoded";
+pub const MULTIPART_FORM_DATA: &str = "multipart/form-data";
+
+/// The body of a request as sent, with the `Content-Type` it needs, if any
+#[derive(Debug, PartialEq)]
+pub struct EncodedBody {
+    pub content: String,
+    pub content_type: Option<String>,
+}
+
+/// Encode the body of the request after its `content_type`: a JSON object of fields as a form for
+/// `application/x-www-form-urlencoded` or `multipart/form-data`, as JSON for any other type.
+/// Fields holding an array are repeated for each of its values.
+pub fn encode_body(request: &RequestConfig) -> Result<Option<EncodedBody>> {
+    if request.body.is_null() {
+        return Ok(None);
+    }
+    let Some(content_type) = &request.content_type else {
+        return Ok(Some(EncodedBody {
+            content: request.body.to_string(),
+            content_type: None,
+        }));
+    };
+
+    let mime_type = content_type.split(';').next().unwrap_or_default().trim();
+    let encoded = if mime_type.eq_ignore_ascii_case(FORM_URLENCODED) {
+        let mut serializer = form_urlencoded::Serializer::new(String::new());
+        for (name, value) in form_fields(&request.body)? {
+            serializer.append_pair(name, &value);
+        }
+        EncodedBody {
+            content: serializer.finish(),
+            content_type: Some(content_type.clone()),
+        }
+    } else if mime_type.eq_ignore_ascii_case(MULTIPART_FORM_DATA) {
+        let fields = form_fields(&request.body)?;
+        // The boundary only depends on the fields, so that the HAR records the body as it was sent
+        let mut hasher = DefaultHasher::new();
+        fields.hash(&mut hasher);
+        let boundary = format!("release-sanity-checker-{:016x}", hasher.finish());
+
+        let mut content = String::new();
+        for (name, value) in fields {
+            content.push_str(&format!(
+                "--{}\r\nContent-Disposition: form-data; name=\"{}\"\r\n\r\n{}\r\n",
+                boundary,
+                name.replace('"', "%22"),
+                value
+            ));
+        }
+        content.push_str(&format!("--{}--\r\n", boundary));
+        EncodedBody {
+            content,
+            content_type: Some(format!("{}; boundary={}", MULTIPART_FORM_DATA, boundary)),
+        }
+    } else {
+        EncodedBody {
+            content: request.body.to_string(),
+            content_type: Some(content_type.clone()),
+        }
+    };
+
+    Ok(Some(encoded))
+}
+
+/// The fields of a form given as a JSON object, strings taken unquoted and arrays giving a field per value
+fn form_fields(body: &Value) -> Result<Vec<(&str, String)>> {
+    let Value::Object(object) = body else {
+        bail!(
+            "A form body must be a JSON object of fields, found {}",
+            body
+        );
+    };
+
+    let mut fields = Vec::with_capacity(object.len());
+    for (name, value) in object {
+        let values = match value {
+            Value::Array(values) => values.iter().collect(),
+            value => vec![value],
+        };
+        for value in values {
+            let value = match value {
+                Value::String(s) => s.clone(),
+                Value::Null => String::new(),
+                Value::Number(_) | Value::Bool(_) => value.to_string(),
+                Value::Array(_) | Value::Object(_) => {
+                    bail!(
+                        "Form field '{}' must hold a scalar value, found {}",
+                        name,
+                        value
+                    )
+                }
+            };
+            fields.push((name.as_str(), value));
+        }
+    }
+
+    Ok(fields)
+}
+
+/// Why an attempt to fetch a response failed
+#[derive(Serialize, Debug, Clone, Copy, PartialEq)]
+#[serde(rename_all = "snake_case")]
+pub enum FailureCategory {
+    /// The connection to the server couldn't be established, so the request was never sent
+    Connect,
+    /// The request was sent, but the response couldn't be received
+    Send,
+    /// The response started, but its body couldn't be read in full
+    BodyRead,
+    /// The server answered with a 5xx status code
+    ServerError,
+    /// The server answered with a 429 status code
+    RateLimited,
+    /// The server answered with another status code configured to be retried, e.g. 408
+    RetryableStatus,
+    /// The server answered with a status code configured to fail the request at once
+    FailureStatus,
+    /// The response exceeded one of the limits
+    LimitExceeded,
+    /// The run was interrupted before the response was received
+    Interrupted,
+}
+
+impl fmt::Display for FailureCategory {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            FailureCategory::Connect => "connection error",
+            FailureCategory::Send => "request error",
+            FailureCategory::BodyRead => "body read error",
+            FailureCategory::ServerError => "server error",
+            FailureCategory::RateLimited => "rate limited",
+            FailureCategory::RetryableStatus => "retryable status code",
+            FailureCategory::FailureStatus => "failure status code",
+            FailureCategory::LimitExceeded => "response limit exceeded",
+            FailureCategory::Interrupted => "interrupted",
+        })
+    }
+}
+
+impl FailureCategory {
+    fn of_status(status: u16, fails: bool) -> FailureCategory {
+        match status {
+            _ if fails => FailureCategory::FailureStatus,
+            429 => FailureCategory::RateLimited,
+            500.. => FailureCategory::ServerError,
+            _ => FailureCategory::RetryableStatus,
+        }
+    }
+
+    fn of(error: &anyhow::Error) -> FailureCategory {
+        if error.downcast_ref::<LimitExceeded>().is_some() {
+            return FailureCategory::LimitExceeded;
+        }
+        match error.downcast_ref::<reqwest::Error>() {
+            Some(e) if e.is_connect() => FailureCategory::Connect,
+            Some(e) if e.is_body() || e.is_decode() => FailureCategory::BodyRead,
+            _ => FailureCategory::Send,
+        }
+    }
+
+    /// Whether another attempt can be made. Requests that never reached the server are always retried,
+    /// while the others are only retried when they are idempotent, as the server may have processed them.
+    /// A rate limited request wasn't processed either. The responses with a status code that is neither
+    /// configured to be retried nor to fail aren't failures, and are never retried.
+    fn is_retryable(self, idempotent: bool) -> bool {
+        match self {
+            FailureCategory::Connect | FailureCategory::RateLimited => true,
+            FailureCategory::Send
+            | FailureCategory::BodyRead
+            | FailureCategory::ServerError
+            | FailureCategory::RetryableStatus => idempotent,
+            FailureCategory::LimitExceeded
+            | FailureCategory::FailureStatus
+            | FailureCategory::Interrupted => false,
+        }
+    }
+}
+
+/// A request that couldn't get a usable response, after all the attempts allowed
+#[derive(Debug)]
+pub struct FetchError {
+    pub url: String,
+    pub attempts: u16,
+    /// The status code of the last response received, if any
+    pub last_status: Option<u16>,
+    /// Why the last attempt failed
+    pub category: FailureCategory,
+    last_error: Option<anyhow::Error>,
+}
+
+impl fmt::Display for FetchError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "Failed to get response from '{}' after {} attempts ({}",
+            self.url, self.attempts, self.category
+        )?;
+        if let Some(status) = self.last_status {
+            write!(f, ", last status code: {}", status)?;
+        }
+        write!(f, ")")
+    }
+}
+
+impl std::error::Error for FetchError {
+    fn source(&self) -> Option<&(dyn std::error::Error + 'static)> {
+        self.last_error
+            .as_ref()
+            .map(|e| &**e as &(dyn std::error::Error + 'static))
+    }
+}
+
+/// Send the request, retrying on errors and server failures up to `max_retries` attempts.
+/// Connection failures and rate limiting are always retried, as the server didn't process the request.
+/// Other failures after the request was sent are only retried when it's idempotent.
+/// When `stop` is signaled, the attempt in progress or the wait before the next one is dropped.
+#[allow(clippy::too_many_arguments)]
+pub async fn fetch_with_retries(
+    request: &RequestConfig,
+    client: &Client,
+    host_limiter: &HostLimiter,
+    body_memory: Option<&BodyMemoryGovernor>,
+    limits: ResponseLimits,
+    stop: &StopSignal,
+    max_retries: u16,
+    backoff: RetryBackoff,
+    follow_redirects: bool,
+    capture_redirects: bool,
+) -> Result<FetchedResponse, FetchError> {
+    let backoff = backoff.for_request(request);
+    let follow_redirects = request.follow_redirects.unwrap_or(follow_redirects);
+    let idempotent = request.is_idempotent();
+    let mut attempt: u16 = 0;
+    let interrupted = |attempts| FetchError {
+        url: request.url.clone(),
+        attempts,
+        last_status: None,
+        category: FailureCategory::Interrupted,
+        last_error: Some(Interrupted.into()),
+    };
+
+    loop {
+        attempt += 1;
+
+        // An interruption drops the request in progress, whatever its state
+        let fetched = stop
+            .unless_stopped(fetch_response(
+                request,
+                client,
+                host_limiter,
+                body_memory,
+                limits,
+                follow_redirects,
+                capture_redirects,
+            ))
+            .await
+            .map_err(|_| interrupted(attempt))?;
+        let (failure, last_status, last_error, retry_after) = match fetched {
+            Ok(res)
+                if request.fails_on_status(res.data.status_code)
+                    || request.retries_on_status(res.data.status_code) =>
+            {
+                let status = res.data.status_code;
+                debug!(
+                    "Request to url {} has errors (status code: {})",
+                    request.url, status
+                );
+                // Only rate limiting and unavailability say when the server will be ready again
+                let retry_after = match status {
+                    429 | 503 => res
+                        .data
+                        .headers
+                        .get("retry-after")
+                        .and_then(|values| values.first())
+                        .and_then(|value| parse_retry_after(value, SystemTime::now())),
+                    _ => None,
+                };
+                (
+                    FailureCategory::of_status(status, request.fails_on_status(status)),
+                    Some(status),
+                    None,
+                    retry_after,
+                )
+            }
+            Ok(res) => return Ok(res),
+            Err(e) => {
+                debug!("Error fetching response: {:#}", e);
+                (FailureCategory::of(&e), None, Some(e), None)
+            }
+        };
+
+        if attempt >= max_retries || !failure.is_retryable(idempotent) {
+            return Err(FetchError {
+                url: request.url.clone(),
+                attempts: attempt,
+                last_status,
+                category: failure,
+                last_error,
+            });
+        }
+
+        let delay = backoff.next_delay(u32::from(attempt), retry_after);
+        debug!(
+            "Retrying request to {} in {:?} ({:?})",
+            request.url, delay, failure
+        );
+        stop.unless_stopped(tokio::time::sleep(delay))
+            .await
+            .map_err(|_| interrupted(attempt))?;
+    }
+}
@@ -0,0 +1,1195 @@
+#[cfg(test)]
+mod tests {
+    use crate::diff_finder::{DiffOptions, Difference, compute_differences};
+    use crate::fetch::{
+        BodyMemoryGovernor, FailureCategory, FetchError, FetchedResponse, HostLimiter,
+        LimitExceeded, ResponseLimits, RetryBackoff, build_request, decode_body, decompress_body,
+        encode_body, fetch_with_retries, format_request, json_depth_exceeds, load_ca_bundle,
+        parse_retry_after, with_auth, with_proxy,
+    };
+    use crate::interrupt::{StopSignal, is_interrupted};
+    use crate::test_server::{self, Reply, TestServer};
+    use crate::{BodySize, RequestConfig};
+    use flate2::{
+        Compression,
+        write::{DeflateEncoder, GzEncoder, ZlibEncoder},
+    };
+    use reqwest::Client;
+    use serde_json::json;
+    use std::io::Write;
+    use std::{
+        collections::HashMap,
+        net::SocketAddr,
+        sync::atomic::{AtomicUsize, Ordering},
+        time::{Duration, SystemTime, UNIX_EPOCH},
+    };
+    use tokio::net::TcpListener;
+
+    const NO_BACKOFF: RetryBackoff = RetryBackoff {
+        initial: Duration::ZERO,
+        max: Duration::ZERO,
+    };
+
+    /// Serve the same raw HTTP response to every request
+    async fn serve(raw_response: &'static str) -> TestServer {
+        test_server::serve(move |_| Reply::raw(raw_response)).await
+    }
+
+    fn request(url: String, body: serde_json::Value) -> RequestConfig {
+        serde_json::from_value(json!({ "url": url, "body": body })).unwrap()
+    }
+
+    async fn fetch(request: &RequestConfig) -> Result<FetchedResponse, FetchError> {
+        fetch_with_retries(
+            request,
+            &Client::new(),
+            &HostLimiter::new(1),
+            None,
+            ResponseLimits::default(),
+            &StopSignal::never(),
+            3,
+            NO_BACKOFF,
+            true,
+            false,
+        )
+        .await
+    }
+
+    #[test]
+    fn test_retry_policy() {
+        assert!(FailureCategory::Connect.is_retryable(true));
+        assert!(FailureCategory::Connect.is_retryable(false));
+        assert!(FailureCategory::RateLimited.is_retryable(false));
+
+        for failure in [
+            FailureCategory::Send,
+            FailureCategory::BodyRead,
+            FailureCategory::ServerError,
+        ] {
+            assert!(failure.is_retryable(true), "{:?}", failure);
+            assert!(!failure.is_retryable(false), "{:?}", failure);
+        }
+    }
+
+    /// A self-signed certificate, for a staging CA
+    const TEST_CA: &str = "\
+-----BEGIN CERTIFICATE-----
+MIIBqDCCAU+gAwIBAgIUZU9d/+KbkW7cAWC+30zLuE6LR6QwCgYIKoZIzj0EAwIw
+KTEnMCUGA1UEAwwecmVsZWFzZS1zYW5pdHktY2hlY2tlciB0ZXN0IENBMCAXDTI2
+MTAxNjE4MzAyN1oYDzIxMjYwOTIyMTgzMDI3WjApMScwJQYDVQQDDB5yZWxlYXNl
+LXNhbml0eS1jaGVja2VyIHRlc3QgQ0EwWTATBgcqhkjOPQIBBggqhkjOPQMBBwNC
+AAT7DPA3J3ikGtVvN37nYE4Uv6XVo8TM1sdWgjEzZ8WAzR3dtdJQEzy5S7h8itTI
+vg9UtsRFFdlfRWomiRO5mqr0o1MwUTAdBgNVHQ4EFgQUFdKIRya/gSBw5jnnkp5x
+yc5jyi8wHwYDVR0jBBgwFoAUFdKIRya/gSBw5jnnkp5xyc5jyi8wDwYDVR0TAQH/
+BAUwAwEB/zAKBggqhkjOPQQDAgNHADBEAiAigW1cgW2n05hf2WzU/WmBAOfNbRfN
+XGv9Isfd9riJ/gIgR5dUVO0A7VarERpzs8XNYUZPFhxiA6gOnLw31FF8mVo=
+-----END CERTIFICATE-----
+";
+
+    #[test]
+    fn test_load_ca_bundle() {
+        let path = std::env::temp_dir().join(format!(
+            "release-sanity-checker-ca-{}.pem",
+            std::process::id()
+        ));
+
+        std::fs::write(&path, format!("{}{}", TEST_CA, TEST_CA)).unwrap();
+        assert_eq!(load_ca_bundle(&path).unwrap().len(), 2);
+
+        std::fs::write(&path, "not a certificate").unwrap();
+        let error = load_ca_bundle(&path).unwrap_err();
+        assert!(error.to_string().contains("CA bundle"), "{:#}", error);
+
+        std::fs::remove_file(&path).unwrap();
+        let error = load_ca_bundle(&path).unwrap_err();
+        assert!(
+            error.to_string().contains("Failed to read CA bundle"),
+            "{:#}",
+            error
+        );
+    }
+
+    #[tokio::test]
+    async fn test_requests_transit_proxy() {
+        let server =
+            serve("HTTP/1.1 200 OK\r\ncontent-length: 2\r\nconnection: close\r\n\r\nok").await;
+        let proxy = server.url("").parse().unwrap();
+        let client = with_proxy(Client::builder(), Some(&proxy))
+            .unwrap()
+            .build()
+            .unwrap();
+
+        // The host doesn't exist, only the proxy can answer
+        let response = fetch_with_retries(
+            &request(
+                "http://release-sanity-checker.invalid/".to_string(),
+                json!(null),
+            ),
+            &client,
+            &HostLimiter::new(1),
+            None,
+            ResponseLimits::default(),
+            &StopSignal::never(),
+            1,
+            NO_BACKOFF,
+            true,
+            false,
+        )
+        .await
+        .unwrap();
+        assert_eq!(response.data.body.raw, "ok");
+        assert_eq!(server.request_count(), 1);
+    }
+
+    /// Redirect /old to /new, which answers "new"
+    async fn serve_redirect() -> String {
+        let server = test_server::serve(|request| {
+            if request.target == "/old" {
+                Reply::new("301 Moved Permanently", &[("location", "/new")], "")
+            } else {
+                Reply::ok("new")
+            }
+        })
+        .await;
+        server.url("/old")
+    }
+
+    #[tokio::test]
+    async fn test_follow_redirects() {
+        let url = serve_redirect().await;
+        // Like the client of a run, which never follows redirects by itself
+        let client = Client::builder()
+            .redirect(reqwest::redirect::Policy::none())
+            .build()
+            .unwrap();
+        let fetch_following = |request: RequestConfig, follow_redirects| {
+            let client = client.clone();
+            async move {
+                fetch_with_retries(
+                    &request,
+                    &client,
+                    &HostLimiter::new(1),
+                    None,
+                    ResponseLimits::default(),
+                    &StopSignal::never(),
+                    1,
+                    NO_BACKOFF,
+                    follow_redirects,
+                    true,
+                )
+                .await
+                .unwrap()
+            }
+        };
+
+        let followed = fetch_following(request(url.clone(), json!(null)), true).await;
+        assert_eq!(followed.data.status_code, 200);
+        assert_eq!(followed.data.body.raw, "new");
+        assert_eq!(followed.data.redirects.unwrap().len(), 1);
+
+        // The redirect itself is the response
+        let not_followed = fetch_following(request(url.clone(), json!(null)), false).await;
+        assert_eq!(not_followed.data.status_code, 301);
+        assert_eq!(not_followed.data.headers["location"], vec!["/new"]);
+        assert_eq!(not_followed.data.redirects.unwrap().len(), 0);
+
+        // The setting of the request takes precedence
+        let request_following = |follow: bool| -> RequestConfig {
+            serde_json::from_value(json!({ "url": url, "follow_redirects": follow })).unwrap()
+        };
+        assert_eq!(
+            fetch_following(request_following(false), true)
+                .await
+                .data
+                .status_code,
+            301
+        );
+        assert_eq!(
+            fetch_following(request_following(true), false)
+                .await
+                .data
+                .status_code,
+            200
+        );
+    }
+
+    /// Fetch the request with a client that never follows redirects by itself, like the one of a run
+    async fn fetch_with_limiter(
+        request: &RequestConfig,
+        host_limiter: &HostLimiter,
+    ) -> FetchedResponse {
+        let client = Client::builder()
+            .redirect(reqwest::redirect::Policy::none())
+            .build()
+            .unwrap();
+        fetch_with_retries(
+            request,
+            &client,
+            host_limiter,
+            None,
+            ResponseLimits::default(),
+            &StopSignal::never(),
+            1,
+            NO_BACKOFF,
+            true,
+            false,
+        )
+        .await
+        .unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_redirects_timed_apart() {
+        let server = test_server::serve(|request| {
+            if request.target == "/old" {
+                Reply::new("302 Found", &[("location", "/new")], "")
+                    .delayed(Duration::from_millis(300))
+            } else {
+                Reply::ok("new")
+            }
+        })
+        .await;
+
+        let response = fetch_with_limiter(
+            &request(server.url("/old"), json!(null)),
+            &HostLimiter::new(1),
+        )
+        .await;
+        assert!(
+            response.timings.redirects_ms >= 300,
+            "{:?}",
+            response.timings
+        );
+        assert!(
+            response.timings.time_to_first_byte_ms < 300,
+            "{:?}",
+            response.timings
+        );
+        assert!(response.timings.latency_ms() >= 300);
+    }
+
+    #[tokio::test]
+    async fn test_credentials_not_sent_to_another_origin() {
+        let mut other = test_server::serve(|_| Reply::ok("other")).await;
+        let other_url = other.url("/landing");
+        let mut origin = test_server::serve(move |request| match request.target.as_str() {
+            "/same" => Reply::new("302 Found", &[("location", "/away")], ""),
+            "/away" => Reply::new("302 Found", &[("location", other_url.as_str())], ""),
+            _ => Reply::ok(""),
+        })
+        .await;
+        let request: RequestConfig = serde_json::from_value(json!({
+            "url": origin.url("/same"),
+            "headers": {
+                "Cookie": ["session=abc"],
+                "Proxy-Authorization": ["Basic cHJveHk6cHJveHk="],
+                "X-Trace": ["1"]
+            },
+            "auth": {"type": "bearer", "token": "secret"}
+        }))
+        .unwrap();
+
+        let response = fetch_with_limiter(&request, &HostLimiter::new(1)).await;
+        assert_eq!(response.data.body.raw, "other");
+
+        // A redirect to the same origin keeps the credentials
+        for _ in 0..2 {
+            let received = origin.next_request().await;
+            assert_eq!(received.header("authorization"), Some("Bearer secret"));
+            assert_eq!(received.header("cookie"), Some("session=abc"));
+            assert!(received.header("proxy-authorization").is_some());
+        }
+        let received = other.next_request().await;
+        assert_eq!(received.target, "/landing");
+        assert_eq!(received.header("authorization"), None);
+        assert_eq!(received.header("cookie"), None);
+        assert_eq!(received.header("proxy-authorization"), None);
+        assert_eq!(received.header("x-trace"), Some("1"));
+    }
+
+    #[tokio::test]
+    async fn test_redirect_releases_host_permit() {
+        let slow =
+            test_server::serve(|_| Reply::ok("slow").delayed(Duration::from_millis(500))).await;
+        let slow_url = slow.url("/");
+        let origin = test_server::serve(move |request| match request.target.as_str() {
+            "/away" => Reply::new("302 Found", &[("location", slow_url.as_str())], ""),
+            _ => Reply::ok("fast"),
+        })
+        .await;
+        let host_limiter = HostLimiter::new(1);
+        let redirected = request(origin.url("/away"), json!(null));
+        let direct = request(origin.url("/"), json!(null));
+
+        let redirected = fetch_with_limiter(&redirected, &host_limiter);
+        let direct = async {
+            // Sent once the other request waits on the slow host
+            tokio::time::sleep(Duration::from_millis(100)).await;
+            let start = std::time::Instant::now();
+            let response = fetch_with_limiter(&direct, &host_limiter).await;
+            (response, start.elapsed())
+        };
+        let (redirected, (direct, direct_elapsed)) = tokio::join!(redirected, direct);
+
+        assert_eq!(redirected.data.body.raw, "slow");
+        assert_eq!(direct.data.body.raw, "fast");
+        assert!(direct_elapsed < Duration::from_millis(300));
+    }
+
+    #[test]
+    fn test_auth_header() {
+        let authorization = |auth: serde_json::Value| {
+            let auth = serde_json::from_value(auth).unwrap();
+            let request = with_auth(Client::new().get("http://localhost/"), Some(&auth))
+                .build()
+                .unwrap();
+            request.headers()["authorization"]
+                .to_str()
+                .unwrap()
+                .to_string()
+        };
+
+        assert_eq!(
+            authorization(json!({"type": "bearer", "token": "abc"})),
+            "Bearer abc"
+        );
+        assert_eq!(
+            authorization(json!({"type": "basic", "username": "user", "password": "pass"})),
+            "Basic dXNlcjpwYXNz"
+        );
+
+        let request = with_auth(Client::new().get("http://localhost/"), None)
+            .build()
+            .unwrap();
+        assert!(request.headers().get("authorization").is_none());
+    }
+
+    #[test]
+    fn test_backoff_delays_grow() {
+        let backoff = RetryBackoff {
+            initial: Duration::from_millis(50),
+            max: Duration::from_secs(2),
+        };
+        let expected_ms = [50, 100, 200, 400, 800, 1600, 2000, 2000];
+        for (attempt, expected) in (1..).zip(expected_ms) {
+            let expected = Duration::from_millis(expected);
+            assert_eq!(backoff.delay(attempt), expected);
+
+            // The jitter waits at least half of the delay, and never more than it
+            let delay = backoff.next_delay(attempt, None);
+            assert!(
+                delay >= expected / 2 && delay <= expected,
+                "{:?} for attempt {}",
+                delay,
+                attempt
+            );
+        }
+    }
+
+    #[test]
+    fn test_retry_after_overrides_backoff() {
+        let backoff = RetryBackoff {
+            initial: Duration::from_millis(50),
+            max: Duration::from_secs(2),
+        };
+        assert_eq!(
+            backoff.next_delay(1, Some(Duration::from_secs(5))),
+            Duration::from_secs(5)
+        );
+        assert_eq!(backoff.next_delay(3, Some(Duration::ZERO)), Duration::ZERO);
+        // A server can't stall the run
+        assert_eq!(
+            backoff.next_delay(1, Some(Duration::from_secs(3600))),
+            Duration::from_secs(60)
+        );
+
+        // Sun, 06 Nov 1994 08:49:37 GMT
+        let now = UNIX_EPOCH + Duration::from_secs(784_111_777);
+        assert_eq!(
+            parse_retry_after("120", now),
+            Some(Duration::from_secs(120))
+        );
+        assert_eq!(
+            parse_retry_after("Sun, 06 Nov 1994 08:50:07 GMT", now),
+            Some(Duration::from_secs(30))
+        );
+        assert_eq!(
+            parse_retry_after("Sun, 06 Nov 1994 08:00:00 GMT", now),
+            Some(Duration::ZERO)
+        );
+        assert_eq!(parse_retry_after("soon", SystemTime::now()), None);
+        assert_eq!(parse_retry_after("06 Nov 1994 08:49:37", now), None);
+    }
+
+    #[tokio::test]
+    async fn test_rate_limited_requests_are_retried() {
+        let server = serve(
+            "HTTP/1.1 429 Too Many Requests\r\nretry-after: 0\r\ncontent-length: 0\r\nconnection: close\r\n\r\n",
+        )
+        .await;
+
+        // A rate limited request wasn't processed, so even a POST is retried
+        let error = fetch(&request(server.url("/"), json!({"a": 1})))
+            .await
+            .err()
+            .expect("The request should fail");
+        assert_eq!(error.category, FailureCategory::RateLimited);
+        assert_eq!(error.last_status, Some(429));
+        assert_eq!(error.attempts, 3);
+        assert_eq!(server.request_count(), 3);
+    }
+
+    #[tokio::test]
+    async fn test_retry_on_custom_statuses() {
+        let server =
+            serve("HTTP/1.1 408 Request Timeout\r\ncontent-length: 0\r\nconnection: close\r\n\r\n")
+                .await;
+        let url = server.url("/");
+
+        let custom: RequestConfig =
+            serde_json::from_value(json!({ "url": url, "retry_on_status": [408, "500-599"] }))
+                .unwrap();
+        let error = fetch(&custom).await.err().expect("The request should fail");
+        assert_eq!(error.category, FailureCategory::RetryableStatus);
+        assert_eq!(error.attempts, 3);
+        assert_eq!(server.request_count(), 3);
+
+        // Without it, a 408 response is compared like any other
+        let response = fetch(&request(url.clone(), json!(null))).await.unwrap();
+        assert_eq!(response.data.status_code, 408);
+        assert_eq!(server.request_count(), 4);
+
+        // A status configured to fail isn't retried, even when it's listed as retryable
+        let custom: RequestConfig = serde_json::from_value(
+            json!({ "url": url, "retry_on_status": [408], "fail_on_status": ["400-499"] }),
+        )
+        .unwrap();
+        let error = fetch(&custom).await.err().expect("The request should fail");
+        assert_eq!(error.category, FailureCategory::FailureStatus);
+        assert_eq!(error.last_status, Some(408));
+        assert_eq!(error.attempts, 1);
+        assert_eq!(server.request_count(), 5);
+    }
+
+    #[tokio::test]
+    async fn test_client_errors_are_not_retried() {
+        let server =
+            serve("HTTP/1.1 404 Not Found\r\ncontent-length: 0\r\nconnection: close\r\n\r\n").await;
+
+        let response = fetch(&request(server.url("/"), json!(null))).await.unwrap();
+        assert_eq!(response.data.status_code, 404);
+        assert_eq!(server.request_count(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_server_errors_are_retried_when_idempotent() {
+        let server = serve(
+            "HTTP/1.1 503 Service Unavailable\r\ncontent-length: 0\r\nconnection: close\r\n\r\n",
+        )
+        .await;
+
+        let error = fetch(&request(server.url("/"), json!(null)))
+            .await
+            .err()
+            .expect("The request should fail");
+        assert_eq!(error.category, FailureCategory::ServerError);
+        assert_eq!(error.last_status, Some(503));
+        assert_eq!(error.attempts, 3);
+        assert_eq!(server.request_count(), 3);
+
+        // A POST may have been processed, so it's sent once
+        let error = fetch(&request(server.url("/"), json!({"a": 1})))
+            .await
+            .err()
+            .expect("The request should fail");
+        assert_eq!(error.attempts, 1);
+        assert_eq!(server.request_count(), 4);
+    }
+
+    #[tokio::test]
+    async fn test_body_read_errors_are_retried_when_idempotent() {
+        // The connection is closed before the announced body is sent in full
+        let server =
+            serve("HTTP/1.1 200 OK\r\ncontent-length: 100\r\nconnection: close\r\n\r\npartial")
+                .await;
+
+        let error = fetch(&request(server.url("/"), json!(null)))
+            .await
+            .err()
+            .expect("The request should fail");
+        assert_eq!(error.category, FailureCategory::BodyRead, "{}", error);
+        assert_eq!(error.attempts, 3);
+        assert_eq!(server.request_count(), 3);
+
+        let error = fetch(&request(server.url("/"), json!({"a": 1})))
+            .await
+            .err()
+            .expect("The request should fail");
+        assert_eq!(error.attempts, 1);
+        assert_eq!(server.request_count(), 4);
+    }
+
+    #[tokio::test]
+    async fn test_connect_errors_are_always_retried() {
+        // Nothing listens on the port once the listener is dropped
+        let addr = TcpListener::bind("127.0.0.1:0")
+            .await
+            .unwrap()
+            .local_addr()
+            .unwrap();
+
+        let error = fetch(&request(format!("http://{}/", addr), json!({"a": 1})))
+            .await
+            .err()
+            .expect("The request should fail");
+        assert_eq!(error.category, FailureCategory::Connect, "{}", error);
+        assert_eq!(error.attempts, 3);
+        assert_eq!(error.last_status, None);
+    }
+
+    #[tokio::test]
+    async fn test_body_size() {
+        let server = serve(
+            "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\nconnection: close\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+        )
+        .await;
+        let response = fetch(&request(server.url("/"), json!(null))).await.unwrap();
+        assert_eq!(
+            response.data.body_size,
+            Some(BodySize {
+                wire_bytes: 5,
+                decoded_bytes: 5,
+                truncated: false,
+            })
+        );
+
+        let server =
+            serve("HTTP/1.1 200 OK\r\ncontent-length: 3\r\nconnection: close\r\n\r\nabc").await;
+        let mut head = request(server.url("/"), json!(null));
+        head.method = Some(reqwest::Method::HEAD);
+        let response = fetch(&head).await.unwrap();
+        assert_eq!(response.data.body_size, None);
+    }
+
+    #[test]
+    fn test_json_depth() {
+        assert!(!json_depth_exceeds(r#"{"a": [1, {"b": 2}]}"#, 3));
+        assert!(json_depth_exceeds(r#"{"a": [1, {"b": 2}]}"#, 2));
+        // Brackets within strings don't nest
+        assert!(!json_depth_exceeds(r#"{"a": "[[[{\"}"}"#, 1));
+    }
+
+    #[tokio::test]
+    async fn test_response_limits() {
+        let server = serve(
+            "HTTP/1.1 200 OK\r\ncontent-type: application/json\r\ncontent-length: 9\r\nconnection: close\r\n\r\n[[[[1]]]]",
+        )
+        .await;
+        let fetch_with_limits = |limits| {
+            let request = request(server.url("/"), json!(null));
+            async move {
+                fetch_with_retries(
+                    &request,
+                    &Client::new(),
+                    &HostLimiter::new(1),
+                    None,
+                    limits,
+                    &StopSignal::never(),
+                    3,
+                    NO_BACKOFF,
+                    true,
+                    false,
+                )
+                .await
+            }
+        };
+
+        // A body over the limit is cut, and neither parsed nor checked for its depth
+        let response = fetch_with_limits(ResponseLimits {
+            max_body_bytes: Some(8),
+            max_json_depth: Some(3),
+        })
+        .await
+        .unwrap();
+        assert_eq!(response.data.body.raw, "[[[[1]]]");
+        assert_eq!(response.data.body.json, None);
+        assert_eq!(
+            response.data.body_size,
+            Some(BodySize {
+                wire_bytes: 9,
+                decoded_bytes: 8,
+                truncated: true,
+            })
+        );
+
+        let error = fetch_with_limits(ResponseLimits {
+            max_body_bytes: Some(9),
+            max_json_depth: Some(3),
+        })
+        .await
+        .err()
+        .expect("The body is too deep");
+        assert_eq!(error.category, FailureCategory::LimitExceeded);
+        assert!(
+            std::error::Error::source(&error)
+                .is_some_and(|e| e.downcast_ref::<LimitExceeded>().is_some())
+        );
+
+        let response = fetch_with_limits(ResponseLimits {
+            max_body_bytes: Some(9),
+            max_json_depth: Some(4),
+        })
+        .await
+        .unwrap();
+        assert_eq!(response.data.body.json, Some(json!([[[[1]]]])));
+        assert_eq!(server.request_count(), 3);
+    }
+
+    #[tokio::test]
+    async fn test_chunked_body_truncated() {
+        let server = serve(
+            "HTTP/1.1 200 OK\r\ncontent-type: application/json\r\ntransfer-encoding: chunked\r\nconnection: close\r\n\r\n5\r\n[1, 2\r\n5\r\n, 3]\n\r\n0\r\n\r\n",
+        )
+        .await;
+        let request = request(server.url("/"), json!(null));
+        let response = fetch_with_retries(
+            &request,
+            &Client::new(),
+            &HostLimiter::new(1),
+            None,
+            ResponseLimits {
+                max_body_bytes: Some(7),
+                max_json_depth: None,
+            },
+            &StopSignal::never(),
+            3,
+            NO_BACKOFF,
+            true,
+            false,
+        )
+        .await
+        .unwrap();
+        // Without a Content-Length, the size on the wire is what was kept
+        assert_eq!(response.data.body.raw, "[1, 2, ");
+        assert_eq!(response.data.body.json, None);
+        assert_eq!(
+            response.data.body_size,
+            Some(BodySize {
+                wire_bytes: 7,
+                decoded_bytes: 7,
+                truncated: true,
+            })
+        );
+        assert_eq!(server.request_count(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_body_memory_released_once_stored() {
+        let body = "x".repeat(51);
+        let chunked = format!(
+            "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\nconnection: close\r\n\r\n{:x}\r\n{}\r\n0\r\n\r\n",
+            body.len(),
+            body
+        );
+        let server = test_server::serve(move |request| match request.target.as_str() {
+            "/chunked" => Reply::raw(chunked.clone()),
+            _ => Reply::ok(body.clone()),
+        })
+        .await;
+        // Room for a single body of 51 bytes at a time
+        let governor = BodyMemoryGovernor::new(100);
+        let fetch_body = |path: &str| {
+            let request = request(server.url(path), json!(null));
+            let governor = governor.clone();
+            async move {
+                let client = Client::new();
+                let host_limiter = HostLimiter::new(1);
+                let stop = StopSignal::never();
+                let response = fetch_with_retries(
+                    &request,
+                    &client,
+                    &host_limiter,
+                    Some(&governor),
+                    ResponseLimits::default(),
+                    &stop,
+                    1,
+                    NO_BACKOFF,
+                    true,
+                    false,
+                );
+                tokio::time::timeout(Duration::from_secs(5), response)
+                    .await
+                    .expect("The fetch waited for memory held by a stored response")
+                    .unwrap()
+            }
+        };
+
+        // The previous responses are still held while the next ones are fetched
+        let first = fetch_body("/sized").await;
+        let second = fetch_body("/sized").await;
+        let third = fetch_body("/chunked").await;
+        for response in [&first, &second, &third] {
+            assert_eq!(response.data.body.raw.len(), 51);
+        }
+    }
+
+    #[test]
+    fn test_decode_body() {
+        let latin1 = HashMap::from([(
+            "content-type".to_string(),
+            vec!["text/plain; charset=\"ISO-8859-1\"".to_string()],
+        )]);
+        assert_eq!(decode_body(b"caf\xe9", &latin1), "café");
+
+        // Without a charset, the body is UTF-8
+        assert_eq!(decode_body("café".as_bytes(), &HashMap::new()), "café");
+        assert_eq!(decode_body(b"caf\xe9", &HashMap::new()), "caf\u{fffd}");
+    }
+
+    /// Answer the first request with `first_status` and the next ones with a 200
+    async fn serve_first_status(first_status: &'static str) -> TestServer {
+        let answered = AtomicUsize::new(0);
+        test_server::serve(move |_| {
+            let first = answered.fetch_add(1, Ordering::SeqCst) == 0;
+            Reply::new(if first { first_status } else { "200 OK" }, &[], "")
+        })
+        .await
+    }
+
+    #[tokio::test]
+    async fn test_retries_resend_the_body() {
+        let mut server = serve_first_status("500 Internal Server Error").await;
+
+        let mut post = request(server.url("/"), json!({"name": "a"}));
+        post.idempotent = Some(true);
+        let response = fetch(&post).await.unwrap();
+        assert_eq!(response.data.status_code, 200);
+
+        assert_eq!(server.request_count(), 2);
+        for _ in 0..2 {
+            assert_eq!(server.next_request().await.body_text(), r#"{"name":"a"}"#);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_configured_method_is_sent() {
+        let mut server = serve_first_status("200 OK").await;
+
+        for (method, body) in [("delete", json!({"id": 1})), ("GET", json!({"id": 2}))] {
+            let request: RequestConfig = serde_json::from_value(json!({
+                "url": server.url("/"),
+                "method": method,
+                "body": body,
+            }))
+            .unwrap();
+            fetch(&request).await.unwrap();
+        }
+
+        let delete = server.next_request().await;
+        assert_eq!(delete.method, "DELETE");
+        assert_eq!(delete.body_text(), r#"{"id":1}"#);
+        let get = server.next_request().await;
+        assert_eq!(get.method, "GET");
+        assert_eq!(get.body_text(), r#"{"id":2}"#);
+
+        let invalid = json!({"url": "http://localhost/", "method": "NOT A METHOD"});
+        assert!(serde_json::from_value::<RequestConfig>(invalid).is_err());
+    }
+
+    #[tokio::test]
+    async fn test_request_timeout() {
+        // The server takes its time to answer
+        let server =
+            test_server::serve(|_| Reply::ok("").delayed(Duration::from_millis(500))).await;
+
+        let mut fast = request(server.url("/"), json!(null));
+        fast.timeout_ms = Some(50);
+        let started = std::time::Instant::now();
+        let error = fetch(&fast)
+            .await
+            .err()
+            .expect("The request should time out");
+        assert_eq!(error.category, FailureCategory::Send, "{}", error);
+        assert_eq!(error.attempts, 3);
+        // Every attempt gave up before the server answered
+        assert!(started.elapsed() < Duration::from_millis(500));
+
+        let slow = request(server.url("/"), json!(null));
+        assert_eq!(fetch(&slow).await.unwrap().data.status_code, 200);
+    }
+
+    #[tokio::test]
+    async fn test_interrupted_requests_stop() {
+        let slow = test_server::serve(|_| Reply::ok("").delayed(Duration::from_secs(30))).await;
+        let failing = serve(
+            "HTTP/1.1 500 Internal Server Error\r\ncontent-length: 0\r\nconnection: close\r\n\r\n",
+        )
+        .await;
+        // Retried after a long time
+        let backoff = RetryBackoff {
+            initial: Duration::from_secs(30),
+            max: Duration::from_secs(30),
+        };
+
+        // Interrupted while waiting for the response, then while waiting to retry
+        for url in [slow.url("/"), failing.url("/")] {
+            let (stop_tx, stop) = StopSignal::new();
+            let request = request(url, json!(null));
+            let client = Client::new();
+            let host_limiter = HostLimiter::new(1);
+            let fetching = fetch_with_retries(
+                &request,
+                &client,
+                &host_limiter,
+                None,
+                ResponseLimits::default(),
+                &stop,
+                3,
+                backoff,
+                true,
+                false,
+            );
+            let stopping = async {
+                tokio::time::sleep(Duration::from_millis(100)).await;
+                stop_tx.send_replace(true);
+            };
+            let (error, _) = tokio::time::timeout(Duration::from_secs(5), async {
+                tokio::join!(fetching, stopping)
+            })
+            .await
+            .expect("The interruption didn't stop the request");
+
+            let error = error.err().expect("The request was interrupted");
+            assert_eq!(error.category, FailureCategory::Interrupted);
+            assert_eq!(error.attempts, 1);
+            assert!(is_interrupted(&error.into()));
+        }
+        assert_eq!(failing.request_count(), 1);
+    }
+
+    fn form_request(url: String, content_type: &str, body: serde_json::Value) -> RequestConfig {
+        serde_json::from_value(json!({ "url": url, "content_type": content_type, "body": body }))
+            .unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_form_urlencoded_body() {
+        let mut server = test_server::serve(|_| Reply::ok("")).await;
+        let form = form_request(
+            server.url("/login"),
+            "application/x-www-form-urlencoded",
+            json!({"name": "Jane Doe", "note": "a&b=c", "tags": ["x", "y"], "age": 42}),
+        );
+
+        assert_eq!(fetch(&form).await.unwrap().data.status_code, 200);
+
+        let received = server.next_request().await;
+        assert_eq!(
+            (received.method.as_str(), received.target.as_str()),
+            ("POST", "/login")
+        );
+        assert_eq!(
+            received.header("content-type"),
+            Some("application/x-www-form-urlencoded")
+        );
+        assert_eq!(
+            received.body_text(),
+            "age=42&name=Jane+Doe&note=a%26b%3Dc&tags=x&tags=y"
+        );
+
+        // A Content-Type header of the request is kept
+        let mut own_type = form.clone();
+        own_type.headers.insert(
+            "Content-Type".to_string(),
+            vec!["application/x-www-form-urlencoded; charset=utf-8".to_string()],
+        );
+        fetch(&own_type).await.unwrap();
+        let received = server.next_request().await;
+        assert_eq!(
+            received.header_values("content-type").collect::<Vec<_>>(),
+            vec!["application/x-www-form-urlencoded; charset=utf-8"]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_user_agent() {
+        let mut server = test_server::serve(|_| Reply::ok("")).await;
+        let client = Client::builder()
+            .user_agent(crate::DEFAULT_USER_AGENT)
+            .build()
+            .unwrap();
+        let send = |request: RequestConfig| {
+            let client = client.clone();
+            async move {
+                fetch_with_retries(
+                    &request,
+                    &client,
+                    &HostLimiter::new(1),
+                    None,
+                    ResponseLimits::default(),
+                    &StopSignal::never(),
+                    1,
+                    NO_BACKOFF,
+                    true,
+                    false,
+                )
+                .await
+                .unwrap()
+            }
+        };
+
+        send(request(server.url("/"), json!(null))).await;
+        assert_eq!(
+            server.next_request().await.header("user-agent"),
+            Some(concat!(
+                "release-sanity-checker/",
+                env!("CARGO_PKG_VERSION")
+            ))
+        );
+
+        // A User-Agent header of the request replaces the default one
+        let mut own_agent = request(server.url("/"), json!(null));
+        own_agent.headers.insert(
+            "User-Agent".to_string(),
+            vec!["smoke-tests/2.0".to_string()],
+        );
+        send(own_agent).await;
+        assert_eq!(
+            server
+                .next_request()
+                .await
+                .header_values("user-agent")
+                .collect::<Vec<_>>(),
+            vec!["smoke-tests/2.0"]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_dry_run_request() {
+        let server = test_server::serve(|_| Reply::ok("")).await;
+        let step: RequestConfig = serde_json::from_value(json!({
+            "url": format!("http://{}/orders?page=2", server.addr),
+            "method": "put",
+            "headers": {"X-Trace": ["abc"]},
+            "auth": {"type": "bearer", "token": "secret-token"},
+            "content_type": "application/x-www-form-urlencoded",
+            "body": {"id": 7, "note": "a b"},
+        }))
+        .unwrap();
+
+        let planned = build_request(&step, &Client::new()).unwrap();
+        assert_eq!(
+            format_request(&planned),
+            format!(
+                "PUT http://{}/orders?page=2\n\
+                 authorization: ***\n\
+                 content-type: application/x-www-form-urlencoded\n\
+                 x-trace: abc\n\
+                 \n\
+                 id=7&note=a+b\n",
+                server.addr
+            )
+        );
+
+        // Without a body, only the request line and headers are planned
+        let get = request(format!("http://{}/health", server.addr), json!(null));
+        assert_eq!(
+            format_request(&build_request(&get, &Client::new()).unwrap()),
+            format!("GET http://{}/health\n", server.addr)
+        );
+
+        tokio::time::sleep(Duration::from_millis(50)).await;
+        assert_eq!(server.request_count(), 0);
+    }
+
+    #[test]
+    fn test_encode_body() {
+        // Without a content type, bodies are sent as JSON
+        let json_request = request("http://localhost/".to_string(), json!({"a": [1, 2]}));
+        let encoded = encode_body(&json_request).unwrap().unwrap();
+        assert_eq!(encoded.content, r#"{"a":[1,2]}"#);
+        assert_eq!(encoded.content_type, None);
+        let no_body = request("http://localhost/".to_string(), json!(null));
+        assert!(encode_body(&no_body).unwrap().is_none());
+
+        let multipart = form_request(
+            "http://localhost/".to_string(),
+            "multipart/form-data",
+            json!({"name": "Jane", "empty": null}),
+        );
+        let encoded = encode_body(&multipart).unwrap().unwrap();
+        let content_type = encoded.content_type.unwrap();
+        let boundary = content_type
+            .strip_prefix("multipart/form-data; boundary=")
+            .unwrap();
+        assert_eq!(
+            encoded.content,
+            format!(
+                "--{b}\r\nContent-Disposition: form-data; name=\"empty\"\r\n\r\n\r\n\
+                 --{b}\r\nContent-Disposition: form-data; name=\"name\"\r\n\r\nJane\r\n\
+                 --{b}--\r\n",
+                b = boundary
+            )
+        );
+        // The same fields give the same boundary
+        assert_eq!(
+            encode_body(&multipart).unwrap().unwrap().content,
+            encoded.content
+        );
+
+        // Forms are flat
+        let nested = form_request(
+            "http://localhost/".to_string(),
+            "application/x-www-form-urlencoded",
+            json!({"user": {"name": "Jane"}}),
+        );
+        assert!(encode_body(&nested).is_err());
+        let not_object = form_request(
+            "http://localhost/".to_string(),
+            "application/x-www-form-urlencoded",
+            json!("name=Jane"),
+        );
+        assert!(encode_body(&not_object).is_err());
+    }
+
+    fn gzip(data: &[u8]) -> Vec<u8> {
+        let mut encoder = GzEncoder::new(Vec::new(), Compression::default());
+        encoder.write_all(data).unwrap();
+        encoder.finish().unwrap()
+    }
+
+    /// Serve a gzip-encoded JSON body to every request
+    async fn serve_gzip_json(json: serde_json::Value) -> SocketAddr {
+        let body = gzip(json.to_string().as_bytes());
+        let server = test_server::serve(move |_| {
+            Reply::new(
+                "200 OK",
+                &[
+                    ("content-type", "application/json"),
+                    ("content-encoding", "gzip"),
+                ],
+                body.clone(),
+            )
+        })
+        .await;
+        server.addr
+    }
+
+    #[tokio::test]
+    async fn test_gzip_body_is_decompressed() {
+        let old = json!({"user": {"id": 1, "name": "Ann"}, "tags": ["a", "b"]});
+        let new = json!({"user": {"id": 1, "name": "Bob"}, "tags": ["a", "b"]});
+        let old_addr = serve_gzip_json(old.clone()).await;
+        let new_addr = serve_gzip_json(new).await;
+
+        let baseline = fetch(&request(format!("http://{}/", old_addr), json!(null)))
+            .await
+            .unwrap()
+            .data;
+        assert_eq!(baseline.body.json, Some(old.clone()));
+        let body_size = baseline.body_size.as_ref().unwrap();
+        assert_eq!(body_size.decoded_bytes, old.to_string().len() as u64);
+        assert_eq!(
+            body_size.wire_bytes,
+            gzip(old.to_string().as_bytes()).len() as u64
+        );
+
+        // The bodies are compared structurally, not as compressed strings
+        let current = fetch(&request(format!("http://{}/", new_addr), json!(null)))
+            .await
+            .unwrap()
+            .data;
+        let differences =
+            compute_differences(&baseline, &current, false, None, &DiffOptions::default());
+        assert_eq!(
+            differences,
+            vec![Difference::BodyValueChanged {
+                path: "user/name".to_string(),
+                old_val: "\"Ann\"".to_string(),
+                new_val: "\"Bob\"".to_string(),
+            }]
+        );
+    }
+
+    #[test]
+    fn test_decompress_body() {
+        let encoded = |encoding: &str| {
+            HashMap::from([("content-encoding".to_string(), vec![encoding.to_string()])])
+        };
+        let body = br#"{"ok":true}"#;
+
+        let mut zlib = ZlibEncoder::new(Vec::new(), Compression::default());
+        zlib.write_all(body).unwrap();
+        let mut raw_deflate = DeflateEncoder::new(Vec::new(), Compression::default());
+        raw_deflate.write_all(body).unwrap();
+        for (encoding, compressed) in [
+            ("gzip", gzip(body)),
+            ("x-gzip", gzip(body)),
+            ("deflate", zlib.finish().unwrap()),
+            ("deflate", raw_deflate.finish().unwrap()),
+            ("identity", body.to_vec()),
+            ("br", body.to_vec()),
+        ] {
+            let decompressed =
+                decompress_body(compressed, &encoded(encoding), None, "http://localhost/").unwrap();
+            assert_eq!(decompressed, (body.to_vec(), false), "{}", encoding);
+        }
+        assert_eq!(
+            decompress_body(body.to_vec(), &HashMap::new(), None, "http://localhost/").unwrap(),
+            (body.to_vec(), false)
+        );
+
+        // Corrupt bodies fail, while bodies going over the limit once decompressed are cut at it
+        assert!(
+            decompress_body(body.to_vec(), &encoded("gzip"), None, "http://localhost/").is_err()
+        );
+        let large = gzip(&vec![b'a'; 10_000]);
+        assert_eq!(
+            decompress_body(large, &encoded("gzip"), Some(1_000), "http://localhost/").unwrap(),
+            (vec![b'a'; 1_000], true)
+        );
+    }
+
+    #[tokio::test]
+    async fn test_request_body_limit() {
+        let server = serve(
+            "HTTP/1.1 200 OK\r\ncontent-type: text/plain\r\ncontent-length: 20\r\nconnection: close\r\n\r\n01234567890123456789",
+        )
+        .await;
+        let fetch_with_limit = |request_limit: Option<usize>, run_limit: Option<usize>| {
+            let request: RequestConfig = serde_json::from_value(json!({
+                "url": server.url("/"),
+                "max_body_bytes": request_limit,
+            }))
+            .unwrap();
+            async move {
+                fetch_with_retries(
+                    &request,
+                    &Client::new(),
+                    &HostLimiter::new(1),
+                    None,
+                    ResponseLimits {
+                        max_body_bytes: run_limit,
+                        max_json_depth: None,
+                    },
+                    &StopSignal::never(),
+                    1,
+                    NO_BACKOFF,
+                    true,
+                    false,
+                )
+                .await
+            }
+        };
+
+        // The limit of the request takes precedence, in both directions
+        let response = fetch_with_limit(Some(10), Some(1000)).await.unwrap();
+        assert_eq!(response.data.body.raw, "0123456789");
+        assert!(response.data.is_truncated());
+        let response = fetch_with_limit(Some(1000), Some(10)).await.unwrap();
+        assert_eq!(response.data.body.raw, "01234567890123456789");
+        assert!(!response.data.is_truncated());
+        let response = fetch_with_limit(None, Some(10)).await.unwrap();
+        assert!(response.data.is_truncated());
+    }
+}
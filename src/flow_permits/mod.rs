@@ -0,0 +1,26 @@
+mod tests;
+
+use crate::interrupt::StopSignal;
+use anyhow::{Context, Result};
+use std::{future::Future, sync::Arc};
+use tokio::sync::Semaphore;
+
+/// Bounds the flows in progress at once, across all the configs. Clones share the same permits.
+#[derive(Clone, Debug)]
+pub struct FlowPermits(Arc<Semaphore>);
+
+impl FlowPermits {
+    pub fn new(concurrency: usize) -> Self {
+        FlowPermits(Arc::new(Semaphore::new(concurrency)))
+    }
+
+    /// Run the flow once a permit is available, holding it until the flow completes.
+    /// Fails with `Interrupted` when the signal stops while waiting for a permit, the flow not being run.
+    pub async fn run<F: Future>(&self, stop: &StopSignal, flow: F) -> Result<F::Output> {
+        let _permit = stop
+            .unless_stopped(self.0.acquire())
+            .await?
+            .context("Failed to acquire a flow permit")?;
+        Ok(flow.await)
+    }
+}
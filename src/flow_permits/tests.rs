@@ -0,0 +1,76 @@
+#[cfg(test)]
+mod tests {
+    use crate::flow_permits::FlowPermits;
+    use crate::interrupt::{StopSignal, is_interrupted};
+    use std::{
+        sync::{
+            Arc,
+            atomic::{AtomicUsize, Ordering},
+        },
+        time::Duration,
+    };
+    use tokio::task::JoinSet;
+
+    #[tokio::test]
+    async fn test_concurrency_limit() {
+        let permits = FlowPermits::new(3);
+        let stop = StopSignal::never();
+        let active = Arc::new(AtomicUsize::new(0));
+        let peak = Arc::new(AtomicUsize::new(0));
+
+        let mut flows = JoinSet::new();
+        for i in 0..20u64 {
+            let (permits, stop, active, peak) =
+                (permits.clone(), stop.clone(), active.clone(), peak.clone());
+            flows.spawn(async move {
+                permits
+                    .run(&stop, async {
+                        let now_active = active.fetch_add(1, Ordering::SeqCst) + 1;
+                        peak.fetch_max(now_active, Ordering::SeqCst);
+                        tokio::time::sleep(Duration::from_millis(10 + (i * 7) % 13)).await;
+                        active.fetch_sub(1, Ordering::SeqCst);
+                        i
+                    })
+                    .await
+            });
+        }
+
+        let mut completed = 0;
+        while let Some(result) = flows.join_next().await {
+            result.unwrap().unwrap();
+            completed += 1;
+        }
+        assert_eq!(completed, 20);
+        // The limit is reached, and never exceeded
+        assert_eq!(peak.load(Ordering::SeqCst), 3);
+        assert_eq!(active.load(Ordering::SeqCst), 0);
+    }
+
+    #[tokio::test]
+    async fn test_stopped_while_waiting() {
+        let permits = FlowPermits::new(1);
+        let (stop_tx, stop) = StopSignal::new();
+
+        let running = permits.run(&stop, tokio::time::sleep(Duration::from_secs(60)));
+        let waiting = async {
+            tokio::time::sleep(Duration::from_millis(20)).await;
+            let waiting = permits.run(&stop, async { panic!("The flow ran after the stop") });
+            let stopping = async {
+                tokio::time::sleep(Duration::from_millis(20)).await;
+                stop_tx.send_replace(true);
+            };
+            tokio::join!(waiting, stopping).0
+        };
+
+        // The flow in progress is dropped by its own stop checks, not by the permits
+        let result = tokio::time::timeout(Duration::from_secs(5), async {
+            tokio::select! {
+                _ = running => unreachable!("The running flow completed"),
+                result = waiting => result,
+            }
+        })
+        .await
+        .expect("The waiting flow wasn't skipped");
+        assert!(is_interrupted(&result.unwrap_err()));
+    }
+}
@@ -0,0 +1,142 @@
+mod tests;
+
+use crate::RequestConfig;
+use crate::dates::format_iso8601;
+use crate::fetch::{FetchedResponse, encode_body};
+use anyhow::{Context, Result};
+use reqwest::Url;
+use serde_json::{Value, json};
+use std::{path::Path, sync::Mutex, time::SystemTime};
+
+/// Collects the requests sent during the run, to export them as a HAR 1.2 file
+/// that can be opened in browser devtools and other HAR viewers
+#[derive(Default)]
+pub struct HarRecorder {
+    entries: Mutex<Vec<(SystemTime, Value)>>,
+}
+
+impl HarRecorder {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Record a request, as it was sent, along with the response it got
+    pub fn record(
+        &self,
+        request_id: &str,
+        request: &RequestConfig,
+        started: SystemTime,
+        response: &FetchedResponse,
+    ) {
+        let request_headers: Vec<Value> = request
+            .headers
+            .iter()
+            .flat_map(|(name, values)| values.iter().map(move |v| har_header(name, v)))
+            .collect();
+        let query_string: Vec<Value> = Url::parse(&request.url)
+            .map(|url| {
+                url.query_pairs()
+                    .map(|(name, value)| har_header(&name, &value))
+                    .collect()
+            })
+            .unwrap_or_default();
+
+        let mut har_request = json!({
+            "method": request.method().as_str(),
+            "url": request.url,
+            "httpVersion": "HTTP/1.1",
+            "cookies": [],
+            "headers": request_headers,
+            "queryString": query_string,
+            "headersSize": -1,
+            "bodySize": 0,
+        });
+        if let Ok(Some(body)) = encode_body(request) {
+            let mime_type = body.content_type.as_deref().unwrap_or("application/json");
+            har_request["bodySize"] = json!(body.content.len());
+            har_request["postData"] = json!({ "mimeType": mime_type, "text": body.content });
+        }
+
+        let data = &response.data;
+        let response_headers: Vec<Value> = data
+            .headers
+            .iter()
+            .flat_map(|(name, values)| values.iter().map(move |v| har_header(name, v)))
+            .collect();
+        let mime_type = data
+            .headers
+            .get("content-type")
+            .and_then(|values| values.first())
+            .map_or("", String::as_str);
+        let redirect_url = data
+            .redirects
+            .as_ref()
+            .and_then(|hops| hops.last())
+            .map_or("", |hop| hop.location.as_str());
+
+        let timings = &response.timings;
+        let entry = json!({
+            "startedDateTime": format_iso8601(started),
+            "time": timings.time_to_first_byte_ms + timings.download_ms,
+            "request": har_request,
+            "response": {
+                "status": data.status_code,
+                "statusText": reqwest::StatusCode::from_u16(data.status_code)
+                    .ok()
+                    .and_then(|s| s.canonical_reason())
+                    .unwrap_or_default(),
+                "httpVersion": "HTTP/1.1",
+                "cookies": [],
+                "headers": response_headers,
+                "content": {
+                    "size": data.body.raw.len(),
+                    "mimeType": mime_type,
+                    "text": data.body.raw,
+                },
+                "redirectURL": redirect_url,
+                "headersSize": -1,
+                "bodySize": data.body.raw.len(),
+            },
+            "cache": {},
+            "comment": format!("Request ID: {}", request_id),
+            // The HTTP client doesn't expose the connection phases, they are all part of the wait
+            "timings": {
+                "send": 0,
+                "wait": timings.time_to_first_byte_ms,
+                "receive": timings.download_ms,
+            },
+        });
+
+        self.entries
+            .lock()
+            .expect("HAR entries lock poisoned")
+            .push((started, entry));
+    }
+
+    /// Write the recorded requests to a HAR file, sorted by start time
+    pub async fn write(&self, path: &Path) -> Result<()> {
+        let mut entries =
+            std::mem::take(&mut *self.entries.lock().expect("HAR entries lock poisoned"));
+        entries.sort_by_key(|(started, _)| *started);
+
+        let har = json!({
+            "log": {
+                "version": "1.2",
+                "creator": {
+                    "name": env!("CARGO_PKG_NAME"),
+                    "version": env!("CARGO_PKG_VERSION"),
+                },
+                "entries": entries.into_iter().map(|(_, entry)| entry).collect::<Vec<_>>(),
+            }
+        });
+
+        let content = serde_json::to_string_pretty(&har).context("Failed to serialize HAR")?;
+        tokio::fs::write(path, content)
+            .await
+            .with_context(|| format!("Failed to write HAR file {}", path.display()))
+    }
+}
+
+fn har_header(name: &str, value: &str) -> Value {
+    json!({ "name": name, "value": value })
+}
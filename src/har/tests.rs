@@ -0,0 +1,150 @@
+#[cfg(test)]
+mod tests {
+    use crate::fetch::{FetchedResponse, ResponseTimings};
+    use crate::har::HarRecorder;
+    use crate::variables::{Variables, extract_variables, substitute_variables};
+    use crate::{HttpResponseData, RedirectHop, RequestConfig};
+    use serde_json::{Value, json};
+    use std::{
+        collections::HashMap,
+        time::{Duration, UNIX_EPOCH},
+    };
+
+    fn step(value: Value) -> RequestConfig {
+        serde_json::from_value(value).unwrap()
+    }
+
+    fn response(status: u16, content_type: &str, body: &str) -> FetchedResponse {
+        let headers = HashMap::from([("Content-Type".to_string(), vec![content_type.to_string()])]);
+        FetchedResponse::new(
+            HttpResponseData::new(status, headers, body.to_string()),
+            ResponseTimings {
+                time_to_first_byte_ms: 30,
+                download_ms: 5,
+                redirects_ms: 0,
+            },
+        )
+    }
+
+    #[tokio::test]
+    async fn test_har_round_trip() {
+        let login = step(json!({
+            "url": "http://api.test/login",
+            "body": {"user": "ann"},
+            "extract": {"token": "/token", "user_id": "/id"}
+        }));
+        let login_response = response(200, "application/json", r#"{"token": "abc", "id": 42}"#);
+        let mut variables = Variables::new();
+        extract_variables(&login, &login_response.data, "/", &mut variables).unwrap();
+
+        // The requests are recorded as they were sent, their variables substituted
+        let profile = substitute_variables(
+            &step(json!({
+                "url": "http://api.test/users/{{user_id}}?fields=name&lang=en",
+                "method": "PUT",
+                "headers": {"Authorization": ["Bearer {{token}}"]},
+                "body": {"name": "Ann", "id": "{{user_id}}"},
+                "content_type": "application/x-www-form-urlencoded"
+            })),
+            &variables,
+        )
+        .unwrap();
+        let mut profile_response = response(201, "text/plain", "created");
+        profile_response.data.redirects = Some(vec![RedirectHop {
+            status_code: 307,
+            location: "http://api.test/v2/users/42".to_string(),
+        }]);
+
+        let started = UNIX_EPOCH + Duration::from_secs(1_704_067_200);
+        let har = HarRecorder::new();
+        // Recorded out of order, as concurrent flows complete
+        har.record(
+            "profile",
+            &profile,
+            started + Duration::from_millis(100),
+            &profile_response,
+        );
+        har.record("login", &login, started, &login_response);
+
+        let path = std::env::temp_dir().join(format!(
+            "release-sanity-checker-har-{}.har",
+            std::process::id()
+        ));
+        har.write(&path).await.unwrap();
+        let written: Value =
+            serde_json::from_str(&std::fs::read_to_string(&path).unwrap()).unwrap();
+        std::fs::remove_file(&path).unwrap();
+
+        let log = &written["log"];
+        assert_eq!(log["version"], "1.2");
+        assert_eq!(log["creator"]["name"], env!("CARGO_PKG_NAME"));
+        // Entries are sorted by start time
+        let entries = log["entries"].as_array().unwrap();
+        assert_eq!(entries.len(), 2);
+        assert_eq!(entries[0]["comment"], "Request ID: login");
+        assert_eq!(entries[0]["startedDateTime"], "2024-01-01T00:00:00.000Z");
+        assert_eq!(entries[1]["comment"], "Request ID: profile");
+        assert_eq!(entries[1]["startedDateTime"], "2024-01-01T00:00:00.100Z");
+
+        let login_entry = &entries[0];
+        assert_eq!(login_entry["request"]["method"], "POST");
+        assert_eq!(
+            login_entry["request"]["postData"],
+            json!({"mimeType": "application/json", "text": r#"{"user":"ann"}"#})
+        );
+        assert_eq!(login_entry["response"]["status"], 200);
+        assert_eq!(login_entry["response"]["statusText"], "OK");
+        assert_eq!(
+            login_entry["response"]["content"],
+            json!({"size": 26, "mimeType": "application/json", "text": r#"{"token": "abc", "id": 42}"#})
+        );
+        assert_eq!(login_entry["time"], 35);
+        assert_eq!(
+            login_entry["timings"],
+            json!({"send": 0, "wait": 30, "receive": 5})
+        );
+
+        let request = &entries[1]["request"];
+        assert_eq!(request["method"], "PUT");
+        assert_eq!(
+            request["url"],
+            "http://api.test/users/42?fields=name&lang=en"
+        );
+        assert_eq!(
+            request["headers"],
+            json!([{"name": "Authorization", "value": "Bearer abc"}])
+        );
+        assert_eq!(
+            request["queryString"],
+            json!([{"name": "fields", "value": "name"}, {"name": "lang", "value": "en"}])
+        );
+        assert_eq!(
+            request["postData"],
+            json!({"mimeType": "application/x-www-form-urlencoded", "text": "id=42&name=Ann"})
+        );
+        assert_eq!(request["bodySize"], 14);
+
+        let response = &entries[1]["response"];
+        assert_eq!(response["status"], 201);
+        assert_eq!(response["statusText"], "Created");
+        assert_eq!(response["redirectURL"], "http://api.test/v2/users/42");
+        assert_eq!(
+            response["headers"],
+            json!([{"name": "content-type", "value": "text/plain"}])
+        );
+    }
+
+    #[tokio::test]
+    async fn test_empty_har() {
+        let path = std::env::temp_dir().join(format!(
+            "release-sanity-checker-empty-{}.har",
+            std::process::id()
+        ));
+        HarRecorder::new().write(&path).await.unwrap();
+        let written: Value =
+            serde_json::from_str(&std::fs::read_to_string(&path).unwrap()).unwrap();
+        std::fs::remove_file(&path).unwrap();
+        assert_eq!(written["log"]["version"], "1.2");
+        assert_eq!(written["log"]["entries"], json!([]));
+    }
+}
@@ -0,0 +1,99 @@
+mod tests;
+
+use crate::variables::Variables;
+use anyhow::{Result, bail};
+use std::{fmt, future::Future, sync::Arc};
+use tokio::sync::watch;
+
+/// A request that wasn't sent, or whose response wasn't awaited, as the run was interrupted.
+/// The flow it belongs to is skipped rather than failed.
+#[derive(Debug)]
+pub struct Interrupted;
+
+impl fmt::Display for Interrupted {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("The run was interrupted")
+    }
+}
+
+impl std::error::Error for Interrupted {}
+
+/// Whether the error comes from a request flow stopped by the interruption of the run
+pub fn is_interrupted(error: &anyhow::Error) -> bool {
+    error.chain().any(|cause| cause.is::<Interrupted>())
+}
+
+/// Tells the request flows of a run that it was interrupted, e.g. by SIGINT or SIGTERM.
+/// Clones share the same signal.
+#[derive(Clone, Debug)]
+pub struct StopSignal(watch::Receiver<bool>);
+
+impl StopSignal {
+    /// A signal that stops once `true` is sent to the returned sender
+    pub fn new() -> (watch::Sender<bool>, StopSignal) {
+        let (sender, receiver) = watch::channel(false);
+        (sender, StopSignal(receiver))
+    }
+
+    /// A signal that never stops, e.g. for the cycles of watch mode, which always complete
+    pub fn never() -> StopSignal {
+        StopSignal::new().1
+    }
+
+    pub fn is_stopped(&self) -> bool {
+        *self.0.borrow()
+    }
+
+    /// Fail with `Interrupted` when the signal stopped, e.g. before sending the next step of a flow
+    pub fn check(&self) -> Result<(), Interrupted> {
+        if self.is_stopped() {
+            return Err(Interrupted);
+        }
+        Ok(())
+    }
+
+    /// Run the future, unless the signal stops first, in which case it's dropped
+    pub async fn unless_stopped<F: Future>(&self, future: F) -> Result<F::Output, Interrupted> {
+        self.check()?;
+        let mut receiver = self.0.clone();
+        tokio::select! {
+            output = future => Ok(output),
+            // A signal whose sender is gone never stops, and this branch is disabled
+            Ok(_) = receiver.wait_for(|&stopped| stopped) => Err(Interrupted),
+        }
+    }
+
+    /// Wait for the prerequisites of a request, by ID, to succeed before it starts, and return the variables
+    /// they extracted, for its steps to use. A prerequisite reports its success with its variables.
+    /// When several prerequisites extracted the same variable, the one listed last wins.
+    /// Fails with `Interrupted` when the request is to be skipped, the run being interrupted before it
+    /// starts or a prerequisite having been skipped, and fails with the ID of the prerequisite that failed.
+    pub async fn wait_for_prerequisites(
+        &self,
+        request_id: &str,
+        prerequisites: Vec<(String, watch::Receiver<Option<Arc<Variables>>>)>,
+    ) -> Result<Variables> {
+        let mut variables = Variables::new();
+        for (id, mut prerequisite) in prerequisites {
+            // The sender is dropped without reporting a success when the prerequisite fails or is skipped
+            match prerequisite.wait_for(Option::is_some).await {
+                Ok(extracted) => variables.extend(
+                    extracted
+                        .iter()
+                        .flat_map(|extracted| extracted.iter())
+                        .map(|(name, value)| (name.clone(), value.clone())),
+                ),
+                Err(_) => {
+                    self.check()?;
+                    bail!(
+                        "Request '{}' skipped, as the request '{}' it depends on failed",
+                        request_id,
+                        id
+                    );
+                }
+            }
+        }
+        self.check()?;
+        Ok(variables)
+    }
+}
@@ -0,0 +1,136 @@
+#[cfg(test)]
+mod tests {
+    use crate::RequestConfig;
+    use crate::interrupt::{Interrupted, StopSignal, is_interrupted};
+    use crate::variables::{Variables, substitute_variables};
+    use anyhow::Context;
+    use serde_json::json;
+    use std::{sync::Arc, time::Duration};
+    use tokio::sync::watch;
+
+    #[tokio::test]
+    async fn test_stop_drops_the_future_in_progress() {
+        let (stop_tx, stop) = StopSignal::new();
+        assert_eq!(stop.unless_stopped(async { 1 }).await.unwrap(), 1);
+
+        let slow = stop.unless_stopped(tokio::time::sleep(Duration::from_secs(60)));
+        let stopping = async {
+            tokio::time::sleep(Duration::from_millis(50)).await;
+            stop_tx.send_replace(true);
+        };
+        let (result, _) = tokio::time::timeout(Duration::from_secs(5), async {
+            tokio::join!(slow, stopping)
+        })
+        .await
+        .expect("The stop didn't drop the future");
+        assert!(result.is_err());
+
+        // Once stopped, nothing starts anymore
+        assert!(stop.is_stopped());
+        assert!(stop.check().is_err());
+        assert!(stop.unless_stopped(async { 1 }).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_never_stops() {
+        let stop = StopSignal::never();
+        assert!(!stop.is_stopped());
+        assert_eq!(stop.unless_stopped(async { 1 }).await.unwrap(), 1);
+        let slept = stop.unless_stopped(tokio::time::sleep(Duration::from_millis(10)));
+        assert!(slept.await.is_ok());
+    }
+
+    #[tokio::test]
+    async fn test_wait_for_prerequisites() {
+        let (stop_tx, stop) = StopSignal::new();
+        // The sender of a prerequisite is dropped once it completed, having reported a success or not
+        let prerequisite = |succeeded: bool| {
+            let (sender, receiver) = watch::channel(None);
+            if succeeded {
+                sender.send_replace(Some(Arc::new(Variables::new())));
+            }
+            ("login".to_string(), receiver)
+        };
+
+        assert!(
+            stop.wait_for_prerequisites("me", vec![prerequisite(true)])
+                .await
+                .is_ok()
+        );
+
+        // A failed prerequisite fails the request, naming it
+        let error = stop
+            .wait_for_prerequisites("me", vec![prerequisite(false)])
+            .await
+            .unwrap_err();
+        assert!(!is_interrupted(&error));
+        assert_eq!(
+            error.to_string(),
+            "Request 'me' skipped, as the request 'login' it depends on failed"
+        );
+
+        // Once interrupted, a prerequisite that didn't succeed was skipped, and so is the request,
+        // while a request whose prerequisites succeeded doesn't start either
+        stop_tx.send_replace(true);
+        let error = stop
+            .wait_for_prerequisites("me", vec![prerequisite(false)])
+            .await
+            .unwrap_err();
+        assert!(is_interrupted(&error));
+        let error = stop
+            .wait_for_prerequisites("me", vec![prerequisite(true)])
+            .await
+            .unwrap_err();
+        assert!(is_interrupted(&error));
+        assert!(stop.wait_for_prerequisites("me", Vec::new()).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_prerequisite_variables() {
+        let stop = StopSignal::never();
+        let (login_sender, login) = watch::channel(None);
+        let (account_sender, account) = watch::channel(None);
+
+        // The prerequisites complete while the request waits for them
+        tokio::spawn(async move {
+            tokio::time::sleep(Duration::from_millis(20)).await;
+            let extracted = Variables::from([
+                ("token".to_string(), "abc".to_string()),
+                ("user".to_string(), "ann".to_string()),
+            ]);
+            login_sender.send_replace(Some(Arc::new(extracted)));
+            let extracted = Variables::from([("user".to_string(), "bob".to_string())]);
+            account_sender.send_replace(Some(Arc::new(extracted)));
+        });
+        let variables = stop
+            .wait_for_prerequisites(
+                "profile",
+                vec![
+                    ("login".to_string(), login),
+                    ("account".to_string(), account),
+                ],
+            )
+            .await
+            .unwrap();
+        // The prerequisite listed last wins
+        assert_eq!(variables["user"], "bob");
+
+        let profile: RequestConfig = serde_json::from_value(json!({
+            "url": "http://api/users/{{user}}",
+            "headers": {"Authorization": ["Bearer {{token}}"]}
+        }))
+        .unwrap();
+        let substituted = substitute_variables(&profile, &variables).unwrap();
+        assert_eq!(substituted.url, "http://api/users/bob");
+        assert_eq!(substituted.headers["Authorization"], vec!["Bearer abc"]);
+    }
+
+    #[test]
+    fn test_is_interrupted() {
+        let error = Err::<(), _>(Interrupted)
+            .context("Failed to get response for request 'me'")
+            .unwrap_err();
+        assert!(is_interrupted(&error));
+        assert!(!is_interrupted(&anyhow::anyhow!("connection refused")));
+    }
+}
@@ -1,33 +1,93 @@
+mod compare_env;
+mod config;
+mod cookies;
+mod dates;
+mod db;
 mod diff_finder;
+mod env_vars;
+mod exit_status;
+mod fetch;
+mod flow_permits;
+mod har;
+mod interrupt;
 mod printer;
+mod recording;
+mod redact;
+mod report;
+mod run_id;
+mod severity;
+#[cfg(test)]
+mod test_server;
+mod variables;
+mod webhook;
 
-use crate::diff_finder::compute_differences;
+use crate::compare_env::{BaseUrls, on_other_environment};
+use crate::config::{
+    AcceptableStatuses, ConfigSource, RequestAuth, RequestChange, StatusRange, SuccessPredicate,
+    TagFilter, diff_configs, is_config_file, load_all_configs, load_configs, skip_disabled,
+    validate_configs,
+};
+use crate::cookies::CookieJar;
+use crate::dates::format_iso8601;
+use crate::db::{
+    DEFAULT_BASELINE_NAME, clear_baseline, find_baseline_timings, find_baseline_variants,
+    find_baselined_request_ids, find_latency_history, find_previous_response,
+    find_response_history, init_db, list_responses, open_read_only_db, preload_previous_responses,
+    save_baseline_variant, save_response,
+};
+use crate::diff_finder::{
+    BodyAssertion, DEFAULT_MAX_DIFF_DEPTH, DEFAULT_MAX_VALUE_LENGTH, DEFAULT_PATH_SEPARATOR,
+    DiffOptions, Difference, Tolerance, check_max_latency, compare_latency,
+    compare_latency_percentile, compare_timings, compute_differences,
+    compute_differences_to_closest, find_array_order_changes, find_expected_header_mismatches,
+    find_failed_assertions, find_forbidden_substrings,
+};
+use crate::fetch::{
+    BodyMemoryGovernor, DEFAULT_RETRY_BACKOFF, FetchedResponse, HostLimiter, ResponseLimits,
+    RetryBackoff, build_request, fetch_with_retries, format_request, load_ca_bundle, with_proxy,
+};
+use crate::flow_permits::FlowPermits;
+use crate::har::HarRecorder;
+use crate::interrupt::{StopSignal, is_interrupted};
 use anyhow::{Context, Result, bail};
 use clap::{Args, Parser};
+use colored::Colorize;
+use env_vars::{env_number, max_retries, requests_per_host};
+use exit_status::{ExitStatus, RunCounters};
 use log::debug;
-use printer::{DifferencesPrinter, DifferencesPrinterMessage};
-use reqwest::Client;
+use printer::{
+    DifferencesPrinter, DifferencesPrinterMessage, OutputFormat, PrinterOptions, RequestOutcome,
+    colors_enabled,
+};
+use recording::{record, replay};
+use redact::{RedactPattern, redact_differences};
+use run_id::generate_run_id;
 use serde::{Deserialize, Serialize};
 use serde_json::Value;
-use sqlx::{
-    Pool, Row, Sqlite,
-    sqlite::{SqliteConnectOptions, SqlitePoolOptions},
-};
-use std::cmp::max;
+use severity::{Severities, Severity, SeverityRule};
 use std::{
-    collections::{HashMap, HashSet},
+    collections::{BTreeMap, HashMap, HashSet},
     env::{self},
-    path::PathBuf,
-    process,
-    str::FromStr,
-    sync::{Arc, atomic::AtomicUsize},
-    time::Duration,
-};
-use tokio::{
-    fs,
-    sync::{Mutex, Semaphore},
-    task::JoinSet,
+    io::IsTerminal,
+    path::{Path, PathBuf},
+    process::ExitCode,
+    sync::Arc,
+    time::{Duration, SystemTime},
 };
+use tokio::{fs, task::JoinSet};
+use variables::{Variables, extract_variables, substitute_variables};
+use webhook::{RunSummary, WebhookFormat, notify_webhook};
+
+/// Print a progress or summary line to stdout, or to stderr when stdout carries the JSON output
+macro_rules! status {
+    ($json_output:expr, $($arg:tt)*) => {
+        if $json_output {
+            eprintln!($($arg)*);
+        } else {
+            println!($($arg)*);
+        }
+    };
+}
 
 #[derive(Serialize, Deserialize, PartialEq, Debug, Default, Clone)]
 struct ParsedBody {
@@ -35,12 +95,36 @@ struct ParsedBody {
     json: Option<Value>,
 }
 
+/// A redirect followed on the way to the final response
+#[derive(Serialize, Deserialize, PartialEq, Debug, Clone)]
+struct RedirectHop {
+    status_code: u16,
+    location: String,
+}
+
+/// The size of a response body, as transferred and once decoded
+#[derive(Serialize, Deserialize, PartialEq, Debug, Clone, Copy)]
+struct BodySize {
+    /// The announced Content-Length, or the bytes read when it isn't announced
+    wire_bytes: u64,
+    decoded_bytes: u64,
+    /// Whether the body was cut at the size limit, in which case it's neither parsed, compared nor saved
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    truncated: bool,
+}
+
 #[derive(Serialize, Deserialize, PartialEq, Debug, Default)]
 struct HttpResponseData {
     status_code: u16,
     #[serde(default, skip_serializing_if = "HashMap::is_empty")]
     headers: HashMap<String, Vec<String>>,
     body: ParsedBody,
+    /// The redirects followed to get the response, if they were captured
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    redirects: Option<Vec<RedirectHop>>,
+    /// The size of the body, if it was recorded when fetching the response
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    body_size: Option<BodySize>,
 }
 
 impl HttpResponseData {
@@ -56,14 +140,8 @@ impl HttpResponseData {
 
         let mut json_body = None;
 
-        // Check if the response is JSON (using normalized header key)
-        if let Some(content_types) = normalized_headers.get("content-type") {
-            if content_types
-                .iter()
-                .any(|ct| ct.to_lowercase().starts_with("application/json"))
-            {
-                json_body = serde_json::from_str(&body).ok()
-            }
+        if is_json(&normalized_headers) {
+            json_body = serde_json::from_str(&body).ok()
         }
 
         HttpResponseData {
@@ -73,17 +151,124 @@ impl HttpResponseData {
                 json: json_body,
                 raw: body,
             },
+            redirects: None,
+            body_size: None,
         }
     }
+
+    /// Whether the body was cut at the size limit
+    fn is_truncated(&self) -> bool {
+        self.body_size.is_some_and(|size| size.truncated)
+    }
+}
+
+/// Whether the response headers, with lowercase names, announce a JSON body
+fn is_json(headers: &HashMap<String, Vec<String>>) -> bool {
+    headers.get("content-type").is_some_and(|content_types| {
+        content_types
+            .iter()
+            .any(|ct| ct.to_lowercase().starts_with("application/json"))
+    })
 }
 
 #[derive(Serialize, Deserialize, Debug, Clone)]
 struct RequestConfig {
     url: String,
+    /// The URL of the same step on the other environment, for --compare-env
+    compare_url: Option<String>,
     #[serde(default)]
     headers: HashMap<String, Vec<String>>,
     #[serde(default)]
     body: Value,
+    /// How the body is encoded: a JSON object is sent as a form for `application/x-www-form-urlencoded`
+    /// and `multipart/form-data`, as JSON otherwise. Sent as the `Content-Type` header unless one is set
+    content_type: Option<String>,
+    auth: Option<RequestAuth>,
+    retry_backoff_ms: Option<u64>,
+    max_retry_backoff_ms: Option<u64>,
+    /// How long an attempt can take, overriding the timeout of the client
+    timeout_ms: Option<u64>,
+    /// Maximum size of the response body, overriding --max-body-bytes
+    max_body_bytes: Option<usize>,
+    /// Whether the request can safely be retried. Defaults to false for POST and PATCH, true otherwise
+    idempotent: Option<bool>,
+    /// Whether redirects are followed, overriding --follow-redirects. When they aren't, the 3xx response is checked
+    follow_redirects: Option<bool>,
+    /// Status codes of the responses to retry, 5xx and 429 by default
+    retry_on_status: Option<Vec<StatusRange>>,
+    /// Status codes failing the request at once, without any retry, e.g. 401 for an expired token
+    #[serde(default)]
+    fail_on_status: Vec<StatusRange>,
+    #[serde(
+        default,
+        deserialize_with = "deserialize_method",
+        serialize_with = "serialize_method"
+    )]
+    method: Option<reqwest::Method>,
+    /// The step is only sent for the flow to run, e.g. a login or cleanup, and never checked
+    #[serde(default)]
+    capture_only: bool,
+    /// Variables extracted from the JSON body of the response, by name, at the given paths.
+    /// Later steps use them as `{{name}}` in their URL, headers and body.
+    #[serde(default)]
+    extract: BTreeMap<String, String>,
+}
+
+fn serialize_method<S>(method: &Option<reqwest::Method>, serializer: S) -> Result<S::Ok, S::Error>
+where
+    S: serde::Serializer,
+{
+    method
+        .as_ref()
+        .map(reqwest::Method::as_str)
+        .serialize(serializer)
+}
+
+fn deserialize_method<'de, D>(deserializer: D) -> Result<Option<reqwest::Method>, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    let Some(method) = Option::<String>::deserialize(deserializer)? else {
+        return Ok(None);
+    };
+    reqwest::Method::from_bytes(method.to_uppercase().as_bytes())
+        .map(Some)
+        .map_err(|_| serde::de::Error::custom(format!("invalid HTTP method '{}'", method)))
+}
+
+impl RequestConfig {
+    /// The HTTP method of the request: the configured one if any, else POST when it has a body, GET otherwise
+    fn method(&self) -> reqwest::Method {
+        if let Some(method) = &self.method {
+            method.clone()
+        } else if self.body.is_null() {
+            reqwest::Method::GET
+        } else {
+            reqwest::Method::POST
+        }
+    }
+
+    fn is_idempotent(&self) -> bool {
+        self.idempotent.unwrap_or_else(|| {
+            !matches!(
+                self.method(),
+                reqwest::Method::POST | reqwest::Method::PATCH
+            )
+        })
+    }
+
+    /// Whether a response with the status is retried
+    fn retries_on_status(&self, status: u16) -> bool {
+        match &self.retry_on_status {
+            Some(ranges) => ranges.iter().any(|r| r.contains(status)),
+            None => status >= 500 || status == 429,
+        }
+    }
+
+    /// Whether a response with the status fails the request at once
+    fn fails_on_status(&self, status: u16) -> bool {
+        self.fail_on_status.iter().any(|r| r.contains(status))
+    }
 }
 
 #[derive(Serialize, Deserialize, Debug, Clone)]
@@ -91,160 +276,936 @@ struct RequestFlowConfig {
     id: String,
     flow: Vec<RequestConfig>,
     ignore_paths: Option<HashSet<String>>,
+    /// Headers whose changes aren't reported, e.g. `Date` or `X-Request-Id`, matched case-insensitively
+    #[serde(default)]
+    ignore_headers: HashSet<String>,
+    /// Send the steps before the last one concurrently, as they don't depend on each other
+    #[serde(default)]
+    parallel: bool,
+    acceptable_statuses: Option<AcceptableStatuses>,
+    /// Status codes the last response must have, whatever the baseline one, checked in every mode
+    expected_status: Option<AcceptableStatuses>,
+    /// How much the numbers at the given paths can drift from the baseline without being reported
+    #[serde(default)]
+    numeric_tolerances: HashMap<String, Tolerance>,
+    /// How much the numbers at the paths without a tolerance of their own can drift from the baseline
+    numeric_tolerance: Option<Tolerance>,
+    /// The latency above which the last response is reported, with or without a baseline
+    max_latency_ms: Option<u64>,
+    /// How much the latency of the last response can grow from the baseline one, in milliseconds or percentage
+    max_latency_increase: Option<Tolerance>,
+    /// Key fields matching the elements of the arrays at the given paths, instead of whole elements
+    #[serde(default)]
+    array_keys: HashMap<String, String>,
+    /// Paths whose values are masked in the reported differences
+    #[serde(default)]
+    redact_paths: HashSet<String>,
+    /// Regexes matching sensitive values, masked wherever they appear in the reported differences
+    #[serde(default)]
+    redact_patterns: Vec<RedactPattern>,
+    /// Compare only the structure of the JSON body, for responses whose values change constantly
+    #[serde(default)]
+    shape_only: bool,
+    /// Substrings that must never appear in the body of the last response, e.g. error messages
+    #[serde(default)]
+    forbidden_substrings: Vec<String>,
+    /// Headers the last response must have, with the given value, e.g. security headers
+    #[serde(default)]
+    expected_headers: BTreeMap<String, String>,
+    /// A condition the body of the last response must meet, for requests failing with a 2xx status code
+    success_if: Option<SuccessPredicate>,
+    /// Conditions the body of the last response must meet, reported as differences when unmet
+    #[serde(default)]
+    assertions: Vec<BodyAssertion>,
+    /// IDs of the requests of the same config that must succeed before this one is sent
+    #[serde(default)]
+    depends_on: Vec<String>,
+    /// Labels selecting the request with --tags and --exclude-tags, e.g. `smoke` or `payments`
+    #[serde(default)]
+    tags: Vec<String>,
+    /// Whether the request is run, true by default. A disabled request is skipped along with the ones depending on it
+    enabled: Option<bool>,
 }
 
 #[derive(Serialize, Deserialize, Debug, Clone)]
 struct SanityCheckConfig {
     requests: Vec<RequestFlowConfig>,
+    /// Paths ignored for all the requests of the config, on top of their own
+    #[serde(default)]
+    ignore_paths: HashSet<String>,
+    /// Headers ignored for all the requests of the config, on top of their own
+    #[serde(default)]
+    ignore_headers: HashSet<String>,
 }
 
-async fn fetch_response(
-    url: &str,
-    headers: &HashMap<String, Vec<String>>,
-    body: &Value,
-    client: &Client,
-    semaphore: &Semaphore,
-) -> Result<HttpResponseData> {
-    let request_builder = if body.is_null() {
-        client.get(url)
+/// The database used without --db or DB_PATH, in the working directory
+const DEFAULT_DB_PATH: &str = "release-sanity-checker-data.db";
+
+/// Number of past latencies of a request compared against with --latency-percentile
+const LATENCY_HISTORY_RUNS: usize = 20;
+/// Number of past latencies needed before a request is compared against its history
+const LATENCY_HISTORY_MIN_RUNS: usize = 5;
+
+/// Identifies the checks in the logs of the servers they hit
+const DEFAULT_USER_AGENT: &str = concat!(env!("CARGO_PKG_NAME"), "/", env!("CARGO_PKG_VERSION"));
+
+#[derive(Parser, Debug)]
+#[command(author, version, about, long_about = None)]
+struct Cli {
+    #[arg(value_name = "FILE")]
+    files: Vec<PathBuf>,
+
+    #[command(flatten)]
+    options: Options,
+}
+
+#[derive(Args, Debug)]
+struct Options {
+    #[arg(long, value_name = "DIRECTORY", conflicts_with = "files")]
+    directory: Option<PathBuf>,
+
+    #[arg(long, value_name = "TAGS", value_delimiter = ',')]
+    tags: Vec<String>,
+
+    #[arg(long, value_name = "TAGS", value_delimiter = ',')]
+    exclude_tags: Vec<String>,
+
+    #[arg(long)]
+    ignore_headers: bool,
+
+    #[arg(long)]
+    canonical_json: bool,
+
+    #[arg(long)]
+    coerce_numeric_strings: bool,
+
+    #[arg(long)]
+    coerce_boolean_strings: bool,
+
+    #[arg(long)]
+    normalize_dates: bool,
+
+    #[arg(long)]
+    allow_empty_additions: bool,
+
+    #[arg(long = "normalize-header", value_name = "NAME")]
+    normalized_headers: Vec<String>,
+
+    #[arg(long, value_name = "SEPARATOR", default_value = DEFAULT_PATH_SEPARATOR, value_parser = clap::builder::NonEmptyStringValueParser::new())]
+    path_separator: String,
+
+    #[arg(long)]
+    baseline: bool,
+
+    #[arg(long, requires = "baseline")]
+    baseline_variant: bool,
+
+    #[arg(long, value_name = "PATH")]
+    db: Option<String>,
+
+    #[arg(long, value_name = "PATH", conflicts_with = "baseline")]
+    baseline_db: Option<String>,
+
+    #[arg(long)]
+    compress_bodies: bool,
+
+    #[arg(long)]
+    verbose: bool,
+
+    #[arg(long, value_enum, default_value = "text", conflicts_with = "verbose")]
+    output: OutputFormat,
+
+    #[arg(long)]
+    include_unchanged: bool,
+
+    #[arg(long)]
+    no_color: bool,
+
+    #[arg(long, default_value_t = true, action = clap::ArgAction::Set)]
+    fail_on_change: bool,
+
+    #[arg(long)]
+    collapse_repeated: bool,
+
+    #[arg(long, value_name = "DEPTH", default_value_t = DEFAULT_MAX_DIFF_DEPTH)]
+    max_diff_depth: usize,
+
+    #[arg(long, value_name = "CHARS", default_value_t = DEFAULT_MAX_VALUE_LENGTH)]
+    max_value_length: usize,
+
+    #[arg(long = "severity", value_name = "KIND=SEVERITY")]
+    severities: Vec<SeverityRule>,
+
+    #[arg(long, conflicts_with = "baseline")]
+    check_ordering: bool,
+
+    #[arg(long, conflicts_with_all = ["baseline", "check_ordering", "preload_baselines", "record", "replay"])]
+    compare_env: bool,
+
+    #[arg(long, num_args = 2, value_names = ["REFERENCE", "OTHER"], requires = "compare_env")]
+    compare_base_urls: Option<Vec<String>>,
+
+    #[arg(long, value_name = "BOOL", default_value_t = true, action = clap::ArgAction::Set)]
+    follow_redirects: bool,
+
+    #[arg(long)]
+    capture_redirects: bool,
+
+    #[arg(long, conflicts_with = "baseline")]
+    read_only: bool,
+
+    #[arg(long, value_name = "NAME")]
+    env: Option<String>,
+
+    #[arg(long, value_name = "LABEL")]
+    label: Option<String>,
+
+    #[arg(long, value_name = "NAME", default_value = DEFAULT_BASELINE_NAME)]
+    baseline_name: String,
+
+    #[arg(long, value_name = "USER_AGENT", default_value = DEFAULT_USER_AGENT)]
+    user_agent: String,
+
+    #[arg(long)]
+    insecure: bool,
+
+    #[arg(long, value_name = "URL")]
+    proxy: Option<reqwest::Url>,
+
+    #[arg(long, value_name = "FILE")]
+    har: Option<PathBuf>,
+
+    #[arg(long, value_name = "MILLISECONDS")]
+    timing_threshold_ms: Option<u64>,
+
+    #[arg(long, value_name = "PERCENTILE", value_parser = parse_percentile)]
+    latency_percentile: Option<f64>,
+
+    #[arg(long, value_name = "BYTES")]
+    max_total_body_bytes: Option<usize>,
+
+    #[arg(long, value_name = "FLOWS", default_value_t = 20, value_parser = clap::value_parser!(u32).range(1..))]
+    concurrency: u32,
+
+    #[arg(long, value_name = "BYTES")]
+    max_body_bytes: Option<usize>,
+
+    #[arg(long, value_name = "DEPTH")]
+    max_json_depth: Option<usize>,
+
+    #[arg(long, value_name = "DIRECTORY")]
+    diff_dir: Option<PathBuf>,
+
+    #[arg(long, value_name = "FILE")]
+    report: Option<PathBuf>,
+
+    #[arg(long, value_name = "DIRECTORY")]
+    record: Option<PathBuf>,
+
+    #[arg(long, value_name = "DIRECTORY", conflicts_with = "record")]
+    replay: Option<PathBuf>,
+
+    #[arg(long, value_name = "COMMAND")]
+    pre_hook: Option<String>,
+
+    #[arg(long, value_name = "COMMAND")]
+    post_hook: Option<String>,
+
+    #[arg(long, value_name = "URL")]
+    webhook: Option<reqwest::Url>,
+
+    #[arg(long, value_enum, default_value = "generic", requires = "webhook")]
+    webhook_format: WebhookFormat,
+
+    #[arg(long, num_args = 2, value_names = ["OLD", "NEW"], conflicts_with_all = ["files", "directory"])]
+    diff_config: Option<Vec<PathBuf>>,
+
+    #[arg(long, conflicts_with_all = ["baseline", "diff_config"])]
+    baseline_plan: bool,
+
+    #[arg(long)]
+    skip_validation: bool,
+
+    #[arg(long, conflicts_with_all = ["baseline", "diff_config", "baseline_plan", "clear_baseline", "list", "history", "check_ordering", "compare_env"])]
+    dry_run: bool,
+
+    #[arg(long, value_name = "REQUEST_ID", num_args = 0..=1, default_missing_value = "", conflicts_with_all = ["baseline", "diff_config", "baseline_plan"])]
+    clear_baseline: Option<String>,
+
+    #[arg(long, conflicts_with_all = ["baseline", "diff_config", "baseline_plan", "clear_baseline"])]
+    list: bool,
+
+    #[arg(long, value_name = "REQUEST_ID", conflicts_with_all = ["baseline", "diff_config", "baseline_plan", "clear_baseline", "list"])]
+    history: Option<String>,
+
+    #[arg(long, conflicts_with_all = ["baseline", "check_ordering"])]
+    preload_baselines: bool,
+
+    #[arg(long, value_name = "INTERVAL", value_parser = parse_interval, conflicts_with_all = ["diff_config", "baseline_plan"])]
+    watch: Option<Duration>,
+
+    #[arg(long, requires = "watch")]
+    watch_changes_only: bool,
+}
+
+/// Parse a watch interval, in seconds or with a unit, e.g. `30`, `500ms`, `30s`, `5m` or `1h`
+fn parse_interval(value: &str) -> Result<Duration, String> {
+    let split = value
+        .find(|c: char| !c.is_ascii_digit())
+        .unwrap_or(value.len());
+    let (amount, unit) = value.split_at(split);
+    let amount: u64 = amount
+        .parse()
+        .map_err(|_| format!("invalid interval '{}', expected e.g. 30s or 5m", value))?;
+
+    let interval = match unit.trim() {
+        "ms" => Duration::from_millis(amount),
+        "" | "s" => Duration::from_secs(amount),
+        "m" => Duration::from_secs(amount * 60),
+        "h" => Duration::from_secs(amount * 3600),
+        _ => {
+            return Err(format!(
+                "invalid interval unit '{}', expected ms, s, m or h",
+                unit
+            ));
+        }
+    };
+    if interval.is_zero() {
+        return Err("the interval must be greater than zero".to_string());
+    }
+
+    Ok(interval)
+}
+
+/// Parse a percentile, e.g. `95` or `99.9`
+fn parse_percentile(value: &str) -> Result<f64, String> {
+    match value.trim_start_matches('p').parse::<f64>() {
+        Ok(percentile) if percentile > 0.0 && percentile <= 100.0 => Ok(percentile),
+        _ => Err(format!(
+            "invalid percentile '{}', expected a number between 0 and 100, e.g. 95",
+            value
+        )),
+    }
+}
+
+/// Wait for SIGINT, or SIGTERM on Unix. Never returns if the signals can't be listened to
+async fn shutdown_signal() {
+    #[cfg(unix)]
+    let terminate = async {
+        match tokio::signal::unix::signal(tokio::signal::unix::SignalKind::terminate()) {
+            Ok(mut signal) => {
+                signal.recv().await;
+            }
+            Err(_) => std::future::pending().await,
+        }
+    };
+    #[cfg(not(unix))]
+    let terminate = std::future::pending::<()>();
+
+    let interrupt = async {
+        if tokio::signal::ctrl_c().await.is_err() {
+            std::future::pending::<()>().await;
+        }
+    };
+
+    tokio::select! {
+        _ = interrupt => {}
+        _ = terminate => {}
+    }
+}
+
+/// Run a shell command, failing if it can't be started or exits unsuccessfully.
+/// With the JSON output, the output of the command goes to stderr, stdout being kept for the differences.
+async fn run_hook(name: &str, command: &str, json_output: bool) -> Result<()> {
+    status!(json_output, "Running {}: {}", name, command);
+
+    let (shell, flag) = if cfg!(windows) {
+        ("cmd", "/C")
     } else {
-        client.post(url).body(body.to_string())
+        ("sh", "-c")
     };
+    let mut process = tokio::process::Command::new(shell);
+    process.args([flag, command]);
+    if json_output {
+        process.stdout(std::io::stderr());
+    }
+    let status = process
+        .status()
+        .await
+        .with_context(|| format!("Failed to run {} '{}'", name, command))?;
 
-    let mut header_map = reqwest::header::HeaderMap::new();
-    for (k, vs) in headers {
-        if let Ok(header_name) = k.parse::<reqwest::header::HeaderName>() {
-            for v in vs {
-                if let Ok(header_value) = v.parse() {
-                    header_map.append(header_name.clone(), header_value);
+    if !status.success() {
+        bail!("{} '{}' failed with {}", name, command, status);
+    }
+
+    Ok(())
+}
+
+/// Sends the requests of flow steps, with the client and limits shared by all the flows of the run
+#[derive(Clone)]
+struct StepSender {
+    http_client: reqwest::Client,
+    host_limiter: HostLimiter,
+    body_memory: Option<BodyMemoryGovernor>,
+    limits: ResponseLimits,
+    /// Stops the requests in progress and the flows between their steps when the run is interrupted
+    stop: StopSignal,
+    max_retries: u16,
+    retry_backoff: RetryBackoff,
+    follow_redirects: bool,
+    capture_redirects: bool,
+    har: Option<Arc<HarRecorder>>,
+    verbose: bool,
+    /// Directory where the responses are recorded
+    record_dir: Option<PathBuf>,
+    /// Directory where recorded responses are served from, instead of sending the requests
+    replay_dir: Option<PathBuf>,
+}
+
+impl StepSender {
+    /// Send a step of a request's flow, `step` being its index in the flow
+    async fn send(
+        &self,
+        request_id: &str,
+        step: usize,
+        flow: &RequestConfig,
+    ) -> Result<FetchedResponse> {
+        let started = SystemTime::now();
+        let response = match &self.replay_dir {
+            Some(dir) => replay(dir, request_id, step).await?,
+            None => {
+                debug!("Sending request {} to {}", request_id, flow.url);
+                fetch_with_retries(
+                    flow,
+                    &self.http_client,
+                    &self.host_limiter,
+                    self.body_memory.as_ref(),
+                    self.limits,
+                    &self.stop,
+                    self.max_retries,
+                    self.retry_backoff,
+                    self.follow_redirects,
+                    self.capture_redirects,
+                )
+                .await
+                .with_context(|| format!("Failed to get response for request '{}'", request_id))?
+            }
+        };
+
+        debug!("Request {} to {} done", request_id, flow.url);
+        if let Some(dir) = &self.record_dir {
+            record(dir, request_id, step, &response).await?;
+        }
+        if let Some(har) = &self.har {
+            har.record(request_id, flow, started, &response);
+        }
+        if self.verbose {
+            println!(
+                "Request '{}' to {}: redirects {} ms, time to first byte {} ms, download {} ms",
+                request_id,
+                flow.url,
+                response.timings.redirects_ms,
+                response.timings.time_to_first_byte_ms,
+                response.timings.download_ms
+            );
+            if let Some(size) = &response.data.body_size {
+                println!(
+                    "Request '{}' to {}: body of {} bytes on the wire, {} bytes decoded",
+                    request_id, flow.url, size.wire_bytes, size.decoded_bytes
+                );
+            }
+        }
+
+        Ok(response)
+    }
+
+    /// Send a step with the variables extracted by the previous steps substituted and the cookies they got,
+    /// then extract its own variables from its response and keep its cookies.
+    /// The step as sent is returned along with its response.
+    async fn send_chained(
+        &self,
+        request_id: &str,
+        step: usize,
+        flow: &RequestConfig,
+        variables: &mut Variables,
+        cookies: &CookieJar,
+        separator: &str,
+    ) -> Result<(RequestConfig, FetchedResponse)> {
+        self.stop.check()?;
+        let flow = substitute_variables(flow, variables).with_context(|| {
+            format!(
+                "Failed to prepare step {} of request '{}'",
+                step, request_id
+            )
+        })?;
+        let flow = cookies.apply(&flow);
+        let response = self.send(request_id, step, &flow).await?;
+        cookies.store_response(&response);
+        extract_variables(&flow, &response.data, separator, variables).with_context(|| {
+            format!(
+                "Failed to extract variables from step {} of request '{}'",
+                step, request_id
+            )
+        })?;
+
+        Ok((flow, response))
+    }
+}
+
+/// Print how the body size of a request changed since the baseline. A change of the decoded size comes
+/// with a content change, while a change of the wire size alone points at the transfer or the encoding.
+fn print_body_size_change(request_id: &str, old: &BodySize, new: &BodySize, json_output: bool) {
+    if old.decoded_bytes != new.decoded_bytes {
+        status!(
+            json_output,
+            "Request '{}': decoded body size changed from {} to {} bytes (wire size from {} to {} bytes)",
+            request_id,
+            old.decoded_bytes,
+            new.decoded_bytes,
+            old.wire_bytes,
+            new.wire_bytes
+        );
+    } else if old.wire_bytes != new.wire_bytes {
+        status!(
+            json_output,
+            "Request '{}': wire body size changed from {} to {} bytes while the decoded body kept its {} bytes, the transfer encoding may have changed",
+            request_id,
+            old.wire_bytes,
+            new.wire_bytes,
+            new.decoded_bytes
+        );
+    }
+}
+
+/// Print the requests added, removed or modified between two versions of a config
+async fn print_config_changes(
+    old_path: &Path,
+    new_path: &Path,
+    client: &reqwest::Client,
+) -> Result<()> {
+    let old = load_configs(&ConfigSource::from(old_path.to_path_buf()), client).await?;
+    let new = load_configs(&ConfigSource::from(new_path.to_path_buf()), client).await?;
+
+    let changes = diff_configs(&old, &new)?;
+    for change in &changes {
+        match change {
+            RequestChange::Added { id } => {
+                println!("{}", format!("+ Added request '{}'", id).green())
+            }
+            RequestChange::Removed { id } => {
+                println!("{}", format!("- Removed request '{}'", id).red())
+            }
+            RequestChange::Modified { id, fields } => {
+                println!("{}", format!("~ Modified request '{}':", id).yellow());
+                for field in fields {
+                    println!("    {}", field);
+                }
+            }
+        }
+    }
+    println!(
+        "\nConfig comparison completed. Changed requests: {}",
+        changes.len()
+    );
+
+    Ok(())
+}
+
+/// Print which requests of the configs already have a baseline and which don't, without sending any request
+async fn print_baseline_plan(
+    config_paths: Vec<PathBuf>,
+    tag_filter: &TagFilter,
+    db_path: &str,
+    baseline_name: &str,
+    client: &reqwest::Client,
+) -> Result<()> {
+    let db = init_db(db_path).await?;
+    let baselined = find_baselined_request_ids(baseline_name, &db).await?;
+
+    let (mut existing, mut new) = (Vec::new(), Vec::new());
+    for config_path in config_paths {
+        for config in load_configs(&ConfigSource::from(config_path), client).await? {
+            let (requests, _) = skip_disabled(tag_filter.select(config.requests));
+            for request in requests {
+                if let Some(label) = baselined.get(&request.id) {
+                    existing.push(match label {
+                        Some(label) => format!("{} (label: {})", request.id, label),
+                        None => request.id,
+                    });
                 } else {
-                    eprintln!("Could not parse header value for {}:{}", k, v);
+                    new.push(request.id);
                 }
             }
-        } else {
-            eprintln!("Could not parse header name: {}", k);
         }
     }
 
-    debug!("Acquiring semaphore for request to {}...", url);
-    let _permit = semaphore
-        .acquire()
-        .await
-        .context("Failed to acquire semaphore")?;
-    debug!(
-        "Semaphore for request to {} acquired! Sending request...",
-        url
+    println!("Already baselined, would be skipped:");
+    for id in &existing {
+        println!("{}", format!("  = {}", id).dimmed());
+    }
+    println!("Without a baseline, would be fetched and stored:");
+    for id in &new {
+        println!("{}", format!("  + {}", id).green());
+    }
+    println!(
+        "\nBaseline plan completed. Already baselined: {}, New: {}",
+        existing.len(),
+        new.len()
     );
-    let response = request_builder
-        .headers(header_map)
-        .send()
-        .await
-        .with_context(|| format!("Failed to send request to {}", url))?;
-
-    let status = response.status().as_u16();
-    let mut resp_headers: HashMap<String, Vec<String>> = HashMap::new();
-    for (k, v) in response.headers().iter() {
-        resp_headers
-            .entry(k.to_string())
-            .or_default()
-            .push(v.to_str().unwrap_or_default().to_string());
-    }
-    let text = response
-        .text()
-        .await
-        .with_context(|| format!("Failed to read response body from {}", url))?;
 
-    Ok(HttpResponseData::new(status, resp_headers, text))
+    Ok(())
 }
 
-/// Find previous response for a request ID, if it exists
-async fn find_previous_response(
-    request_id: &str,
-    headers_ignored: bool,
-    db: &Pool<Sqlite>,
-) -> Result<Option<HttpResponseData>> {
-    let query = if headers_ignored {
-        "SELECT baseline_status_code, baseline_body FROM response WHERE request_id = ?"
+/// Load the configs of every path of the run, by path. Every config failing to load and, unless validation
+/// is skipped, every problem found in the loaded ones is reported, and the run fails before any request is sent.
+async fn load_run_configs(
+    config_paths: &[PathBuf],
+    client: &reqwest::Client,
+    validate: bool,
+) -> Result<Vec<Vec<SanityCheckConfig>>> {
+    let sources: Vec<ConfigSource> = config_paths
+        .iter()
+        .cloned()
+        .map(ConfigSource::from)
+        .collect();
+    let (loaded, load_errors) = load_all_configs(&sources, client).await;
+    let validation_errors = if validate {
+        validate_configs(&loaded)
     } else {
-        "SELECT baseline_status_code, baseline_body, baseline_headers FROM response WHERE request_id = ?"
+        Vec::new()
     };
 
-    match sqlx::query(query)
-        .persistent(true)
-        .bind(request_id)
-        .fetch_optional(db)
-        .await
-        .context("Failed to query previous response from database")?
-    {
-        Some(row) => {
-            let headers = if !headers_ignored {
-                let headers_str: &str = row.get("baseline_headers");
-                serde_json::from_str(headers_str).unwrap_or_default()
-            } else {
-                HashMap::new()
-            };
+    for e in load_errors.iter().chain(&validation_errors) {
+        eprintln!("Error: {:#}", e);
+    }
+    if !load_errors.is_empty() {
+        bail!(
+            "{} configs failed to load, no request was sent",
+            load_errors.len()
+        );
+    }
+    if !validation_errors.is_empty() {
+        bail!(
+            "Found {} problems in the configs, no request was sent. Use --skip-validation to run anyway",
+            validation_errors.len()
+        );
+    }
 
-            let body: String = row.get("baseline_body");
+    Ok(loaded.into_iter().map(|(_, configs)| configs).collect())
+}
 
-            Ok(Some(HttpResponseData::new(
-                row.get("baseline_status_code"),
-                headers,
-                body,
-            )))
+/// Print the requests of the flows as they would be sent, without sending any of them.
+/// The variables extracted from the responses are left as `{{name}}` placeholders in the later steps.
+async fn print_planned_requests(
+    config_paths: &[PathBuf],
+    tag_filter: &TagFilter,
+    validate: bool,
+    client: &reqwest::Client,
+) -> Result<ExitStatus> {
+    let (mut planned, mut errors_count) = (0, 0);
+    for configs in load_run_configs(config_paths, client, validate).await? {
+        for config in configs {
+            let (requests, _) = skip_disabled(tag_filter.select(config.requests));
+            for request in requests {
+                let mut variables = Variables::new();
+                for (step, flow) in request.flow.iter().enumerate() {
+                    let planned_request = substitute_variables(flow, &variables)
+                        .and_then(|flow| build_request(&flow, client))
+                        .with_context(|| {
+                            format!(
+                                "Failed to prepare step {} of request '{}'",
+                                step, request.id
+                            )
+                        });
+                    match planned_request {
+                        Ok(planned_request) => {
+                            println!(
+                                "{}",
+                                format!("Request '{}', step {}:", request.id, step).bold()
+                            );
+                            println!("{}", format_request(&planned_request));
+                            planned += 1;
+                        }
+                        Err(e) => {
+                            errors_count += 1;
+                            eprintln!("Error: {:#}", e);
+                            break;
+                        }
+                    }
+                    variables.extend(
+                        flow.extract
+                            .keys()
+                            .map(|name| (name.clone(), format!("{{{{{}}}}}", name))),
+                    );
+                }
+            }
         }
-        None => Ok(None),
     }
+
+    println!(
+        "Dry run completed, no request was sent. Planned requests: {}, errors: {}",
+        planned, errors_count
+    );
+    Ok(ExitStatus::of_run(0, errors_count, false))
 }
 
-#[derive(Parser, Debug)]
-#[command(author, version, about, long_about = None)]
-struct Cli {
-    #[arg(value_name = "FILE")]
-    files: Vec<PathBuf>,
+/// Print the responses stored in the database as a table, one row per request and baseline name
+async fn print_stored_responses(db_path: &str) -> Result<()> {
+    let db = init_db(db_path).await?;
+    let responses = list_responses(&db).await?;
 
-    #[command(flatten)]
-    options: Options,
+    // Responses stored by versions without capture times only tell whether they exist
+    let capture =
+        |captured_at: &Option<String>, latency_ms: Option<u64>| match (captured_at, latency_ms) {
+            (Some(captured_at), Some(latency_ms)) => format!("{} ({} ms)", captured_at, latency_ms),
+            (Some(captured_at), None) => captured_at.clone(),
+            (None, _) => "yes".to_string(),
+        };
+    let rows: Vec<[String; 6]> = responses
+        .iter()
+        .map(|response| {
+            [
+                response.baseline_name.clone(),
+                response.request_id.clone(),
+                response.url.clone(),
+                response
+                    .baseline_status_code
+                    .map_or("-".to_string(), |status| status.to_string()),
+                match response.baseline_status_code {
+                    Some(_) => {
+                        capture(&response.baseline_captured_at, response.baseline_latency_ms)
+                    }
+                    None => "no".to_string(),
+                },
+                match response.has_checktime {
+                    true => capture(
+                        &response.checktime_captured_at,
+                        response.checktime_latency_ms,
+                    ),
+                    false => "no".to_string(),
+                },
+            ]
+        })
+        .collect();
+    print_table(
+        [
+            "BASELINE",
+            "REQUEST ID",
+            "URL",
+            "STATUS",
+            "BASELINE CAPTURED",
+            "CHECKTIME CAPTURED",
+        ],
+        &rows,
+    );
+    println!("\n{} stored responses.", rows.len());
+
+    Ok(())
 }
 
-#[derive(Args, Debug)]
-struct Options {
-    #[arg(long, value_name = "DIRECTORY", conflicts_with = "files")]
-    directory: Option<PathBuf>,
+/// Print rows as a table of left-aligned columns, under a bold header
+fn print_table<const N: usize>(header: [&str; N], rows: &[[String; N]]) {
+    let header = header.map(str::to_string);
+    let widths: Vec<usize> = (0..N)
+        .map(|i| {
+            std::iter::once(&header)
+                .chain(rows)
+                .map(|row| row[i].chars().count())
+                .max()
+                .unwrap_or_default()
+        })
+        .collect();
+    let format_row = |row: &[String; N]| {
+        row.iter()
+            .zip(&widths)
+            .map(|(cell, width)| format!("{:<width$}", cell, width = width))
+            .collect::<Vec<_>>()
+            .join("  ")
+            .trim_end()
+            .to_string()
+    };
 
-    #[arg(long)]
-    ignore_headers: bool,
+    println!("{}", format_row(&header).bold());
+    for row in rows {
+        println!("{}", format_row(row));
+    }
+}
 
-    #[arg(long)]
-    baseline: bool,
+/// Print the checktime responses saved for a request, oldest first, pointing out the ones whose status code
+/// or body changed from the previous one to tell when a drift started
+async fn print_response_history(
+    db_path: &str,
+    request_id: &str,
+    baseline_name: &str,
+) -> Result<()> {
+    let db = init_db(db_path).await?;
+    let history = find_response_history(request_id, baseline_name, &db).await?;
+    if history.is_empty() {
+        println!(
+            "No response saved for request '{}' in the '{}' baseline.",
+            request_id, baseline_name
+        );
+        return Ok(());
+    }
 
-    #[arg(long)]
-    verbose: bool,
+    let mut previous: Option<&HttpResponseData> = None;
+    let rows: Vec<[String; 6]> = history
+        .iter()
+        .map(|entry| {
+            let response = &entry.response;
+            let change = match previous {
+                None => "first",
+                Some(p) if p.status_code != response.status_code => "status changed",
+                Some(p) if p.body.raw != response.body.raw => "body changed",
+                Some(_) => "",
+            };
+            previous = Some(response);
+            [
+                entry.captured_at.clone(),
+                entry.run_id.clone().unwrap_or_default(),
+                entry.label.clone().unwrap_or_default(),
+                response.status_code.to_string(),
+                entry
+                    .latency_ms
+                    .map_or(String::new(), |ms| format!("{} ms", ms)),
+                change.to_string(),
+            ]
+        })
+        .collect();
+    print_table(
+        ["CAPTURED", "RUN ID", "LABEL", "STATUS", "LATENCY", "CHANGE"],
+        &rows,
+    );
+    println!(
+        "\n{} responses saved for request '{}'.",
+        rows.len(),
+        request_id
+    );
+
+    Ok(())
 }
 
 #[tokio::main]
-async fn main() -> Result<()> {
+async fn main() -> ExitCode {
+    match run().await {
+        Ok(status) => status.into(),
+        Err(e) => {
+            eprintln!("Error: {:?}", e);
+            ExitStatus::Errored.into()
+        }
+    }
+}
+
+async fn run() -> Result<ExitStatus> {
     env_logger::init();
 
-    let requests_per_host: usize = env::var("REQUESTS_PER_HOST")
-        .unwrap_or(30.to_string())
-        .parse()
-        .context("Invalid REQUESTS_PER_HOST env variable")?;
-    let max_retries: u16 = max(
-        1,
-        env::var("MAX_RETRIES")
-            .unwrap_or(3.to_string())
-            .parse()
-            .context("Invalid MAX_RETRIES env variable")?,
-    );
+    let requests_per_host = requests_per_host(env::var("REQUESTS_PER_HOST"))?;
+    let max_retries = max_retries(env::var("MAX_RETRIES"))?;
+    let retry_backoff = RetryBackoff {
+        initial: Duration::from_millis(env_number(
+            "RETRY_BASE_DELAY_MS",
+            env::var("RETRY_BASE_DELAY_MS"),
+            DEFAULT_RETRY_BACKOFF.initial.as_millis() as u64,
+        )?),
+        max: Duration::from_millis(env_number(
+            "RETRY_MAX_DELAY_MS",
+            env::var("RETRY_MAX_DELAY_MS"),
+            DEFAULT_RETRY_BACKOFF.max.as_millis() as u64,
+        )?),
+    };
+
+    let preload_max_bytes: u64 = env_number(
+        "PRELOAD_MAX_BYTES",
+        env::var("PRELOAD_MAX_BYTES"),
+        256 * 1024 * 1024,
+    )?;
+    let ca_bundle_path = std::env::var_os("CA_BUNDLE_PATH").map(PathBuf::from);
 
     let cli = Cli::parse();
+    let db_path = cli
+        .options
+        .db
+        .clone()
+        .or_else(|| std::env::var("DB_PATH").ok())
+        .unwrap_or_else(|| DEFAULT_DB_PATH.to_string());
+    let json_output = cli.options.output == OutputFormat::Json;
+    if cli.options.include_unchanged && !json_output {
+        bail!("--include-unchanged only applies to the JSON output, use it with --output json");
+    }
+
+    let no_color_env = std::env::var("NO_COLOR").ok();
+    if !colors_enabled(
+        cli.options.no_color,
+        no_color_env.as_deref(),
+        std::io::stdout().is_terminal(),
+    ) {
+        colored::control::set_override(false);
+    }
+
+    if cli.options.list {
+        print_stored_responses(&db_path).await?;
+        return Ok(ExitStatus::Clean);
+    }
+
+    if let Some(request_id) = &cli.options.history {
+        print_response_history(&db_path, request_id, &cli.options.baseline_name).await?;
+        return Ok(ExitStatus::Clean);
+    }
+
+    if let Some(request_id) = &cli.options.clear_baseline {
+        let db = init_db(&db_path).await?;
+        let request_id = Some(request_id.as_str()).filter(|id| !id.is_empty());
+        let deleted = clear_baseline(request_id, &cli.options.baseline_name, &db).await?;
+        println!(
+            "Removed {} responses from the '{}' baseline.",
+            deleted, cli.options.baseline_name
+        );
+        return Ok(ExitStatus::Clean);
+    }
+
+    if cli.options.insecure {
+        eprintln!("Warning: TLS certificates aren't verified (--insecure).");
+    }
+    let ca_certificates = match &ca_bundle_path {
+        Some(path) => load_ca_bundle(path)?,
+        None => Vec::new(),
+    };
+    let build_http_client = |redirect_policy| -> Result<reqwest::Client> {
+        // Without --proxy, the client uses the HTTP_PROXY, HTTPS_PROXY and NO_PROXY env variables
+        let mut builder = with_proxy(reqwest::ClientBuilder::new(), cli.options.proxy.as_ref())?;
+        for certificate in &ca_certificates {
+            builder = builder.add_root_certificate(certificate.clone());
+        }
+        builder
+            .danger_accept_invalid_certs(cli.options.insecure)
+            .connect_timeout(Duration::from_secs(10))
+            .timeout(Duration::from_secs(10))
+            .pool_max_idle_per_host(requests_per_host)
+            .tcp_keepalive(Duration::from_secs(60))
+            .redirect(redirect_policy)
+            // A User-Agent header set on a request takes precedence
+            .user_agent(&cli.options.user_agent)
+            .build()
+            .context("Failed to build HTTP client")
+    };
+    // Redirects are followed by hand, to stop at the redirect of the requests not following them,
+    // and to record every hop when they are captured
+    let http_client = build_http_client(reqwest::redirect::Policy::none())?;
+    // Remote configs are fetched wherever they were moved, by every command loading them
+    let config_client = build_http_client(reqwest::redirect::Policy::default())?;
+
+    if let Some(paths) = &cli.options.diff_config {
+        print_config_changes(&paths[0], &paths[1], &config_client).await?;
+        return Ok(ExitStatus::Clean);
+    }
+
     let mut config_paths: Vec<PathBuf> = Vec::new();
 
     // Handle directory option
     if let Some(dir_path) = cli.options.directory {
         if !dir_path.is_dir() {
             eprintln!("Error: '{}' is not a valid directory.", dir_path.display());
-            process::exit(1);
+            return Ok(ExitStatus::Errored);
         }
 
         let mut files = fs::read_dir(&dir_path)
@@ -258,7 +1219,7 @@ async fn main() -> Result<()> {
             .context("Failed to read next entry in directory")?
         {
             let path = file.path();
-            if path.is_file() && path.extension().is_some_and(|ext| ext == "json") {
+            if is_config_file(&path) {
                 config_paths.push(path);
                 found_files = true;
             }
@@ -266,7 +1227,7 @@ async fn main() -> Result<()> {
 
         if !found_files {
             eprintln!(
-                "Warning: No JSON config files found in directory '{}'.",
+                "Warning: No JSON or YAML config files found in directory '{}'.",
                 dir_path.display()
             );
         }
@@ -277,234 +1238,879 @@ async fn main() -> Result<()> {
 
     if config_paths.is_empty() {
         eprintln!("Error: No config file or directory specified.");
-        process::exit(1);
-    }
-
-    let db_path = "release-sanity-checker-data.db";
-    let db = Arc::new(
-        SqlitePoolOptions::new()
-            .max_connections(20)
-            .acquire_timeout(Duration::from_secs(1))
-            .connect_with(
-                SqliteConnectOptions::from_str(&format!("sqlite://{}", db_path))
-                    .context("Failed to parse SQLite connection options")?
-                    .create_if_missing(true)
-                    .journal_mode(sqlx::sqlite::SqliteJournalMode::Wal)
-                    .synchronous(sqlx::sqlite::SqliteSynchronous::Normal)
-                    .locking_mode(sqlx::sqlite::SqliteLockingMode::Normal),
-            )
+        return Ok(ExitStatus::Errored);
+    }
+
+    let tag_filter = TagFilter {
+        included: cli.options.tags.clone(),
+        excluded: cli.options.exclude_tags.clone(),
+    };
+
+    if cli.options.dry_run {
+        return print_planned_requests(
+            &config_paths,
+            &tag_filter,
+            !cli.options.skip_validation,
+            &config_client,
+        )
+        .await;
+    }
+
+    if cli.options.baseline_plan {
+        print_baseline_plan(
+            config_paths,
+            &tag_filter,
+            &db_path,
+            &cli.options.baseline_name,
+            &config_client,
+        )
+        .await?;
+        return Ok(ExitStatus::Clean);
+    }
+
+    if let Some(diff_dir) = &cli.options.diff_dir {
+        fs::create_dir_all(diff_dir)
             .await
-            .context(format!("Failed to connect to database at {}", db_path))?,
-    );
-    let _ = sqlx::query(
-        "CREATE TABLE IF NOT EXISTS response (
-                request_id              TEXT NOT NULL,
-                url                     TEXT NOT NULL, 
-                baseline_status_code    INTEGER,
-                checktime_status_code   INTEGER,
-                baseline_headers        TEXT,
-                checktime_headers       TEXT,
-                baseline_body           TEXT,
-                checktime_body          TEXT,
-                PRIMARY KEY(request_id)
+            .with_context(|| format!("Failed to create diff directory {:?}", diff_dir))?;
+    }
+
+    if let Some(record_dir) = &cli.options.record {
+        fs::create_dir_all(record_dir)
+            .await
+            .with_context(|| format!("Failed to create record directory {:?}", record_dir))?;
+    }
+
+    let db = Arc::new(init_db(&db_path).await?);
+    // The baseline is read from a separate, read-only database if requested, otherwise from the same one
+    let baseline_db = match &cli.options.baseline_db {
+        Some(path) => Arc::new(open_read_only_db(path).await?),
+        None => db.clone(),
+    };
+
+    // Bounds the flows in progress at once, across all the configs
+    let flow_permits = FlowPermits::new(cli.options.concurrency as usize);
+
+    // SIGINT or SIGTERM stops the run: the requests in progress are dropped and the flows are skipped.
+    // In watch mode, the cycle in progress completes. A second signal exits right away.
+    let (stop_tx, stop) = StopSignal::new();
+    tokio::spawn(async move {
+        shutdown_signal().await;
+        let _ = stop_tx.send(true);
+        shutdown_signal().await;
+        eprintln!("\nInterrupted again, exiting without waiting for the requests in progress.");
+        std::process::exit(ExitStatus::Errored.code().into());
+    });
+    let flow_stop = match cli.options.watch {
+        Some(_) => StopSignal::never(),
+        None => stop.clone(),
+    };
+
+    for cycle in 1.. {
+        if let Some(pre_hook) = &cli.options.pre_hook {
+            run_hook("pre-hook", pre_hook, json_output).await?;
+        }
+        // Configs are loaded again at each cycle, the pre-hook may have generated them
+        let loaded_configs =
+            load_run_configs(&config_paths, &config_client, !cli.options.skip_validation).await?;
+
+        let counters = Arc::new(RunCounters::default());
+        // Latency of the checked response of each request, for the summary
+        let latencies = Arc::new(std::sync::Mutex::new(Vec::new()));
+        let severities = Arc::new(Severities::new(&cli.options.severities));
+        let run_id: Arc<str> = Arc::from(generate_run_id());
+        let path_separator: Arc<str> = Arc::from(cli.options.path_separator.as_str());
+        // Header names are stored lowercase
+        let normalized_headers: Arc<HashSet<String>> = Arc::new(
+            cli.options
+                .normalized_headers
+                .iter()
+                .map(|name| name.to_lowercase())
+                .collect(),
+        );
+        let compare_base_urls = cli.options.compare_base_urls.as_ref().map(|urls| BaseUrls {
+            reference: urls[0].clone(),
+            other: urls[1].clone(),
+        });
+        let har = cli
+            .options
+            .har
+            .as_ref()
+            .map(|_| Arc::new(HarRecorder::new()));
+        let step_sender = StepSender {
+            http_client: http_client.clone(),
+            host_limiter: HostLimiter::new(requests_per_host),
+            body_memory: cli
+                .options
+                .max_total_body_bytes
+                .map(BodyMemoryGovernor::new),
+            limits: ResponseLimits {
+                max_body_bytes: cli.options.max_body_bytes,
+                max_json_depth: cli.options.max_json_depth,
+            },
+            stop: flow_stop.clone(),
+            max_retries,
+            retry_backoff,
+            follow_redirects: cli.options.follow_redirects,
+            capture_redirects: cli.options.capture_redirects,
+            har: har.clone(),
+            verbose: cli.options.verbose,
+            record_dir: cli.options.record.clone(),
+            replay_dir: cli.options.replay.clone(),
+        };
+
+        let mut tasks = JoinSet::new();
+        // The ID of the request checked by each task, for its outcome to be reported even when it failed
+        let mut task_requests = HashMap::new();
+        let mut errors_count = 0;
+        let mut skipped_count = 0;
+        let mut disabled_count = 0;
+
+        let (done_tx, done_rx) = tokio::sync::oneshot::channel();
+        {
+            let (sender, receiver) = tokio::sync::mpsc::channel(100);
+            let printer = DifferencesPrinter::new(
+                receiver,
+                done_tx,
+                PrinterOptions {
+                    collapse_repeated: cli.options.collapse_repeated,
+                    diff_dir: cli.options.diff_dir.clone(),
+                    run_id: run_id.to_string(),
+                    label: cli.options.label.clone(),
+                    severities: severities.as_ref().clone(),
+                    output: cli.options.output,
+                    keep_records: cli.options.webhook.is_some(),
+                    report: cli.options.report.clone(),
+                    include_unchanged: cli.options.include_unchanged,
+                },
             );
-            CREATE INDEX IF NOT EXISTS url_idx ON response(request_id);",
-    )
-    .execute(db.as_ref())
-    .await
-    .context("Failed to initialize database schema")?;
-
-    let http_client = reqwest::ClientBuilder::new()
-        .connect_timeout(Duration::from_secs(10))
-        .timeout(Duration::from_secs(10))
-        .pool_max_idle_per_host(requests_per_host)
-        .tcp_keepalive(Duration::from_secs(60))
-        .build()
-        .context("Failed to build HTTP client")?;
-
-    let url_to_semaphore = Arc::new(Mutex::new(HashMap::new()));
-    let requests_counter = Arc::new(AtomicUsize::new(0));
-    let changed_requests_counter = Arc::new(AtomicUsize::new(0));
-
-    let mut tasks = JoinSet::new();
-    let mut errors_count = 0;
-
-    let (done_tx, done_rx) = tokio::sync::oneshot::channel();
-    {
-        let (sender, receiver) = tokio::sync::mpsc::channel(100);
-        let printer = DifferencesPrinter::new(receiver, done_tx);
-        tokio::task::spawn(printer::run_differences_printer(printer));
-
-        println!("Starting to process requests...\n");
-
-        for config_path in config_paths {
-            debug!("Reading config path at {:#?}...", config_path);
-            let content = tokio::fs::read_to_string(&config_path)
-                .await
-                .with_context(|| format!("Failed to read config file {:?}", config_path))?;
-            let config: SanityCheckConfig = serde_json::from_str(&content)
-                .with_context(|| format!("Failed to parse JSON config at {:?}", config_path))?;
-
-            // Process requests inside config file concurrently
-            for request_config in config.requests {
-                let db = db.clone();
-                let http_client = http_client.clone();
-                let url_to_semaphore = url_to_semaphore.clone();
-                let requests_counter = requests_counter.clone();
-                let changed_requests_counter = changed_requests_counter.clone();
-                let print_sender = sender.clone();
-
-                tasks.spawn(async move {
-                    requests_counter.fetch_add(1, std::sync::atomic::Ordering::SeqCst);
-
-                    debug!("Checking request '{}'", request_config.id);
-
-                    // Flow is processed serially
-                    for i in 0..request_config.flow.len() {
-                        let flow = request_config.flow.get(i).unwrap();
-
-                        let semaphore = {
-                            let mut map = url_to_semaphore.lock().await;
-                            map.entry(flow.url.clone())
-                                .or_insert_with(|| Arc::new(Semaphore::new(requests_per_host)))
-                                .clone()
-                        };
-
-                        let mut retries = max_retries.clone();
-                        let mut current_response = None;
-                        while retries > 0 {
-                            debug!("Sending request {} to {}", request_config.id, flow.url);
-
-                            match fetch_response(
-                                &flow.url,
-                                &flow.headers,
-                                &flow.body,
-                                &http_client,
-                                &semaphore,
-                            )
-                            .await {
-                                Ok(res) => {
-                                    if res.status_code >= 500 {
-                                        debug!("Request to url {} has errors (status code: {})", flow.url, res.status_code);
-                                        retries -= 1;
+            tokio::task::spawn(printer::run_differences_printer(printer));
+
+            if !cli.options.watch_changes_only {
+                match &cli.options.label {
+                    Some(label) => status!(
+                        json_output,
+                        "Starting to process requests (run ID: {}, label: {})...\n",
+                        run_id,
+                        label
+                    ),
+                    None => status!(
+                        json_output,
+                        "Starting to process requests (run ID: {})...\n",
+                        run_id
+                    ),
+                }
+            }
+
+            for mut configs in loaded_configs {
+                for config in &mut configs {
+                    let (requests, skipped) =
+                        skip_disabled(tag_filter.select(std::mem::take(&mut config.requests)));
+                    for request in &skipped {
+                        sender
+                            .send(DifferencesPrinterMessage::RecordOutcome {
+                                request_id: request.id.clone(),
+                                outcome: RequestOutcome::Skipped,
+                                error: None,
+                            })
+                            .await
+                            .context("Failed to send the outcome of a request to printer")?;
+                        if request.enabled == Some(false) {
+                            status!(json_output, "Request '{}' is disabled, skipped", request.id);
+                        } else {
+                            status!(
+                                json_output,
+                                "Request '{}' skipped, as a request it depends on is disabled",
+                                request.id
+                            );
+                        }
+                    }
+                    disabled_count += skipped.len();
+                    config.requests = requests;
+                }
+
+                // The baselines of the whole config are loaded at once, unless they are too large to be held in memory
+                let preloaded_baselines = if cli.options.preload_baselines {
+                    let request_ids: Vec<String> = configs
+                        .iter()
+                        .flat_map(|config| config.requests.iter().map(|r| r.id.clone()))
+                        .collect();
+                    let preloaded = preload_previous_responses(
+                        &request_ids,
+                        &cli.options.baseline_name,
+                        cli.options.ignore_headers,
+                        preload_max_bytes,
+                        baseline_db.as_ref(),
+                    )
+                    .await?;
+                    if preloaded.is_none() {
+                        status!(
+                            json_output,
+                            "Baselines larger than {} bytes, they are queried request by request",
+                            preload_max_bytes
+                        );
+                    }
+                    preloaded.map(Arc::new)
+                } else {
+                    None
+                };
+
+                for config in configs {
+                    // Each request tells the ones depending on it whether it succeeded by the time it completes,
+                    // handing them the variables it extracted
+                    let mut completions = HashMap::new();
+                    let mut completed_receivers = HashMap::new();
+                    for request_config in &config.requests {
+                        let (completed, completed_receiver) = tokio::sync::watch::channel(None);
+                        completions.insert(request_config.id.clone(), completed);
+                        completed_receivers.insert(request_config.id.clone(), completed_receiver);
+                    }
+
+                    // Process requests inside config file concurrently
+                    for request_config in config.requests {
+                        let completed = completions.remove(&request_config.id);
+                        let prerequisites: Vec<_> = request_config
+                            .depends_on
+                            .iter()
+                            .map(|id| (id.clone(), completed_receivers[id].clone()))
+                            .collect();
+                        let db = db.clone();
+                        let baseline_db = baseline_db.clone();
+                        let step_sender = step_sender.clone();
+                        let counters = counters.clone();
+                        let latencies = latencies.clone();
+                        let flow_permits = flow_permits.clone();
+                        let flow_stop = flow_stop.clone();
+                        let severities = severities.clone();
+                        let run_id = run_id.clone();
+                        let env = cli.options.env.clone();
+                        let label = cli.options.label.clone();
+                        let baseline_name = cli.options.baseline_name.clone();
+                        let path_separator = path_separator.clone();
+                        let print_sender = sender.clone();
+                        let preloaded_baselines = preloaded_baselines.clone();
+                        let normalized_headers = normalized_headers.clone();
+                        let compare_base_urls = compare_base_urls.clone();
+
+                        let request_id = request_config.id.clone();
+                        let task = tasks.spawn(async move {
+                            counters.count_request();
+
+                            debug!("Checking request '{}'", request_config.id);
+
+                            // The sender is dropped without reporting a success when the request fails or is skipped
+                            let inherited_variables =
+                                flow_stop.wait_for_prerequisites(&request_config.id, prerequisites).await?;
+                            // Run once the prerequisites succeeded, so that waiting flows never hold all the permits
+                            flow_permits
+                                .run(&flow_stop, async {
+                                    // Without steps, nothing is sent
+                                    if request_config.flow.is_empty() {
+                                        if let Some(completed) = completed {
+                                            completed.send_replace(Some(Arc::new(inherited_variables)));
+                                        }
+                                        return Ok(RequestOutcome::Skipped);
+                                    }
+
+                                    // The checked step is the last one that isn't capture only, the steps after it are only sent
+                                    let Some(checked_step) =
+                                        request_config.flow.iter().rposition(|flow| !flow.capture_only)
+                                    else {
+                                        bail!("Request '{}' has no step to check, all of them are capture_only", request_config.id);
+                                    };
+                                    let (preceding_steps, rest) = request_config.flow.split_at(checked_step);
+                                    let (flow, following_steps) = rest.split_first().expect("The checked step is in the flow");
+
+                                    // The variables of the prerequisites are available to every step, its own extracted ones
+                                    // taking precedence
+                                    let mut variables = inherited_variables;
+                                    let cookies = CookieJar::default();
+                                    if request_config.parallel {
+                                        // Steps before the checked one don't depend on each other, send them all at once,
+                                        // so their variables are only available to the checked step and the ones after it
+                                        let mut steps = JoinSet::new();
+                                        for (step, flow) in preceding_steps.iter().enumerate() {
+                                            let step_sender = step_sender.clone();
+                                            let request_id = request_config.id.clone();
+                                            let path_separator = path_separator.clone();
+                                            let flow = flow.clone();
+                                            let cookies = cookies.clone();
+                                            let mut extracted = variables.clone();
+                                            steps.spawn(async move {
+                                                step_sender
+                                                    .send_chained(&request_id, step, &flow, &mut extracted, &cookies, &path_separator)
+                                                    .await?;
+                                                Ok::<_, anyhow::Error>(extracted)
+                                            });
+                                        }
+                                        while let Some(result) = steps.join_next().await {
+                                            variables.extend(result.context("Flow step panicked")??);
+                                        }
                                     } else {
-                                        current_response = Some(res);
-                                        break;
+                                        // Flow is processed serially
+                                        for (step, flow) in preceding_steps.iter().enumerate() {
+                                            step_sender
+                                                .send_chained(&request_config.id, step, flow, &mut variables, &cookies, &path_separator)
+                                                .await?;
+                                        }
                                     }
-                                },
-                                Err(e) => {
-                                    debug!("Error fetching response: {:#}", e);
-                                    retries -= 1;
-                                },
-                            }
-                        }
 
-                        let current_response = match current_response {
-                            Some(res) => res,
-                            None => bail!("Failed to get response for request '{}' to '{}' after multiple retries", 
-                                request_config.id, flow.url),
-                        };
-
-                        debug!("Request {} to {} done", request_config.id, flow.url);
-
-                        // If it's the last request of the flow, run the check on the response
-                        if i == request_config.flow.len() - 1 {
-                            if !cli.options.baseline {
-                                // Try to find a previous response for that request (identified by id)
-                                let prev_response = find_previous_response(
-                                    &request_config.id,
-                                    cli.options.ignore_headers,
-                                    db.as_ref(),
-                                )
-                                    .await?;
-
-                                if let Some(prev_response) = prev_response {
-                                    let differences = compute_differences(
-                                        &prev_response,
-                                        &current_response,
-                                        cli.options.ignore_headers,
-                                        request_config.ignore_paths.as_ref(),
-                                    );
-
-                                    if differences.is_empty() {
-                                        if cli.options.verbose {
-                                            println!(
-                                                "\n✅ Request with ID: '{}' has not changed. ✅",
-                                                request_config.id
+                                    // The checked request is always sent after the ones before it, and its response is checked
+                                    let (flow, current_response) = step_sender
+                                        .send_chained(&request_config.id, checked_step, flow, &mut variables, &cookies, &path_separator)
+                                        .await?;
+                                    let flow = &flow;
+                                    // A truncated body is only reported, its response being neither checked, compared nor saved
+                                    let truncated = current_response.data.is_truncated();
+                                    let body_truncated = || Difference::BodyTruncated {
+                                        limit_bytes: flow.max_body_bytes.or(cli.options.max_body_bytes).unwrap_or_default(),
+                                    };
+                                    if let Ok(mut latencies) = latencies.lock() {
+                                        latencies.push(current_response.timings.latency_ms());
+                                    }
+
+                                    for (step, flow) in following_steps.iter().enumerate() {
+                                        step_sender
+                                            .send_chained(
+                                                &request_config.id,
+                                                checked_step + 1 + step,
+                                                flow,
+                                                &mut variables,
+                                                &cookies,
+                                                &path_separator,
+                                            )
+                                            .await?;
+                                    }
+
+                                    // A response failing the assertions is an error, it's neither compared nor saved
+                                    if let Some(expected) = &request_config.expected_status {
+                                        expected
+                                            .check(env.as_deref(), current_response.data.status_code)
+                                            .with_context(|| {
+                                                format!("Request '{}' returned an unexpected status", request_config.id)
+                                            })?;
+                                    }
+                                    if let Some(predicate) = request_config.success_if.as_ref().filter(|_| !truncated) {
+                                        predicate
+                                            .check(current_response.data.body.json.as_ref(), &path_separator)
+                                            .with_context(|| {
+                                                format!("Request '{}' failed its success_if predicate", request_config.id)
+                                            })?;
+                                    }
+
+                                    let diff_options = DiffOptions {
+                                        canonical_json: cli.options.canonical_json,
+                                        skip_body: flow.method() == reqwest::Method::HEAD,
+                                        path_separator: path_separator.to_string(),
+                                        numeric_tolerances: request_config.numeric_tolerances.clone(),
+                                        numeric_tolerance: request_config.numeric_tolerance,
+                                        shape_only: request_config.shape_only,
+                                        ignored_headers: request_config
+                                            .ignore_headers
+                                            .iter()
+                                            .map(|name| name.to_lowercase())
+                                            .collect(),
+                                        normalized_headers: normalized_headers.as_ref().clone(),
+                                        coerce_numeric_strings: cli.options.coerce_numeric_strings,
+                                        coerce_boolean_strings: cli.options.coerce_boolean_strings,
+                                        normalize_dates: cli.options.normalize_dates,
+                                        allow_empty_additions: cli.options.allow_empty_additions,
+                                        array_keys: request_config.array_keys.clone(),
+                                        max_depth: cli.options.max_diff_depth,
+                                        max_value_length: cli.options.max_value_length,
+                                    };
+
+                                    let differences = if truncated {
+                                        Some(vec![body_truncated()])
+                                    } else if cli.options.check_ordering {
+                                        // Send the same request again, and look for arrays returned in a different order
+                                        let second_response =
+                                            step_sender.send(&request_config.id, checked_step, flow).await?;
+
+                                        let mut differences = Vec::new();
+                                        if let (Some(json1), Some(json2)) = (
+                                            &current_response.data.body.json,
+                                            &second_response.data.body.json,
+                                        ) {
+                                            find_array_order_changes(
+                                                "",
+                                                json1,
+                                                json2,
+                                                &mut differences,
+                                                &path_separator,
                                             );
                                         }
+                                        Some(differences)
+                                    } else if cli.options.compare_env {
+                                        // Run the whole flow again on the other environment, with variables and cookies of its own,
+                                        // and compare its checked response to the one of the reference environment
+                                        let mut other_variables = Variables::new();
+                                        let other_cookies = CookieJar::default();
+                                        let mut other_response = None;
+                                        for (step, flow) in request_config.flow.iter().enumerate() {
+                                            let other_flow = on_other_environment(flow, compare_base_urls.as_ref())
+                                                .with_context(|| {
+                                                    format!(
+                                                        "Failed to send step {} of request '{}' to the other environment",
+                                                        step, request_config.id
+                                                    )
+                                                })?;
+                                            let (_, response) = step_sender
+                                                .send_chained(
+                                                    &request_config.id,
+                                                    step,
+                                                    &other_flow,
+                                                    &mut other_variables,
+                                                    &other_cookies,
+                                                    &path_separator,
+                                                )
+                                                .await?;
+                                            if step == checked_step {
+                                                other_response = Some(response);
+                                            }
+                                        }
+                                        let other_response = other_response.expect("The checked step is in the flow");
+
+                                        if other_response.data.is_truncated() {
+                                            Some(vec![body_truncated()])
+                                        } else {
+                                            Some(compute_differences(
+                                                &current_response.data,
+                                                &other_response.data,
+                                                cli.options.ignore_headers,
+                                                request_config.ignore_paths.as_ref(),
+                                                &diff_options,
+                                            ))
+                                        }
+                                    } else if !cli.options.baseline {
+                                        // Try to find a previous response for that request (identified by id)
+                                        let queried_response;
+                                        let prev_response = match &preloaded_baselines {
+                                            Some(preloaded) => preloaded.responses.get(&request_config.id),
+                                            None => {
+                                                queried_response = find_previous_response(
+                                                    &request_config.id,
+                                                    &baseline_name,
+                                                    cli.options.ignore_headers,
+                                                    baseline_db.as_ref(),
+                                                )
+                                                .await?;
+                                                queried_response.as_ref()
+                                            }
+                                        };
+
+                                        match prev_response {
+                                            Some(prev_response) => {
+                                                // The response is unchanged if it matches any of the accepted baselines
+                                                let queried_variants;
+                                                let variants = match &preloaded_baselines {
+                                                    Some(preloaded) => preloaded
+                                                        .variants
+                                                        .get(&request_config.id)
+                                                        .map(Vec::as_slice)
+                                                        .unwrap_or_default(),
+                                                    None => {
+                                                        queried_variants = find_baseline_variants(
+                                                            &request_config.id,
+                                                            &baseline_name,
+                                                            cli.options.ignore_headers,
+                                                            baseline_db.as_ref(),
+                                                        )
+                                                        .await?;
+                                                        queried_variants.as_slice()
+                                                    }
+                                                };
+                                                let baselines: Vec<&HttpResponseData> =
+                                                    std::iter::once(prev_response).chain(variants).collect();
+                                                let (matched, mut differences) = compute_differences_to_closest(
+                                                    &baselines,
+                                                    &current_response.data,
+                                                    cli.options.ignore_headers,
+                                                    request_config.ignore_paths.as_ref(),
+                                                    &diff_options,
+                                                )
+                                                .unwrap_or_default();
+
+                                                if cli.options.verbose && !variants.is_empty() {
+                                                    status!(
+                                                        json_output,
+                                                        "Request '{}' is {} baseline variant {} of {}",
+                                                        request_config.id,
+                                                        if differences.is_empty() { "matching" } else { "closest to" },
+                                                        matched + 1,
+                                                        baselines.len()
+                                                    );
+                                                }
+
+                                                if cli.options.verbose {
+                                                    if let (Some(old), Some(new)) =
+                                                        (&prev_response.body_size, &current_response.data.body_size)
+                                                    {
+                                                        print_body_size_change(&request_config.id, old, new, json_output);
+                                                    }
+                                                }
+
+                                                // A status accepted for the environment isn't a change, whatever the baseline one
+                                                if let Some(acceptable) = &request_config.acceptable_statuses {
+                                                    differences.retain(|d| {
+                                                        !matches!(d, Difference::StatusCodeChanged { new_val, .. }
+                                                            if acceptable.accepts(env.as_deref(), *new_val))
+                                                    });
+                                                }
+
+                                                if cli.options.timing_threshold_ms.is_some()
+                                                    || request_config.max_latency_increase.is_some()
+                                                {
+                                                    if let Some(baseline_timings) = find_baseline_timings(
+                                                        &request_config.id,
+                                                        &baseline_name,
+                                                        baseline_db.as_ref(),
+                                                    )
+                                                    .await?
+                                                    {
+                                                        if let Some(threshold_ms) = cli.options.timing_threshold_ms {
+                                                            differences.extend(compare_timings(
+                                                                &baseline_timings,
+                                                                &current_response.timings,
+                                                                threshold_ms,
+                                                            ));
+                                                        }
+                                                        if let Some(max_increase) = &request_config.max_latency_increase {
+                                                            differences.extend(compare_latency(
+                                                                &baseline_timings,
+                                                                &current_response.timings,
+                                                                max_increase,
+                                                            ));
+                                                        }
+                                                    }
+                                                }
+
+                                                if let Some(percentile) = cli.options.latency_percentile {
+                                                    let history = find_latency_history(
+                                                        &request_config.id,
+                                                        &baseline_name,
+                                                        LATENCY_HISTORY_RUNS,
+                                                        db.as_ref(),
+                                                    )
+                                                    .await?;
+                                                    differences.extend(compare_latency_percentile(
+                                                        &history,
+                                                        &current_response.timings,
+                                                        percentile,
+                                                        LATENCY_HISTORY_MIN_RUNS,
+                                                    ));
+                                                }
+                                                Some(differences)
+                                            }
+                                            None => None,
+                                        }
+                                    } else {
+                                        None
+                                    };
+
+                                    // Forbidden substrings and expected headers are checked whether the request has a baseline or not
+                                    let differences = if truncated
+                                        || cli.options.check_ordering
+                                        || cli.options.compare_env
+                                        || cli.options.baseline
+                                    {
+                                        differences
                                     } else {
-                                        changed_requests_counter
-                                            .fetch_add(1, std::sync::atomic::Ordering::Relaxed);
+                                        let mut assertions = find_forbidden_substrings(
+                                            &current_response.data.body.raw,
+                                            &request_config.forbidden_substrings,
+                                        );
+                                        assertions.extend(find_expected_header_mismatches(
+                                            &current_response.data.headers,
+                                            &request_config.expected_headers,
+                                        ));
+                                        assertions.extend(find_failed_assertions(
+                                            &current_response.data.body,
+                                            &request_config.assertions,
+                                            &path_separator,
+                                        ));
+                                        if let Some(max_ms) = request_config.max_latency_ms {
+                                            assertions.extend(check_max_latency(&current_response.timings, max_ms));
+                                        }
+                                        match differences {
+                                            Some(mut differences) => {
+                                                differences.extend(assertions);
+                                                Some(differences)
+                                            }
+                                            None => (!assertions.is_empty()).then_some(assertions),
+                                        }
+                                    };
+
+                                    let outcome = match differences {
+                                        Some(mut differences) => {
+                                            differences.retain(|d| severities.of(d) != Severity::Ignore);
+                                            redact_differences(
+                                                &mut differences,
+                                                &request_config.redact_paths,
+                                                &request_config.redact_patterns,
+                                                &path_separator,
+                                            );
+
+                                            if differences.is_empty() {
+                                                if cli.options.verbose {
+                                                    status!(
+                                                        json_output,
+                                                        "\n✅ Request with ID: '{}' has not changed. ✅",
+                                                        request_config.id
+                                                    );
+                                                }
+                                                RequestOutcome::Unchanged
+                                            } else {
+                                                counters.count_differences(
+                                                    differences.iter().any(|d| severities.of(d) == Severity::Fail),
+                                                );
+
+                                                print_sender
+                                                    .send(DifferencesPrinterMessage::PrintDifferences {
+                                                        differences,
+                                                        request_id: request_config.id.clone(),
+                                                    })
+                                                    .await
+                                                    .context("Failed to send differences to printer")?;
+                                                RequestOutcome::Changed
+                                            }
+                                        }
+                                        None => RequestOutcome::NoBaseline,
+                                    };
 
-                                        print_sender.send(DifferencesPrinterMessage::PrintDifferences {
-                                            differences, request_id: request_config.id.clone()
-                                        }).await.context("Failed to send differences to printer")?
+                                    if truncated {
+                                        debug!("Response to request {} is truncated, it isn't saved", request_config.id);
+                                    } else if cli.options.baseline_variant
+                                        && find_previous_response(&request_config.id, &baseline_name, true, db.as_ref())
+                                            .await?
+                                            .is_some()
+                                    {
+                                        save_baseline_variant(
+                                            &request_config.id,
+                                            &baseline_name,
+                                            &current_response.data,
+                                            &run_id,
+                                            cli.options.compress_bodies,
+                                            db.as_ref(),
+                                        )
+                                        .await?;
+                                    } else if !cli.options.check_ordering && !cli.options.compare_env && !cli.options.read_only {
+                                        save_response(
+                                            &request_config.id,
+                                            &baseline_name,
+                                            &flow.url,
+                                            &current_response.data,
+                                            &current_response.timings,
+                                            &run_id,
+                                            label.as_deref(),
+                                            cli.options.baseline,
+                                            cli.options.compress_bodies,
+                                            db.as_ref(),
+                                        )
+                                        .await?;
                                     }
-                                }
-                            }
-
-                            let query_str = if cli.options.baseline {
-                                "INSERT INTO response (request_id, url, baseline_status_code, baseline_body, baseline_headers)
-                                    VALUES (?, ?, ?, ?, ?)
-                                    ON CONFLICT (request_id) DO UPDATE SET url = excluded.url, baseline_status_code = excluded.baseline_status_code,
-                                            baseline_body = excluded.baseline_body,
-                                            baseline_headers = excluded.baseline_headers".to_string()
-                            } else {
-                                "INSERT INTO response (request_id, url, checktime_status_code, checktime_body, checktime_headers)
-                                    VALUES (?, ?, ?, ?, ?)
-                                    ON CONFLICT (request_id) DO UPDATE SET checktime_status_code = excluded.checktime_status_code,
-                                            checktime_body = excluded.checktime_body,
-                                            checktime_headers = excluded.checktime_headers".to_string()
-                            };
-                            sqlx::query(&query_str)
-                                .persistent(true)
-                                .bind(&request_config.id)
-                                .bind(&flow.url)
-                                .bind(current_response.status_code)
-                                .bind(&current_response.body.raw,)
-                                .bind(serde_json::to_string(&current_response.headers).context("Failed to serialize headers")?)
-                                .execute(db.as_ref())
-                                .await
-                                .context("Failed to save response to database")?;
-                        };
-                    }
 
-                    Ok::<(), anyhow::Error>(())
-                });
+                                    if let Some(completed) = completed {
+                                        completed.send_replace(Some(Arc::new(variables)));
+                                    }
+                                    Ok::<RequestOutcome, anyhow::Error>(outcome)
+                                })
+                                .await?
+                        });
+                        task_requests.insert(task.id(), request_id);
+                    }
+                }
             }
-        }
 
-        // Wait for all tasks for finish
-        while let Some(result) = tasks.join_next().await {
-            match result {
-                Ok(r) => {
-                    if let Err(e) = r {
+            // Wait for all tasks for finish
+            while let Some(result) = tasks.join_next_with_id().await {
+                let (request_id, outcome, error) = match result {
+                    Ok((id, Ok(outcome))) => (task_requests.remove(&id), outcome, None),
+                    // A flow stopped by the interruption of the run is skipped, not failed
+                    Ok((id, Err(e))) if is_interrupted(&e) => {
+                        skipped_count += 1;
+                        debug!("Request skipped, the run was interrupted: {:#}", e);
+                        (task_requests.remove(&id), RequestOutcome::Skipped, None)
+                    }
+                    Ok((id, Err(e))) => {
                         errors_count += 1;
-                        eprintln!("Error processing request: {:#}", e)
+                        eprintln!("Error processing request: {:#}", e);
+                        (
+                            task_requests.remove(&id),
+                            RequestOutcome::Error,
+                            Some(format!("{:#}", e)),
+                        )
                     }
+                    Err(e) => {
+                        errors_count += 1;
+                        eprintln!("Task join error: {}", e);
+                        (
+                            task_requests.remove(&e.id()),
+                            RequestOutcome::Error,
+                            Some(e.to_string()),
+                        )
+                    }
+                };
+                // The changed requests are recorded along with their differences
+                if let Some(request_id) = request_id.filter(|_| outcome != RequestOutcome::Changed)
+                {
+                    sender
+                        .send(DifferencesPrinterMessage::RecordOutcome {
+                            request_id,
+                            outcome,
+                            error,
+                        })
+                        .await
+                        .context("Failed to send the outcome of a request to printer")?;
                 }
-                Err(e) => eprintln!("Task join error: {}", e),
             }
         }
-    }
 
-    let _ = done_rx.await; // Wait for print_actor to confirm it's done
+        // Wait for print_actor to confirm it's done
+        let records = done_rx.await.unwrap_or_default();
 
-    if cli.options.baseline {
-        println!(
-            "\nBaseline built successfully. Processed {} requests, errors: {}",
-            requests_counter.load(std::sync::atomic::Ordering::Relaxed),
-            errors_count
-        );
-    } else {
-        println!(
-            "\nResponse check completed. Changed request: {} out of {}. Errors: {}",
-            changed_requests_counter.load(std::sync::atomic::Ordering::Relaxed),
-            requests_counter.load(std::sync::atomic::Ordering::Relaxed),
-            errors_count
+        if let (Some(har), Some(path)) = (&har, &cli.options.har) {
+            if let Err(e) = har.write(path).await {
+                errors_count += 1;
+                eprintln!("Error: {:#}", e);
+            }
+        }
+
+        if let Some(post_hook) = &cli.options.post_hook {
+            if let Err(e) = run_hook("post-hook", post_hook, json_output).await {
+                errors_count += 1;
+                eprintln!("Error: {:#}", e);
+            }
+        }
+
+        // In watch mode, quiet cycles can be left out
+        let quiet_cycle = cli.options.watch_changes_only
+            && counters.changed() == 0
+            && counters.warned() == 0
+            && errors_count == 0;
+        if !quiet_cycle {
+            if cli.options.watch.is_some() {
+                status!(
+                    json_output,
+                    "\n[{}] Watch cycle {} completed",
+                    format_iso8601(SystemTime::now()),
+                    cycle
+                );
+            }
+            if cli.options.baseline {
+                status!(
+                    json_output,
+                    "\nBaseline built successfully (run ID: {}). Processed {} requests, errors: {}",
+                    run_id,
+                    counters.requests(),
+                    errors_count
+                );
+            } else if cli.options.check_ordering {
+                status!(
+                    json_output,
+                    "\nOrdering check completed (run ID: {}). Requests with unstable ordering: {} out of {}. Warnings: {}. Errors: {}",
+                    run_id,
+                    counters.changed(),
+                    counters.requests(),
+                    counters.warned(),
+                    errors_count
+                );
+            } else if cli.options.compare_env {
+                status!(
+                    json_output,
+                    "\nEnvironment comparison completed (run ID: {}). Requests differing between the environments: {} out of {}. Warnings: {}. Errors: {}",
+                    run_id,
+                    counters.changed(),
+                    counters.requests(),
+                    counters.warned(),
+                    errors_count
+                );
+            } else {
+                status!(
+                    json_output,
+                    "\nResponse check completed (run ID: {}). Changed request: {} out of {}. Warnings: {}. Errors: {}",
+                    run_id,
+                    counters.changed(),
+                    counters.requests(),
+                    counters.warned(),
+                    errors_count
+                );
+                if cli.options.read_only {
+                    status!(
+                        json_output,
+                        "Read-only run: no response was saved to the database."
+                    );
+                }
+            }
+            let skipped = skipped_count;
+            if skipped > 0 {
+                status!(
+                    json_output,
+                    "Interrupted: {} requests were skipped.",
+                    skipped
+                );
+            }
+            if disabled_count > 0 {
+                status!(
+                    json_output,
+                    "Disabled: {} requests were skipped.",
+                    disabled_count
+                );
+            }
+            if let Ok(latencies) = latencies.lock() {
+                if let Some(max_ms) = latencies.iter().max() {
+                    status!(
+                        json_output,
+                        "Latency: average {} ms, max {} ms",
+                        latencies.iter().sum::<u64>() / latencies.len() as u64,
+                        max_ms
+                    );
+                }
+            }
+        }
+
+        // Once everything is processed and summarized, the webhook is told about changes and errors
+        if let Some(url) = &cli.options.webhook {
+            let summary = RunSummary {
+                run_id: run_id.to_string(),
+                label: cli.options.label.clone(),
+                requests: counters.requests(),
+                changed: counters.changed(),
+                warnings: counters.warned(),
+                errors: errors_count + skipped_count,
+                differences: records,
+            };
+            match notify_webhook(&config_client, url, cli.options.webhook_format, &summary).await {
+                Ok(true) => status!(json_output, "Webhook notified of the changes."),
+                Ok(false) => {}
+                Err(e) => {
+                    errors_count += 1;
+                    eprintln!("Error: {:#}", e);
+                }
+            }
+        }
+
+        // Only differences that fail the run, not the ones that are just warnings, make it exit with an error.
+        // An interrupted run is incomplete, like a run with errors
+        let status = ExitStatus::of_run(
+            counters.changed(),
+            errors_count + skipped_count,
+            cli.options.fail_on_change,
         );
+        let Some(interval) = cli.options.watch else {
+            return Ok(status);
+        };
+
+        // The cycle in progress always completes, the watch stops before starting the next one
+        if stop
+            .unless_stopped(tokio::time::sleep(interval))
+            .await
+            .is_err()
+        {
+            status!(json_output, "\nWatch stopped after {} cycles.", cycle);
+            // A stopped watch reports the outcome of its last cycle
+            return Ok(status);
+        }
     }
 
-    Ok(())
+    Ok(ExitStatus::Clean)
 }
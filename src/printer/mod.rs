@@ -0,0 +1,295 @@
+mod tests;
+
+use crate::diff_finder::{Difference, collapse_repeated_differences};
+use crate::report::html_report;
+use crate::severity::{Severities, Severity};
+use colored::Colorize;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use tokio::sync::mpsc;
+
+/// How the differences are printed to stdout
+#[derive(Clone, Copy, Debug, PartialEq, clap::ValueEnum)]
+pub enum OutputFormat {
+    /// Colorized blocks for humans
+    Text,
+    /// A single JSON array of all the differences found, printed once the run completes
+    Json,
+}
+
+/// A difference found for a request, as printed in the JSON output
+#[derive(Serialize, Deserialize, Debug, PartialEq, Clone)]
+pub struct DifferenceRecord {
+    pub run_id: String,
+    pub request_id: String,
+    pub severity: Severity,
+    #[serde(flatten)]
+    pub difference: Difference,
+}
+
+/// The JSON output of a run: the array of the differences found
+pub fn json_output(records: &[DifferenceRecord]) -> serde_json::Result<String> {
+    serde_json::to_string_pretty(records)
+}
+
+/// How the check of a request ended
+#[derive(Serialize, Deserialize, Debug, PartialEq, Clone, Copy)]
+#[serde(rename_all = "snake_case")]
+pub enum RequestOutcome {
+    /// Differences were found
+    Changed,
+    /// The response matches its baseline
+    Unchanged,
+    /// The request failed, e.g. it couldn't be sent
+    Error,
+    /// There was no baseline to compare the response to, e.g. on the first run or when saving baselines
+    NoBaseline,
+    /// The request wasn't sent: it's disabled, a request it depends on failed, or the run was interrupted
+    Skipped,
+}
+
+/// The outcome of a request along with its differences, as printed in the JSON output with `--include-unchanged`
+#[derive(Serialize, Deserialize, Debug, PartialEq)]
+pub struct RequestRecord {
+    pub run_id: String,
+    pub request_id: String,
+    pub outcome: RequestOutcome,
+    /// Why the request failed, with the `error` outcome
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+    pub differences: Vec<DifferenceRecord>,
+}
+
+/// Whether the output is colorized. Colors are disabled by `--no-color`, by a non-empty `NO_COLOR`
+/// env variable (see https://no-color.org), and when stdout isn't a terminal, e.g. redirected to a file.
+pub fn colors_enabled(
+    no_color_flag: bool,
+    no_color_env: Option<&str>,
+    stdout_is_terminal: bool,
+) -> bool {
+    !no_color_flag && no_color_env.is_none_or(str::is_empty) && stdout_is_terminal
+}
+
+pub struct PrinterOptions {
+    pub collapse_repeated: bool,
+    /// Directory where the differences of each changed request are also written, one file per request
+    pub diff_dir: Option<PathBuf>,
+    pub run_id: String,
+    /// The label of the build being checked, e.g. a git commit or a release tag
+    pub label: Option<String>,
+    pub severities: Severities,
+    pub output: OutputFormat,
+    /// Keep the differences found even with the text output, for the webhook
+    pub keep_records: bool,
+    /// HTML file where all the differences are rendered once the run completes
+    pub report: Option<PathBuf>,
+    /// Print the outcome of every request in the JSON output, changed or not, instead of the differences only
+    pub include_unchanged: bool,
+}
+
+pub struct DifferencesPrinter {
+    receiver: mpsc::Receiver<DifferencesPrinterMessage>,
+    /// Sent the differences found once all of them are printed
+    done_signal: tokio::sync::oneshot::Sender<Vec<DifferenceRecord>>,
+    options: PrinterOptions,
+    /// The differences found so far, with the JSON output or when the records are kept
+    records: Vec<DifferenceRecord>,
+    /// The outcomes of the requests checked so far, with `include_unchanged`
+    requests: Vec<RequestRecord>,
+}
+pub enum DifferencesPrinterMessage {
+    PrintDifferences {
+        differences: Vec<Difference>,
+        request_id: String,
+    },
+    /// The outcome of a request without differences, the changed ones being recorded with their differences
+    RecordOutcome {
+        request_id: String,
+        outcome: RequestOutcome,
+        error: Option<String>,
+    },
+}
+
+impl DifferencesPrinter {
+    pub fn new(
+        receiver: mpsc::Receiver<DifferencesPrinterMessage>,
+        done_signal: tokio::sync::oneshot::Sender<Vec<DifferenceRecord>>,
+        options: PrinterOptions,
+    ) -> Self {
+        DifferencesPrinter {
+            receiver,
+            done_signal,
+            options,
+            records: Vec::new(),
+            requests: Vec::new(),
+        }
+    }
+    fn handle_message(&mut self, msg: DifferencesPrinterMessage) {
+        match msg {
+            DifferencesPrinterMessage::PrintDifferences {
+                differences,
+                request_id,
+            } => {
+                assert!(!differences.is_empty());
+
+                let differences = if self.options.collapse_repeated {
+                    collapse_repeated_differences(differences)
+                } else {
+                    differences
+                };
+
+                if let Some(dir) = &self.options.diff_dir {
+                    write_diff_file(dir, &self.options, &request_id, &differences);
+                }
+
+                if self.options.output == OutputFormat::Json
+                    || self.options.keep_records
+                    || self.options.report.is_some()
+                {
+                    let records: Vec<DifferenceRecord> = differences
+                        .iter()
+                        .map(|difference| DifferenceRecord {
+                            run_id: self.options.run_id.clone(),
+                            request_id: request_id.clone(),
+                            severity: self.options.severities.of(difference),
+                            difference: difference.clone(),
+                        })
+                        .collect();
+                    if self.options.include_unchanged {
+                        self.requests.push(RequestRecord {
+                            run_id: self.options.run_id.clone(),
+                            request_id: request_id.clone(),
+                            outcome: RequestOutcome::Changed,
+                            error: None,
+                            differences: records.clone(),
+                        });
+                    }
+                    self.records.extend(records);
+                }
+                if self.options.output == OutputFormat::Json {
+                    return;
+                }
+
+                // Requests with only warning-level differences get a distinct frame
+                let warnings_only = differences
+                    .iter()
+                    .all(|d| self.options.severities.of(d) == Severity::Warn);
+                let (marker, title) = if warnings_only {
+                    ("⚠️ ", "Warnings")
+                } else {
+                    ("❌", "Differences")
+                };
+
+                println!(
+                    "\n{}-----------------------------------------------------------------------------------------{}",
+                    marker, marker
+                );
+                println!(
+                    "{}",
+                    format!("{} detected for request with ID: '{}'", title, request_id).yellow()
+                );
+
+                for diff in &differences {
+                    if self.options.severities.of(diff) == Severity::Warn {
+                        println!("{}", "  [warning]".yellow());
+                    }
+                    diff.print();
+                }
+
+                println!(
+                    "{}-----------------------------------------------------------------------------------------{}",
+                    marker, marker
+                );
+            }
+            DifferencesPrinterMessage::RecordOutcome {
+                request_id,
+                outcome,
+                error,
+            } => {
+                if self.options.include_unchanged {
+                    self.requests.push(RequestRecord {
+                        run_id: self.options.run_id.clone(),
+                        request_id,
+                        outcome,
+                        error,
+                        differences: Vec::new(),
+                    });
+                }
+            }
+        }
+    }
+}
+
+/// A file name for the files of a request, made of its ID with any unsafe character replaced
+pub fn file_name_for(request_id: &str) -> String {
+    request_id
+        .chars()
+        .map(|c| {
+            if c.is_ascii_alphanumeric() || c == '-' || c == '_' || c == '.' {
+                c
+            } else {
+                '_'
+            }
+        })
+        .collect()
+}
+
+/// Write the differences of a request to its own file inside `dir`, named after the request ID
+fn write_diff_file(
+    dir: &Path,
+    options: &PrinterOptions,
+    request_id: &str,
+    differences: &[Difference],
+) {
+    let mut content = match &options.label {
+        Some(label) => format!(
+            "Differences detected for request with ID: '{}' (run ID: {}, label: {})\n",
+            request_id, options.run_id, label
+        ),
+        None => format!(
+            "Differences detected for request with ID: '{}' (run ID: {})\n",
+            request_id, options.run_id
+        ),
+    };
+    for diff in differences {
+        let _ = diff.write_to(&mut content, false);
+    }
+
+    let path = dir.join(format!("{}.diff", file_name_for(request_id)));
+
+    if let Err(e) = std::fs::write(&path, content) {
+        eprintln!("Failed to write differences to {}: {}", path.display(), e);
+    }
+}
+
+pub async fn run_differences_printer(mut actor: DifferencesPrinter) {
+    while let Some(msg) = actor.receiver.recv().await {
+        actor.handle_message(msg);
+    }
+
+    if actor.options.output == OutputFormat::Json {
+        let output = if actor.options.include_unchanged {
+            serde_json::to_string_pretty(&actor.requests)
+        } else {
+            json_output(&actor.records)
+        };
+        match output {
+            Ok(output) => println!("{}", output),
+            Err(e) => eprintln!("Failed to serialize differences to JSON: {}", e),
+        }
+    }
+
+    if let Some(path) = &actor.options.report {
+        let report = html_report(
+            &actor.options.run_id,
+            actor.options.label.as_deref(),
+            &actor.records,
+        );
+        if let Err(e) = std::fs::write(path, report) {
+            eprintln!("Failed to write report to {}: {}", path.display(), e);
+        }
+    }
+
+    // Signal we're done
+    let _ = actor.done_signal.send(actor.records);
+}
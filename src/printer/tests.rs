@@ -0,0 +1,127 @@
+#[cfg(test)]
+mod tests {
+    use crate::diff_finder::Difference;
+    use crate::printer::{
+        DifferenceRecord, DifferencesPrinter, DifferencesPrinterMessage, OutputFormat,
+        PrinterOptions, RequestOutcome, colors_enabled, json_output,
+    };
+    use crate::severity::{Severities, Severity};
+
+    #[test]
+    fn test_json_output_round_trip() {
+        let records = vec![
+            DifferenceRecord {
+                run_id: "20250101T120000Z-3fa9c1".to_string(),
+                request_id: "get-user".to_string(),
+                severity: Severity::Fail,
+                difference: Difference::BodyValueChanged {
+                    path: "user/name".to_string(),
+                    old_val: "\"a\"".to_string(),
+                    new_val: "\"b\"".to_string(),
+                },
+            },
+            DifferenceRecord {
+                run_id: "20250101T120000Z-3fa9c1".to_string(),
+                request_id: "get-user".to_string(),
+                severity: Severity::Warn,
+                difference: Difference::HeaderValueRemoved {
+                    header_name: "etag".to_string(),
+                },
+            },
+        ];
+
+        let output = json_output(&records).unwrap();
+        let value: serde_json::Value = serde_json::from_str(&output).unwrap();
+        assert_eq!(value[0]["kind"], "body_value_changed");
+        assert_eq!(value[0]["path"], "user/name");
+        assert_eq!(value[1]["kind"], "header_value_removed");
+        assert_eq!(value[1]["severity"], "warn");
+        assert_eq!(value[1]["header_name"], "etag");
+
+        let parsed: Vec<DifferenceRecord> = serde_json::from_str(&output).unwrap();
+        assert_eq!(parsed, records);
+    }
+
+    #[test]
+    fn test_colors_enabled() {
+        assert!(colors_enabled(false, None, true));
+        assert!(colors_enabled(false, Some(""), true));
+        assert!(!colors_enabled(true, None, true));
+        assert!(!colors_enabled(false, Some("1"), true));
+        assert!(!colors_enabled(false, None, false));
+    }
+
+    #[test]
+    fn test_no_ansi_escapes_with_colors_disabled() {
+        colored::control::set_override(false);
+
+        let difference = Difference::BodyValueChanged {
+            path: "user/name".to_string(),
+            old_val: "\"a\"".to_string(),
+            new_val: "\"b\"".to_string(),
+        };
+        let mut output = String::new();
+        difference.write_to(&mut output, true).unwrap();
+
+        assert!(output.contains("Changed body value at 'user/name'"));
+        assert!(!output.contains('\x1b'));
+    }
+
+    #[test]
+    fn test_include_unchanged() {
+        let (_sender, receiver) = tokio::sync::mpsc::channel(1);
+        let (done_tx, _done_rx) = tokio::sync::oneshot::channel();
+        let mut printer = DifferencesPrinter::new(
+            receiver,
+            done_tx,
+            PrinterOptions {
+                collapse_repeated: false,
+                diff_dir: None,
+                run_id: "run".to_string(),
+                label: None,
+                severities: Severities::default(),
+                output: OutputFormat::Json,
+                keep_records: false,
+                report: None,
+                include_unchanged: true,
+            },
+        );
+
+        printer.handle_message(DifferencesPrinterMessage::RecordOutcome {
+            request_id: "health".to_string(),
+            outcome: RequestOutcome::Unchanged,
+            error: None,
+        });
+        printer.handle_message(DifferencesPrinterMessage::PrintDifferences {
+            differences: vec![Difference::StatusCodeChanged {
+                old_val: 200,
+                new_val: 500,
+            }],
+            request_id: "get-user".to_string(),
+        });
+        printer.handle_message(DifferencesPrinterMessage::RecordOutcome {
+            request_id: "login".to_string(),
+            outcome: RequestOutcome::Error,
+            error: Some("connection refused".to_string()),
+        });
+
+        // Every request is listed with its outcome, the changed ones with their differences
+        let value = serde_json::to_value(&printer.requests).unwrap();
+        assert_eq!(value[0]["request_id"], "health");
+        assert_eq!(value[0]["outcome"], "unchanged");
+        assert_eq!(value[0]["differences"], serde_json::json!([]));
+        assert!(value[0].get("error").is_none());
+        assert_eq!(value[1]["request_id"], "get-user");
+        assert_eq!(value[1]["outcome"], "changed");
+        assert_eq!(value[1]["differences"][0]["kind"], "status_code_changed");
+        assert_eq!(value[1]["differences"][0]["new_val"], 500);
+        assert_eq!(value[2]["outcome"], "error");
+        assert_eq!(value[2]["error"], "connection refused");
+        assert_eq!(printer.records.len(), 1);
+
+        assert_eq!(
+            serde_json::to_value(RequestOutcome::NoBaseline).unwrap(),
+            "no_baseline"
+        );
+    }
+}
@@ -0,0 +1,95 @@
+mod tests;
+
+use crate::fetch::{FetchedResponse, ResponseTimings};
+use crate::printer::file_name_for;
+use crate::{BodySize, HttpResponseData, RedirectHop};
+use anyhow::{Context, Result};
+use reqwest::Url;
+use serde::{Deserialize, Serialize};
+use std::{
+    collections::HashMap,
+    path::{Path, PathBuf},
+};
+
+/// A raw response as recorded on disk, to be served again instead of sending the request
+#[derive(Serialize, Deserialize)]
+struct RecordedResponse {
+    status_code: u16,
+    headers: HashMap<String, Vec<String>>,
+    body: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    redirects: Option<Vec<RedirectHop>>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    body_size: Option<BodySize>,
+    #[serde(default)]
+    timings: ResponseTimings,
+    /// The `Set-Cookie` headers of each response received, the redirects included, by the URL that set them
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    set_cookies: Vec<(String, Vec<String>)>,
+}
+
+/// The file of the response to a step of a request's flow, e.g. `get-user.1.json` for its second step
+fn recording_path(dir: &Path, request_id: &str, step: usize) -> PathBuf {
+    dir.join(format!("{}.{}.json", file_name_for(request_id), step))
+}
+
+/// Save the response to a step of a request's flow in `dir`
+pub async fn record(
+    dir: &Path,
+    request_id: &str,
+    step: usize,
+    response: &FetchedResponse,
+) -> Result<()> {
+    let recorded = RecordedResponse {
+        status_code: response.data.status_code,
+        headers: response.data.headers.clone(),
+        body: response.data.body.raw.clone(),
+        redirects: response.data.redirects.clone(),
+        body_size: response.data.body_size,
+        timings: response.timings,
+        set_cookies: response
+            .set_cookies
+            .iter()
+            .map(|(url, set_cookies)| (url.to_string(), set_cookies.clone()))
+            .collect(),
+    };
+    let path = recording_path(dir, request_id, step);
+    let content =
+        serde_json::to_string_pretty(&recorded).context("Failed to serialize recorded response")?;
+
+    tokio::fs::write(&path, content)
+        .await
+        .with_context(|| format!("Failed to record response to {}", path.display()))
+}
+
+/// Load the response recorded in `dir` for a step of a request's flow
+pub async fn replay(dir: &Path, request_id: &str, step: usize) -> Result<FetchedResponse> {
+    let path = recording_path(dir, request_id, step);
+    let content = tokio::fs::read(&path).await.with_context(|| {
+        format!(
+            "No recorded response for step {} of request '{}' at {}",
+            step,
+            request_id,
+            path.display()
+        )
+    })?;
+    let recorded: RecordedResponse = serde_json::from_slice(&content)
+        .with_context(|| format!("Invalid recorded response {}", path.display()))?;
+
+    let set_cookies = recorded
+        .set_cookies
+        .into_iter()
+        .filter_map(|(url, set_cookies)| Some((Url::parse(&url).ok()?, set_cookies)))
+        .collect();
+    Ok(FetchedResponse {
+        set_cookies,
+        ..FetchedResponse::new(
+            HttpResponseData {
+                redirects: recorded.redirects,
+                body_size: recorded.body_size,
+                ..HttpResponseData::new(recorded.status_code, recorded.headers, recorded.body)
+            },
+            recorded.timings,
+        )
+    })
+}
@@ -0,0 +1,101 @@
+#[cfg(test)]
+mod tests {
+    use crate::fetch::{FetchedResponse, ResponseTimings};
+    use crate::recording::{record, recording_path, replay};
+    use crate::{BodySize, HttpResponseData, RedirectHop};
+    use reqwest::Url;
+    use serde_json::json;
+    use std::{collections::HashMap, path::PathBuf};
+
+    fn recording_dir(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!(
+            "release-sanity-checker-recording-{}-{}",
+            name,
+            std::process::id()
+        ));
+        std::fs::create_dir_all(&dir).unwrap();
+        dir
+    }
+
+    #[tokio::test]
+    async fn test_record_then_replay() {
+        let dir = recording_dir("round-trip");
+        let headers = HashMap::from([(
+            "content-type".to_string(),
+            vec!["application/json".to_string()],
+        )]);
+        let mut response = FetchedResponse::new(
+            HttpResponseData {
+                redirects: Some(vec![RedirectHop {
+                    status_code: 302,
+                    location: "https://api.test/users/42".to_string(),
+                }]),
+                body_size: Some(BodySize {
+                    wire_bytes: 120,
+                    decoded_bytes: 23,
+                    truncated: false,
+                }),
+                ..HttpResponseData::new(200, headers, json!({"id": 42, "name": "Ann"}).to_string())
+            },
+            ResponseTimings {
+                time_to_first_byte_ms: 40,
+                download_ms: 3,
+                redirects_ms: 12,
+            },
+        );
+        response.set_cookies = vec![
+            (
+                Url::parse("https://api.test/me").unwrap(),
+                vec!["session=abc; Path=/".to_string()],
+            ),
+            (
+                Url::parse("https://api.test/users/42").unwrap(),
+                vec!["seen=1".to_string(), "theme=dark; Max-Age=60".to_string()],
+            ),
+        ];
+
+        // Request IDs are made safe for file names
+        record(&dir, "get user/42", 1, &response).await.unwrap();
+        assert!(dir.join("get_user_42.1.json").is_file());
+        let replayed = replay(&dir, "get user/42", 1).await.unwrap();
+        std::fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(replayed.data, response.data);
+        assert_eq!(
+            replayed.data.body.json,
+            Some(json!({"id": 42, "name": "Ann"}))
+        );
+        assert_eq!(replayed.timings, response.timings);
+        assert_eq!(replayed.set_cookies, response.set_cookies);
+    }
+
+    #[tokio::test]
+    async fn test_replay_errors() {
+        let dir = recording_dir("errors");
+
+        let error = replay(&dir, "missing", 0).await.err().unwrap();
+        assert_eq!(
+            error.to_string(),
+            format!(
+                "No recorded response for step 0 of request 'missing' at {}",
+                recording_path(&dir, "missing", 0).display()
+            )
+        );
+
+        std::fs::write(recording_path(&dir, "broken", 0), "{\"status_code\":").unwrap();
+        let error = replay(&dir, "broken", 0).await.err().unwrap();
+        assert!(error.to_string().starts_with("Invalid recorded response"));
+
+        // Recordings made before the timings and cookies were recorded are still replayed
+        std::fs::write(
+            recording_path(&dir, "old", 0),
+            json!({"status_code": 204, "headers": {}, "body": ""}).to_string(),
+        )
+        .unwrap();
+        let replayed = replay(&dir, "old", 0).await.unwrap();
+        std::fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(replayed.data.status_code, 204);
+        assert_eq!(replayed.timings, ResponseTimings::default());
+        assert!(replayed.set_cookies.is_empty());
+    }
+}
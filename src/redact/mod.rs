@@ -0,0 +1,125 @@
+mod tests;
+
+use crate::diff_finder::{Difference, without_elements};
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+
+/// What redacted values are replaced with in the reported differences
+pub const REDACTED: &str = "***";
+
+/// A regex matching sensitive values, e.g. tokens, written as a string in the config
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(try_from = "String", into = "String")]
+pub struct RedactPattern(Regex);
+
+impl TryFrom<String> for RedactPattern {
+    type Error = String;
+
+    fn try_from(pattern: String) -> Result<Self, Self::Error> {
+        Regex::new(&pattern)
+            .map(RedactPattern)
+            .map_err(|e| format!("invalid redact pattern '{}': {}", pattern, e))
+    }
+}
+
+impl From<RedactPattern> for String {
+    fn from(pattern: RedactPattern) -> Self {
+        pattern.0.as_str().to_string()
+    }
+}
+
+/// Mask the sensitive values of the differences, so they can be shared without exposing secrets.
+/// Values found at (or under) one of the `paths` are masked entirely, while the parts of any value
+/// matching one of the `patterns` are masked wherever they appear. The differences themselves are kept.
+pub fn redact_differences(
+    differences: &mut [Difference],
+    paths: &HashSet<String>,
+    patterns: &[RedactPattern],
+    separator: &str,
+) {
+    if paths.is_empty() && patterns.is_empty() {
+        return;
+    }
+
+    for difference in differences {
+        redact_difference(difference, paths, patterns, separator);
+    }
+}
+
+fn redact_difference(
+    difference: &mut Difference,
+    paths: &HashSet<String>,
+    patterns: &[RedactPattern],
+    separator: &str,
+) {
+    let redact = |value: &mut String, path: Option<&str>| {
+        if path.is_some_and(|path| is_redacted_path(path, paths, separator)) {
+            *value = REDACTED.to_string();
+        } else {
+            for pattern in patterns {
+                if let std::borrow::Cow::Owned(masked) = pattern.0.replace_all(value, REDACTED) {
+                    *value = masked;
+                }
+            }
+        }
+    };
+
+    match difference {
+        Difference::HeaderValueChanged {
+            old_val, new_val, ..
+        } => old_val
+            .iter_mut()
+            .chain(new_val.iter_mut())
+            .for_each(|value| redact(value, None)),
+        Difference::BodyValueChanged {
+            path,
+            old_val,
+            new_val,
+        } => {
+            redact(old_val, Some(path));
+            redact(new_val, Some(path));
+        }
+        Difference::BodyValueRemoved { path, value }
+        | Difference::BodyValueAdded { path, value }
+        | Difference::ArrayElementRemoved { path, value }
+        | Difference::ArrayElementAdded { path, value } => redact(value, Some(path)),
+        Difference::DifferentBodyString { before, after } => {
+            redact(before, None);
+            redact(after, None);
+        }
+        Difference::RedirectHopChanged {
+            old_val, new_val, ..
+        } => old_val
+            .iter_mut()
+            .chain(new_val.iter_mut())
+            .for_each(|value| redact(value, None)),
+        Difference::ForbiddenSubstring { context, .. } => redact(context, None),
+        Difference::ExpectedHeaderMismatch { actual, .. } => actual
+            .iter_mut()
+            .flatten()
+            .for_each(|value| redact(value, None)),
+        Difference::AssertionFailed { actual, .. } => {
+            actual.iter_mut().for_each(|value| redact(value, None))
+        }
+        Difference::Repeated { sample, .. } => {
+            redact_difference(sample, paths, patterns, separator)
+        }
+        _ => {}
+    }
+}
+
+/// Whether the path of a difference is one of the redacted paths, or is under one of them.
+/// Array elements don't need to be spelled out: `/users/ssn` covers `users[0]/ssn`, and `/tokens`
+/// covers `tokens[3]` as well as the keyed `tokens[id=5]`.
+fn is_redacted_path(path: &str, paths: &HashSet<String>, separator: &str) -> bool {
+    let path = without_elements(&format!("{}{}", separator, path));
+    paths.iter().any(|redacted| {
+        let redacted = match redacted.strip_suffix(separator) {
+            Some(trimmed) if !trimmed.is_empty() => trimmed,
+            _ => redacted,
+        };
+        let redacted = without_elements(redacted);
+        path == redacted || path.starts_with(&format!("{}{}", redacted, separator))
+    })
+}
@@ -0,0 +1,112 @@
+#[cfg(test)]
+mod tests {
+    use crate::diff_finder::Difference;
+    use crate::redact::{REDACTED, RedactPattern, redact_differences};
+    use serde_json::json;
+    use std::collections::HashSet;
+
+    #[test]
+    fn test_redact_differences() {
+        let mut differences = vec![
+            Difference::BodyValueChanged {
+                path: "user/email".to_string(),
+                old_val: "\"a@example.com\"".to_string(),
+                new_val: "\"b@example.com\"".to_string(),
+            },
+            Difference::BodyValueAdded {
+                path: "user/address/city".to_string(),
+                value: "\"Paris\"".to_string(),
+            },
+            Difference::BodyValueChanged {
+                path: "session".to_string(),
+                old_val: "\"token=abc123; ttl=60\"".to_string(),
+                new_val: "\"token=def456; ttl=60\"".to_string(),
+            },
+            Difference::HeaderValueChanged {
+                header_name: "set-cookie".to_string(),
+                old_val: vec!["token=abc123".to_string()],
+                new_val: vec!["token=def456".to_string()],
+            },
+            Difference::BodyValueChanged {
+                path: "count".to_string(),
+                old_val: "1".to_string(),
+                new_val: "2".to_string(),
+            },
+        ];
+
+        let paths = HashSet::from(["/user/email".to_string(), "/user/address/".to_string()]);
+        let patterns: Vec<RedactPattern> =
+            serde_json::from_value(json!(["token=[a-z0-9]+"])).unwrap();
+        redact_differences(&mut differences, &paths, &patterns, "/");
+
+        assert_eq!(
+            differences,
+            vec![
+                Difference::BodyValueChanged {
+                    path: "user/email".to_string(),
+                    old_val: REDACTED.to_string(),
+                    new_val: REDACTED.to_string(),
+                },
+                Difference::BodyValueAdded {
+                    path: "user/address/city".to_string(),
+                    value: REDACTED.to_string(),
+                },
+                Difference::BodyValueChanged {
+                    path: "session".to_string(),
+                    old_val: "\"***; ttl=60\"".to_string(),
+                    new_val: "\"***; ttl=60\"".to_string(),
+                },
+                Difference::HeaderValueChanged {
+                    header_name: "set-cookie".to_string(),
+                    old_val: vec![REDACTED.to_string()],
+                    new_val: vec![REDACTED.to_string()],
+                },
+                Difference::BodyValueChanged {
+                    path: "count".to_string(),
+                    old_val: "1".to_string(),
+                    new_val: "2".to_string(),
+                },
+            ]
+        );
+
+        assert!(serde_json::from_value::<Vec<RedactPattern>>(json!(["token=("])).is_err());
+    }
+
+    #[test]
+    fn test_redact_array_paths() {
+        let changed = |path: &str| Difference::BodyValueChanged {
+            path: path.to_string(),
+            old_val: "\"a\"".to_string(),
+            new_val: "\"b\"".to_string(),
+        };
+        let mut differences = vec![
+            changed("users[0]/ssn"),
+            changed("users[12]/name"),
+            changed("tokens[3]"),
+            changed("items[id=5]"),
+            changed("items[id=5]/secret"),
+            changed("tokens_count"),
+            Difference::ArrayElementAdded {
+                path: "tokens".to_string(),
+                value: "\"abc\"".to_string(),
+            },
+        ];
+
+        let paths = HashSet::from([
+            "/users/ssn".to_string(),
+            "/tokens".to_string(),
+            "/items[*]".to_string(),
+        ]);
+        redact_differences(&mut differences, &paths, &[], "/");
+
+        let redacted: Vec<bool> = differences
+            .iter()
+            .map(|difference| match difference {
+                Difference::BodyValueChanged { old_val, .. } => old_val == REDACTED,
+                Difference::ArrayElementAdded { value, .. } => value == REDACTED,
+                _ => unreachable!(),
+            })
+            .collect();
+        assert_eq!(redacted, vec![true, false, true, true, true, false, true]);
+    }
+}
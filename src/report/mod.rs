@@ -0,0 +1,124 @@
+mod tests;
+
+use crate::printer::DifferenceRecord;
+use crate::severity::Severity;
+use std::fmt::Write;
+
+const STYLE: &str = "body { font-family: sans-serif; margin: 2em; color: #222; }
+h2 { font-size: 1.1em; margin-top: 2em; }
+table { border-collapse: collapse; width: 100%; }
+td { border-top: 1px solid #ddd; padding: 0.4em 0.6em; vertical-align: top; }
+td.kind, td.severity { white-space: nowrap; font-family: monospace; }
+tr.added { background: #eefbea; }
+tr.removed { background: #fdecec; }
+tr.changed { background: #fff8e1; }
+pre { margin: 0; white-space: pre-wrap; word-break: break-all; }
+.old { color: #1a7f37; }
+.new { color: #cf222e; }
+.warn { color: #9a6700; }";
+
+/// A standalone HTML page of the differences of a run, grouped by request ID in the order they were found.
+/// Each difference is a row colored after whether it adds, removes or changes something, with the same
+/// description as the text output.
+pub fn html_report(run_id: &str, label: Option<&str>, records: &[DifferenceRecord]) -> String {
+    let mut request_ids: Vec<&str> = Vec::new();
+    for record in records {
+        if !request_ids.contains(&record.request_id.as_str()) {
+            request_ids.push(&record.request_id);
+        }
+    }
+
+    let title = match label {
+        Some(label) => format!("Differences of run {} ({})", run_id, label),
+        None => format!("Differences of run {}", run_id),
+    };
+
+    let mut html = String::new();
+    html.push_str("<!DOCTYPE html>\n<html lang=\"en\">\n<head>\n<meta charset=\"utf-8\">\n");
+    let _ = writeln!(html, "<title>{}</title>", escape_html(&title));
+    let _ = writeln!(html, "<style>\n{}\n</style>\n</head>\n<body>", STYLE);
+    let _ = writeln!(html, "<h1>{}</h1>", escape_html(&title));
+    let _ = writeln!(
+        html,
+        "<p>{} differences detected in {} requests.</p>",
+        records.len(),
+        request_ids.len()
+    );
+
+    for request_id in request_ids {
+        let _ = writeln!(
+            html,
+            "<h2>Differences detected for request with ID: '{}'</h2>\n<table>",
+            escape_html(request_id)
+        );
+        for record in records.iter().filter(|r| r.request_id == request_id) {
+            write_row(&mut html, record);
+        }
+        html.push_str("</table>\n");
+    }
+
+    html.push_str("</body>\n</html>\n");
+    html
+}
+
+fn write_row(html: &mut String, record: &DifferenceRecord) {
+    let kind = record.difference.kind();
+    let class = if kind.ends_with("_added") {
+        "added"
+    } else if kind.ends_with("_removed") {
+        "removed"
+    } else {
+        "changed"
+    };
+    let severity = match record.severity {
+        Severity::Warn => "<span class=\"warn\">warning</span>",
+        _ => "",
+    };
+
+    let mut description = String::new();
+    let _ = record.difference.write_to(&mut description, false);
+
+    let _ = write!(
+        html,
+        "<tr class=\"{}\"><td class=\"kind\">{}</td><td class=\"severity\">{}</td><td><pre>",
+        class, kind, severity
+    );
+    // Removed and added values are colored like in the terminal
+    for line in description.trim_matches('\n').lines() {
+        let line_class = match line.trim_start().chars().next() {
+            Some('-') => Some("old"),
+            Some('+') => Some("new"),
+            _ => None,
+        };
+        match line_class {
+            Some(line_class) => {
+                let _ = writeln!(
+                    html,
+                    "<span class=\"{}\">{}</span>",
+                    line_class,
+                    escape_html(line)
+                );
+            }
+            None => {
+                let _ = writeln!(html, "{}", escape_html(line));
+            }
+        }
+    }
+    html.push_str("</pre></td></tr>\n");
+}
+
+/// Escape text to be put in HTML content or attribute values
+fn escape_html(text: &str) -> String {
+    let mut escaped = String::with_capacity(text.len());
+    for c in text.chars() {
+        match c {
+            '&' => escaped.push_str("&amp;"),
+            '<' => escaped.push_str("&lt;"),
+            '>' => escaped.push_str("&gt;"),
+            '"' => escaped.push_str("&quot;"),
+            '\'' => escaped.push_str("&#39;"),
+            _ => escaped.push(c),
+        }
+    }
+    escaped
+}
@@ -0,0 +1,87 @@
+#[cfg(test)]
+mod tests {
+    use crate::diff_finder::Difference;
+    use crate::printer::DifferenceRecord;
+    use crate::report::{escape_html, html_report};
+    use crate::severity::Severity;
+
+    fn record(request_id: &str, severity: Severity, difference: Difference) -> DifferenceRecord {
+        DifferenceRecord {
+            run_id: "20250101T120000Z-3fa9c1".to_string(),
+            request_id: request_id.to_string(),
+            severity,
+            difference,
+        }
+    }
+
+    #[test]
+    fn test_html_report() {
+        let records = vec![
+            record(
+                "get-user",
+                Severity::Fail,
+                Difference::BodyValueChanged {
+                    path: "user/name".to_string(),
+                    old_val: "\"<b>Ann</b>\"".to_string(),
+                    new_val: "\"Bob & co\"".to_string(),
+                },
+            ),
+            record(
+                "<script>alert(1)</script>",
+                Severity::Warn,
+                Difference::HeaderValueAdded {
+                    header_name: "x-trace".to_string(),
+                },
+            ),
+            record(
+                "get-user",
+                Severity::Fail,
+                Difference::ArrayElementRemoved {
+                    path: "user/roles[1]".to_string(),
+                    value: "\"admin\"".to_string(),
+                },
+            ),
+        ];
+
+        let report = html_report("20250101T120000Z-3fa9c1", Some("v1.2.0"), &records);
+
+        assert!(report.starts_with("<!DOCTYPE html>"));
+        assert!(
+            report.contains("<title>Differences of run 20250101T120000Z-3fa9c1 (v1.2.0)</title>")
+        );
+        assert!(report.contains("<p>3 differences detected in 2 requests.</p>"));
+
+        // Grouped by request, in the order they were found
+        let user = report
+            .find("<h2>Differences detected for request with ID: 'get-user'</h2>")
+            .unwrap();
+        let script = report
+            .find("&lt;script&gt;alert(1)&lt;/script&gt;")
+            .unwrap();
+        assert!(user < script);
+        assert!(!report.contains("<script>"));
+        let removed = report.find("<tr class=\"removed\">").unwrap();
+        assert!(user < removed && removed < script);
+
+        // Rows are colored after the kind of difference, lines after the side of the value
+        assert!(
+            report.contains("<tr class=\"changed\"><td class=\"kind\">body_value_changed</td>")
+        );
+        assert!(report.contains("<tr class=\"added\"><td class=\"kind\">header_value_added</td><td class=\"severity\"><span class=\"warn\">warning</span>"));
+        assert!(
+            report
+                .contains("<span class=\"old\">      - &quot;&lt;b&gt;Ann&lt;/b&gt;&quot;</span>")
+        );
+        assert!(report.contains("<span class=\"new\">      + &quot;Bob &amp; co&quot;</span>"));
+        assert!(report.contains("Changed body value at &#39;user/name&#39;"));
+    }
+
+    #[test]
+    fn test_escape_html() {
+        assert_eq!(
+            escape_html(r#"<a href="x?a=1&b='2'">"#),
+            "&lt;a href=&quot;x?a=1&amp;b=&#39;2&#39;&quot;&gt;"
+        );
+        assert_eq!(escape_html("plain"), "plain");
+    }
+}
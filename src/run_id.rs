@@ -0,0 +1,35 @@
+use crate::dates::civil_from_days;
+use std::{
+    collections::hash_map::RandomState,
+    hash::{BuildHasher, Hasher},
+    process,
+    time::{SystemTime, UNIX_EPOCH},
+};
+
+/// Generate the ID of a run: its UTC start time followed by a short random suffix, e.g. `20250101T120000Z-3fa9c1`.
+/// IDs sort by start time, and the suffix keeps runs started in the same second apart
+pub fn generate_run_id() -> String {
+    let now = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_default();
+
+    let secs = now.as_secs();
+    let (year, month, day) = civil_from_days((secs / 86_400) as i64);
+    let secs_of_day = secs % 86_400;
+
+    // RandomState is seeded randomly by the standard library, which is enough for a short suffix
+    let mut hasher = RandomState::new().build_hasher();
+    hasher.write_u128(now.as_nanos());
+    hasher.write_u32(process::id());
+
+    format!(
+        "{:04}{:02}{:02}T{:02}{:02}{:02}Z-{:06x}",
+        year,
+        month,
+        day,
+        secs_of_day / 3600,
+        secs_of_day % 3600 / 60,
+        secs_of_day % 60,
+        hasher.finish() & 0xff_ffff
+    )
+}
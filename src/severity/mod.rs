@@ -0,0 +1,90 @@
+mod tests;
+
+use crate::diff_finder::Difference;
+use serde::{Deserialize, Serialize};
+use std::{collections::HashMap, str::FromStr};
+
+/// How much a kind of difference matters for the outcome of a run
+#[derive(Serialize, Deserialize, Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord)]
+#[serde(rename_all = "lowercase")]
+pub enum Severity {
+    /// The difference is dropped, as if it wasn't found
+    Ignore,
+    /// The difference is reported, but doesn't fail the run
+    Warn,
+    /// The difference is reported and fails the run
+    Fail,
+}
+
+impl FromStr for Severity {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_lowercase().as_str() {
+            "ignore" => Ok(Severity::Ignore),
+            "warn" => Ok(Severity::Warn),
+            "fail" => Ok(Severity::Fail),
+            _ => Err(format!(
+                "invalid severity '{}', expected one of: fail, warn, ignore",
+                s
+            )),
+        }
+    }
+}
+
+/// A `<difference kind>=<severity>` rule, as given on the command line
+#[derive(Clone, Debug)]
+pub struct SeverityRule {
+    kind: String,
+    severity: Severity,
+}
+
+impl FromStr for SeverityRule {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let (kind, severity) = s
+            .split_once('=')
+            .ok_or_else(|| format!("invalid rule '{}', expected <kind>=<severity>", s))?;
+
+        if !Difference::KINDS.contains(&kind) {
+            return Err(format!(
+                "unknown difference kind '{}', expected one of: {}",
+                kind,
+                Difference::KINDS.join(", ")
+            ));
+        }
+
+        Ok(SeverityRule {
+            kind: kind.to_string(),
+            severity: severity.parse()?,
+        })
+    }
+}
+
+/// The severity of each kind of difference. Kinds without a rule fail the run.
+#[derive(Clone, Debug, Default)]
+pub struct Severities {
+    rules: HashMap<String, Severity>,
+}
+
+impl Severities {
+    pub fn new(rules: &[SeverityRule]) -> Severities {
+        Severities {
+            rules: rules
+                .iter()
+                .map(|rule| (rule.kind.clone(), rule.severity))
+                .collect(),
+        }
+    }
+
+    pub fn of(&self, difference: &Difference) -> Severity {
+        // Repeated differences are as severe as the difference they repeat
+        let kind = match difference {
+            Difference::Repeated { sample, .. } => sample.kind(),
+            _ => difference.kind(),
+        };
+
+        self.rules.get(kind).copied().unwrap_or(Severity::Fail)
+    }
+}
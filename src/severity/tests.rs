@@ -0,0 +1,114 @@
+#[cfg(test)]
+mod tests {
+    use crate::diff_finder::Difference;
+    use crate::severity::{Severities, Severity, SeverityRule};
+
+    fn rules(rules: &[&str]) -> Severities {
+        let rules: Vec<SeverityRule> = rules.iter().map(|rule| rule.parse().unwrap()).collect();
+        Severities::new(&rules)
+    }
+
+    fn changed_value(path: &str) -> Difference {
+        Difference::BodyValueChanged {
+            path: path.to_string(),
+            old_val: "1".to_string(),
+            new_val: "2".to_string(),
+        }
+    }
+
+    #[test]
+    fn test_parse_severity() {
+        assert_eq!("warn".parse::<Severity>(), Ok(Severity::Warn));
+        assert_eq!("IGNORE".parse::<Severity>(), Ok(Severity::Ignore));
+        assert_eq!("Fail".parse::<Severity>(), Ok(Severity::Fail));
+        assert_eq!(
+            "error".parse::<Severity>(),
+            Err("invalid severity 'error', expected one of: fail, warn, ignore".to_string())
+        );
+    }
+
+    #[test]
+    fn test_parse_severity_rule() {
+        let rule: SeverityRule = "timing_regressed=warn".parse().unwrap();
+        assert_eq!(rule.kind, "timing_regressed");
+        assert_eq!(rule.severity, Severity::Warn);
+
+        assert_eq!(
+            "timing_regressed".parse::<SeverityRule>().unwrap_err(),
+            "invalid rule 'timing_regressed', expected <kind>=<severity>"
+        );
+        assert_eq!(
+            "timing_regressed=".parse::<SeverityRule>().unwrap_err(),
+            "invalid severity '', expected one of: fail, warn, ignore"
+        );
+        let error = "slow=warn".parse::<SeverityRule>().unwrap_err();
+        assert!(
+            error.starts_with(
+                "unknown difference kind 'slow', expected one of: status_code_changed,"
+            ),
+            "{}",
+            error
+        );
+        // Kinds are matched exactly
+        assert!("Timing_Regressed=warn".parse::<SeverityRule>().is_err());
+        assert!(" timing_regressed=warn".parse::<SeverityRule>().is_err());
+    }
+
+    #[test]
+    fn test_severity_of_difference() {
+        let severities = rules(&[
+            "body_value_changed=warn",
+            "array_order_changed=ignore",
+            // A later rule for the same kind takes precedence
+            "array_order_changed=fail",
+            "header_value_added=ignore",
+        ]);
+        assert_eq!(severities.of(&changed_value("/a")), Severity::Warn);
+        assert_eq!(
+            severities.of(&Difference::ArrayOrderChanged {
+                path: "/items".to_string()
+            }),
+            Severity::Fail
+        );
+        assert_eq!(
+            severities.of(&Difference::HeaderValueAdded {
+                header_name: "x-trace".to_string(),
+            }),
+            Severity::Ignore
+        );
+        // Kinds without a rule fail the run
+        assert_eq!(
+            severities.of(&Difference::StatusCodeChanged {
+                old_val: 200,
+                new_val: 500
+            }),
+            Severity::Fail
+        );
+        assert_eq!(
+            Severities::default().of(&changed_value("/a")),
+            Severity::Fail
+        );
+    }
+
+    #[test]
+    fn test_severity_of_repeated() {
+        let repeated = Difference::Repeated {
+            path: "/users[*]/name".to_string(),
+            count: 3,
+            sample: Box::new(changed_value("/users[0]/name")),
+        };
+        // A repeated difference is as severe as the difference it repeats
+        assert_eq!(
+            rules(&["body_value_changed=warn"]).of(&repeated),
+            Severity::Warn
+        );
+        assert_eq!(
+            rules(&["body_value_changed=ignore"]).of(&repeated),
+            Severity::Ignore
+        );
+        assert_eq!(
+            rules(&["body_value_removed=warn"]).of(&repeated),
+            Severity::Fail
+        );
+    }
+}
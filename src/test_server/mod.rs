@@ -0,0 +1,197 @@
+use std::{
+    net::SocketAddr,
+    sync::{
+        Arc,
+        atomic::{AtomicUsize, Ordering},
+    },
+    time::Duration,
+};
+use tokio::{
+    io::{AsyncReadExt, AsyncWriteExt},
+    net::{TcpListener, TcpStream},
+    sync::mpsc,
+};
+
+/// A request received by the test server, with its whole body
+#[derive(Debug, Clone)]
+pub struct ReceivedRequest {
+    pub method: String,
+    /// The path and query of the request
+    pub target: String,
+    /// Header names are lowercase, in the order they were received
+    pub headers: Vec<(String, String)>,
+    pub body: Vec<u8>,
+}
+
+impl ReceivedRequest {
+    /// The first value of the header, by case-insensitive name
+    pub fn header(&self, name: &str) -> Option<&str> {
+        self.header_values(name).next()
+    }
+
+    /// Every value of the header, by case-insensitive name
+    pub fn header_values(&self, name: &str) -> impl Iterator<Item = &str> {
+        let name = name.to_lowercase();
+        self.headers
+            .iter()
+            .filter(move |(header, _)| *header == name)
+            .map(|(_, value)| value.as_str())
+    }
+
+    pub fn body_text(&self) -> String {
+        String::from_utf8_lossy(&self.body).into_owned()
+    }
+}
+
+/// What the test server answers to a request
+pub struct Reply {
+    raw: Vec<u8>,
+    delay: Duration,
+}
+
+impl Reply {
+    /// A response with the status, headers and body, its Content-Length and closing the connection
+    pub fn new(status: &str, headers: &[(&str, &str)], body: impl Into<Vec<u8>>) -> Reply {
+        let body = body.into();
+        let mut raw = format!("HTTP/1.1 {}\r\n", status);
+        for (name, value) in headers {
+            raw.push_str(&format!("{}: {}\r\n", name, value));
+        }
+        raw.push_str(&format!(
+            "content-length: {}\r\nconnection: close\r\n\r\n",
+            body.len()
+        ));
+        let mut raw = raw.into_bytes();
+        raw.extend(body);
+        Reply::raw(raw)
+    }
+
+    /// A 200 response with the body
+    pub fn ok(body: impl Into<Vec<u8>>) -> Reply {
+        Reply::new("200 OK", &[], body)
+    }
+
+    /// A JSON 200 response
+    pub fn json(body: &serde_json::Value) -> Reply {
+        Reply::new(
+            "200 OK",
+            &[("content-type", "application/json")],
+            body.to_string(),
+        )
+    }
+
+    /// The bytes sent as they are, e.g. for a truncated or chunked response. The connection is closed after them.
+    pub fn raw(raw: impl Into<Vec<u8>>) -> Reply {
+        Reply {
+            raw: raw.into(),
+            delay: Duration::ZERO,
+        }
+    }
+
+    /// Wait before answering
+    pub fn delayed(self, delay: Duration) -> Reply {
+        Reply { delay, ..self }
+    }
+}
+
+/// A local HTTP server answering every request with the reply of a closure
+pub struct TestServer {
+    pub addr: SocketAddr,
+    requests: mpsc::UnboundedReceiver<ReceivedRequest>,
+    count: Arc<AtomicUsize>,
+}
+
+impl TestServer {
+    pub fn url(&self, path: &str) -> String {
+        format!("http://{}{}", self.addr, path)
+    }
+
+    /// The next request received, in the order they were received
+    pub async fn next_request(&mut self) -> ReceivedRequest {
+        self.requests.recv().await.expect("The test server stopped")
+    }
+
+    /// The number of requests received so far
+    pub fn request_count(&self) -> usize {
+        self.count.load(Ordering::SeqCst)
+    }
+}
+
+/// Start a server on a free local port, answering each request with `respond` once it's fully received,
+/// its body being read up to its Content-Length. Connections are handled concurrently.
+pub async fn serve<F>(respond: F) -> TestServer
+where
+    F: Fn(&ReceivedRequest) -> Reply + Send + Sync + 'static,
+{
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let (sender, requests) = mpsc::unbounded_channel();
+    let count = Arc::new(AtomicUsize::new(0));
+    let respond = Arc::new(respond);
+
+    let counter = count.clone();
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let respond = respond.clone();
+            let sender = sender.clone();
+            let counter = counter.clone();
+            tokio::spawn(async move {
+                let Some(request) = read_request(&mut socket).await else {
+                    return;
+                };
+                counter.fetch_add(1, Ordering::SeqCst);
+                let reply = respond(&request);
+                let _ = sender.send(request);
+                tokio::time::sleep(reply.delay).await;
+                let _ = socket.write_all(&reply.raw).await;
+                let _ = socket.shutdown().await;
+            });
+        }
+    });
+
+    TestServer {
+        addr,
+        requests,
+        count,
+    }
+}
+
+async fn read_request(socket: &mut TcpStream) -> Option<ReceivedRequest> {
+    let mut received = Vec::new();
+    let mut buf = [0u8; 4096];
+    let head_end = loop {
+        if let Some(end) = received.windows(4).position(|w| w == b"\r\n\r\n") {
+            break end;
+        }
+        let len = socket.read(&mut buf).await.ok().filter(|&len| len > 0)?;
+        received.extend_from_slice(&buf[..len]);
+    };
+
+    let head = String::from_utf8_lossy(&received[..head_end]).into_owned();
+    let mut lines = head.split("\r\n");
+    let mut request_line = lines.next()?.split(' ');
+    let method = request_line.next()?.to_string();
+    let target = request_line.next()?.to_string();
+    let headers: Vec<(String, String)> = lines
+        .filter_map(|line| line.split_once(':'))
+        .map(|(name, value)| (name.trim().to_lowercase(), value.trim().to_string()))
+        .collect();
+    let content_length = headers
+        .iter()
+        .find(|(name, _)| name == "content-length")
+        .and_then(|(_, value)| value.parse::<usize>().ok())
+        .unwrap_or(0);
+
+    let mut body = received.split_off(head_end + 4);
+    while body.len() < content_length {
+        let len = socket.read(&mut buf).await.ok().filter(|&len| len > 0)?;
+        body.extend_from_slice(&buf[..len]);
+    }
+
+    Some(ReceivedRequest {
+        method,
+        target,
+        headers,
+        body,
+    })
+}
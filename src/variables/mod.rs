@@ -0,0 +1,104 @@
+mod tests;
+
+use crate::config::RequestAuth;
+use crate::diff_finder::find_value_at_path;
+use crate::{HttpResponseData, RequestConfig};
+use anyhow::{Result, bail};
+use serde_json::Value;
+use std::collections::HashMap;
+
+/// Values extracted from the responses of the steps of a flow, by variable name
+pub type Variables = HashMap<String, String>;
+
+/// Extract the variables of a step from the JSON body of its response, at the paths of its `extract` map.
+/// Strings are extracted as is, other values as JSON.
+pub fn extract_variables(
+    step: &RequestConfig,
+    response: &HttpResponseData,
+    separator: &str,
+    variables: &mut Variables,
+) -> Result<()> {
+    if step.extract.is_empty() {
+        return Ok(());
+    }
+    let Some(body) = &response.body.json else {
+        bail!("the response body isn't JSON, nothing can be extracted from it");
+    };
+
+    for (name, path) in &step.extract {
+        let value = match find_value_at_path(body, path, separator) {
+            Some(Value::String(s)) => s.clone(),
+            Some(value) => value.to_string(),
+            None => bail!("nothing found at {} to extract into '{}'", path, name),
+        };
+        variables.insert(name.clone(), value);
+    }
+
+    Ok(())
+}
+
+/// A copy of the step with every `{{name}}` in its URL, header values, credentials and body strings replaced
+/// with the value of the variable. A variable that wasn't extracted by a previous step is an error.
+pub fn substitute_variables(step: &RequestConfig, variables: &Variables) -> Result<RequestConfig> {
+    let mut step = step.clone();
+
+    step.url = substitute(&step.url, variables)?;
+    for values in step.headers.values_mut() {
+        for value in values {
+            *value = substitute(value, variables)?;
+        }
+    }
+    match &mut step.auth {
+        Some(RequestAuth::Bearer { token }) => *token = substitute(token, variables)?,
+        Some(RequestAuth::Basic { username, password }) => {
+            *username = substitute(username, variables)?;
+            *password = substitute(password, variables)?;
+        }
+        None => {}
+    }
+    substitute_in_value(&mut step.body, variables)?;
+
+    Ok(step)
+}
+
+fn substitute_in_value(value: &mut Value, variables: &Variables) -> Result<()> {
+    match value {
+        Value::String(s) => *s = substitute(s, variables)?,
+        Value::Array(arr) => {
+            for v in arr {
+                substitute_in_value(v, variables)?;
+            }
+        }
+        Value::Object(map) => {
+            for v in map.values_mut() {
+                substitute_in_value(v, variables)?;
+            }
+        }
+        _ => {}
+    }
+    Ok(())
+}
+
+fn substitute(text: &str, variables: &Variables) -> Result<String> {
+    let mut result = String::with_capacity(text.len());
+    let mut rest = text;
+
+    while let Some(start) = rest.find("{{") {
+        let Some(len) = rest[start + 2..].find("}}") else {
+            break;
+        };
+        let name = rest[start + 2..start + 2 + len].trim();
+        let Some(value) = variables.get(name) else {
+            bail!(
+                "variable '{}' is used, but no previous step extracted it",
+                name
+            );
+        };
+        result.push_str(&rest[..start]);
+        result.push_str(value);
+        rest = &rest[start + 2 + len + 2..];
+    }
+    result.push_str(rest);
+
+    Ok(result)
+}
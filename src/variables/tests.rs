@@ -0,0 +1,84 @@
+#[cfg(test)]
+mod tests {
+    use crate::config::RequestAuth;
+    use crate::variables::{Variables, extract_variables, substitute_variables};
+    use crate::{HttpResponseData, RequestConfig};
+    use serde_json::json;
+    use std::collections::HashMap;
+
+    fn step(value: serde_json::Value) -> RequestConfig {
+        serde_json::from_value(value).unwrap()
+    }
+
+    fn json_response(body: serde_json::Value) -> HttpResponseData {
+        HttpResponseData::new(
+            200,
+            HashMap::from([(
+                "content-type".to_string(),
+                vec!["application/json".to_string()],
+            )]),
+            body.to_string(),
+        )
+    }
+
+    #[test]
+    fn test_token_then_use() {
+        let login = step(json!({
+            "url": "http://api/login",
+            "body": {"user": "a"},
+            "extract": {"token": "/auth/token", "user_id": "/user/id"}
+        }));
+        let mut variables = Variables::new();
+        extract_variables(
+            &login,
+            &json_response(json!({"auth": {"token": "abc"}, "user": {"id": 42}})),
+            "/",
+            &mut variables,
+        )
+        .unwrap();
+
+        let use_token = step(json!({
+            "url": "http://api/users/{{user_id}}",
+            "headers": {"Authorization": ["Bearer {{ token }}"]},
+            "body": {"ids": ["{{user_id}}"], "n": 1}
+        }));
+        let substituted = substitute_variables(&use_token, &variables).unwrap();
+        assert_eq!(substituted.url, "http://api/users/42");
+        assert_eq!(substituted.headers["Authorization"], vec!["Bearer abc"]);
+        assert_eq!(substituted.body, json!({"ids": ["42"], "n": 1}));
+
+        let use_auth = step(json!({
+            "url": "http://api/me",
+            "auth": {"type": "bearer", "token": "{{token}}"}
+        }));
+        let substituted = substitute_variables(&use_auth, &variables).unwrap();
+        assert!(matches!(
+            substituted.auth,
+            Some(RequestAuth::Bearer { token }) if token == "abc"
+        ));
+    }
+
+    #[test]
+    fn test_missing_variables() {
+        let login = step(json!({"url": "http://api/login", "extract": {"token": "/token"}}));
+        let mut variables = Variables::new();
+        let error = extract_variables(
+            &login,
+            &json_response(json!({"error": "denied"})),
+            "/",
+            &mut variables,
+        )
+        .unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "nothing found at /token to extract into 'token'"
+        );
+
+        let use_token = step(json!({"url": "http://api/me?token={{token}}"}));
+        let error = substitute_variables(&use_token, &variables).unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "variable 'token' is used, but no previous step extracted it"
+        );
+    }
+}
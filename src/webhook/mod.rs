@@ -0,0 +1,107 @@
+mod tests;
+
+use crate::printer::DifferenceRecord;
+use anyhow::{Context, Result, bail};
+use reqwest::{Client, Url, header::CONTENT_TYPE};
+use serde::Serialize;
+use serde_json::json;
+use std::collections::BTreeMap;
+
+/// The shape of the JSON posted to the webhook
+#[derive(Clone, Copy, Debug, PartialEq, clap::ValueEnum)]
+pub enum WebhookFormat {
+    /// The counts of the run and every difference found, as in the JSON output
+    Generic,
+    /// A `text` message listing the changed requests, for Slack incoming webhooks
+    Slack,
+}
+
+/// The outcome of a run, as notified to the webhook
+#[derive(Serialize, Debug)]
+pub struct RunSummary {
+    pub run_id: String,
+    pub label: Option<String>,
+    pub requests: usize,
+    pub changed: usize,
+    pub warnings: usize,
+    pub errors: usize,
+    pub differences: Vec<DifferenceRecord>,
+}
+
+impl RunSummary {
+    /// Whether the run found anything worth a notification: changed requests or errors
+    pub fn has_changes(&self) -> bool {
+        self.changed > 0 || self.errors > 0
+    }
+}
+
+/// The JSON body posted to the webhook for the run
+pub fn webhook_payload(summary: &RunSummary, format: WebhookFormat) -> serde_json::Value {
+    match format {
+        WebhookFormat::Generic => json!(summary),
+        WebhookFormat::Slack => json!({ "text": slack_text(summary) }),
+    }
+}
+
+fn slack_text(summary: &RunSummary) -> String {
+    let mut text = match &summary.label {
+        Some(label) => format!(
+            ":x: Release sanity check found changes (run ID: {}, label: {})",
+            summary.run_id, label
+        ),
+        None => format!(
+            ":x: Release sanity check found changes (run ID: {})",
+            summary.run_id
+        ),
+    };
+    text.push_str(&format!(
+        "\nChanged requests: {} out of {}. Warnings: {}. Errors: {}",
+        summary.changed, summary.requests, summary.warnings, summary.errors
+    ));
+
+    // The kinds of the differences of each request, in the order they were found
+    let mut kinds_by_request: BTreeMap<&str, (usize, Vec<&str>)> = BTreeMap::new();
+    for record in &summary.differences {
+        let (count, kinds) = kinds_by_request.entry(&record.request_id).or_default();
+        *count += 1;
+        let kind = record.difference.kind();
+        if !kinds.contains(&kind) {
+            kinds.push(kind);
+        }
+    }
+    for (request_id, (count, kinds)) in kinds_by_request {
+        text.push_str(&format!(
+            "\n• `{}`: {} difference{} ({})",
+            request_id,
+            count,
+            if count == 1 { "" } else { "s" },
+            kinds.join(", ")
+        ));
+    }
+    text
+}
+
+/// Post the summary of the run to the webhook when it found changes or errors.
+/// Returns whether the webhook was called.
+pub async fn notify_webhook(
+    client: &Client,
+    url: &Url,
+    format: WebhookFormat,
+    summary: &RunSummary,
+) -> Result<bool> {
+    if !summary.has_changes() {
+        return Ok(false);
+    }
+
+    let response = client
+        .post(url.clone())
+        .header(CONTENT_TYPE, "application/json")
+        .body(webhook_payload(summary, format).to_string())
+        .send()
+        .await
+        .with_context(|| format!("Failed to call webhook {}", url))?;
+    if !response.status().is_success() {
+        bail!("Webhook {} answered with status {}", url, response.status());
+    }
+    Ok(true)
+}
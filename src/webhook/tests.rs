@@ -0,0 +1,144 @@
+#[cfg(test)]
+mod tests {
+    use crate::diff_finder::Difference;
+    use crate::printer::DifferenceRecord;
+    use crate::severity::Severity;
+    use crate::test_server::{Reply, TestServer, serve};
+    use crate::webhook::{RunSummary, WebhookFormat, notify_webhook};
+    use reqwest::{Client, Url};
+    use serde_json::Value;
+
+    /// Answer 200 to every webhook request
+    async fn serve_webhook() -> (Url, TestServer) {
+        let server = serve(|_| Reply::ok("")).await;
+        (Url::parse(&server.url("/")).unwrap(), server)
+    }
+
+    /// The JSON body of the next webhook request
+    async fn next_payload(server: &mut TestServer) -> Value {
+        serde_json::from_slice(&server.next_request().await.body).unwrap()
+    }
+
+    fn summary(changed: usize, differences: Vec<DifferenceRecord>) -> RunSummary {
+        RunSummary {
+            run_id: "20250101T120000Z-3fa9c1".to_string(),
+            label: Some("v1.2.0".to_string()),
+            requests: 3,
+            changed,
+            warnings: 0,
+            errors: 0,
+            differences,
+        }
+    }
+
+    fn record(request_id: &str, difference: Difference) -> DifferenceRecord {
+        DifferenceRecord {
+            run_id: "20250101T120000Z-3fa9c1".to_string(),
+            request_id: request_id.to_string(),
+            severity: Severity::Fail,
+            difference,
+        }
+    }
+
+    fn changes() -> Vec<DifferenceRecord> {
+        vec![
+            record(
+                "get-user",
+                Difference::BodyValueChanged {
+                    path: "user/name".to_string(),
+                    old_val: "\"a\"".to_string(),
+                    new_val: "\"b\"".to_string(),
+                },
+            ),
+            record(
+                "get-user",
+                Difference::HeaderValueRemoved {
+                    header_name: "etag".to_string(),
+                },
+            ),
+            record(
+                "list-orders",
+                Difference::StatusCodeChanged {
+                    old_val: 200,
+                    new_val: 500,
+                },
+            ),
+        ]
+    }
+
+    #[tokio::test]
+    async fn test_generic_webhook_payload() {
+        let (url, mut server) = serve_webhook().await;
+
+        let sent = notify_webhook(
+            &Client::new(),
+            &url,
+            WebhookFormat::Generic,
+            &summary(2, changes()),
+        )
+        .await
+        .unwrap();
+        assert!(sent);
+
+        let payload = next_payload(&mut server).await;
+        assert_eq!(payload["run_id"], "20250101T120000Z-3fa9c1");
+        assert_eq!(payload["label"], "v1.2.0");
+        assert_eq!(payload["requests"], 3);
+        assert_eq!(payload["changed"], 2);
+        assert_eq!(payload["errors"], 0);
+        let differences = payload["differences"].as_array().unwrap();
+        assert_eq!(differences.len(), 3);
+        assert_eq!(differences[0]["request_id"], "get-user");
+        assert_eq!(differences[0]["kind"], "body_value_changed");
+        assert_eq!(differences[0]["path"], "user/name");
+        assert_eq!(differences[2]["kind"], "status_code_changed");
+        assert_eq!(differences[2]["severity"], "fail");
+    }
+
+    #[tokio::test]
+    async fn test_slack_webhook_payload() {
+        let (url, mut server) = serve_webhook().await;
+
+        notify_webhook(
+            &Client::new(),
+            &url,
+            WebhookFormat::Slack,
+            &summary(2, changes()),
+        )
+        .await
+        .unwrap();
+
+        let payload = next_payload(&mut server).await;
+        assert_eq!(payload.as_object().unwrap().len(), 1);
+        assert_eq!(
+            payload["text"],
+            ":x: Release sanity check found changes (run ID: 20250101T120000Z-3fa9c1, label: v1.2.0)\n\
+             Changed requests: 2 out of 3. Warnings: 0. Errors: 0\n\
+             • `get-user`: 2 differences (body_value_changed, header_value_removed)\n\
+             • `list-orders`: 1 difference (status_code_changed)"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_no_webhook_on_clean_run() {
+        let (url, mut server) = serve_webhook().await;
+
+        for format in [WebhookFormat::Generic, WebhookFormat::Slack] {
+            let sent = notify_webhook(&Client::new(), &url, format, &summary(0, Vec::new()))
+                .await
+                .unwrap();
+            assert!(!sent);
+        }
+        assert_eq!(server.request_count(), 0);
+
+        // Errors alone are notified
+        let mut errored = summary(0, Vec::new());
+        errored.errors = 1;
+        assert!(
+            notify_webhook(&Client::new(), &url, WebhookFormat::Generic, &errored)
+                .await
+                .unwrap()
+        );
+        assert_eq!(next_payload(&mut server).await["errors"], 1);
+    }
+}